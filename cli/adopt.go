@@ -0,0 +1,128 @@
+package run
+
+/*
+ * The functions in this file adopt the clusters which directory in the k3d directory ($HOME/.config/k3d)
+ * was lost, or never existed on this host (`k3d adopt`): everything k3d needs is derived from the labels
+ * and the configuration of their containers, and the cluster directory is rebuilt.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// getCommandArgs returns the arguments of the k3s command (server or agent) of the nodes of a cluster
+func getCommandArgs(cluster Cluster, role string) []string {
+	var command string
+	if role == "server" {
+		command = cluster.server.Command
+	} else if len(cluster.workers) > 0 {
+		command = cluster.workers[0].Command
+	}
+	fields := strings.Fields(command)
+	for i, field := range fields {
+		if field == role {
+			return fields[i+1:]
+		}
+	}
+	return []string{}
+}
+
+// getClusterSpecLabels returns the parameters a cluster was created with (its `spec.*` labels), derived
+// from its containers for the clusters created without these labels
+func getClusterSpecLabels(cluster Cluster) map[string]string {
+	labels := map[string]string{}
+	for k, v := range cluster.server.Labels {
+		if strings.HasPrefix(k, "spec.") {
+			labels[k] = v
+		}
+	}
+	if _, ok := labels["spec.image"]; ok {
+		return labels
+	}
+
+	serverArgs := getCommandArgs(cluster, "server")
+	apiPort := "6443"
+	for i, arg := range serverArgs {
+		if arg == "--https-listen-port" && i+1 < len(serverArgs) {
+			apiPort = serverArgs[i+1]
+		}
+	}
+
+	// docker lists the ports published on IPv4 and IPv6 twice
+	ports := map[string]bool{}
+	for _, node := range cluster.nodes() {
+		for _, port := range node.Ports {
+			if port.PublicPort == 0 || (node.ID == cluster.server.ID && strconv.Itoa(int(port.PrivatePort)) == apiPort) {
+				continue
+			}
+			ports[fmt.Sprintf("%d:%d/%s@%s", port.PublicPort, port.PrivatePort, port.Type, getNodeName(node))] = true
+		}
+	}
+	portSpecs := []string{}
+	for port := range ports {
+		portSpecs = append(portSpecs, port)
+	}
+	sort.Strings(portSpecs)
+
+	registry := ""
+	if name := cluster.server.Labels["registry"]; name != "" {
+		registry = name
+		if registries, err := getRegistryContainers(); err == nil {
+			for _, r := range registries {
+				if getNodeName(r) == name {
+					registry = fmt.Sprintf("%s:%s", r.Labels["hostname"], r.Labels["port"])
+				}
+			}
+		}
+	}
+
+	labels["spec.image"] = cluster.server.Image
+	labels["spec.api-port"] = apiPort
+	labels["spec.workers"] = strconv.Itoa(len(cluster.workers))
+	labels["spec.ports"] = strings.Join(portSpecs, ",")
+	labels["spec.registry"] = registry
+	labels["spec.server-args"] = strings.Join(serverArgs, " ")
+	labels["spec.agent-args"] = strings.Join(getCommandArgs(cluster, "agent"), " ")
+	if len(cluster.servers) > 0 {
+		labels["spec.servers"] = strconv.Itoa(len(cluster.servers) + 1)
+	}
+	return labels
+}
+
+// adoptCluster rebuilds what's missing in the directory of a cluster: the directory itself (with its info file),
+// the configuration recorded for `k3d verify` and the kubeconfig (when the server is running).
+// It returns what was rebuilt.
+func adoptCluster(cluster Cluster) ([]string, error) {
+	clusterDir, err := getClusterDir(cluster.name)
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilt := []string{}
+	if !fileExists(path.Join(clusterDir, clusterDirInfoFile)) {
+		createClusterDir(cluster.name)
+		rebuilt = append(rebuilt, "directory")
+	}
+	if specPath, err := getClusterSpecPath(cluster.name); err != nil {
+		return rebuilt, err
+	} else if !fileExists(specPath) {
+		if err := recordClusterSpec(cluster.name); err != nil {
+			return rebuilt, err
+		}
+		rebuilt = append(rebuilt, "configuration")
+	}
+	if kubeConfigPath, err := getClusterKubeConfigPath(cluster.name); err != nil {
+		return rebuilt, err
+	} else if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) && cluster.server.State == "running" {
+		if err := createKubeConfigFile(cluster.name); err != nil {
+			return rebuilt, err
+		}
+		rebuilt = append(rebuilt, "kubeconfig")
+	}
+	return rebuilt, nil
+}
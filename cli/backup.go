@@ -0,0 +1,254 @@
+package run
+
+/*
+ * The functions in this file back up the data of the server of a cluster into a file of the host (`k3d backup`)
+ * and restore them into a freshly created cluster (`k3d restore`), so a long-lived cluster survives docker prunes
+ * and moves to other hosts. The data of the agent and the binaries of k3s are left out: k3s re-creates them.
+ */
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// backupPaths are the files of the server saved in a backup, restored at the same place
+var backupPaths = []string{
+	k3sServerDataDir,
+	// the password of the node of the server, registered in the datastore
+	"/etc/rancher/node/password",
+}
+
+// clusterBackup is a backup file taken with `k3d backup`
+type clusterBackup struct {
+	token string // the token of the cluster the backup was taken in
+	etcd  bool   // the datastore of the backup is the embedded etcd
+}
+
+// getBackupEntry returns the name of the entry of a path of the server in a backup archive
+func getBackupEntry(p string) string {
+	return strings.TrimPrefix(p, "/")
+}
+
+// readClusterBackup checks a backup file and returns what it holds
+func readClusterBackup(file string) (*clusterBackup, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't open backup %s\n%+v", file, err)
+	}
+	defer f.Close()
+
+	backup := &clusterBackup{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf(" Couldn't read backup %s\n%+v", file, err)
+		}
+		switch {
+		case hdr.Name == getBackupEntry(k3sServerTokenFile):
+			var token strings.Builder
+			if _, err := io.Copy(&token, tr); err != nil {
+				return nil, fmt.Errorf(" Couldn't read the token of backup %s\n%+v", file, err)
+			}
+			backup.token = strings.TrimSpace(token.String())
+		case strings.HasPrefix(hdr.Name, getBackupEntry(etcdDataDir)+"/"):
+			backup.etcd = true
+		}
+	}
+	if backup.token == "" {
+		return nil, fmt.Errorf("%s is not a backup taken with `k3d backup`", file)
+	}
+	return backup, nil
+}
+
+// getServerSecret returns the secret of the token a server was created with
+func getServerSecret(server types.ContainerJSON) string {
+	secret := ""
+	for _, env := range server.Config.Env {
+		split := strings.SplitN(env, "=", 2)
+		switch split[0] {
+		case "K3S_TOKEN":
+			return getTokenSecret(split[1])
+		case "K3S_CLUSTER_SECRET":
+			secret = split[1]
+		}
+	}
+	return secret
+}
+
+// backupCluster saves the data of the server of a cluster into a backup file, returning its path.
+// A running server is paused while its data are copied.
+func backupCluster(clusterName string, output string) (string, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return "", err
+	}
+	if cluster.server.Labels["datastore"] == "external" {
+		return "", fmt.Errorf("Cluster %s uses an external datastore: back it up with the tools of the datastore", clusterName)
+	}
+	if len(cluster.servers) > 0 {
+		return "", fmt.Errorf("Cluster %s has %d servers: backing up an HA cluster is not supported (use `k3d snapshot save`)", clusterName, len(cluster.servers)+1)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("k3d-%s-%s.backup.tar", clusterName, time.Now().Format("20060102-150405"))
+	}
+	// the backup holds the token and the CA keys of the cluster
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create %s\n%+v", output, err)
+	}
+
+	if cluster.server.State == "running" {
+		log.Println("...Pausing the server while copying its data")
+		if err := docker.ContainerPause(ctx, cluster.server.ID); err != nil {
+			f.Close()
+			os.Remove(output)
+			return "", fmt.Errorf(" Couldn't pause the server of cluster %s\n%+v", clusterName, err)
+		}
+		defer func() {
+			if err := docker.ContainerUnpause(ctx, cluster.server.ID); err != nil {
+				log.Warningf("Couldn't unpause the server of cluster %s: use `k3d unpause --name %s`\n%+v", clusterName, clusterName, err)
+			}
+		}()
+	}
+
+	tw := tar.NewWriter(f)
+	for _, p := range backupPaths {
+		if err = addToArchive(tw, cluster.server.ID, p, getBackupEntry(path.Dir(p))+"/"); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+	return output, nil
+}
+
+// restoreClusterBackup restores a backup into a cluster created for it, with a single server using the same
+// datastore (sqlite or the embedded etcd): the nodes are stopped, the data of the server are replaced by the
+// ones of the backup, and the nodes of the cluster the backup was taken in are deleted before the workers start.
+// The embedded etcd of a backup only works with the token of its cluster.
+func restoreClusterBackup(clusterName string, file string, timeoutSeconds int) error {
+	backup, err := readClusterBackup(file)
+	if err != nil {
+		return err
+	}
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	if cluster.server.Labels["datastore"] == "external" {
+		return fmt.Errorf("Cluster %s uses an external datastore: restore it with the tools of the datastore", clusterName)
+	}
+	if len(cluster.servers) > 0 {
+		return fmt.Errorf("Cluster %s has %d servers: restoring a backup in an HA cluster is not supported", clusterName, len(cluster.servers)+1)
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	server, err := docker.ContainerInspect(ctx, cluster.server.ID)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect the server of cluster %s\n%+v", clusterName, err)
+	}
+
+	// without an external datastore, the clusters which servers can be added to run the embedded etcd
+	if usesEtcd := canAddServers(server); backup.etcd && !usesEtcd {
+		return fmt.Errorf("Backup %s holds an embedded etcd: create cluster %s with `--server-arg --cluster-init`", file, clusterName)
+	} else if !backup.etcd && usesEtcd {
+		return fmt.Errorf("Backup %s holds a sqlite database: create cluster %s without `--cluster-init`", file, clusterName)
+	}
+	if backup.etcd && getServerSecret(server) != getTokenSecret(backup.token) {
+		return fmt.Errorf("The embedded etcd of backup %s only works with the token of its cluster: seed a new cluster with a snapshot instead (`k3d snapshot save`, `k3d create --snapshot`)", file)
+	}
+
+	log.Println("...Stopping the nodes")
+	for _, worker := range cluster.workers {
+		if err := docker.ContainerStop(ctx, worker.ID, nil); err != nil {
+			return fmt.Errorf(" Couldn't stop worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+	if err := docker.ContainerStop(ctx, server.ID, nil); err != nil {
+		return fmt.Errorf(" Couldn't stop the server of cluster %s\n%+v", clusterName, err)
+	}
+
+	log.Printf("...Replacing the data of the server with %s", file)
+	helperName := fmt.Sprintf("%s-%s-restore", defaultContainerNamePrefix, clusterName)
+	if err := runHelperContainer(helperName, server.Config.Image, server.ID, nil, []string{"rm", "-rf", k3sServerDataDir}); err != nil {
+		return fmt.Errorf(" Couldn't wipe the data of the server (the nodes are stopped)\n%+v", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf(" Couldn't open backup %s (the nodes are stopped)\n%+v", file, err)
+	}
+	err = docker.CopyToContainer(ctx, server.ID, "/", f, types.CopyToContainerOptions{})
+	f.Close()
+	if err != nil {
+		return fmt.Errorf(" Couldn't copy backup %s into the server (the nodes are stopped)\n%+v", file, err)
+	}
+
+	// k3s writes the token the server was created with into the restored data, for the workers to join
+	log.Println("...Starting the server")
+	if err := startContainer(server.ID); err != nil {
+		return fmt.Errorf(" Couldn't start the server of cluster %s\n%+v", clusterName, err)
+	}
+	names := []string{getNodeName(cluster.server)}
+	for _, worker := range cluster.workers {
+		names = append(names, getNodeName(worker))
+	}
+	if err := deleteSnapshotNodes(server.ID, names, timeoutSeconds); err != nil {
+		return fmt.Errorf(" Couldn't delete the nodes of the cluster the backup was taken in (the workers are stopped)\n%+v", err)
+	}
+	// the workers register again, with the passwords of their nodes
+	for _, worker := range cluster.workers {
+		secret := fmt.Sprintf("%s.node-password.k3s", getNodeName(worker))
+		if _, err := kubectl(server.ID, "delete", "secret", "--namespace", "kube-system", secret, "--ignore-not-found"); err != nil {
+			log.Warningf("Couldn't delete secret %s: worker %s may not join the cluster\n%+v", secret, getNodeName(worker), err)
+		}
+	}
+
+	log.Println("...Starting the workers")
+	for _, worker := range cluster.workers {
+		if err := startContainer(worker.ID); err != nil {
+			return fmt.Errorf(" Couldn't start worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+
+	// the kubeconfig has the certificates of the backup now
+	if kubeconfig, err := getClusterKubeConfigPath(clusterName); err == nil {
+		if err := os.Remove(kubeconfig); err != nil && !os.IsNotExist(err) {
+			log.Warningf("Couldn't remove %s: use `k3d get-kubeconfig --overwrite`\n%+v", kubeconfig, err)
+		}
+	}
+	return nil
+}
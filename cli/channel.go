@@ -0,0 +1,75 @@
+package run
+
+/*
+ * The functions in this file resolve a release channel of k3s (`--channel stable`, `latest`, `v1.27`, ...) into
+ * the tag of the k3s image of its latest release, with the channel server of k3s (the one of its install script).
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultK3sChannelServer lists the release channels of k3s with their latest release
+const DefaultK3sChannelServer = "https://update.k3s.io/v1-release/channels"
+
+// how long the channel server is waited for
+const defaultChannelTimeout = 10 * time.Second
+
+// k3sChannel is a release channel of k3s, as listed by the channel server
+type k3sChannel struct {
+	Name   string `json:"name"`
+	Latest string `json:"latest"`
+}
+
+// getK3sChannels returns the release channels of k3s listed by a channel server
+func getK3sChannels(channelServer string) ([]k3sChannel, error) {
+	httpClient := &http.Client{Timeout: defaultChannelTimeout}
+	resp, err := httpClient.Get(channelServer)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't get the release channels of k3s from %s\n%+v", channelServer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(" Couldn't get the release channels of k3s from %s: %s", channelServer, resp.Status)
+	}
+	channels := struct {
+		Data []k3sChannel `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&channels); err != nil {
+		return nil, fmt.Errorf(" Couldn't parse the release channels of k3s from %s\n%+v", channelServer, err)
+	}
+	return channels.Data, nil
+}
+
+// resolveK3sChannel returns the latest release of k3s in a channel (e.g. `v1.27.4+k3s1`)
+func resolveK3sChannel(channelServer string, channel string) (string, error) {
+	channels, err := getK3sChannels(channelServer)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, ch := range channels {
+		if ch.Name == channel && ch.Latest != "" {
+			return ch.Latest, nil
+		}
+		names = append(names, ch.Name)
+	}
+	return "", fmt.Errorf("Unknown release channel of k3s [%s] (the channels are %s)", channel, strings.Join(names, ", "))
+}
+
+// getK3sImageTag returns the tag of the k3s image of a release of k3s: docker tags can't have a `+`
+func getK3sImageTag(release string) string {
+	return strings.Replace(release, "+", "-", -1)
+}
+
+// getImageRepository returns an image without its tag
+func getImageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
@@ -0,0 +1,216 @@
+package run
+
+/*
+ * The functions in this file inject failures in the docker layer of a cluster,
+ * for exercising the resilience of the workloads running in it.
+ */
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// chaosChain is the iptables chain holding the rules used for partitioning the network
+const chaosChain = "K3D-CHAOS"
+
+// chaosInterface is the network interface of the nodes affected by the added latency
+const chaosInterface = "eth0"
+
+// getNodeIP returns the IP address of a node in the cluster network
+func getNodeIP(node types.Container, clusterName string) (string, error) {
+	if node.NetworkSettings != nil {
+		if settings, ok := node.NetworkSettings.Networks[k3dNetworkName(clusterName)]; ok && settings.IPAddress != "" {
+			return settings.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("Node %s has no IP address in the network of cluster %s (is it running?)", getNodeName(node), clusterName)
+}
+
+// killNodes sends a signal to the selected nodes of a cluster
+func killNodes(clusterName string, nodeSpecifier string, signal string) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	nodes, err := getNodesBySpecifier(cluster, nodeSpecifier)
+	if err != nil {
+		return err
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	for _, node := range nodes {
+		log.Printf("...Sending %s to node %s", signal, getNodeName(node))
+		if err := docker.ContainerKill(ctx, node.ID, signal); err != nil {
+			return fmt.Errorf(" Couldn't kill node %s\n%+v", getNodeName(node), err)
+		}
+	}
+	return nil
+}
+
+// ensureChaosChain creates the iptables chain used for partitioning the network in a node (if not existing)
+func ensureChaosChain(node types.Container) error {
+	if _, err := execInContainer(node.ID, []string{"iptables", "-n", "-L", chaosChain}); err == nil {
+		return nil
+	}
+	for _, cmd := range [][]string{
+		{"iptables", "-N", chaosChain},
+		{"iptables", "-I", "INPUT", "-j", chaosChain},
+		{"iptables", "-I", "OUTPUT", "-j", chaosChain},
+	} {
+		if _, err := execInContainer(node.ID, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionNetwork drops all the traffic between two groups of nodes of a cluster
+func partitionNetwork(clusterName string, specifierA string, specifierB string) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	nodesA, err := getNodesBySpecifier(cluster, specifierA)
+	if err != nil {
+		return err
+	}
+	nodesB, err := getNodesBySpecifier(cluster, specifierB)
+	if err != nil {
+		return err
+	}
+
+	// block the traffic in both directions, on both sides
+	partition := func(from []types.Container, to []types.Container) error {
+		for _, node := range from {
+			if err := ensureChaosChain(node); err != nil {
+				return fmt.Errorf(" Couldn't set up iptables in node %s\n%+v", getNodeName(node), err)
+			}
+			for _, peer := range to {
+				if peer.ID == node.ID {
+					continue
+				}
+				peerIP, err := getNodeIP(peer, clusterName)
+				if err != nil {
+					return err
+				}
+				log.Printf("...Dropping traffic between %s and %s", getNodeName(node), getNodeName(peer))
+				for _, cmd := range [][]string{
+					{"iptables", "-A", chaosChain, "-s", peerIP, "-j", "DROP"},
+					{"iptables", "-A", chaosChain, "-d", peerIP, "-j", "DROP"},
+				} {
+					if _, err := execInContainer(node.ID, cmd); err != nil {
+						return fmt.Errorf(" Couldn't partition node %s\n%+v", getNodeName(node), err)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := partition(nodesA, nodesB); err != nil {
+		return err
+	}
+	return partition(nodesB, nodesA)
+}
+
+// healNetwork removes all the network partitions in a cluster
+func healNetwork(clusterName string) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range cluster.nodes() {
+		if _, err := execInContainer(node.ID, []string{"iptables", "-n", "-L", chaosChain}); err != nil {
+			continue // no partition in this node
+		}
+		log.Printf("...Healing network partitions in node %s", getNodeName(node))
+		if _, err := execInContainer(node.ID, []string{"iptables", "-F", chaosChain}); err != nil {
+			return fmt.Errorf(" Couldn't heal the network of node %s\n%+v", getNodeName(node), err)
+		}
+	}
+	return nil
+}
+
+// pauseRegistry pauses (or unpauses) the registry container used by a cluster. A registry shared with other
+// clusters is only paused when forced, as they lose it too.
+func pauseRegistry(clusterName string, unpause bool, force bool) error {
+	cid, err := getClusterRegistryContainer(clusterName)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry found for cluster %s", clusterName)
+	}
+	if !unpause {
+		users, err := getRegistryUsers(cid)
+		if err != nil {
+			return err
+		}
+		others := []string{}
+		for _, user := range users {
+			if user != clusterName {
+				others = append(others, user)
+			}
+		}
+		if len(others) > 0 && !force {
+			return fmt.Errorf("The registry of cluster %s is shared with clusters %v, which would lose it too (use --force to pause it anyway)", clusterName, others)
+		} else if len(others) > 0 {
+			log.Warningf("Pausing the registry shared with clusters %v", others)
+		}
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	if unpause {
+		log.Println("...Unpausing the registry")
+		return docker.ContainerUnpause(ctx, cid)
+	}
+	log.Println("...Pausing the registry")
+	return docker.ContainerPause(ctx, cid)
+}
+
+// addLatency adds (or removes) network latency in the selected nodes of a cluster using `tc`
+func addLatency(clusterName string, nodeSpecifier string, delay string, remove bool) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	nodes, err := getNodesBySpecifier(cluster, nodeSpecifier)
+	if err != nil {
+		return err
+	}
+
+	// the k3s images don't all ship `tc`: fail before changing any node
+	for _, node := range nodes {
+		if _, err := execInContainer(node.ID, []string{"tc", "-V"}); err != nil {
+			return fmt.Errorf("Node %s has no `tc` (iproute2) for changing its latency: use an image of k3s providing it\n%+v", getNodeName(node), err)
+		}
+	}
+
+	for _, node := range nodes {
+		cmd := []string{"tc", "qdisc", "replace", "dev", chaosInterface, "root", "netem", "delay", delay}
+		if remove {
+			log.Printf("...Removing latency from node %s", getNodeName(node))
+			cmd = []string{"tc", "qdisc", "del", "dev", chaosInterface, "root"}
+		} else {
+			log.Printf("...Adding %s of latency to node %s", delay, getNodeName(node))
+		}
+		if _, err := execInContainer(node.ID, cmd); err != nil {
+			return fmt.Errorf(" Couldn't change the latency of node %s\n%+v", getNodeName(node), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package run
+
+/*
+ * The functions in this file remove the files left in the k3d directory ($HOME/.config/k3d, or $HOME/.k3d
+ * with older versions of k3d) by clusters that don't exist anymore (kubeconfigs, image tarballs...).
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+)
+
+// clusterDirInfoFile records which cluster owns a cluster directory, and when it was created
+const clusterDirInfoFile = ".k3d-cluster"
+
+// getClustersDir returns the directory holding the cluster directories ($HOME/.config/k3d)
+func getClustersDir() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, ".config", "k3d"), nil
+}
+
+// writeClusterDirInfo records the owner of a cluster directory, so it can be cleaned up when the cluster is gone
+func writeClusterDirInfo(name string) error {
+	clusterPath, err := getClusterDir(name)
+	if err != nil {
+		return err
+	}
+	info := fmt.Sprintf("cluster: %s\ncreated: %s\n", name, time.Now().Format("2006-01-02 15:04:05"))
+	return ioutil.WriteFile(path.Join(clusterPath, clusterDirInfoFile), []byte(info), 0644)
+}
+
+// clusterDirGracePeriod protects the directories of the clusters being created, which don't have containers yet
+const clusterDirGracePeriod = 10 * time.Minute
+
+// readClusterDirInfo returns the cluster owning a cluster directory and when it was created, as recorded
+// by writeClusterDirInfo (os.IsNotExist(err) for the directories created by older versions of k3d)
+func readClusterDirInfo(clusterPath string) (string, time.Time, error) {
+	content, err := ioutil.ReadFile(path.Join(clusterPath, clusterDirInfoFile))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	name := ""
+	var created time.Time
+	for _, line := range strings.Split(string(content), "\n") {
+		split := strings.SplitN(line, ": ", 2)
+		if len(split) != 2 {
+			continue
+		}
+		switch split[0] {
+		case "cluster":
+			name = split[1]
+		case "created":
+			if created, err = time.ParseInLocation("2006-01-02 15:04:05", split[1], time.Local); err != nil {
+				return "", time.Time{}, fmt.Errorf(" Couldn't parse the creation time of %s\n%+v", clusterPath, err)
+			}
+		}
+	}
+	return name, created, nil
+}
+
+// getDirSize returns the size of the files in a directory (recursively)
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// getLegacyClustersDir returns the k3d directory of older versions of k3d ($HOME/.k3d), which may still
+// hold cluster directories (along with the global registries file, kept)
+func getLegacyClustersDir() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(homeDir, ".k3d"), nil
+}
+
+// cleanupHome removes the directories of the clusters that don't exist anymore, in the k3d directory and
+// in the one of older versions of k3d, returning the names of those clusters and the space reclaimed (in bytes)
+func cleanupHome(dryRun bool) ([]string, int64, error) {
+	clustersDir, err := getClustersDir()
+	if err != nil {
+		return nil, 0, fmt.Errorf(" Couldn't get the k3d directory\n%+v", err)
+	}
+	legacyDir, err := getLegacyClustersDir()
+	if err != nil {
+		return nil, 0, fmt.Errorf(" Couldn't get the k3d directory\n%+v", err)
+	}
+
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	removed := []string{}
+	var reclaimed int64
+	for _, dir := range []string{clustersDir, legacyDir} {
+		dirRemoved, dirReclaimed, err := cleanupClustersDir(dir, clusters, dryRun)
+		removed = append(removed, dirRemoved...)
+		reclaimed += dirReclaimed
+		if err != nil {
+			return removed, reclaimed, err
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+// cleanupClustersDir removes the directories of the clusters that don't exist anymore from a k3d directory
+func cleanupClustersDir(clustersDir string, clusters map[string]Cluster, dryRun bool) ([]string, int64, error) {
+	entries, err := ioutil.ReadDir(clustersDir)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf(" Couldn't read the k3d directory %s\n%+v", clustersDir, err)
+	}
+
+	removed := []string{}
+	var reclaimed int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if _, exists := clusters[name]; exists {
+			continue
+		}
+		// directories created by older versions of k3d have no info file, but they are named after a cluster anyway
+		if CheckClusterName(name) != nil {
+			log.Debugf("Skipping %s: not a cluster directory", path.Join(clustersDir, name))
+			continue
+		}
+
+		clusterPath := path.Join(clustersDir, name)
+		owner, created, err := readClusterDirInfo(clusterPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warningf("Skipping %s: couldn't read its info file\n%+v", clusterPath, err)
+			continue
+		} else if err == nil && owner != name {
+			log.Debugf("Skipping %s: it belongs to cluster %s", clusterPath, owner)
+			continue
+		} else if err == nil && time.Since(created) < clusterDirGracePeriod {
+			log.Debugf("Skipping %s: created less than %s ago, the cluster may still be in creation", clusterPath, clusterDirGracePeriod)
+			continue
+		}
+
+		size, err := getDirSize(clusterPath)
+		if err != nil {
+			log.Warningf("Couldn't get the size of %s\n%+v", clusterPath, err)
+		}
+		log.Printf("...Removing %s (%s)", clusterPath, units.HumanSize(float64(size)))
+		if !dryRun {
+			if err := os.RemoveAll(clusterPath); err != nil {
+				return removed, reclaimed, fmt.Errorf(" Couldn't remove %s\n%+v", clusterPath, err)
+			}
+		}
+		removed = append(removed, name)
+		reclaimed += size
+	}
+	return removed, reclaimed, nil
+}
@@ -0,0 +1,307 @@
+package run
+
+/*
+ * The functions in this file duplicate a cluster (`k3d clone`): the new cluster gets copies of the node
+ * containers of the source cluster, on its own network and with other host ports, and its server starts
+ * from a copy of the datastore of the source server, so it has the same workloads from the start.
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	log "github.com/sirupsen/logrus"
+)
+
+// the data of the k3s server copied into the clone (the agent data of the nodes is not)
+const k3sServerDataDir = "/var/lib/rancher/k3s/server"
+
+// clonePorts allocates the host ports of a clone: free ones chosen by docker for the ports of the source cluster
+type clonePorts struct {
+	allocated map[int]bool
+}
+
+// remap returns a free host port for a port of the source cluster
+func (p *clonePorts) remap(hostPort string) (string, error) {
+	port, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return "", fmt.Errorf("Invalid host port [%s]\n%+v", hostPort, err)
+	}
+	for {
+		free, err := getFreeHostPort(pullPolicyIfNotPresent)
+		if err != nil {
+			return "", err
+		}
+		// the probes release their port, which docker may give again to the next one
+		if !p.allocated[free] {
+			p.allocated[free] = true
+			log.Printf("...Publishing the host port %d as %d", port, free)
+			return strconv.Itoa(free), nil
+		}
+	}
+}
+
+// getCloneNodeConfig returns the configuration of the copy of a node in a clone: the names of the source
+// cluster replaced, the API port and the host ports remapped
+func getCloneNodeConfig(node types.ContainerJSON, src, dst string, oldAPIPort, newAPIPort string, ports *clonePorts) (*container.Config, *container.HostConfig, error) {
+	srcPrefix := fmt.Sprintf("%s-%s-", defaultContainerNamePrefix, src)
+	dstPrefix := fmt.Sprintf("%s-%s-", defaultContainerNamePrefix, dst)
+	rename := func(s string) string {
+		return strings.ReplaceAll(s, srcPrefix, dstPrefix)
+	}
+
+	config := *node.Config
+	config.Hostname = rename(config.Hostname)
+	config.Cmd = []string{}
+	for i, arg := range node.Config.Cmd {
+		if i > 0 && node.Config.Cmd[i-1] == "--https-listen-port" {
+			arg = newAPIPort
+		}
+		config.Cmd = append(config.Cmd, rename(arg))
+	}
+	config.Env = []string{}
+	for _, env := range node.Config.Env {
+		env = rename(env)
+		if strings.HasPrefix(env, "K3S_URL=") {
+			env = strings.Replace(env, ":"+oldAPIPort, ":"+newAPIPort, 1)
+		}
+		config.Env = append(config.Env, env)
+	}
+	config.Labels = map[string]string{}
+	for k, v := range node.Config.Labels {
+		config.Labels[k] = v
+	}
+	config.Labels["cluster"] = dst
+	delete(config.Labels, nodeVolumesLabel)
+
+	hostConfig := *node.HostConfig
+	hostConfig.Binds = []string{}
+	for _, bind := range node.HostConfig.Binds {
+		hostConfig.Binds = append(hostConfig.Binds, strings.Replace(bind,
+			fmt.Sprintf("k3d-%s-images:", src), fmt.Sprintf("k3d-%s-images:", dst), 1))
+	}
+	if string(hostConfig.NetworkMode) == k3dNetworkName(src) {
+		hostConfig.NetworkMode = container.NetworkMode(k3dNetworkName(dst))
+	}
+
+	// the API port is the same in the container and in the host
+	hostConfig.PortBindings = nat.PortMap{}
+	config.ExposedPorts = nat.PortSet{}
+	for port, bindings := range node.HostConfig.PortBindings {
+		if port.Port() == oldAPIPort {
+			port = nat.Port(fmt.Sprintf("%s/%s", newAPIPort, port.Proto()))
+		}
+		for _, binding := range bindings {
+			if port.Port() == newAPIPort {
+				binding.HostPort = newAPIPort
+			} else if binding.HostPort != "" {
+				hostPort, err := ports.remap(binding.HostPort)
+				if err != nil {
+					return nil, nil, err
+				}
+				binding.HostPort = hostPort
+			}
+			hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], binding)
+		}
+		config.ExposedPorts[port] = struct{}{}
+	}
+	return &config, &hostConfig, nil
+}
+
+// connectCloneRegistries connects the registries of the source cluster to the network of the clone,
+// with the same aliases, as the clone has the same registries configuration
+func connectCloneRegistries(src, dst string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	nid, err := getClusterNetwork(src)
+	if err != nil {
+		return err
+	}
+	cids, err := getContainersInNetwork(nid)
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the containers of network %s\n%+v", k3dNetworkName(src), err)
+	}
+	for _, cid := range cids {
+		info, err := docker.ContainerInspect(ctx, cid)
+		if err != nil {
+			return fmt.Errorf(" Couldn't inspect container %s\n%+v", cid, err)
+		}
+		if info.Config.Labels["component"] != "registry" {
+			continue
+		}
+		aliases := []string{}
+		if settings, ok := info.NetworkSettings.Networks[k3dNetworkName(src)]; ok {
+			for _, alias := range settings.Aliases {
+				// the short ID is added by docker to every container
+				if !strings.HasPrefix(info.ID, alias) {
+					aliases = append(aliases, alias)
+				}
+			}
+		}
+		log.Printf("...Connecting the registry %s to the network of the clone", strings.TrimPrefix(info.Name, "/"))
+		if err := connectContainerToNetwork(info.ID, k3dNetworkName(dst), aliases); err != nil {
+			return fmt.Errorf(" Couldn't connect the registry %s to network %s\n%+v", info.Name, k3dNetworkName(dst), err)
+		}
+	}
+	return nil
+}
+
+// cloneCluster creates a cluster with copies of the nodes of another one, starting from a copy of its datastore
+func cloneCluster(src, dst string, apiPort string, timeoutSeconds int) error {
+	cluster, err := getCluster(src)
+	if err != nil {
+		return err
+	}
+	if _, err := getCluster(dst); err == nil {
+		return fmt.Errorf("Cluster %s already exists", dst)
+	}
+	if cluster.server.Labels["datastore"] == "external" {
+		return fmt.Errorf("Cluster %s uses an external datastore: cloning it would share the datastore", src)
+	}
+	if len(cluster.servers) > 0 {
+		return fmt.Errorf("Cluster %s has %d servers: cloning an HA cluster is not supported", src, len(cluster.servers)+1)
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	server, err := docker.ContainerInspect(ctx, cluster.server.ID)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect the server of cluster %s\n%+v", src, err)
+	}
+	ports := &clonePorts{allocated: map[int]bool{}}
+	oldAPIPort := getServerAPIPort(server)
+	if apiPort == "" {
+		if apiPort, err = ports.remap(oldAPIPort); err != nil {
+			return err
+		}
+	}
+
+	created := []string{}
+	deleteClone := func() {
+		log.Printf("Removing the clone %s", dst)
+		for _, id := range created {
+			if err := removeContainer(id); err != nil {
+				log.Warningln(err)
+			}
+		}
+		// the registries of the source cluster
+		if nid, err := getClusterNetwork(dst); err == nil {
+			cids, _ := getContainersInNetwork(nid)
+			for _, cid := range cids {
+				if err := disconnectContainerFromNetwork(cid, nid); err != nil {
+					log.Warningln(err)
+				}
+			}
+		}
+		if err := deleteClusterNetwork(dst); err != nil {
+			log.Warningln(err)
+		}
+		if err := deleteImageVolume(dst); err != nil {
+			log.Warningln(err)
+		}
+		deleteClusterDir(dst)
+	}
+
+	log.Printf("Creating the network and the image volume of cluster %s", dst)
+	if _, err := createClusterNetwork(dst); err != nil {
+		return err
+	}
+	createClusterDir(dst)
+	if _, err := createImageVolume(dst); err != nil {
+		deleteClone()
+		return fmt.Errorf(" Couldn't create the image volume of cluster %s\n%+v", dst, err)
+	}
+	if err := connectCloneRegistries(src, dst); err != nil {
+		deleteClone()
+		return err
+	}
+
+	for _, node := range cluster.nodes() {
+		info, err := docker.ContainerInspect(ctx, node.ID)
+		if err != nil {
+			deleteClone()
+			return fmt.Errorf(" Couldn't inspect node %s\n%+v", getNodeName(node), err)
+		}
+		config, hostConfig, err := getCloneNodeConfig(info, src, dst, oldAPIPort, apiPort, ports)
+		if err != nil {
+			deleteClone()
+			return err
+		}
+		name := config.Hostname
+		networkingConfig := &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				k3dNetworkName(dst): {
+					Aliases: []string{name},
+				},
+			},
+		}
+
+		log.Printf("...Creating node %s as a copy of %s", name, getNodeName(node))
+		id, err := createContainer(config, hostConfig, networkingConfig, name)
+		if err != nil {
+			deleteClone()
+			return err
+		}
+		created = append(created, id)
+
+		paths := nodeUpgradePaths
+		paused := false
+		if node.ID == cluster.server.ID {
+			paths = append([]string{k3sServerDataDir}, nodeUpgradePaths...)
+			// the datastore is copied while the server is frozen, for a consistent copy
+			if info.State.Running && !info.State.Paused {
+				if err := docker.ContainerPause(ctx, node.ID); err != nil {
+					deleteClone()
+					return fmt.Errorf(" Couldn't pause the server of cluster %s\n%+v", src, err)
+				}
+				paused = true
+			}
+		}
+		err = copyNodeConfig(node.ID, id, paths)
+		if paused {
+			if err := docker.ContainerUnpause(ctx, node.ID); err != nil {
+				log.Warningf("Couldn't unpause the server of cluster %s: use `k3d unpause --name %s`\n%+v", src, src, err)
+			}
+		}
+		if err == nil {
+			err = startContainer(id)
+		}
+		if err == nil && node.ID == cluster.server.ID {
+			log.Printf("Waiting for the server %s to be up...", name)
+			err = waitForContainerLogMessage(id, "Wrote kubeconfig", timeoutSeconds)
+		}
+		if err != nil {
+			deleteClone()
+			return fmt.Errorf(" Couldn't start node %s\n%+v", name, err)
+		}
+	}
+
+	// the nodes of the source cluster are in the copied datastore, as nodes not ready anymore
+	for _, node := range cluster.nodes() {
+		if _, err := kubectl(created[0], "delete", "node", getNodeName(node), "--ignore-not-found"); err != nil {
+			log.Warningf("Couldn't delete node %s from the clone: you may want to `kubectl delete node %s`\n%+v", getNodeName(node), getNodeName(node), err)
+		}
+	}
+
+	if err := recordClusterSpec(dst); err != nil {
+		log.Warningf("Couldn't record the configuration of cluster %s\n%+v", dst, err)
+	}
+	return nil
+}
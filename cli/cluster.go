@@ -2,18 +2,19 @@ package run
 
 import (
 	"bytes"
-	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/olekukonko/tablewriter"
 	log "github.com/sirupsen/logrus"
 )
@@ -62,6 +63,9 @@ func createClusterDir(name string) {
 	if err := createDirIfNotExists(clusterPath + "/images"); err != nil {
 		log.Fatalf("Couldn't create cluster sub-directory [%s] -> %+v", clusterPath+"/images", err)
 	}
+	if err := writeClusterDirInfo(name); err != nil {
+		log.Warningf("Couldn't write the info file of cluster directory [%s] -> %+v", clusterPath, err)
+	}
 }
 
 // deleteClusterDir contrary to createClusterDir, this deletes the cluster directory under $HOME/.config/k3d/<cluster_name>
@@ -74,12 +78,12 @@ func deleteClusterDir(name string) {
 
 // getClusterDir returns the path to the cluster directory which is $HOME/.config/k3d/<cluster_name>
 func getClusterDir(name string) (string, error) {
-	homeDir, err := homedir.Dir()
+	clustersDir, err := getClustersDir()
 	if err != nil {
 		log.Error("Couldn't get user's home directory")
 		return "", err
 	}
-	return path.Join(homeDir, ".config", "k3d", name), nil
+	return path.Join(clustersDir, name), nil
 }
 
 func getClusterKubeConfigPath(cluster string) (string, error) {
@@ -88,7 +92,7 @@ func getClusterKubeConfigPath(cluster string) (string, error) {
 }
 
 func createKubeConfigFile(cluster string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
@@ -180,13 +184,22 @@ func getKubeConfig(cluster string, overwrite bool) (string, error) {
 		return "", err
 	}
 
-	if clusters, err := getClusters(false, cluster); err != nil || len(clusters) != 1 {
-		if err != nil {
-			return "", err
-		}
+	clusters, err := getClusters(false, cluster)
+	if err != nil {
+		return "", err
+	}
+	if len(clusters) != 1 {
 		return "", fmt.Errorf("Cluster %s does not exist", cluster)
 	}
 
+	// the clusters which directory was lost are adopted first
+	if clusterDir, err := getClusterDir(cluster); err == nil && !fileExists(clusterDir) {
+		log.Debugf("Directory %s does not exist. Adopting cluster %s...", clusterDir, cluster)
+		if _, err := adoptCluster(clusters[cluster]); err != nil {
+			log.Warningf("Couldn't adopt cluster %s: use `k3d adopt --name %s`\n%+v", cluster, cluster, err)
+		}
+	}
+
 	// Create or overwrite file no matter if it exists or not
 	if overwrite {
 		log.Debugf("Creating/Overwriting file %s...", kubeConfigPath)
@@ -213,7 +226,8 @@ func getKubeConfig(cluster string, overwrite bool) (string, error) {
 }
 
 // printClusters prints the names of existing clusters
-func printClusters() error {
+// (and the parameters they were created with, when 'wide' is set)
+func printClusters(wide bool) error {
 	clusters, err := getClusters(true, "")
 	if err != nil {
 		log.Fatalf("Couldn't list clusters\n%+v", err)
@@ -224,7 +238,11 @@ func printClusters() error {
 
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetAlignment(tablewriter.ALIGN_CENTER)
-	table.SetHeader([]string{"NAME", "IMAGE", "STATUS", "WORKERS"})
+	header := []string{"NAME", "IMAGE", "STATUS", "WORKERS"}
+	if wide {
+		header = append(header, "API-PORT", "PORTS", "REGISTRY", "SERVER-ARGS", "AGENT-ARGS", "SPEC-HASH")
+	}
+	table.SetHeader(header)
 
 	for _, cluster := range clusters {
 		workersRunning := 0
@@ -235,18 +253,33 @@ func printClusters() error {
 		}
 		workerData := fmt.Sprintf("%d/%d", workersRunning, len(cluster.workers))
 		clusterData := []string{cluster.name, cluster.image, cluster.status, workerData}
+		if wide {
+			labels := getClusterSpecLabels(cluster)
+			clusterData = append(clusterData, labels["spec.api-port"], labels["spec.ports"], labels["spec.registry"],
+				labels["spec.server-args"], labels["spec.agent-args"], labels["spec.hash"])
+		}
 		table.Append(clusterData)
 	}
 
 	table.Render()
+
+	// the registries, to tell at a glance if they're healthy
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return err
+	}
+	if len(registries) > 0 {
+		fmt.Println()
+		return printRegistries()
+	}
 	return nil
 }
 
 // Classify cluster state: Running, Stopped or Abnormal
-func getClusterStatus(server types.Container, workers []types.Container) string {
+func getClusterStatus(server types.Container, nodes []types.Container) string {
 	// The cluster is in the abnromal state when server state and the worker
 	// states don't agree.
-	for _, w := range workers {
+	for _, w := range nodes {
 		if w.State != server.State {
 			return "unhealthy"
 		}
@@ -261,12 +294,57 @@ func getClusterStatus(server types.Container, workers []types.Container) string
 	return server.State
 }
 
+// forEachCluster runs an action on clusters in parallel (e.g. for stopping all of them at once), reports
+// its outcome for each cluster and fails if it failed for any of them. A single cluster gets the error as is.
+func forEachCluster(clusters map[string]Cluster, action string, done string, f func(Cluster) error) error {
+	if len(clusters) == 1 {
+		for _, cluster := range clusters {
+			return f(cluster)
+		}
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(clusters))
+	for _, cluster := range clusters {
+		go func(cluster Cluster) {
+			results <- result{name: cluster.name, err: f(cluster)}
+		}(cluster)
+	}
+	errs := map[string]error{}
+	for range clusters {
+		r := <-results
+		errs[r.name] = r.err
+	}
+
+	names := []string{}
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := []string{}
+	for _, name := range names {
+		if errs[name] != nil {
+			log.Errorf("Couldn't %s cluster [%s]\n%+v", action, name, errs[name])
+			failed = append(failed, name)
+		} else {
+			log.Printf("Cluster [%s]: %s", name, done)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't %s %d of %d clusters: %v", action, len(failed), len(clusters), failed)
+	}
+	return nil
+}
+
 // getClusters uses the docker API to get existing clusters and compares that with the list of cluster directories
 // When 'all' is true, 'cluster' contains all clusters found from the docker daemon
 // When 'all' is false, 'cluster' contains up to one cluster whose name matches 'name'. 'cluster' can
 // be empty if no matching cluster is found.
 func getClusters(all bool, name string) (map[string]Cluster, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -288,6 +366,14 @@ func getClusters(all bool, name string) (map[string]Cluster, error) {
 
 	clusters := make(map[string]Cluster)
 
+	// the other servers of the HA clusters (all but the one that initialized the cluster)
+	haServers := map[string][]types.Container{}
+	for _, server := range k3dServers {
+		if index := server.Labels["server-index"]; index != "" && index != "0" {
+			haServers[server.Labels["cluster"]] = append(haServers[server.Labels["cluster"]], server)
+		}
+	}
+
 	// don't filter for servers but for workers now
 	filters.Del("label", "component=server")
 	filters.Add("label", "component=worker")
@@ -295,6 +381,9 @@ func getClusters(all bool, name string) (map[string]Cluster, error) {
 	// for all servers created by k3d, get workers and cluster information
 	for _, server := range k3dServers {
 		clusterName := server.Labels["cluster"]
+		if index := server.Labels["server-index"]; index != "" && index != "0" {
+			continue
+		}
 
 		// Skip the cluster if we don't want all of them, and
 		// the cluster name does not match.
@@ -320,9 +409,10 @@ func getClusters(all bool, name string) (map[string]Cluster, error) {
 			clusters[clusterName] = Cluster{
 				name:        clusterName,
 				image:       server.Image,
-				status:      getClusterStatus(server, workers),
+				status:      getClusterStatus(server, append(haServers[clusterName], workers...)),
 				serverPorts: serverPorts,
 				server:      server,
+				servers:     haServers[clusterName],
 				workers:     workers,
 			}
 			// clear label filters before searching for next cluster
@@ -332,3 +422,149 @@ func getClusters(all bool, name string) (map[string]Cluster, error) {
 
 	return clusters, nil
 }
+
+// getNodesBySpecifier selects the node containers of a cluster matching a node-specifier:
+// either a group of nodes (see nodeRuleGroupsMap) or the name of a node container (with or without its `k3d-` prefix)
+func getNodesBySpecifier(cluster Cluster, specifier string) ([]types.Container, error) {
+	nodes := []types.Container{}
+	for _, node := range cluster.nodes() {
+		role := node.Labels["component"]
+		matched := false
+		for _, group := range nodeRuleGroupsMap[role] {
+			if group == specifier {
+				matched = true
+				break
+			}
+		}
+		for _, name := range node.Names {
+			name = strings.TrimPrefix(name, "/")
+			if name == specifier || name == fmt.Sprintf("%s-%s", defaultContainerNamePrefix, specifier) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			nodes = append(nodes, node)
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("No nodes matching [%s] found in cluster %s", specifier, cluster.name)
+	}
+	return nodes, nil
+}
+
+// getNodeName returns the name of a node container
+func getNodeName(node types.Container) string {
+	if len(node.Names) == 0 {
+		return node.ID
+	}
+	return strings.TrimPrefix(node.Names[0], "/")
+}
+
+// getCluster returns the cluster with the given name, failing if it does not exist
+func getCluster(name string) (Cluster, error) {
+	clusters, err := getClusters(false, name)
+	if err != nil {
+		return Cluster{}, err
+	}
+	cluster, ok := clusters[name]
+	if !ok {
+		return Cluster{}, fmt.Errorf("Cluster %s does not exist", name)
+	}
+	return cluster, nil
+}
+
+// getNextWorkerSuffix returns the first unused suffix for the name of a new worker node of a cluster
+func getNextWorkerSuffix(clusterName string) (int, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	filters := filters.NewArgs()
+	filters.Add("label", "app=k3d")
+	filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	filters.Add("label", "component=worker")
+
+	workers, err := docker.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters,
+	})
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't list worker containers of cluster %s\n%+v", clusterName, err)
+	}
+
+	next := 0
+	for _, worker := range workers {
+		split := strings.Split(getNodeName(worker), "-")
+		suffix, err := strconv.Atoi(split[len(split)-1])
+		if err != nil {
+			continue
+		}
+		if suffix >= next {
+			next = suffix + 1
+		}
+	}
+	return next, nil
+}
+
+// creationLabels encodes the normalized parameters a cluster was created with as labels for its server
+func (spec *ClusterSpec) creationLabels() map[string]string {
+	ports := []string{}
+	for node, portSpecs := range spec.NodeToPortSpecMap {
+		for _, portSpec := range portSpecs {
+			ports = append(ports, fmt.Sprintf("%s@%s", portSpec, node))
+		}
+	}
+	sort.Strings(ports)
+
+	registry := ""
+	if spec.RegistryEnabled {
+		registry = fmt.Sprintf("%s:%d", spec.RegistryName, spec.RegistryPort)
+		if spec.RegistryCacheEnabled {
+			registry += " (cache)"
+		}
+	}
+
+	labels := map[string]string{
+		"spec.image":       spec.Image,
+		"spec.api-port":    spec.APIPort.Port,
+		"spec.workers":     strconv.Itoa(spec.Workers),
+		"spec.ports":       strings.Join(ports, ","),
+		"spec.registry":    registry,
+		"spec.server-args": strings.Join(append(append([]string{}, spec.ServerArgs...), getNodeArgSpecs(spec.NodeServerArgs)...), " "),
+		"spec.agent-args":  strings.Join(append(append([]string{}, spec.AgentArgs...), getNodeArgSpecs(spec.NodeAgentArgs)...), " "),
+	}
+	// only recorded for the HA clusters, keeping the hash of the other clusters unchanged
+	if spec.Servers > 1 {
+		labels["spec.servers"] = strconv.Itoa(spec.Servers)
+	}
+	// only recorded for the clusters created from a release channel, with the release pinned
+	if spec.Channel != "" {
+		labels["spec.channel"] = spec.Channel
+	}
+
+	// a hash of all the parameters, for telling at a glance if two clusters were created the same way
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", k, labels[k])
+	}
+	labels["spec.hash"] = fmt.Sprintf("%x", hash.Sum(nil))[:12]
+
+	// the flags of create, for telling if creating the cluster again is a no-op (not in the hash, which
+	// would change with every new flag of k3d)
+	if len(spec.CreateFlags) > 0 {
+		if flags, err := json.Marshal(spec.CreateFlags); err == nil {
+			labels["spec.flags"] = string(flags)
+		}
+	}
+
+	return labels
+}
@@ -8,13 +8,20 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -22,7 +29,7 @@ import (
 // CheckTools checks if the docker API server is responding
 func CheckTools(c *cli.Context) error {
 	log.Print("Checking docker...")
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
@@ -36,24 +43,153 @@ func CheckTools(c *cli.Context) error {
 	return nil
 }
 
+// Doctor checks the environment k3d runs in, failing if it found problems
+func Doctor(c *cli.Context) error {
+	port, err := parseAPIPort(c.String("api-port"))
+	if err != nil {
+		return err
+	}
+	apiPort, _ := strconv.Atoi(port.Port)
+	registryPort, err := parseRegistryPort(c.String("registry-port"))
+	if err != nil {
+		return err
+	}
+
+	problems, err := runDoctor(c.String("image"), apiPort, registryPort)
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("Found %d problem(s): `k3d create` may fail or the clusters may not work properly", problems)
+	}
+	log.Println("SUCCESS: no problems found")
+	return nil
+}
+
 // CreateCluster creates a new single-node cluster container and initializes the cluster directory
 func CreateCluster(c *cli.Context) error {
+	// the docker calls in flight are aborted when --timeout is exceeded
+	defer startOperation(operationContext(), c.Duration("timeout"))()
+	progress := newProgress("create")
+	err := createCluster(c, progress)
+	progress.finish(err)
+	return err
+}
+
+// createCluster creates the cluster, reporting its phases in 'progress'
+func createCluster(c *cli.Context, progress *progress) error {
 
 	// On Error delete the cluster.  If there createCluster() encounter any error,
 	// call this function to remove all resources allocated for the cluster so far
 	// so that they don't linger around.
-	deleteCluster := func() {
-		log.Println("ERROR: Cluster creation failed, rolling back...")
-		if err := DeleteCluster(c); err != nil {
-			log.Printf("Error: Failed to delete cluster %s", c.String("name"))
+	// The rollback happens once, be it on an error or on an interruption (see below).
+	var rollback sync.Once
+	rollbackCluster := func() {
+		// the rollback isn't bound by the creation which may have timed out
+		defer startOperation(context.Background(), 0)()
+		if _, err := getCluster(c.String("name")); err == nil {
+			if err := DeleteCluster(c); err != nil {
+				log.Printf("Error: Failed to delete cluster %s", c.String("name"))
+			}
+		}
+		// what exists before the server, or isn't removed with the nodes
+		if err := removeClusterLeftovers(c.String("name")); err != nil {
+			log.Warningf("Couldn't remove the leftovers of cluster %s\n%+v", c.String("name"), err)
 		}
 	}
+	deleteCluster := func() {
+		rollback.Do(func() {
+			if operationContext().Err() == context.DeadlineExceeded {
+				log.Printf("ERROR: Timeout of %s exceeded", c.Duration("timeout"))
+			}
+			log.Println("ERROR: Cluster creation failed, rolling back...")
+			rollbackCluster()
+		})
+	}
+
+	progress.start("configuration", 0)
 
 	// validate --wait flag
 	if c.IsSet("wait") && c.Int("wait") < 0 {
 		log.Fatalf("Negative value for '--wait' not allowed (set '%d')", c.Int("wait"))
 	}
 
+	/*
+	 * --wait-for
+	 * Readiness conditions checked once all the nodes are created
+	 */
+	readinessConditions, err := parseReadinessConditions(c.StringSlice("wait-for"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --servers
+	 * More than one server runs an HA control plane with the embedded etcd
+	 */
+	if c.Int("servers") < 1 {
+		return fmt.Errorf("Invalid value for '--servers' (set '%d'): a cluster needs at least one server", c.Int("servers"))
+	}
+	if c.Int("servers")%2 == 0 {
+		log.Warnf("%d servers don't tolerate more failures than %d: use an odd number of servers for the etcd quorum", c.Int("servers"), c.Int("servers")-1)
+	}
+
+	/*
+	 * --size, --memory, --cpus, --servers-memory, --servers-cpus, --agents-memory, --agents-cpus
+	 * Presets for the number of workers and the resource limits of the nodes (the flags given explicitly win,
+	 * and the ones of a role win over the ones of all the nodes)
+	 */
+	if err := applyClusterSize(c); err != nil {
+		return err
+	}
+	resources, err := parseNodeResources(c.String("memory"), c.String("cpus"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --gpus
+	 * GPUs of the docker host given to all the nodes, which need an image of k3s with the NVIDIA container runtime
+	 */
+	if c.IsSet("gpus") {
+		if resources.GPUs, err = parseGPUs(c.String("gpus")); err != nil {
+			return err
+		}
+		if err := checkGPUSupport(); err != nil {
+			return err
+		}
+		if !c.IsSet("image") && !c.IsSet("i") {
+			return fmt.Errorf("--gpus needs a CUDA-enabled k3s image with the NVIDIA container runtime given with --image: the default image of k3s can't run GPU workloads (see the docs for building one)")
+		}
+	}
+	serverResources, err := resources.override(c.String("servers-memory"), c.String("servers-cpus"))
+	if err != nil {
+		return err
+	}
+	agentResources, err := resources.override(c.String("agents-memory"), c.String("agents-cpus"))
+	if err != nil {
+		return err
+	}
+	for _, r := range []*nodeResources{&serverResources, &agentResources} {
+		if err := r.setSystemReserved(); err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * --snapshot
+	 * Seed the datastore of the server with a snapshot taken with `k3d snapshot save`
+	 */
+	var snapshot *clusterSnapshot
+	if c.IsSet("snapshot") {
+		if c.Int("servers") > 1 || c.String("datastore-endpoint") != "" {
+			return fmt.Errorf("'--snapshot' only seeds the datastore of a single server (sqlite or the embedded etcd)")
+		}
+		if snapshot, err = readClusterSnapshot(c.String("snapshot")); err != nil {
+			return err
+		}
+	}
+
 	/**********************
 	 *										*
 	 *		CONFIGURATION		*
@@ -70,14 +206,45 @@ func CreateCluster(c *cli.Context) error {
 		return err
 	}
 
-	// check if the cluster name is already taken
-	if cluster, err := getClusters(false, c.String("name")); err != nil {
+	/*
+	 * --force
+	 * Check if the cluster name is already taken: creating the same cluster again is a no-op,
+	 * and a different one fails, unless the existing cluster is deleted first
+	 */
+	requestedFlags := getCreateFlags(c)
+	if clusters, err := getClusters(false, c.String("name")); err != nil {
 		return err
-	} else if len(cluster) != 0 {
-		// A cluster exists with the same name. Return with an error.
-		return fmt.Errorf(" Cluster %s already exists", c.String("name"))
+	} else if cluster, ok := clusters[c.String("name")]; ok {
+		// the temporary clusters of `k3d run` can't be existing ones
+		if c.Command.Name != "create" {
+			return fmt.Errorf(" Cluster %s already exists", c.String("name"))
+		}
+		if !c.Bool("force") {
+			return checkExistingCluster(cluster, requestedFlags)
+		}
+		log.Printf("Cluster %s already exists: deleting it first (--force)", c.String("name"))
+		if err := DeleteCluster(c); err != nil {
+			return err
+		}
 	}
 
+	/*
+	 * SIGINT, SIGTERM
+	 * Cancel the docker calls in flight and roll back, unless --keep-partial is set
+	 * (only from here: an existing cluster with the same name must not be rolled back)
+	 */
+	stopInterrupts := handleInterrupts(func() {
+		rollback.Do(func() {
+			if c.Bool("keep-partial") {
+				log.Warningf("Creation of cluster %s interrupted: keeping what was created (remove it with `%s delete --name %s`, or `%s prune` if its server wasn't created yet)", c.String("name"), os.Args[0], c.String("name"), os.Args[0])
+				return
+			}
+			log.Printf("Creation of cluster %s interrupted, rolling back...", c.String("name"))
+			rollbackCluster()
+		})
+	})
+	defer stopInterrupts()
+
 	/*
 	 * --image, -i
 	 * The k3s image used for the k3d node containers
@@ -89,11 +256,35 @@ func CreateCluster(c *cli.Context) error {
 		image = fmt.Sprintf("%s/%s", DefaultRegistry, image)
 	}
 
+	/*
+	 * --channel, --channel-server
+	 * The release channel of k3s whose latest release is used: the tag of the image is replaced by it
+	 */
+	channel := ""
+	if c.String("channel") != "" {
+		release, err := resolveK3sChannel(c.String("channel-server"), c.String("channel"))
+		if err != nil {
+			return err
+		}
+		image = fmt.Sprintf("%s:%s", getImageRepository(image), getK3sImageTag(release))
+		channel = fmt.Sprintf("%s (%s)", c.String("channel"), release)
+		log.Printf("Using k3s %s from the %s channel (%s)", release, c.String("channel"), image)
+	}
+
+	/*
+	 * --pull-policy
+	 * When to pull the k3s image (and the registry image)
+	 */
+	if err := validatePullPolicy(c.String("pull-policy")); err != nil {
+		return err
+	}
+
 	/*
 	 * Cluster network
 	 * For proper communication, all k3d node containers have to be in the same docker network
 	 */
 	// create cluster network
+	progress.start("network", 5)
 	networkID, err := createClusterNetwork(c.String("name"))
 	if err != nil {
 		return err
@@ -107,14 +298,23 @@ func CreateCluster(c *cli.Context) error {
 	// environment variables
 	env := []string{"K3S_KUBECONFIG_OUTPUT=/output/kubeconfig.yaml"}
 	env = append(env, c.StringSlice("env")...)
-	env = append(env, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", GenerateRandomString(20)))
+	clusterSecret := GenerateRandomString(20)
+	if snapshot != nil {
+		// k3s only accepts the datastore of the snapshot with the token of its cluster
+		clusterSecret = getTokenSecret(snapshot.token)
+	}
+	env = append(env, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", clusterSecret))
+	if c.Int("servers") > 1 || snapshot != nil {
+		// the servers joining the embedded etcd, or seeded with a snapshot, need the token (K3S_CLUSTER_SECRET is only used by the agents)
+		env = append(env, fmt.Sprintf("K3S_TOKEN=%s", clusterSecret))
+	}
 
 	/*
 	 * --label, -l
 	 * Docker container labels that will be added to the k3d node containers
 	 */
 	// labels
-	labelmap, err := mapNodesToLabelSpecs(c.StringSlice("label"), GetAllContainerNames(c.String("name"), DefaultServerCount, c.Int("workers")))
+	labelmap, err := mapNodesToLabelSpecs(c.StringSlice("label"), GetAllContainerNames(c.String("name"), c.Int("servers"), c.Int("workers")))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -155,23 +355,99 @@ func CreateCluster(c *cli.Context) error {
 		k3sServerArgs = append(k3sServerArgs, "--tls-san", apiPort.Host)
 	}
 
+	/*
+	 * --status-port
+	 * The status sidecar verifies the API server certificate using the server container name
+	 */
+	if c.Int("status-port") < 0 || c.Int("status-port") > 65535 {
+		return fmt.Errorf("Invalid '--status-port' %d", c.Int("status-port"))
+	}
+	if c.Int("status-port") > 0 {
+		k3sServerArgs = append(k3sServerArgs, "--tls-san", GetContainerName("server", c.String("name"), -1))
+	}
+
+	// the workers of an HA cluster reach the servers through their load balancer
+	if c.Int("servers") > 1 {
+		k3sServerArgs = append(k3sServerArgs, "--tls-san", GetContainerName("serverlb", c.String("name"), -1))
+	}
+
+	/*
+	 * --k3s-config
+	 * k3s configuration file copied into all the nodes
+	 */
+	var k3sConfig map[string]interface{}
+	if c.IsSet("k3s-config") {
+		k3sConfig, err = loadK3sConfig(c.String("k3s-config"))
+		if err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * --datastore-endpoint, --datastore-cafile, --datastore-certfile, --datastore-keyfile, --datastore-container
+	 * External datastore of the servers (instead of sqlite or the embedded etcd)
+	 */
+	datastore, err := parseDatastore(c.String("datastore-endpoint"), c.String("datastore-cafile"), c.String("datastore-certfile"),
+		c.String("datastore-keyfile"), c.String("datastore-container"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --node-label, --node-taint
+	 * Labels and taints of the Kubernetes nodes, given to k3s with the node filters of the servers or the workers
+	 */
+	serverArgSpecs := c.StringSlice("server-arg")
+	agentArgSpecs := c.StringSlice("agent-arg")
+	for _, flag := range []string{"node-label", "node-taint"} {
+		serverNodeArgs, agentNodeArgs, err := getNodeFlagArgs(flag, c.StringSlice(flag))
+		if err != nil {
+			return err
+		}
+		serverArgSpecs = append(serverArgSpecs, serverNodeArgs...)
+		agentArgSpecs = append(agentArgSpecs, agentNodeArgs...)
+	}
+
 	/*
 	 * --server-arg, -x
-	 * Add user-supplied arguments for the k3s server
+	 * Add user-supplied arguments for the k3s server, the ones with node filters (`@server[0]`) only to some servers
 	 */
-	if c.IsSet("server-arg") || c.IsSet("x") {
-		k3sServerArgs = append(k3sServerArgs, c.StringSlice("server-arg")...)
+	nodeServerArgs := []nodeArg{}
+	if len(serverArgSpecs) > 0 {
+		args, filtered, err := parseNodeArgs(serverArgSpecs, "server")
+		if err != nil {
+			return err
+		}
+		if err := validateNodeArgs(filtered, c.Int("servers")); err != nil {
+			return err
+		}
+		k3sServerArgs = append(k3sServerArgs, args...)
+		nodeServerArgs = filtered
+	}
+
+	// the datastore of an etcd snapshot is the embedded etcd
+	if snapshot != nil && snapshot.etcd != "" {
+		k3sServerArgs = append(k3sServerArgs, "--cluster-init")
 	}
 
 	/*
 	 * --agent-arg
-	 * Add user-supplied arguments for the k3s agent
+	 * Add user-supplied arguments for the k3s agent, the ones with node filters (`@worker[1-2]`) only to some workers
 	 */
-	if c.IsSet("agent-arg") {
-		if c.Int("workers") < 1 {
+	nodeAgentArgs := []nodeArg{}
+	if len(agentArgSpecs) > 0 {
+		if c.IsSet("agent-arg") && c.Int("workers") < 1 {
 			log.Warnln("--agent-arg supplied, but --workers is 0, so no agents will be created")
 		}
-		k3AgentArgs = append(k3AgentArgs, c.StringSlice("agent-arg")...)
+		args, filtered, err := parseNodeArgs(agentArgSpecs, "worker")
+		if err != nil {
+			return err
+		}
+		if err := validateNodeArgs(filtered, c.Int("workers")); err != nil {
+			return err
+		}
+		k3AgentArgs = append(k3AgentArgs, args...)
+		nodeAgentArgs = filtered
 	}
 
 	/*
@@ -179,11 +455,26 @@ func CreateCluster(c *cli.Context) error {
 	 * List of ports, that should be mapped from some or all k3d node containers to the host system (or other interface)
 	 */
 	// new port map
-	portmap, err := mapNodesToPortSpecs(c.StringSlice("port"), GetAllContainerNames(c.String("name"), DefaultServerCount, c.Int("workers")))
+	portmap, err := mapNodesToPortSpecs(c.StringSlice("port"), GetAllContainerNames(c.String("name"), c.Int("servers"), c.Int("workers")))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	/*
+	 * --volume, -v
+	 * List of volumes: host directory mounts for some or all k3d node containers in the cluster
+	 * (checked before creating anything)
+	 */
+	volumes := c.StringSlice("volume")
+
+	volumesSpec, err := NewVolumes(volumes)
+	if err != nil {
+		return err
+	}
+	if err := checkHostPaths(volumesSpec, c.Bool("create-missing-host-paths"), c.Bool("allow-dangerous-mounts"), c.Bool("skip-shared-paths-check")); err != nil {
+		return err
+	}
+
 	/*
 	 * Image Volume
 	 * A docker volume that will be shared by every k3d node container in the cluster.
@@ -197,17 +488,6 @@ func CreateCluster(c *cli.Context) error {
 		return err
 	}
 
-	/*
-	 * --volume, -v
-	 * List of volumes: host directory mounts for some or all k3d node containers in the cluster
-	 */
-	volumes := c.StringSlice("volume")
-
-	volumesSpec, err := NewVolumes(volumes)
-	if err != nil {
-		return err
-	}
-
 	volumesSpec.DefaultVolumes = append(volumesSpec.DefaultVolumes, fmt.Sprintf("%s:/images", imageVolume.Name))
 
 	/*
@@ -230,611 +510,2328 @@ func CreateCluster(c *cli.Context) error {
 			registriesFile = ""
 		}
 	}
+	// fail before creating any node if the file is not valid
+	if registriesFile != "" {
+		vars := getRegistriesFileVars(&ClusterSpec{
+			ClusterName:          c.String("name"),
+			RegistriesFile:       registriesFile,
+			RegistryInternalPort: c.Int("registry-internal-port"),
+			RegistryName:         c.String("registry-name"),
+		})
+		if _, err := loadRegistriesFile(registriesFile, vars); err != nil {
+			return err
+		}
+	}
 
 	/*
-	 * clusterSpec
-	 * Defines, with which specifications, the cluster and the nodes inside should be created
+	 * --registry-config
+	 * A full registry configuration file that will be mounted in the registry container
 	 */
-	clusterSpec := &ClusterSpec{
-		AgentArgs:            k3AgentArgs,
-		APIPort:              *apiPort,
-		AutoRestart:          c.Bool("auto-restart"),
-		ClusterName:          c.String("name"),
-		Env:                  env,
-		NodeToLabelSpecMap:   labelmap,
-		Image:                image,
-		NodeToPortSpecMap:    portmap,
-		PortAutoOffset:       c.Int("port-auto-offset"),
-		RegistriesFile:       registriesFile,
-		RegistryEnabled:      c.Bool("enable-registry"),
-		RegistryCacheEnabled: c.Bool("enable-registry-cache"),
-		RegistryName:         c.String("registry-name"),
-		RegistryPort:         c.Int("registry-port"),
-		RegistryVolume:       c.String("registry-volume"),
-		ServerArgs:           k3sServerArgs,
-		Volumes:              volumesSpec,
+	registryConfig := ""
+	if c.IsSet("registry-config") {
+		if !c.Bool("enable-registry") {
+			log.Warnln("--registry-config supplied, but --enable-registry is not set, so it will be ignored")
+		}
+		registryConfig, err = filepath.Abs(c.String("registry-config"))
+		if err != nil {
+			return err
+		}
+		if !fileExists(registryConfig) {
+			log.Fatalf("registry-config %q does not exists", registryConfig)
+		}
 	}
 
-	/******************
-	 *								*
-	 *		CREATION		*
-	 * vvvvvvvvvvvvvv	*
-	 ******************/
-
-	log.Printf("Creating cluster [%s]", c.String("name"))
-
 	/*
-	 * Cluster Directory
+	 * --registry-cache-user, --registry-cache-password, --registry-cache-password-file
+	 * Docker Hub credentials used by the pull-through cache
 	 */
-	// create the directory where we will put the kubeconfig file by default (when running `k3d get-config`)
-	createClusterDir(c.String("name"))
+	registryCacheAuth, err := getRegistryCacheAuth(c)
+	if err != nil {
+		return err
+	}
+	if registryCacheAuth != nil && !c.Bool("enable-registry-cache") {
+		log.Warnln("Registry cache credentials supplied, but --enable-registry-cache is not set, so they will be ignored")
+	}
 
-	/* (1)
-	 * Registry (optional)
-	 * Create the (optional) registry container
+	/*
+	 * --registry-notify, --registry-notify-header, --registry-notify-events
+	 * Webhooks called by the registry on pushes (or other events)
 	 */
-	var registryNameExists *dnsNameCheck
-	if clusterSpec.RegistryEnabled {
-		registryNameExists = newAsyncNameExists(clusterSpec.RegistryName, 1*time.Second)
-		if _, err = createRegistry(*clusterSpec); err != nil {
-			deleteCluster()
-			return err
-		}
+	registryNotifications, err := parseRegistryNotifications(c.StringSlice("registry-notify"), c.StringSlice("registry-notify-header"), c.String("registry-notify-events"))
+	if err != nil {
+		return err
+	}
+	if len(registryNotifications) > 0 && !c.Bool("enable-registry") {
+		log.Warnln("--registry-notify supplied, but --enable-registry is not set, so it will be ignored")
 	}
 
-	/* (2)
-	 * Server
-	 * Create the server node container
+	/*
+	 * --registry-network
+	 * User-defined networks the registry is attached to
 	 */
-	serverContainerID, err := createServer(clusterSpec)
+	registryNetworks, err := parseRegistryNetworks(c.StringSlice("registry-network"))
 	if err != nil {
-		deleteCluster()
 		return err
 	}
+	if len(registryNetworks) > 0 && !c.Bool("enable-registry") {
+		log.Warnln("--registry-network supplied, but --enable-registry is not set, so it will be ignored")
+	}
 
-	/* (2.1)
-	 * Wait
-	 * Wait for k3s server to be done initializing, if wanted
+	/*
+	 * --registry-rewrite
+	 * Rewrite rules for the repositories of the images pulled from the k3d registry
 	 */
-	// We're simply scanning the container logs for a line that tells us that everything's up and running
-	// TODO: also wait for worker nodes
-	if c.IsSet("wait") {
-		if err := waitForContainerLogMessage(serverContainerID, "Wrote kubeconfig", c.Int("wait")); err != nil {
-			deleteCluster()
-			return fmt.Errorf("ERROR: failed while waiting for server to come up\n%+v", err)
-		}
+	registryRewrites, err := parseRegistryRewrites(c.StringSlice("registry-rewrite"))
+	if err != nil {
+		return err
+	}
+	if len(registryRewrites) > 0 && !c.Bool("enable-registry") && c.String("registry-use") == "" && !c.Bool("registry-adopt") {
+		log.Warnln("--registry-rewrite supplied, but no registry is used (--enable-registry, --registry-use or --registry-adopt), so it will be ignored")
 	}
 
-	/* (3)
-	 * Workers
-	 * Create the worker node containers
+	/*
+	 * --registry-mirror
+	 * Additional mirrors for some upstream registries
 	 */
-	// TODO: do this concurrently in different goroutines
-	if c.Int("workers") > 0 {
-		log.Printf("Booting %s workers for cluster %s", strconv.Itoa(c.Int("workers")), c.String("name"))
-		for i := 0; i < c.Int("workers"); i++ {
-			workerID, err := createWorker(clusterSpec, i)
-			if err != nil {
-				deleteCluster()
-				return err
-			}
-			log.Printf("Created worker with ID %s\n", workerID)
-		}
+	registryMirrors, err := parseRegistryMirrors(c.StringSlice("registry-mirror"))
+	if err != nil {
+		return err
 	}
 
-	/* (4)
-	 * Done
-	 * Finished creating resources.
+	/*
+	 * --registry-volume-max-size
+	 * Size quota enforced by `k3d registry prune`
 	 */
+	registryMaxSize, err := parseRegistryMaxSize(c.String("registry-volume-max-size"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --registry-volume-dir
+	 * Host directory of the registry storage
+	 */
+	registryVolumeDir, err := parseRegistryVolumeDir(c.String("registry-volume-dir"), c.String("registry-volume"))
+	if err != nil {
+		return err
+	}
+	if err := validateRegistryMaxSize(registryMaxSize, c.Bool("enable-registry-cache")); err != nil {
+		return err
+	}
+	if registryMaxSize > 0 && !c.Bool("enable-registry") {
+		log.Warnln("--registry-volume-max-size supplied, but --enable-registry is not set, so it will be ignored")
+	}
+
+	/*
+	 * --registry-ready-timeout
+	 * Maximum time waited for the registry before creating the nodes
+	 */
+	if c.Int("registry-ready-timeout") < 0 {
+		return fmt.Errorf("Negative value for '--registry-ready-timeout' not allowed (set '%d')", c.Int("registry-ready-timeout"))
+	}
+
+	/*
+	 * --registry-use
+	 * Use a registry not managed by k3d
+	 */
+	registryUse := c.String("registry-use")
+	if (registryUse != "" || c.Bool("registry-adopt")) && c.Bool("enable-registry") {
+		return fmt.Errorf("--registry-use/--registry-adopt and --enable-registry are mutually exclusive")
+	}
+
+	/*
+	 * --registry-adopt
+	 * Look for a registry created by other tools (like kind)
+	 */
+	if c.Bool("registry-adopt") && registryUse == "" {
+		registryUse, err = detectLocalRegistry()
+		if err != nil {
+			return err
+		}
+		if registryUse == "" {
+			return fmt.Errorf("No registry container found for adopting (use --enable-registry for creating one)")
+		}
+		log.Printf("Adopting the registry container %s", registryUse)
+	}
+
+	/*
+	 * --registry-port
+	 * A port number or `auto` for selecting a free port
+	 */
+	registryPort, err := parseRegistryPort(c.String("registry-port"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --registry-bind-address
+	 * Host address the registry port is published on
+	 */
+	registryBindAddresses, err := parseRegistryBindIPs(c.String("registry-bind-address"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --registry-debug-port
+	 * Host port the metrics of the registry are published on
+	 */
+	if err := validateRegistryDebugPort(c.Int("registry-debug-port"), registryPort, c.Int("registry-internal-port")); err != nil {
+		return err
+	}
+
+	/*
+	 * --add-registry
+	 * Additional registries created along with the cluster
+	 */
+	extraRegistries, err := parseExtraRegistries(c.StringSlice("add-registry"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --registry-mtls
+	 * Mutual TLS between the nodes and the registry
+	 */
+	if c.Bool("registry-mtls") && !c.Bool("enable-registry") {
+		return fmt.Errorf("--registry-mtls requires --enable-registry")
+	}
+
+	/*
+	 * --self-heal
+	 * Restart the nodes that die unexpectedly, which --auto-restart already does
+	 */
+	if c.Bool("self-heal") && c.Bool("auto-restart") {
+		return fmt.Errorf("--self-heal and --auto-restart can't be used together (--auto-restart restarts the nodes that die too)")
+	}
+
+	/*
+	 * --restart-policy
+	 * Restart policy of all the containers of the cluster, replacing --auto-restart and --self-heal
+	 */
+	if c.String("restart-policy") != "" {
+		if c.Bool("auto-restart") || c.Bool("self-heal") {
+			return fmt.Errorf("--restart-policy can't be used with --auto-restart (unless-stopped) or --self-heal (on-failure for the nodes)")
+		}
+		if _, err := parseRestartPolicy(c.String("restart-policy")); err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * --registry-restart
+	 * Restart policy of the registry, independent of --auto-restart and --restart-policy
+	 */
+	if c.String("registry-restart") != "" {
+		if _, err := parseRestartPolicy(c.String("registry-restart")); err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * clusterSpec
+	 * Defines, with which specifications, the cluster and the nodes inside should be created
+	 */
+	clusterSpec := &ClusterSpec{
+		AgentArgs:            k3AgentArgs,
+		APIPort:              *apiPort,
+		AutoRestart:          c.Bool("auto-restart"),
+		Channel:              channel,
+		ClusterName:          c.String("name"),
+		CreateFlags:          requestedFlags,
+		Datastore:            datastore,
+		Env:                  env,
+		ExtraRegistries:      extraRegistries,
+		NodeToLabelSpecMap:   labelmap,
+		Image:                image,
+		K3sConfig:            k3sConfig,
+		NodeToPortSpecMap:    portmap,
+		PortAutoOffset:       c.Int("port-auto-offset"),
+		PullPolicy:           c.String("pull-policy"),
+		ServerResources:      serverResources,
+		AgentResources:       agentResources,
+		RegistriesFile:       registriesFile,
+		RegistryBindIPs:      registryBindAddresses,
+		RegistryEnabled:      c.Bool("enable-registry"),
+		RegistryCacheEnabled: c.Bool("enable-registry-cache"),
+		RegistryCacheAuth:    registryCacheAuth,
+		RegistryConfig:       registryConfig,
+		RegistryDebugPort:    c.Int("registry-debug-port"),
+		RegistryEnv:          c.StringSlice("registry-env"),
+		RegistryFailover:     c.Bool("registry-failover"),
+		RegistryImage:        c.String("registry-image"),
+		RegistryInternalPort: c.Int("registry-internal-port"),
+		RegistryLabels:       c.StringSlice("registry-label"),
+		RegistryMaxSize:      registryMaxSize,
+		RegistryMirrors:      registryMirrors,
+		RegistryMTLS:         c.Bool("registry-mtls"),
+		RegistryName:         c.String("registry-name"),
+		RegistryNetworks:     registryNetworks,
+		RegistryNotify:       registryNotifications,
+		RegistryPerCluster:   c.Bool("registry-per-cluster"),
+		RegistryPort:         registryPort,
+		RegistryPrivileged:   c.Bool("registry-privileged"),
+		RegistryRestart:      c.String("registry-restart"),
+		RegistryRewrite:      registryRewrites,
+		RegistryUse:          registryUse,
+		RegistryVolume:       c.String("registry-volume"),
+		RegistryVolumeDir:    registryVolumeDir,
+		RestartPolicy:        c.String("restart-policy"),
+		SelfHeal:             c.Bool("self-heal"),
+		ServerArgs:           k3sServerArgs,
+		NodeServerArgs:       nodeServerArgs,
+		NodeAgentArgs:        nodeAgentArgs,
+		Servers:              c.Int("servers"),
+		Snapshot:             snapshot,
+		StopSignal:           c.String("stop-signal"),
+		StopTimeout:          c.Duration("stop-timeout"),
+		Volumes:              volumesSpec,
+		Workers:              c.Int("workers"),
+	}
+
+	/******************
+	 *								*
+	 *		CREATION		*
+	 * vvvvvvvvvvvvvv	*
+	 ******************/
+
+	log.Printf("Creating cluster [%s]", c.String("name"))
+
+	/*
+	 * Cluster Directory
+	 */
+	// create the directory where we will put the kubeconfig file by default (when running `k3d get-config`)
+	createClusterDir(c.String("name"))
+
+	/* (1)
+	 * Registry (optional)
+	 * Create the (optional) registry container
+	 */
+	var registryNameExists *dnsNameCheck
+	if clusterSpec.RegistryEnabled {
+		progress.start("registry", 10)
+		registryNameExists = newAsyncNameExists(clusterSpec.RegistryName, 1*time.Second)
+		if err := resolveRegistryPorts(clusterSpec); err != nil {
+			deleteCluster()
+			return err
+		}
+		registryID, err := createRegistry(*clusterSpec)
+		if err != nil {
+			deleteCluster()
+			return err
+		}
+		log.Printf("Waiting for the registry to be ready...")
+		if err := waitForRegistryReady(registryID, c.Int("registry-ready-timeout")); err != nil {
+			deleteCluster()
+			return err
+		}
+		if clusterSpec.RegistryMTLS {
+			clusterDir, err := getClusterDir(clusterSpec.ClusterName)
+			if err != nil {
+				deleteCluster()
+				return err
+			}
+			tlsDir := filepath.Join(clusterDir, "registry-tls")
+			if err := writeRegistryTLSInDir(registryID, tlsDir); err != nil {
+				deleteCluster()
+				return err
+			}
+			log.Printf("The CA and the client certificate of the registry are in %s: copy them to /etc/docker/certs.d/%s:%d for pushing images with docker",
+				tlsDir, clusterSpec.RegistryName, clusterSpec.RegistryPort)
+		}
+	}
+
+	if clusterSpec.RegistryUse != "" {
+		if err := adoptRegistry(clusterSpec); err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	if len(clusterSpec.ExtraRegistries) > 0 {
+		if err := validateExtraRegistries(clusterSpec); err != nil {
+			deleteCluster()
+			return err
+		}
+		if err := createExtraRegistries(clusterSpec, c.Int("registry-ready-timeout")); err != nil {
+			// there's no server yet: the registries wouldn't be found when rolling back
+			if err := removeExtraRegistries(clusterSpec.ClusterName, false); err != nil {
+				log.Warningf("Couldn't remove the additional registries\n%+v", err)
+			}
+			deleteCluster()
+			return err
+		}
+	}
+
+	/* (1.1)
+	 * Network readiness
+	 * Make sure that the registry can be resolved in the cluster network before starting any node
+	 */
+	if clusterSpec.RegistryEnabled {
+		registryImage := clusterSpec.RegistryImage
+		if registryImage == "" {
+			registryImage = defaultRegistryImage
+		}
+		log.Printf("Waiting for %s to be resolvable in the cluster network...", clusterSpec.RegistryName)
+		if err := waitForNetworkAliases(clusterSpec.ClusterName, registryImage, []string{clusterSpec.RegistryName}, defaultNetworkReadyTimeout); err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	/* (1.2)
+	 * --datastore-container
+	 * Make the container of the datastore reachable from the servers
+	 */
+	if clusterSpec.Datastore != nil && clusterSpec.Datastore.Container != "" {
+		if err := connectDatastore(clusterSpec.ClusterName, clusterSpec.Datastore.Container); err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	/* (2)
+	 * Server
+	 * Create the server node container
+	 */
+	progress.start("server", 30)
+	if err := ensureImage(clusterSpec.Image, clusterSpec.PullPolicy); err != nil {
+		deleteCluster()
+		return err
+	}
+
+	/*
+	 * --volume-filter
+	 * Mount filtered copies of the host directories having a .k3dignore file
+	 */
+	if c.Bool("volume-filter") {
+		if err := filterVolumes(clusterSpec.Volumes, clusterSpec.ClusterName, clusterSpec.Image); err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	var serverContainerID string
+	if clusterSpec.Servers > 1 {
+		log.Printf("Booting %d servers for cluster %s", clusterSpec.Servers, clusterSpec.ClusterName)
+		serverIDs, err := createHAServers(clusterSpec, c.Int("wait"))
+		if err != nil {
+			deleteCluster()
+			return err
+		}
+		serverContainerID = serverIDs[0]
+	} else {
+		serverContainerID, err = createServer(clusterSpec, 0)
+		if err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	/* (2.1)
+	 * Wait
+	 * Wait for k3s server to be done initializing, if wanted
+	 */
+	// We're simply scanning the container logs for a line that tells us that everything's up and running
+	// TODO: also wait for worker nodes
+	if c.IsSet("wait") {
+		progress.start("wait-server", 40)
+		if err := waitForContainerLogMessage(serverContainerID, "Wrote kubeconfig", c.Int("wait")); err != nil {
+			deleteCluster()
+			return fmt.Errorf("ERROR: failed while waiting for server to come up\n%+v", err)
+		}
+	}
+
+	/* (3)
+	 * Workers
+	 * Create the worker node containers
+	 */
+	// TODO: do this concurrently in different goroutines
+	if c.Int("workers") > 0 {
+		log.Printf("Booting %s workers for cluster %s", strconv.Itoa(c.Int("workers")), c.String("name"))
+		for i := 0; i < c.Int("workers"); i++ {
+			progress.start(fmt.Sprintf("worker-%d", i), 50+40*i/c.Int("workers"))
+			workerID, err := createWorker(clusterSpec, i)
+			if err != nil {
+				deleteCluster()
+				return err
+			}
+			log.Printf("Created worker with ID %s\n", workerID)
+		}
+	}
+
+	/* (3.1)
+	 * --registry-pull-secrets
+	 * Create imagePullSecrets out of the credentials in the registries file
+	 */
+	if c.IsSet("registry-pull-secrets") {
+		if registriesFile == "" {
+			log.Warnln("--registry-pull-secrets supplied, but no registries file found, so no imagePullSecrets will be created")
+		} else {
+			progress.start("pull-secrets", 90)
+			log.Println("Creating imagePullSecrets from the registries file credentials")
+			namespaces := strings.Split(c.String("registry-pull-secrets"), ",")
+			timeout := 0 // wait forever for the API, unless --wait is set
+			if c.IsSet("wait") {
+				timeout = c.Int("wait")
+			}
+			if err := createPullSecrets(serverContainerID, clusterSpec, namespaces, timeout); err != nil {
+				deleteCluster()
+				return err
+			}
+		}
+	}
+
+	/* (3.2)
+	 * --snapshot
+	 * Delete the nodes of the cluster the snapshot was taken in
+	 */
+	if snapshot != nil {
+		names := []string{GetContainerName("server", c.String("name"), -1)}
+		for i := 0; i < c.Int("workers"); i++ {
+			names = append(names, GetContainerName("worker", c.String("name"), i))
+		}
+		if err := deleteSnapshotNodes(serverContainerID, names, c.Int("wait")); err != nil {
+			log.Warningf("Couldn't delete the nodes of the cluster the snapshot was taken in\n%+v", err)
+		}
+	}
+
+	/* (3.3)
+	 * --status-port
+	 * Report the readiness of the cluster over HTTP
+	 */
+	if c.Int("status-port") > 0 {
+		progress.start("status", 95)
+		statusContainer, err := createStatusContainer(clusterSpec, serverContainerID, c.Int("status-port"))
+		if err != nil {
+			deleteCluster()
+			return err
+		}
+		if statusURL, err := getStatusURL(statusContainer); err == nil {
+			log.Printf("Cluster readiness is reported at %s", statusURL)
+		}
+	}
+
+	/* (3.4)
+	 * --wait-for
+	 * Wait for the cluster to be usable: API reachable, nodes Ready, rollouts complete
+	 */
+	if len(readinessConditions) > 0 {
+		progress.start("wait-ready", 97)
+		timeout := 0 // wait forever, unless --wait is set
+		if c.IsSet("wait") {
+			timeout = c.Int("wait")
+		}
+		if err := waitForReadiness(c.String("name"), serverContainerID, clusterSpec.ServerArgs, readinessConditions, timeout); err != nil {
+			deleteCluster()
+			return err
+		}
+	}
+
+	/* (4)
+	 * Done
+	 * Finished creating resources.
+	 */
+	if err := recordClusterSpec(c.String("name")); err != nil {
+		log.Warningf("Couldn't record the configuration of the cluster (`%s verify` won't work)\n%+v", os.Args[0], err)
+	}
+
 	log.Printf("SUCCESS: created cluster [%s]", c.String("name"))
 
-	if clusterSpec.RegistryEnabled {
-		log.Printf("A local registry has been started as %s:%d", clusterSpec.RegistryName, clusterSpec.RegistryPort)
+	if clusterSpec.RegistryEnabled {
+		log.Printf("A local registry has been started as %s:%d", clusterSpec.RegistryName, clusterSpec.RegistryPort)
+
+		exists, err := registryNameExists.Exists()
+		if !exists || err != nil {
+			log.Printf("Make sure %s resolves to '127.0.0.1' (using /etc/hosts f.e, or run `%s registry hosts --add`)", clusterSpec.RegistryName, os.Args[0])
+		}
+	}
+
+	printClusterUsage(c.String("name"))
+
+	return nil
+}
+
+// DeleteCluster removes the containers belonging to a cluster and its local directory
+func DeleteCluster(c *cli.Context) error {
+	// the docker calls in flight are aborted when --timeout is exceeded
+	defer startOperation(operationContext(), c.Duration("timeout"))()
+	progress := newProgress("delete")
+	err := deleteClusters(c, progress)
+	progress.finish(err)
+	return err
+}
+
+// deleteClusters removes the clusters selected in the flags, reporting each one as a phase in 'progress'
+func deleteClusters(c *cli.Context, progress *progress) error {
+
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+
+	if err != nil {
+		return err
+	}
+
+	if len(clusters) == 0 {
+		if !c.IsSet("all") && c.IsSet("name") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to delete other clusters)", c.String("name"))
+		}
+		return fmt.Errorf("No cluster(s) found")
+	}
+
+	// remove clusters one by one instead of appending all names to the docker command
+	// this allows for more granular error handling and logging
+	removed := 0
+	for _, cluster := range clusters {
+		progress.start(fmt.Sprintf("cluster-%s", cluster.name), 100*removed/len(clusters))
+		removed++
+		log.Printf("Removing cluster [%s]", cluster.name)
+		if len(cluster.workers) > 0 {
+			// TODO: this could be done in goroutines
+			log.Printf("...Removing %d workers\n", len(cluster.workers))
+			for _, worker := range cluster.workers {
+				if err := removeContainer(worker.ID); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+		if err := removeStatusContainer(cluster.name); err != nil {
+			log.Warningf("Couldn't remove the status sidecar of cluster %s\n%+v", cluster.name, err)
+		}
+		if err := removeServerLB(cluster.name); err != nil {
+			log.Warningf("Couldn't remove the load balancer of cluster %s\n%+v", cluster.name, err)
+		}
+		deleteClusterDir(cluster.name)
+		if len(cluster.servers) > 0 {
+			log.Printf("...Removing %d other servers\n", len(cluster.servers))
+			for _, server := range cluster.servers {
+				if err := removeContainer(server.ID); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+		log.Println("...Removing server")
+		if err := removeContainer(cluster.server.ID); err != nil {
+			return fmt.Errorf(" Couldn't remove server for cluster %s\n%+v", cluster.name, err)
+		}
+
+		if err := disconnectRegistryFromNetwork(cluster.name, c.IsSet("keep-registry-volume")); err != nil {
+			log.Warningf("Couldn't disconnect Registry from network %s\n%+v", cluster.name, err)
+		}
+		if err := removeExtraRegistries(cluster.name, c.IsSet("keep-registry-volume")); err != nil {
+			log.Warningf("Couldn't remove the additional registries of cluster %s\n%+v", cluster.name, err)
+		}
+		if err := releaseExternalRegistry(cluster.name, cluster.server.Labels["registry-use"]); err != nil {
+			log.Warningf("Couldn't disconnect the registry %s from network %s\n%+v", cluster.server.Labels["registry-use"], cluster.name, err)
+		}
+		if err := releaseDatastore(cluster.name, cluster.server.Labels["datastore-container"]); err != nil {
+			log.Warningf("Couldn't disconnect the datastore %s from network %s\n%+v", cluster.server.Labels["datastore-container"], cluster.name, err)
+		}
+
+		if c.IsSet("prune") {
+			// disconnect any other container that is connected to the k3d network
+			nid, err := getClusterNetwork(cluster.name)
+			if err != nil {
+				log.Warningf("Couldn't get the network for cluster %q\n%+v", cluster.name, err)
+			}
+			cids, err := getContainersInNetwork(nid)
+			if err != nil {
+				log.Warningf("Couldn't get the list of containers connected to network %q\n%+v", nid, err)
+			}
+			for _, cid := range cids {
+				err := disconnectContainerFromNetwork(cid, nid)
+				if err != nil {
+					log.Warningf("Couldn't disconnect container %q from network %q", cid, nid)
+					continue
+				}
+				log.Printf("...%q has been forced to disconnect from %q's network", cid, cluster.name)
+			}
+		}
+
+		if err := deleteClusterNetwork(cluster.name); err != nil {
+			log.Warningf("Couldn't delete cluster network for cluster %s\n%+v", cluster.name, err)
+		}
+
+		log.Println("...Removing docker image volume")
+		if err := deleteImageVolume(cluster.name); err != nil {
+			log.Warningf("Couldn't delete image docker volume for cluster %s\n%+v", cluster.name, err)
+		}
+		if err := deleteFilteredVolumes(cluster.name); err != nil {
+			log.Warningf("Couldn't delete the filtered volumes of cluster %s\n%+v", cluster.name, err)
+		}
+
+		log.Infof("Removed cluster [%s]", cluster.name)
+	}
+
+	return nil
+}
+
+// StopCluster stops a running cluster container (restartable)
+func StopCluster(c *cli.Context) error {
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+
+	if err != nil {
+		return err
+	}
+
+	if len(clusters) == 0 {
+		if !c.IsSet("all") && c.IsSet("name") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to stop other clusters)", c.String("name"))
+		}
+		return fmt.Errorf("No cluster(s) found")
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// the stop timeout of the nodes (set at the creation of the cluster) is used, unless overridden
+	var timeout *time.Duration
+	if c.IsSet("timeout") {
+		t := c.Duration("timeout")
+		timeout = &t
+	}
+
+	// the clusters are stopped in parallel, each one reporting its outcome
+	return forEachCluster(clusters, "stop", "stopped", func(cluster Cluster) error {
+		log.Printf("Stopping cluster [%s]", cluster.name)
+		if len(cluster.workers) > 0 {
+			log.Printf("...Stopping %d workers\n", len(cluster.workers))
+			for _, worker := range cluster.workers {
+				if err := docker.ContainerStop(ctx, worker.ID, timeout); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+		if statusContainer, err := getStatusContainer(cluster.name); err != nil {
+			log.Warningf("Couldn't get the status sidecar of cluster %s\n%+v", cluster.name, err)
+		} else if statusContainer != "" {
+			log.Println("...Stopping status sidecar")
+			if err := docker.ContainerStop(ctx, statusContainer, nil); err != nil {
+				log.Println(err)
+			}
+		}
+		if lbContainer, err := getServerLBContainer(cluster.name); err != nil {
+			log.Warningf("Couldn't get the load balancer of cluster %s\n%+v", cluster.name, err)
+		} else if lbContainer != "" {
+			log.Println("...Stopping the load balancer of the servers")
+			if err := docker.ContainerStop(ctx, lbContainer, nil); err != nil {
+				log.Println(err)
+			}
+		}
+		if len(cluster.servers) > 0 {
+			log.Printf("...Stopping %d other servers\n", len(cluster.servers))
+			for _, server := range cluster.servers {
+				if err := docker.ContainerStop(ctx, server.ID, timeout); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+		log.Println("...Stopping server")
+		if err := docker.ContainerStop(ctx, cluster.server.ID, timeout); err != nil {
+			return fmt.Errorf(" Couldn't stop server for cluster %s\n%+v", cluster.name, err)
+		}
+
+		log.Infof("Stopped cluster [%s]", cluster.name)
+		return nil
+	})
+}
+
+// StartCluster starts a stopped cluster container
+func StartCluster(c *cli.Context) error {
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+
+	if err != nil {
+		return err
+	}
+
+	if len(clusters) == 0 {
+		if !c.IsSet("all") && c.IsSet("name") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to start other clusters)", c.String("name"))
+		}
+		return fmt.Errorf("No cluster(s) found")
+	}
+
+	// validate the workloads to wait for before touching any container
+	workloads := []*workload{}
+	for _, spec := range c.StringSlice("wait-for-workloads") {
+		w, err := parseWorkload(spec)
+		if err != nil {
+			return err
+		}
+		workloads = append(workloads, w)
+	}
+	if c.Int("timeout") < 0 {
+		return fmt.Errorf("Negative value for '--timeout' not allowed (set '%d')", c.Int("timeout"))
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// the clusters are started in parallel, each one reporting its outcome
+	return forEachCluster(clusters, "start", "started", func(cluster Cluster) error {
+		log.Printf("Starting cluster [%s]", cluster.name)
+
+		// TODO: consider only touching the registry if it's really in use by a cluster
+		registryContainer, err := getClusterRegistryContainer(cluster.name)
+		if err != nil {
+			log.Warn("Couldn't get registry container, if you know you have one, try starting it manually via `docker start`")
+		}
+		if registryContainer != "" {
+			log.Infof("...Starting registry container '%s'", registryContainer)
+			if err := docker.ContainerStart(ctx, registryContainer, types.ContainerStartOptions{}); err != nil {
+				log.Warnf("Failed to start the registry container '%s', try starting it manually via `docker start %s`", registryContainer, registryContainer)
+			}
+		} else {
+			log.Debugln("No registry container found. Proceeding.")
+		}
+
+		log.Println("...Starting server")
+		if err := docker.ContainerStart(ctx, cluster.server.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf(" Couldn't start server for cluster %s\n%+v", cluster.name, err)
+		}
+
+		if len(cluster.servers) > 0 {
+			log.Printf("...Starting %d other servers\n", len(cluster.servers))
+			for _, server := range cluster.servers {
+				if err := docker.ContainerStart(ctx, server.ID, types.ContainerStartOptions{}); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+		if lbContainer, err := getServerLBContainer(cluster.name); err != nil {
+			log.Warningf("Couldn't get the load balancer of cluster %s\n%+v", cluster.name, err)
+		} else if lbContainer != "" {
+			log.Println("...Starting the load balancer of the servers")
+			if err := docker.ContainerStart(ctx, lbContainer, types.ContainerStartOptions{}); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if len(cluster.workers) > 0 {
+			log.Printf("...Starting %d workers\n", len(cluster.workers))
+			for _, worker := range cluster.workers {
+				if err := docker.ContainerStart(ctx, worker.ID, types.ContainerStartOptions{}); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+		}
+
+		if statusContainer, err := getStatusContainer(cluster.name); err != nil {
+			log.Warningf("Couldn't get the status sidecar of cluster %s\n%+v", cluster.name, err)
+		} else if statusContainer != "" {
+			log.Println("...Starting status sidecar")
+			if err := docker.ContainerStart(ctx, statusContainer, types.ContainerStartOptions{}); err != nil {
+				log.Println(err)
+			} else if statusURL, err := getStatusURL(statusContainer); err == nil {
+				log.Printf("...Cluster readiness is reported at %s", statusURL)
+			}
+		}
+
+		/*
+		 * --wait-for-workloads
+		 * Block until the nodes are Ready and the given workloads are available again
+		 */
+		if len(workloads) > 0 {
+			log.Println("...Waiting for nodes to be ready")
+			if err := waitForNodesReady(cluster.server.ID, c.Int("timeout")); err != nil {
+				return fmt.Errorf(" Nodes of cluster %s didn't get ready\n%+v", cluster.name, err)
+			}
+			for _, w := range workloads {
+				log.Printf("...Waiting for %s in namespace %s to be available", w.Resource, w.Namespace)
+				if err := waitForWorkload(cluster.server.ID, w, c.Int("timeout")); err != nil {
+					return fmt.Errorf(" %s in namespace %s of cluster %s didn't get available\n%+v", w.Resource, w.Namespace, cluster.name, err)
+				}
+			}
+		}
+
+		log.Printf("SUCCESS: Started cluster [%s]", cluster.name)
+		return nil
+	})
+}
+
+// PauseCluster freezes the containers of running clusters, keeping their state in memory
+func PauseCluster(c *cli.Context) error {
+	return pauseClusters(c, false)
+}
+
+// UnpauseCluster resumes paused clusters
+func UnpauseCluster(c *cli.Context) error {
+	return pauseClusters(c, true)
+}
+
+// pauseClusters pauses (or unpauses) the clusters selected in the flags
+func pauseClusters(c *cli.Context, unpause bool) error {
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return err
+	}
+	if len(clusters) == 0 {
+		if !c.IsSet("all") && c.IsSet("name") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to select other clusters)", c.String("name"))
+		}
+		return fmt.Errorf("No cluster(s) found")
+	}
+
+	for _, cluster := range clusters {
+		if unpause {
+			log.Printf("Unpausing cluster [%s]", cluster.name)
+		} else {
+			log.Printf("Pausing cluster [%s]", cluster.name)
+		}
+		if err := pauseCluster(cluster.name, unpause); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListClusters prints a list of created clusters
+func ListClusters(c *cli.Context) error {
+	if err := printClusters(c.Bool("wide")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListVersions lists the tags of the k3s image, optionally of a minor version of Kubernetes
+func ListVersions(c *cli.Context) error {
+	minor := c.String("minor")
+	if c.NArg() > 0 {
+		minor = c.Args().First()
+	}
+	return listK3sVersions(c.String("tags-server"), c.String("channel-server"), minor, c.Bool("pre-releases"), c.Int("limit"))
+}
+
+// GetKubeConfig grabs the kubeconfig from the running cluster and prints the path to stdout
+func GetKubeConfig(c *cli.Context) error {
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return err
+	}
+
+	if len(clusters) == 0 {
+		if !c.IsSet("all") && c.IsSet("name") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to check other clusters)", c.String("name"))
+		}
+		return fmt.Errorf("No cluster(s) found")
+	}
+
+	for _, cluster := range clusters {
+		kubeConfigPath, err := getKubeConfig(cluster.name, c.Bool("overwrite"))
+		if err != nil {
+			if !c.Bool("all") {
+				return err
+			}
+			log.Println(err)
+			continue
+		}
+
+		// output kubeconfig file path to stdout
+		fmt.Println(kubeConfigPath)
+	}
+
+	return nil
+}
+
+// Shell starts a new subshell with the KUBECONFIG pointing to the selected cluster
+func Shell(c *cli.Context) error {
+	return subShell(c.String("name"), c.String("shell"), c.String("command"))
+}
+
+// ImportImage saves an image locally and imports it into the k3d containers
+func ImportImage(c *cli.Context) error {
+	images := make([]string, 0)
+	if strings.Contains(c.Args().First(), ",") {
+		images = append(images, strings.Split(c.Args().First(), ",")...)
+	} else {
+		images = append(images, c.Args()...)
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("No images specified for import")
+	}
+	progress := newProgress("import")
+	err := importImage(c.String("name"), images, c.Bool("no-remove"), progress)
+	progress.finish(err)
+	return err
+}
+
+// WatchCluster restarts the nodes of a cluster that die unexpectedly, until interrupted
+func WatchCluster(c *cli.Context) error {
+	if c.Int("max-restarts") < 0 {
+		return fmt.Errorf("--max-restarts must be >= 0")
+	}
+	return watchCluster(c.String("name"), c.Int("max-restarts"))
+}
+
+// WatchBuilds imports the images built in the local docker daemon into a cluster as soon as they are tagged
+func WatchBuilds(c *cli.Context) error {
+	if len(c.StringSlice("match")) == 0 {
+		return fmt.Errorf("No image patterns specified (Usage: `k3d watch-builds --name NAME --match 'myapp:*'`)")
+	}
+	return watchBuilds(c.String("name"), c.StringSlice("match"), c.Bool("push"))
+}
+
+// AddNode adds a node to an existing cluster
+func AddNode(c *cli.Context) error {
+
+	/*
+	 * (0) Check flags
+	 */
+
+	clusterName := c.String("name")
+	nodeCount := c.Int("count")
+
+	clusterSpec := &ClusterSpec{
+		AgentArgs:          nil,
+		APIPort:            apiPort{},
+		AutoRestart:        false,
+		ClusterName:        clusterName,
+		Env:                nil,
+		NodeToLabelSpecMap: nil,
+		Image:              "",
+		NodeToPortSpecMap:  nil,
+		PortAutoOffset:     0,
+		ServerArgs:         nil,
+		Volumes:            &Volumes{},
+	}
+
+	/* (0.1)
+	 * --role
+	 * Role of the node that has to be created.
+	 * One of (server|master), (agent|worker)
+	 */
+	nodeRole := c.String("role")
+	if nodeRole == "worker" {
+		nodeRole = "agent"
+	}
+	if nodeRole == "master" {
+		nodeRole = "server"
+	}
+
+	if nodeRole != "agent" && nodeRole != "server" {
+		return fmt.Errorf("Adding nodes of type '%s' is not supported", nodeRole)
+	}
+	if nodeRole == "server" && c.IsSet("k3s") {
+		return fmt.Errorf("Adding server nodes to a non-k3d k3s cluster is not supported")
+	}
+
+	/* (0.2)
+	 * --image, -i
+	 * The k3s image used for the k3d node containers (the image of the server of the cluster, if not set)
+	 */
+	image := c.String("image")
+	if !c.IsSet("image") && !c.IsSet("k3s") {
+		image = ""
+	}
+	// if no registry was provided, use the default docker.io
+	if image != "" && len(strings.Split(image, "/")) <= 2 {
+		image = fmt.Sprintf("%s/%s", DefaultRegistry, image)
+	}
+	clusterSpec.Image = image
+
+	/*
+	 * --pull-policy
+	 * When to pull the image of the new nodes
+	 */
+	if err := validatePullPolicy(c.String("pull-policy")); err != nil {
+		return err
+	}
+	clusterSpec.PullPolicy = c.String("pull-policy")
+
+	/* (0.3)
+	 * --env, -e <key1=val1>[,<keyX=valX]
+	 * Environment variables that will be passed to the node containers
+	 */
+	clusterSpec.Env = []string{}
+	clusterSpec.Env = append(clusterSpec.Env, c.StringSlice("env")...)
+
+	/* (0.4)
+	 * --arg, -x <argument>
+	 * Argument passed in to the k3s server/agent command
+	 */
+	clusterSpec.ServerArgs = append(clusterSpec.ServerArgs, c.StringSlice("arg")...)
+	clusterSpec.AgentArgs = append(clusterSpec.AgentArgs, c.StringSlice("arg")...)
+
+	/* (0.5)
+	 * --volume, -v
+	 * Add volume mounts
+	 */
+	volumeSpec, err := NewVolumes(c.StringSlice("volume"))
+	if err != nil {
+		return err
+	}
+	// TODO: volumeSpec.DefaultVolumes = append(volumeSpec.DefaultVolumes, "%s:/images", imageVolume.Name)
+	clusterSpec.Volumes = volumeSpec
+
+	/* (0.5) BREAKOUT
+	 * --k3s <url>
+	 * Connect to a non-dockerized k3s server
+	 */
+
+	if c.IsSet("k3s") {
+		log.Infof("Adding %d %s-nodes to k3s cluster %s...\n", nodeCount, nodeRole, c.String("k3s"))
+		if _, err := createClusterNetwork(clusterName); err != nil {
+			return err
+		}
+		if err := addNodeToK3s(c, clusterSpec, nodeRole); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	/*
+	 * (1) Check cluster
+	 */
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Errorln("Failed to create docker client")
+		return err
+	}
+
+	filters := filters.NewArgs()
+	filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	filters.Add("label", "app=k3d")
+
+	/*
+	 * (1.1) Verify, that the cluster (i.e. the server) that we want to connect to, is running
+	 */
+	filters.Add("label", "component=server")
+
+	serverList, err := docker.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters,
+	})
+	if err != nil || len(serverList) == 0 {
+		log.Errorf("Failed to get server container for cluster '%s'", clusterName)
+		return err
+	}
+
+	/*
+	 * (1.2) Extract cluster information from server container (the one that created the cluster)
+	 */
+	server := serverList[0]
+	for _, s := range serverList {
+		if getServerIndex(s) == 0 {
+			server = s
+		}
+	}
+	serverContainer, err := docker.ContainerInspect(ctx, server.ID)
+	if err != nil {
+		log.Errorf("Failed to inspect server container '%s' to get cluster secret", server.ID)
+		return err
+	}
+	if clusterSpec.Image == "" {
+		clusterSpec.Image = serverContainer.Config.Image
+	}
+
+	// the new nodes get the registries configuration and certificates of the server
+	clusterSpec.NodeConfigFrom = serverContainer.ID
+	if imageVolume, err := getImageVolume(clusterName); err == nil {
+		clusterSpec.Volumes.DefaultVolumes = append(clusterSpec.Volumes.DefaultVolumes, fmt.Sprintf("%s:/images", imageVolume.Name))
+	}
+
+	/*
+	 * (1.2.1) Extract cluster secret from server container's labels
+	 */
+	clusterSecretEnvVar := ""
+	for _, envVar := range serverContainer.Config.Env {
+		if envVarSplit := strings.SplitN(envVar, "=", 2); envVarSplit[0] == "K3S_CLUSTER_SECRET" {
+			clusterSecretEnvVar = envVar
+		}
+	}
+	if clusterSecretEnvVar == "" {
+		return fmt.Errorf("Failed to get cluster secret from server container")
+	}
+
+	if nodeRole == "agent" {
+		clusterSpec.Env = append(clusterSpec.Env, clusterSecretEnvVar)
+	}
+
+	// the new nodes get the resource limits the cluster was created with (`--memory`, `--cpus`, `--gpus`)
+	if flags, ok := getRecordedCreateFlags(Cluster{server: server}); ok {
+		resources, err := getRecordedNodeResources(flags, nodeRole)
+		if err != nil {
+			return fmt.Errorf(" Couldn't get the resource limits of cluster %s\n%+v", clusterName, err)
+		}
+		if err := resources.setSystemReserved(); err != nil {
+			return err
+		}
+		clusterSpec.ServerResources = resources
+		clusterSpec.AgentResources = resources
+	}
+
+	// the new nodes are stopped like the server
+	clusterSpec.StopSignal = serverContainer.Config.StopSignal
+	if serverContainer.Config.StopTimeout != nil {
+		clusterSpec.StopTimeout = time.Duration(*serverContainer.Config.StopTimeout) * time.Second
+	}
+
+	/*
+	 * (1.2.2) Extract API server Port from server container's cmd
+	 */
+	serverListenPort := ""
+	for cmdIndex, cmdPart := range serverContainer.Config.Cmd {
+		if cmdPart == "--https-listen-port" {
+			serverListenPort = serverContainer.Config.Cmd[cmdIndex+1]
+		}
+	}
+	if serverListenPort == "" {
+		return fmt.Errorf("Failed to get https-listen-port from server container")
+	}
+
+	clusterSpec.APIPort.Port = serverListenPort
+
+	// the workers of an HA cluster reach the servers through their load balancer
+	serverName := strings.TrimLeft(serverContainer.Name, "/")
+	if lbContainer, err := getServerLBContainer(clusterName); err != nil {
+		return err
+	} else if lbContainer != "" {
+		serverName = GetContainerName("serverlb", clusterName, -1)
+	}
+	if nodeRole == "agent" {
+		serverURLEnvVar := fmt.Sprintf("K3S_URL=https://%s:%s", serverName, serverListenPort)
+		clusterSpec.Env = append(clusterSpec.Env, serverURLEnvVar)
+	}
+
+	/*
+	 * (1.2.3) New servers join the embedded etcd (or the external datastore) with the settings of the server
+	 */
+	if nodeRole == "server" {
+		if !canAddServers(serverContainer) {
+			return fmt.Errorf("Cluster %s can't get more servers: create it with `--servers` (or `--server-arg --cluster-init`, or an external datastore)", clusterName)
+		}
+		getJoiningServerSpec(clusterSpec, serverContainer)
+	}
+
+	/*
+	 * (1.3) Get the docker network of the cluster that we want to connect to
+	 */
+	filters.Del("label", "component=server")
+
+	networkList, err := docker.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters,
+	})
+	if err != nil || len(networkList) == 0 {
+		log.Errorf("Failed to find network for cluster '%s'", clusterName)
+		return err
+	}
+
+	/*
+	 * (2) Now identify any existing worker nodes IF we're adding a new one
+	 */
+	highestExistingWorkerSuffix := 0 // needs to be outside conditional because of bad branching
+
+	if nodeRole == "agent" {
+		filters.Add("label", "component=worker")
 
-		exists, err := registryNameExists.Exists()
-		if !exists || err != nil {
-			log.Printf("Make sure %s resolves to '127.0.0.1' (using /etc/hosts f.e)", clusterSpec.RegistryName)
+		workerList, err := docker.ContainerList(ctx, types.ContainerListOptions{
+			Filters: filters,
+			All:     true,
+		})
+		if err != nil {
+			log.Errorln("Failed to list worker node containers")
+			return err
+		}
+
+		for _, worker := range workerList {
+			split := strings.Split(worker.Names[0], "-")
+			currSuffix, err := strconv.Atoi(split[len(split)-1])
+			if err != nil {
+				log.Errorln("Failed to get highest worker suffix")
+				return err
+			}
+			if currSuffix > highestExistingWorkerSuffix {
+				highestExistingWorkerSuffix = currSuffix
+			}
 		}
 	}
 
-	log.Printf(`You can now use the cluster with:
+	/*
+	 * (3) Create the nodes with configuration that automatically joins them to the cluster
+	 */
+
+	log.Infof("Adding %d %s-nodes to k3d cluster %s...\n", nodeCount, nodeRole, clusterName)
+
+	if err := ensureImage(clusterSpec.Image, clusterSpec.PullPolicy); err != nil {
+		return err
+	}
+	if nodeRole == "server" {
+		if err := addServers(clusterSpec, nodeCount, c.Int("timeout")); err != nil {
+			return err
+		}
+	} else if err := createNodes(clusterSpec, nodeRole, highestExistingWorkerSuffix+1, nodeCount); err != nil {
+		return err
+	}
 
-export KUBECONFIG="$(%s get-kubeconfig --name='%s')"
-kubectl cluster-info`, os.Args[0], c.String("name"))
+	if err := recordClusterSpec(clusterName); err != nil {
+		log.Warningf("Couldn't record the configuration of the cluster with the new nodes\n%+v", err)
+	}
 
 	return nil
 }
 
-// DeleteCluster removes the containers belonging to a cluster and its local directory
-func DeleteCluster(c *cli.Context) error {
+func addNodeToK3s(c *cli.Context, clusterSpec *ClusterSpec, nodeRole string) error {
 
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	k3sURLEnvVar := fmt.Sprintf("K3S_URL=%s", c.String("k3s"))
+	k3sConnSecretEnvVar := fmt.Sprintf("K3S_CLUSTER_SECRET=%s", c.String("k3s-secret"))
+	if c.IsSet("k3s-token") {
+		k3sConnSecretEnvVar = fmt.Sprintf("K3S_TOKEN=%s", c.String("k3s-token"))
+	}
 
-	if err != nil {
+	clusterSpec.Env = append(clusterSpec.Env, k3sURLEnvVar, k3sConnSecretEnvVar)
+
+	if err := ensureImage(clusterSpec.Image, clusterSpec.PullPolicy); err != nil {
+		return err
+	}
+	if err := createNodes(clusterSpec, nodeRole, 0, c.Int("count")); err != nil {
 		return err
 	}
 
-	if len(clusters) == 0 {
-		if !c.IsSet("all") && c.IsSet("name") {
-			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to delete other clusters)", c.String("name"))
+	return nil
+}
+
+// createNodes helps creating multiple nodes at once with an incrementing suffix in the name
+func createNodes(clusterSpec *ClusterSpec, role string, suffixNumberStart int, count int) error {
+	for suffix := suffixNumberStart; suffix < suffixNumberStart+count; suffix++ {
+		containerID := ""
+		var err error
+		if role == "agent" {
+			containerID, err = createWorker(clusterSpec, suffix)
+		} else if role == "server" {
+			containerID, err = createServer(clusterSpec, 0)
+		}
+		if err != nil {
+			log.Errorf("Failed to create %s-node", role)
+			return err
+		}
+		log.Infof("Created %s-node with ID %s", role, containerID)
+	}
+	return nil
+}
+
+// RefreshRegistryCache re-pulls the images used by the workloads of some clusters through the registry cache
+func RefreshRegistryCache(c *cli.Context) error {
+	clusterNames := strings.Split(c.String("images-from"), ",")
+	if c.Bool("all") {
+		clusters, err := getClusters(true, "")
+		if err != nil {
+			return err
 		}
+		clusterNames = []string{}
+		for name := range clusters {
+			clusterNames = append(clusterNames, name)
+		}
+	}
+	if len(clusterNames) == 0 {
 		return fmt.Errorf("No cluster(s) found")
 	}
 
-	// remove clusters one by one instead of appending all names to the docker command
-	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Removing cluster [%s]", cluster.name)
-		if len(cluster.workers) > 0 {
-			// TODO: this could be done in goroutines
-			log.Printf("...Removing %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := removeContainer(worker.ID); err != nil {
-					log.Println(err)
-					continue
-				}
+	refresh := func() error {
+		failed := false
+		for _, clusterName := range clusterNames {
+			log.Printf("Refreshing the registry cache with the images of cluster [%s]", clusterName)
+
+			registryContainer, err := getClusterRegistryContainer(clusterName)
+			if err != nil {
+				return err
+			}
+			if registryContainer == "" {
+				return fmt.Errorf("No registry found for cluster %s", clusterName)
+			}
+			if isCache, err := isRegistryCache(registryContainer); err != nil {
+				return err
+			} else if !isCache {
+				return fmt.Errorf("The registry used by cluster %s is not a pull-through cache (see `--enable-registry-cache`)", clusterName)
+			}
+
+			registry, err := getRegistryAPI(registryContainer)
+			if err != nil {
+				return err
 			}
+
+			images, err := getClusterWorkloadImages(clusterName)
+			if err != nil {
+				return err
+			}
+
+			if err := refreshRegistryCache(registry, images); err != nil {
+				log.Warningln(err)
+				failed = true
+				continue
+			}
+			log.Printf("SUCCESS: refreshed %d images of cluster [%s]", len(images), clusterName)
 		}
-		deleteClusterDir(cluster.name)
-		log.Println("...Removing server")
-		if err := removeContainer(cluster.server.ID); err != nil {
-			return fmt.Errorf(" Couldn't remove server for cluster %s\n%+v", cluster.name, err)
+		if failed {
+			return fmt.Errorf("Failed to refresh the registry cache for some clusters")
 		}
+		return nil
+	}
 
-		if err := disconnectRegistryFromNetwork(cluster.name, c.IsSet("keep-registry-volume")); err != nil {
-			log.Warningf("Couldn't disconnect Registry from network %s\n%+v", cluster.name, err)
+	if c.Int("interval") <= 0 {
+		return refresh()
+	}
+
+	// keep refreshing periodically until interrupted
+	for {
+		if err := refresh(); err != nil {
+			log.Warningln(err)
+		}
+		log.Printf("Next refresh in %d seconds", c.Int("interval"))
+		time.Sleep(time.Duration(c.Int("interval")) * time.Second)
+	}
+}
+
+// ChaosKillNode kills some nodes of a cluster
+func ChaosKillNode(c *cli.Context) error {
+	if err := killNodes(c.String("name"), c.String("node"), c.String("signal")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: killed nodes [%s] of cluster [%s]", c.String("node"), c.String("name"))
+	return nil
+}
+
+// ChaosPartitionNetwork drops the traffic between two groups of nodes of a cluster (or heals it)
+func ChaosPartitionNetwork(c *cli.Context) error {
+	if c.Bool("heal") {
+		if err := healNetwork(c.String("name")); err != nil {
+			return err
+		}
+		log.Printf("SUCCESS: healed the network of cluster [%s]", c.String("name"))
+		return nil
+	}
+
+	if !c.IsSet("nodes-a") || !c.IsSet("nodes-b") {
+		return fmt.Errorf("Both --nodes-a and --nodes-b are required for partitioning the network (or use --heal)")
+	}
+	if err := partitionNetwork(c.String("name"), c.String("nodes-a"), c.String("nodes-b")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: partitioned [%s] from [%s] in cluster [%s]", c.String("nodes-a"), c.String("nodes-b"), c.String("name"))
+	return nil
+}
+
+// ChaosPauseRegistry pauses the registry used by a cluster (or unpauses it)
+func ChaosPauseRegistry(c *cli.Context) error {
+	return pauseRegistry(c.String("name"), c.Bool("unpause"), c.Bool("force"))
+}
+
+// ChaosAddLatency adds network latency to some nodes of a cluster (or removes it)
+func ChaosAddLatency(c *cli.Context) error {
+	return addLatency(c.String("name"), c.String("node"), c.String("delay"), c.Bool("remove"))
+}
+
+// getNodesClusterName returns the cluster of the nodes given as arguments: the one of --name,
+// or the cluster of the first node when --name is not set
+func getNodesClusterName(c *cli.Context) (string, error) {
+	if len(c.Args()) == 0 {
+		return "", fmt.Errorf("Specify the nodes (e.g. `k3d %s %s`)", c.Command.Name, GetContainerName("worker", c.String("name"), 0))
+	}
+	if c.IsSet("name") {
+		return c.String("name"), nil
+	}
+	return getNodeClusterName(c.Args().First())
+}
+
+// DeleteNode removes nodes from a running cluster
+func DeleteNode(c *cli.Context) error {
+	clusterName, err := getNodesClusterName(c)
+	if err != nil {
+		return err
+	}
+	if err := deleteNodes(clusterName, c.Args(), c.Bool("drain"), c.Int("timeout"), c.Bool("force")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: removed nodes %v from cluster [%s]", []string(c.Args()), clusterName)
+	return nil
+}
+
+// ExecNode opens a shell (or runs a command) in a node of a cluster
+func ExecNode(c *cli.Context) error {
+	clusterName, err := getNodesClusterName(c)
+	if err != nil {
+		return err
+	}
+
+	// the command gets the interrupts from the terminal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := execInNode(clusterName, c.Args().First(), c.Args().Tail()); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return cli.NewExitError("", exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// CopyNodeFiles copies files and directories between the host and the nodes of a cluster
+func CopyNodeFiles(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("Specify the source and the destination (e.g. `k3d cp ./ca.crt all:/etc/ssl/certs/` or `k3d cp server:/etc/rancher/k3s/k3s.yaml .`)")
+	}
+	srcNode, srcPath, fromNode := parseNodePath(c.Args().Get(0))
+	dstNode, dstPath, toNodes := parseNodePath(c.Args().Get(1))
+	if fromNode == toNodes {
+		return fmt.Errorf("Exactly one of the source and the destination must be in the nodes (`NODE:PATH`)")
+	}
+	node := srcNode
+	if toNodes {
+		node = dstNode
+	}
+
+	// the cluster of a node given by name, unless specified (the groups of nodes are in the default cluster)
+	clusterName := c.String("name")
+	if !c.IsSet("name") {
+		if name, err := getNodeClusterName(node); err == nil {
+			clusterName = name
 		}
+	}
+
+	if toNodes {
+		return copyToNodes(clusterName, node, srcPath, dstPath)
+	}
+	return copyFromNode(clusterName, node, srcPath, dstPath)
+}
+
+// CompleteNodes prints the names of the nodes of all the clusters, for the shell completion
+func CompleteNodes(c *cli.Context) {
+	// only the node is completed, not the command run in it
+	if c.NArg() > 0 {
+		return
+	}
+	names, err := getNodeNames()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+// StopNode stops nodes of a cluster (e.g. for simulating node failures)
+func StopNode(c *cli.Context) error {
+	clusterName, err := getNodesClusterName(c)
+	if err != nil {
+		return err
+	}
+	// the stop timeout of the nodes (set at the creation of the cluster) is used, unless overridden
+	var timeout *time.Duration
+	if c.IsSet("timeout") {
+		t := c.Duration("timeout")
+		timeout = &t
+	}
+	if err := stopNodes(clusterName, c.Args(), timeout); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: stopped nodes %v of cluster [%s]", []string(c.Args()), clusterName)
+	return nil
+}
+
+// StartNode starts stopped nodes of a cluster
+func StartNode(c *cli.Context) error {
+	clusterName, err := getNodesClusterName(c)
+	if err != nil {
+		return err
+	}
+	if err := startNodes(clusterName, c.Args()); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: started nodes %v of cluster [%s]", []string(c.Args()), clusterName)
+	return nil
+}
+
+// CloneCluster creates a copy of a cluster, with its workloads
+func CloneCluster(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("Specify the cluster to clone and the name of the new cluster (e.g. `k3d clone dev dev-copy`)")
+	}
+	src, dst := c.Args().Get(0), c.Args().Get(1)
+	if err := CheckClusterName(dst); err != nil {
+		return err
+	}
+
+	log.Printf("Cloning cluster [%s] as [%s]", src, dst)
+	if err := cloneCluster(src, dst, c.String("api-port"), c.Int("timeout")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: cloned cluster [%s] as [%s]", src, dst)
+	printClusterUsage(dst)
+	return nil
+}
+
+// RenameCluster gives a new name to a cluster
+func RenameCluster(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("Specify the cluster to rename and its new name (e.g. `k3d rename dev staging`)")
+	}
+	src, dst := c.Args().Get(0), c.Args().Get(1)
+	if err := CheckClusterName(dst); err != nil {
+		return err
+	}
+
+	log.Printf("Renaming cluster [%s] to [%s]", src, dst)
+	if err := renameCluster(src, dst, c.Int("timeout")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: renamed cluster [%s] to [%s]", src, dst)
+	printClusterUsage(dst)
+	return nil
+}
+
+// UpgradeCluster replaces the nodes of a cluster by containers of another k3s image, keeping its state
+func UpgradeCluster(c *cli.Context) error {
+	if !c.IsSet("image") {
+		return fmt.Errorf("Specify the k3s image to upgrade to with --image (e.g. rancher/k3s:v1.19.3-k3s1)")
+	}
+	if err := validatePullPolicy(c.String("pull-policy")); err != nil {
+		return err
+	}
+	image := c.String("image")
+	// if no registry was provided, use the default docker.io
+	if len(strings.Split(image, "/")) <= 2 {
+		image = fmt.Sprintf("%s/%s", DefaultRegistry, image)
+	}
+
+	log.Printf("Upgrading cluster [%s] to %s", c.String("cluster"), image)
+	if err := upgradeCluster(c.String("cluster"), image, c.String("pull-policy"), c.Int("timeout"), c.Bool("rolling")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: upgraded cluster [%s] to %s", c.String("cluster"), image)
+	return nil
+}
+
+// NodeJoin creates an agent node in the local docker daemon and joins it to a (remote) k3s server
+func NodeJoin(c *cli.Context) error {
+	clusterName := c.String("name")
+	if err := CheckClusterName(clusterName); err != nil {
+		return err
+	}
+
+	if !c.IsSet("url") {
+		return fmt.Errorf("--url is required for joining a server")
+	}
+	if !c.IsSet("token") && !c.IsSet("secret") {
+		return fmt.Errorf("One of --token or --secret is required for joining a server")
+	}
+
+	image := c.String("image")
+	if len(strings.Split(image, "/")) <= 2 {
+		image = fmt.Sprintf("%s/%s", DefaultRegistry, image)
+	}
+
+	env := append([]string{fmt.Sprintf("K3S_URL=%s", c.String("url"))}, c.StringSlice("env")...)
+	if c.IsSet("token") {
+		env = append(env, fmt.Sprintf("K3S_TOKEN=%s", c.String("token")))
+	} else {
+		env = append(env, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", c.String("secret")))
+	}
+
+	volumesSpec, err := NewVolumes(c.StringSlice("volume"))
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * --external-ip
+	 * The server and the nodes on other hosts can't reach the docker network of this host,
+	 * so the agent advertises the host address and the kubelet and flannel (vxlan) ports are published there
+	 */
+	agentArgs := c.StringSlice("arg")
+	portSpecs := []string{}
+	if c.IsSet("external-ip") {
+		agentArgs = append(agentArgs, "--node-external-ip", c.String("external-ip"))
+		portSpecs = append(portSpecs,
+			fmt.Sprintf("%s:10250:10250/tcp", c.String("external-ip")), // kubelet
+			fmt.Sprintf("%s:8472:8472/udp", c.String("external-ip")),   // flannel vxlan
+		)
+	} else {
+		log.Warnln("--external-ip not set: the server will only be able to reach this node if it can route to its docker network")
+	}
+	portSpecs = append(portSpecs, c.StringSlice("port")...)
+	if err := validatePortSpecs(portSpecs); err != nil {
+		return err
+	}
 
-		if c.IsSet("prune") {
-			// disconnect any other container that is connected to the k3d network
-			nid, err := getClusterNetwork(cluster.name)
-			if err != nil {
-				log.Warningf("Couldn't get the network for cluster %q\n%+v", cluster.name, err)
-			}
-			cids, err := getContainersInNetwork(nid)
-			if err != nil {
-				log.Warningf("Couldn't get the list of containers connected to network %q\n%+v", nid, err)
-			}
-			for _, cid := range cids {
-				err := disconnectContainerFromNetwork(cid, nid)
-				if err != nil {
-					log.Warningf("Couldn't disconnect container %q from network %q", cid, nid)
-					continue
-				}
-				log.Printf("...%q has been forced to disconnect from %q's network", cid, cluster.name)
-			}
-		}
+	clusterSpec := &ClusterSpec{
+		AgentArgs:          agentArgs,
+		APIPort:            apiPort{},
+		AutoRestart:        c.Bool("auto-restart"),
+		ClusterName:        clusterName,
+		Env:                env,
+		NodeToLabelSpecMap: nil,
+		Image:              image,
+		NodeToPortSpecMap:  map[string][]string{"workers": portSpecs},
+		PortAutoOffset:     0,
+		ServerArgs:         nil,
+		Volumes:            volumesSpec,
+	}
 
-		if err := deleteClusterNetwork(cluster.name); err != nil {
-			log.Warningf("Couldn't delete cluster network for cluster %s\n%+v", cluster.name, err)
-		}
+	if _, err := createClusterNetwork(clusterName); err != nil {
+		return err
+	}
 
-		log.Println("...Removing docker image volume")
-		if err := deleteImageVolume(cluster.name); err != nil {
-			log.Warningf("Couldn't delete image docker volume for cluster %s\n%+v", cluster.name, err)
-		}
+	suffix, err := getNextWorkerSuffix(clusterName)
+	if err != nil {
+		return err
+	}
 
-		log.Infof("Removed cluster [%s]", cluster.name)
+	log.Infof("Joining an agent node to k3s server %s...", c.String("url"))
+	if err := createNodes(clusterSpec, "agent", suffix, 1); err != nil {
+		return err
 	}
 
+	log.Printf("SUCCESS: joined %s to %s", GetContainerName("worker", clusterName, suffix), c.String("url"))
 	return nil
 }
 
-// StopCluster stops a running cluster container (restartable)
-func StopCluster(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+// GarbageCollectRegistry removes the blobs not referenced by any manifest from the registry storage
+func GarbageCollectRegistry(c *cli.Context) error {
+	log.Printf("Running the garbage collector in registry [%s]", c.String("registry"))
+	reclaimed, err := garbageCollectRegistry(c.String("registry"), c.Bool("delete-untagged"), c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		log.Printf("SUCCESS: dry run finished in registry [%s] (run with --verbose for the details)", c.String("registry"))
+		return nil
+	}
+	log.Printf("SUCCESS: reclaimed %d KiB in registry [%s]", reclaimed, c.String("registry"))
+	return nil
+}
 
+// PruneRegistry deletes the least recently pulled images of a registry until its storage is under its size quota
+func PruneRegistry(c *cli.Context) error {
+	maxSize, err := parseRegistryMaxSize(c.String("max-size"))
 	if err != nil {
 		return err
 	}
 
-	if len(clusters) == 0 {
-		if !c.IsSet("all") && c.IsSet("name") {
-			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to stop other clusters)", c.String("name"))
-		}
-		return fmt.Errorf("No cluster(s) found")
+	log.Printf("Pruning registry [%s]", c.String("registry"))
+	reclaimed, err := pruneRegistry(c.String("registry"), maxSize, c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry-run") {
+		log.Printf("SUCCESS: dry run finished in registry [%s]", c.String("registry"))
+		return nil
 	}
+	log.Printf("SUCCESS: reclaimed %d KiB in registry [%s]", reclaimed, c.String("registry"))
+	return nil
+}
 
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// PruneOrphanRegistries removes the registries not used by any cluster anymore
+func PruneOrphanRegistries(c *cli.Context) error {
+	pruned, err := pruneOrphanRegistries(c.Bool("keep-registry-volume"))
 	if err != nil {
-		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+		return err
+	}
+	if len(pruned) == 0 {
+		log.Println("No orphan registries found")
+		return nil
 	}
+	log.Printf("SUCCESS: removed orphan registries %v", pruned)
+	return nil
+}
 
-	// remove clusters one by one instead of appending all names to the docker command
-	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Stopping cluster [%s]", cluster.name)
-		if len(cluster.workers) > 0 {
-			log.Printf("...Stopping %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := docker.ContainerStop(ctx, worker.ID, nil); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
+// CreateRegistry creates a standalone registry, that clusters will use when created with `--enable-registry`
+func CreateRegistry(c *cli.Context) error {
+	for _, label := range strings.Split(c.String("name"), ".") {
+		if err := ValidateHostname(label); err != nil {
+			return fmt.Errorf("Invalid registry name\n%+v", err)
 		}
-		log.Println("...Stopping server")
-		if err := docker.ContainerStop(ctx, cluster.server.ID, nil); err != nil {
-			return fmt.Errorf(" Couldn't stop server for cluster %s\n%+v", cluster.name, err)
+	}
+
+	registryConfig := ""
+	if c.IsSet("registry-config") {
+		var err error
+		registryConfig, err = filepath.Abs(c.String("registry-config"))
+		if err != nil {
+			return err
+		}
+		if !fileExists(registryConfig) {
+			return fmt.Errorf("registry-config %q does not exists", registryConfig)
 		}
+	}
 
-		log.Infof("Stopped cluster [%s]", cluster.name)
+	registryCacheAuth, err := getRegistryCacheAuth(c)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	registryNotifications, err := parseRegistryNotifications(c.StringSlice("notify"), c.StringSlice("notify-header"), c.String("notify-events"))
+	if err != nil {
+		return err
+	}
 
-// StartCluster starts a stopped cluster container
-func StartCluster(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err := validatePullPolicy(c.String("pull-policy")); err != nil {
+		return err
+	}
 
+	registryNetworks, err := parseRegistryNetworks(c.StringSlice("network"))
 	if err != nil {
 		return err
 	}
 
-	if len(clusters) == 0 {
-		if !c.IsSet("all") && c.IsSet("name") {
-			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to start other clusters)", c.String("name"))
-		}
-		return fmt.Errorf("No cluster(s) found")
+	registryMaxSize, err := parseRegistryMaxSize(c.String("volume-max-size"))
+	if err != nil {
+		return err
+	}
+	if err := validateRegistryMaxSize(registryMaxSize, c.Bool("enable-registry-cache")); err != nil {
+		return err
+	}
+	registryVolumeDir, err := parseRegistryVolumeDir(c.String("registry-volume-dir"), c.String("registry-volume"))
+	if err != nil {
+		return err
 	}
 
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	registryPort, err := parseRegistryPort(c.String("port"))
 	if err != nil {
-		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+		return err
+	}
+	if c.Int("ready-timeout") < 0 {
+		return fmt.Errorf("Negative value for '--ready-timeout' not allowed (set '%d')", c.Int("ready-timeout"))
+	}
+	registryBindAddresses, err := parseRegistryBindIPs(c.String("bind-address"))
+	if err != nil {
+		return err
+	}
+	if err := validateRegistryDebugPort(c.Int("debug-port"), registryPort, c.Int("internal-port")); err != nil {
+		return err
+	}
+	if c.String("restart") != "" {
+		if _, err := parseRestartPolicy(c.String("restart")); err != nil {
+			return err
+		}
 	}
 
-	// remove clusters one by one instead of appending all names to the docker command
-	// this allows for more granular error handling and logging
-	for _, cluster := range clusters {
-		log.Printf("Starting cluster [%s]", cluster.name)
+	registrySpec := ClusterSpec{
+		AutoRestart:          c.Bool("auto-restart"),
+		PullPolicy:           c.String("pull-policy"),
+		RegistryBindIPs:      registryBindAddresses,
+		RegistryCacheEnabled: c.Bool("enable-registry-cache"),
+		RegistryCacheAuth:    registryCacheAuth,
+		RegistryConfig:       registryConfig,
+		RegistryDebugPort:    c.Int("debug-port"),
+		RegistryEnv:          c.StringSlice("env"),
+		RegistryEnabled:      true,
+		RegistryImage:        c.String("registry-image"),
+		RegistryInternalPort: c.Int("internal-port"),
+		RegistryLabels:       c.StringSlice("label"),
+		RegistryMaxSize:      registryMaxSize,
+		RegistryName:         c.String("name"),
+		RegistryNetworks:     registryNetworks,
+		RegistryNotify:       registryNotifications,
+		RegistryPort:         registryPort,
+		RegistryPrivileged:   c.Bool("privileged"),
+		RegistryRestart:      c.String("restart"),
+		RegistryVolume:       c.String("registry-volume"),
+		RegistryVolumeDir:    registryVolumeDir,
+	}
 
-		// TODO: consider only touching the registry if it's really in use by a cluster
-		registryContainer, err := getRegistryContainer()
-		if err != nil {
-			log.Warn("Couldn't get registry container, if you know you have one, try starting it manually via `docker start`")
+	// a dry run doesn't probe the docker host (nor pull anything) for the `auto` port
+	if c.Bool("dry-run") {
+		if registrySpec.RegistryInternalPort == 0 {
+			registrySpec.RegistryInternalPort = defaultRegistryPort
 		}
-		if registryContainer != "" {
-			log.Infof("...Starting registry container '%s'", registryContainer)
-			if err := docker.ContainerStart(ctx, registryContainer, types.ContainerStartOptions{}); err != nil {
-				log.Warnf("Failed to start the registry container '%s', try starting it manually via `docker start %s`", registryContainer, registryContainer)
-			}
-		} else {
-			log.Debugln("No registry container found. Proceeding.")
+		if registrySpec.RegistryPort == 0 {
+			log.Printf("The port of the registry is `auto`: it's chosen by docker when creating the registry (shown as 0)")
 		}
+		return printRegistryDryRun(registrySpec, c.String("format"))
+	}
+	if err := resolveRegistryPorts(&registrySpec); err != nil {
+		return err
+	}
+	registryID, err := createRegistry(registrySpec)
+	if err != nil {
+		return err
+	}
+	if err := waitForRegistryReady(registryID, c.Int("ready-timeout")); err != nil {
+		return err
+	}
 
-		log.Println("...Starting server")
-		if err := docker.ContainerStart(ctx, cluster.server.ID, types.ContainerStartOptions{}); err != nil {
-			return fmt.Errorf(" Couldn't start server for cluster %s\n%+v", cluster.name, err)
-		}
+	log.Printf("SUCCESS: created registry %s:%d", registrySpec.RegistryName, registrySpec.RegistryPort)
+	return nil
+}
 
-		if len(cluster.workers) > 0 {
-			log.Printf("...Starting %d workers\n", len(cluster.workers))
-			for _, worker := range cluster.workers {
-				if err := docker.ContainerStart(ctx, worker.ID, types.ContainerStartOptions{}); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
-		}
+// ListRegistries prints a list of the registries managed by k3d
+func ListRegistries(c *cli.Context) error {
+	return printRegistries()
+}
 
-		log.Printf("SUCCESS: Started cluster [%s]", cluster.name)
+// RegistryStatus prints the state of a registry
+func RegistryStatus(c *cli.Context) error {
+	return printRegistryStatus(c.String("registry"))
+}
+
+// ListRegistryImages prints the repositories and tags stored in a registry
+func ListRegistryImages(c *cli.Context) error {
+	return printRegistryImages(c.String("registry"))
+}
+
+// SimulateRegistryOutage stops a registry for some time, starting it again afterwards
+func SimulateRegistryOutage(c *cli.Context) error {
+	log.Printf("Simulating an outage of %s in registry [%s]", c.Duration("simulate"), c.String("registry"))
+	if err := simulateRegistryOutage(c.String("registry"), c.Duration("simulate")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: registry [%s] is back", c.String("registry"))
+	return nil
+}
+
+// ExportRegistry writes the storage of a registry to a tarball
+func ExportRegistry(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("No archive specified (Usage: `k3d registry export [options] FILE`, with '-' for stdout)")
 	}
 
+	log.Printf("Exporting registry [%s] to %s", c.String("registry"), c.Args().First())
+	if err := exportRegistry(c.String("registry"), c.Args().First()); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: exported registry [%s]", c.String("registry"))
 	return nil
 }
 
-// ListClusters prints a list of created clusters
-func ListClusters(c *cli.Context) error {
-	if err := printClusters(); err != nil {
+// ImportRegistry copies the contents of a tarball created by `k3d registry export` into a registry
+func ImportRegistry(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("No archive specified (Usage: `k3d registry import [options] FILE`, with '-' for stdin)")
+	}
+
+	log.Printf("Importing %s into registry [%s]", c.Args().First(), c.String("registry"))
+	if err := importRegistry(c.String("registry"), c.Args().First()); err != nil {
 		return err
 	}
+	log.Printf("SUCCESS: imported %s into registry [%s]", c.Args().First(), c.String("registry"))
 	return nil
 }
 
-// GetKubeConfig grabs the kubeconfig from the running cluster and prints the path to stdout
-func GetKubeConfig(c *cli.Context) error {
-	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+// SyncRegistry copies the repositories and tags of a registry to a remote registry
+func SyncRegistry(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("No destination specified (Usage: `k3d registry sync [options] DEST`, e.g. registry.example.com/team)")
+	}
+
+	target, err := parseRegistrySyncTarget(c.Args().First(), c.Bool("insecure"))
 	if err != nil {
 		return err
 	}
+	target.Username = c.String("user")
+	target.Password = c.String("password")
 
-	if len(clusters) == 0 {
-		if !c.IsSet("all") && c.IsSet("name") {
-			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` and `--name <CLUSTER-NAME>` to check other clusters)", c.String("name"))
+	log.Printf("Copying the images of registry [%s] to %s", c.String("registry"), c.Args().First())
+	if err := syncRegistry(c.String("registry"), target, c.StringSlice("match")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: copied the images of registry [%s] to %s", c.String("registry"), c.Args().First())
+	return nil
+}
+
+// PushImage tags local images with the address of the k3d registry and pushes them there
+func PushImage(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return fmt.Errorf("No images specified (Usage: `k3d push [options] IMAGE...`)")
+	}
+
+	registryName := c.String("registry")
+	if c.IsSet("cluster") {
+		var err error
+		if registryName, err = getClusterRegistryName(c.String("cluster")); err != nil {
+			return err
 		}
-		return fmt.Errorf("No cluster(s) found")
 	}
 
-	for _, cluster := range clusters {
-		kubeConfigPath, err := getKubeConfig(cluster.name, c.Bool("overwrite"))
+	for _, image := range c.Args() {
+		target, err := pushImageToRegistry(registryName, image)
 		if err != nil {
-			if !c.Bool("all") {
-				return err
-			}
-			log.Println(err)
-			continue
+			return err
+		}
+		if c.Bool("print-ref") {
+			fmt.Println(target)
+		} else {
+			log.Printf("SUCCESS: pushed %s: use it in the clusters as %s", image, target)
 		}
-
-		// output kubeconfig file path to stdout
-		fmt.Println(kubeConfigPath)
 	}
-
 	return nil
 }
 
-// Shell starts a new subshell with the KUBECONFIG pointing to the selected cluster
-func Shell(c *cli.Context) error {
-	return subShell(c.String("name"), c.String("shell"), c.String("command"))
-}
-
-// ImportImage saves an image locally and imports it into the k3d containers
-func ImportImage(c *cli.Context) error {
-	images := make([]string, 0)
-	if strings.Contains(c.Args().First(), ",") {
-		images = append(images, strings.Split(c.Args().First(), ",")...)
-	} else {
-		images = append(images, c.Args()...)
-	}
-	if len(images) == 0 {
-		return fmt.Errorf("No images specified for import")
+// DeleteRegistry removes a registry
+func DeleteRegistry(c *cli.Context) error {
+	if err := deleteRegistry(c.String("registry"), c.Bool("keep-registry-volume"), c.Bool("force")); err != nil {
+		return err
 	}
-	return importImage(c.String("name"), images, c.Bool("no-remove"))
+	log.Printf("SUCCESS: deleted registry [%s]", c.String("registry"))
+	return nil
 }
 
-// AddNode adds a node to an existing cluster
-func AddNode(c *cli.Context) error {
-
-	/*
-	 * (0) Check flags
-	 */
-
-	clusterName := c.String("name")
-	nodeCount := c.Int("count")
-
-	clusterSpec := &ClusterSpec{
-		AgentArgs:          nil,
-		APIPort:            apiPort{},
-		AutoRestart:        false,
-		ClusterName:        clusterName,
-		Env:                nil,
-		NodeToLabelSpecMap: nil,
-		Image:              "",
-		NodeToPortSpecMap:  nil,
-		PortAutoOffset:     0,
-		ServerArgs:         nil,
-		Volumes:            &Volumes{},
+// RegistryHosts manages the entries for the registry hostnames in the hosts file of this machine
+func RegistryHosts(c *cli.Context) error {
+	hostnames, err := getRegistryHostnames(c.String("registry"))
+	if err != nil {
+		return err
 	}
 
-	/* (0.1)
-	 * --role
-	 * Role of the node that has to be created.
-	 * One of (server|master), (agent|worker)
-	 */
-	nodeRole := c.String("role")
-	if nodeRole == "worker" {
-		nodeRole = "agent"
+	if !c.Bool("add") && !c.Bool("remove") {
+		log.Printf("Add these entries to %s so the registries can be reached from this machine (or run this command with --add):", c.String("hosts-file"))
+		printHostsEntries(hostnames)
+		return nil
 	}
-	if nodeRole == "master" {
-		nodeRole = "server"
+
+	if err := updateHostsFile(c.String("hosts-file"), hostnames, c.Bool("remove")); err != nil {
+		return err
 	}
+	log.Printf("SUCCESS: updated %s", c.String("hosts-file"))
+	return nil
+}
 
-	// TODO: support adding server nodes
-	if nodeRole != "worker" && nodeRole != "agent" {
-		return fmt.Errorf("Adding nodes of type '%s' is not supported", nodeRole)
+// RegistryEnv prints the environment and the configuration snippets needed for pushing to a registry from the host
+func RegistryEnv(c *cli.Context) error {
+	return printRegistryEnv(c.String("registry"), c.String("format"))
+}
+
+// ExportState writes the state of the clusters and the registries as Prometheus metrics or JSON
+func ExportState(c *cli.Context) error {
+	if err := exportState(c.String("format"), c.String("output")); err != nil {
+		return err
 	}
+	if c.String("output") != "-" {
+		log.Debugf("Exported the state to %s", c.String("output"))
+	}
+	return nil
+}
 
-	/* (0.2)
-	 * --image, -i
-	 * The k3s image used for the k3d node containers
-	 */
-	// TODO: use the currently running image by default
-	image := c.String("image")
-	// if no registry was provided, use the default docker.io
-	if len(strings.Split(image, "/")) <= 2 {
-		image = fmt.Sprintf("%s/%s", DefaultRegistry, image)
+// SetupDNS registers a domain for the clusters and the registries in the resolver of the host
+func SetupDNS(c *cli.Context) error {
+	if err := setupDNS(c.String("provider"), c.String("domain"), c.Int("port"), c.String("image")); err != nil {
+		return err
 	}
-	clusterSpec.Image = image
+	log.Printf("SUCCESS: *.%s resolves to %s", c.String("domain"), getRegistryHostIP())
+	if c.String("provider") == "dnsmasq" {
+		log.Printf("Forward the %s domain to 127.0.0.1:%d in your resolver", c.String("domain"), c.Int("port"))
+	}
+	return nil
+}
 
-	/* (0.3)
-	 * --env, -e <key1=val1>[,<keyX=valX]
-	 * Environment variables that will be passed to the node containers
-	 */
-	clusterSpec.Env = []string{}
-	clusterSpec.Env = append(clusterSpec.Env, c.StringSlice("env")...)
+// TeardownDNS removes a domain from the resolver of the host
+func TeardownDNS(c *cli.Context) error {
+	if err := teardownDNS(c.String("provider"), c.String("domain")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: removed *.%s", c.String("domain"))
+	return nil
+}
 
-	/* (0.4)
-	 * --arg, -x <argument>
-	 * Argument passed in to the k3s server/agent command
-	 */
-	clusterSpec.ServerArgs = append(clusterSpec.ServerArgs, c.StringSlice("arg")...)
-	clusterSpec.AgentArgs = append(clusterSpec.AgentArgs, c.StringSlice("arg")...)
+// CleanupHome removes the files left in the k3d directory by clusters that don't exist anymore
+func CleanupHome(c *cli.Context) error {
+	removed, reclaimed, err := cleanupHome(c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		log.Println("No stale cluster directories found")
+		return nil
+	}
+	if c.Bool("dry-run") {
+		log.Printf("Would remove the directories of clusters %v, reclaiming %s", removed, units.HumanSize(float64(reclaimed)))
+		return nil
+	}
+	log.Printf("SUCCESS: removed the directories of clusters %v, reclaiming %s", removed, units.HumanSize(float64(reclaimed)))
+	return nil
+}
 
-	/* (0.5)
-	 * --volume, -v
-	 * Add volume mounts
-	 */
-	volumeSpec, err := NewVolumes(c.StringSlice("volume"))
+// ListEtcdSnapshots prints the etcd snapshots stored in the server of a cluster
+func ListEtcdSnapshots(c *cli.Context) error {
+	server, err := getEtcdServer(c.String("name"))
 	if err != nil {
 		return err
 	}
-	// TODO: volumeSpec.DefaultVolumes = append(volumeSpec.DefaultVolumes, "%s:/images", imageVolume.Name)
-	clusterSpec.Volumes = volumeSpec
+	snapshots, err := listEtcdSnapshots(server.ID)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		fmt.Println(snapshot)
+	}
+	return nil
+}
 
-	/* (0.5) BREAKOUT
-	 * --k3s <url>
-	 * Connect to a non-dockerized k3s server
-	 */
+// SaveSnapshot saves the datastore of a cluster into a snapshot file
+func SaveSnapshot(c *cli.Context) error {
+	log.Printf("Saving a snapshot of cluster [%s]", c.String("name"))
+	snapshot, err := saveClusterSnapshot(c.String("name"), c.String("output"))
+	if err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: saved snapshot %s (restore it with `%s snapshot restore --name %s %s`)", snapshot, os.Args[0], c.String("name"), snapshot)
+	return nil
+}
 
-	if c.IsSet("k3s") {
-		log.Infof("Adding %d %s-nodes to k3s cluster %s...\n", nodeCount, nodeRole, c.String("k3s"))
-		if _, err := createClusterNetwork(clusterName); err != nil {
-			return err
-		}
-		if err := addNodeToK3s(c, clusterSpec, nodeRole); err != nil {
-			return err
-		}
-		return nil
+// RestoreSnapshot restores a snapshot file, or an etcd snapshot, in a cluster
+func RestoreSnapshot(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("No snapshot specified (Usage: `k3d snapshot restore [options] SNAPSHOT`, with a file or the name of an etcd snapshot in the server)")
 	}
 
-	/*
-	 * (1) Check cluster
-	 */
+	log.Printf("Restoring snapshot %s in cluster [%s]", c.Args().First(), c.String("name"))
+	if err := restoreClusterSnapshot(c.String("name"), c.Args().First()); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: restored snapshot %s in cluster [%s]", c.Args().First(), c.String("name"))
+	return nil
+}
 
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// BackupCluster saves the data of the server of a cluster into a backup file
+func BackupCluster(c *cli.Context) error {
+	log.Printf("Backing up cluster [%s]", c.String("name"))
+	backup, err := backupCluster(c.String("name"), c.String("output"))
 	if err != nil {
-		log.Errorln("Failed to create docker client")
 		return err
 	}
+	log.Printf("SUCCESS: saved backup %s (restore it in a new cluster with `%s restore --name <cluster> %s`)", backup, os.Args[0], backup)
+	return nil
+}
 
-	filters := filters.NewArgs()
-	filters.Add("label", fmt.Sprintf("cluster=%s", clusterName))
-	filters.Add("label", "app=k3d")
+// RestoreCluster restores a backup file into a cluster created for it
+func RestoreCluster(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("No backup specified (Usage: `k3d restore [options] BACKUP`)")
+	}
 
-	/*
-	 * (1.1) Verify, that the cluster (i.e. the server) that we want to connect to, is running
-	 */
-	filters.Add("label", "component=server")
+	log.Printf("Restoring backup %s in cluster [%s]", c.Args().First(), c.String("name"))
+	if err := restoreClusterBackup(c.String("name"), c.Args().First(), c.Int("timeout")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: restored backup %s in cluster [%s]", c.Args().First(), c.String("name"))
+	printClusterUsage(c.String("name"))
+	return nil
+}
 
-	serverList, err := docker.ContainerList(ctx, types.ContainerListOptions{
-		Filters: filters,
-	})
-	if err != nil || len(serverList) == 0 {
-		log.Errorf("Failed to get server container for cluster '%s'", clusterName)
+// ResetCluster wipes the workloads and the datastore of a cluster, keeping its nodes, network, volumes and registries
+func ResetCluster(c *cli.Context) error {
+	log.Printf("Resetting cluster [%s]", c.String("name"))
+	if err := resetCluster(c.String("name"), ""); err != nil {
 		return err
 	}
+	log.Printf("SUCCESS: reset cluster [%s]", c.String("name"))
+	return nil
+}
 
-	/*
-	 * (1.2) Extract cluster information from server container
-	 */
-	serverContainer, err := docker.ContainerInspect(ctx, serverList[0].ID)
+// VerifyCluster compares the containers of a cluster with the configuration recorded at its creation
+func VerifyCluster(c *cli.Context) error {
+	drifted, err := verifyCluster(c.String("name"))
 	if err != nil {
-		log.Errorf("Failed to inspect server container '%s' to get cluster secret", serverList[0].ID)
 		return err
 	}
+	if drifted {
+		return fmt.Errorf("Cluster %s has drifted from its recorded configuration (containers changed out-of-band)", c.String("name"))
+	}
+	return nil
+}
 
-	/*
-	 * (1.2.1) Extract cluster secret from server container's labels
-	 */
-	clusterSecretEnvVar := ""
-	for _, envVar := range serverContainer.Config.Env {
-		if envVarSplit := strings.SplitN(envVar, "=", 2); envVarSplit[0] == "K3S_CLUSTER_SECRET" {
-			clusterSecretEnvVar = envVar
-		}
+// ClusterStatus prints the health of a cluster, failing if it is not healthy
+func ClusterStatus(c *cli.Context) error {
+	clusterName := c.String("name")
+	if c.NArg() > 0 {
+		clusterName = c.Args().First()
 	}
-	if clusterSecretEnvVar == "" {
-		return fmt.Errorf("Failed to get cluster secret from server container")
+	problems, err := printClusterHealth(clusterName)
+	if err != nil {
+		return err
 	}
+	if problems > 0 {
+		return fmt.Errorf("Cluster %s is not healthy (%d problem(s))", clusterName, problems)
+	}
+	return nil
+}
 
-	clusterSpec.Env = append(clusterSpec.Env, clusterSecretEnvVar)
+// ClusterLogs prints the logs of the nodes of a cluster (and optionally of its registry and load balancer)
+func ClusterLogs(c *cli.Context) error {
+	clusterName := c.String("name")
+	if c.NArg() > 0 {
+		clusterName = c.Args().First()
+	}
+	options := types.ContainerLogsOptions{
+		Follow:     c.Bool("follow"),
+		Since:      c.String("since"),
+		Tail:       c.String("tail"),
+		Timestamps: c.Bool("timestamps"),
+	}
+	return printClusterLogs(clusterName, options, c.Bool("registry"), c.Bool("loadbalancer"))
+}
 
-	/*
-	 * (1.2.2) Extract API server Port from server container's cmd
-	 */
-	serverListenPort := ""
-	for cmdIndex, cmdPart := range serverContainer.Config.Cmd {
-		if cmdPart == "--https-listen-port" {
-			serverListenPort = serverContainer.Config.Cmd[cmdIndex+1]
+// AdoptCluster rebuilds the directory of clusters from their containers, for k3d to manage them again
+func AdoptCluster(c *cli.Context) error {
+	clusters, err := getClusters(c.Bool("all"), c.String("name"))
+	if err != nil {
+		return err
+	}
+	if len(clusters) == 0 {
+		if !c.Bool("all") {
+			return fmt.Errorf("No cluster with name '%s' found (You can add `--all` to adopt all the clusters)", c.String("name"))
 		}
+		return fmt.Errorf("No cluster(s) found")
 	}
-	if serverListenPort == "" {
-		return fmt.Errorf("Failed to get https-listen-port from server container")
+
+	names := []string{}
+	for name := range clusters {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	serverURLEnvVar := fmt.Sprintf("K3S_URL=https://%s:%s", strings.TrimLeft(serverContainer.Name, "/"), serverListenPort)
-	clusterSpec.Env = append(clusterSpec.Env, serverURLEnvVar)
+	failed := []string{}
+	for _, name := range names {
+		cluster := clusters[name]
+		rebuilt, err := adoptCluster(cluster)
+		if err != nil {
+			log.Warningf("Couldn't adopt cluster %s\n%+v", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		labels := getClusterSpecLabels(cluster)
+		log.Debugf("Cluster %s: image=%s api-port=%s workers=%s ports=%s registry=%s", name, labels["spec.image"],
+			labels["spec.api-port"], labels["spec.workers"], labels["spec.ports"], labels["spec.registry"])
+		if len(rebuilt) == 0 {
+			log.Printf("Cluster %s is already managed by k3d, nothing to rebuild", name)
+			continue
+		}
+		log.Printf("SUCCESS: adopted cluster [%s] (rebuilt: %s)", name, strings.Join(rebuilt, ", "))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't adopt cluster(s) %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
 
-	/*
-	 * (1.3) Get the docker network of the cluster that we want to connect to
-	 */
-	filters.Del("label", "component=server")
+// CreateVolume creates a data volume managed by k3d
+func CreateVolume(c *cli.Context) error {
+	volName := c.Args().First()
+	if volName == "" {
+		return fmt.Errorf("No volume name specified (Usage: `k3d volume create [--cluster NAME] VOLUME`)")
+	}
 
-	networkList, err := docker.NetworkList(ctx, types.NetworkListOptions{
-		Filters: filters,
-	})
-	if err != nil || len(networkList) == 0 {
-		log.Errorf("Failed to find network for cluster '%s'", clusterName)
+	// creating an existing volume is a no-op in docker: don't take over volumes not created by us
+	if vol, err := getVolume(fmt.Sprintf("^%s$", volName), map[string]string{}); err != nil {
 		return err
+	} else if vol != nil {
+		return fmt.Errorf("Volume %s already exists", volName)
 	}
 
-	/*
-	 * (2) Now identify any existing worker nodes IF we're adding a new one
-	 */
-	highestExistingWorkerSuffix := 0 // needs to be outside conditional because of bad branching
+	if _, err := createDataVolume(volName, c.String("cluster")); err != nil {
+		return err
+	}
+	log.Printf("SUCCESS: created volume [%s]", volName)
+	return nil
+}
 
-	if nodeRole == "agent" {
-		filters.Add("label", "component=worker")
+// ListVolumes prints the volumes managed by k3d
+func ListVolumes(c *cli.Context) error {
+	return printVolumes(c.String("cluster"))
+}
 
-		workerList, err := docker.ContainerList(ctx, types.ContainerListOptions{
-			Filters: filters,
-			All:     true,
-		})
+// DeleteVolume removes volumes managed by k3d: the given ones, or all the volumes of a cluster
+func DeleteVolume(c *cli.Context) error {
+	volNames := []string(c.Args())
+	if len(volNames) == 0 {
+		if !c.IsSet("cluster") {
+			return fmt.Errorf("No volumes specified (Usage: `k3d volume delete VOLUME...` or `k3d volume delete --cluster NAME`)")
+		}
+		volumes, err := getK3dVolumes(c.String("cluster"))
 		if err != nil {
-			log.Errorln("Failed to list worker node containers")
 			return err
 		}
-
-		for _, worker := range workerList {
-			split := strings.Split(worker.Names[0], "-")
-			currSuffix, err := strconv.Atoi(split[len(split)-1])
-			if err != nil {
-				log.Errorln("Failed to get highest worker suffix")
-				return err
-			}
-			if currSuffix > highestExistingWorkerSuffix {
-				highestExistingWorkerSuffix = currSuffix
-			}
+		for _, vol := range volumes {
+			volNames = append(volNames, vol.Name)
+		}
+		if len(volNames) == 0 {
+			return fmt.Errorf("No volumes found for cluster %s", c.String("cluster"))
 		}
 	}
 
-	/*
-	 * (3) Create the nodes with configuration that automatically joins them to the cluster
-	 */
-
-	log.Infof("Adding %d %s-nodes to k3d cluster %s...\n", nodeCount, nodeRole, clusterName)
-
-	if err := createNodes(clusterSpec, nodeRole, highestExistingWorkerSuffix+1, nodeCount); err != nil {
-		return err
+	failed := 0
+	for _, volName := range volNames {
+		log.Printf("...Removing volume %s", volName)
+		if err := deleteK3dVolume(volName); err != nil {
+			log.Warningln(err)
+			failed++
+		}
 	}
-
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d volume(s)", failed)
+	}
+	log.Printf("SUCCESS: deleted %d volume(s)", len(volNames))
 	return nil
 }
 
-func addNodeToK3s(c *cli.Context, clusterSpec *ClusterSpec, nodeRole string) error {
+// Dashboard serves a read-only web dashboard with the state of the clusters and the registries
+func Dashboard(c *cli.Context) error {
+	return serveDashboard(c.String("listen"))
+}
 
-	k3sURLEnvVar := fmt.Sprintf("K3S_URL=%s", c.String("k3s"))
-	k3sConnSecretEnvVar := fmt.Sprintf("K3S_CLUSTER_SECRET=%s", c.String("k3s-secret"))
-	if c.IsSet("k3s-token") {
-		k3sConnSecretEnvVar = fmt.Sprintf("K3S_TOKEN=%s", c.String("k3s-token"))
+// RunEphemeral creates a temporary cluster, runs a command with the KUBECONFIG pointing to it
+// and deletes the cluster afterwards, no matter if the command succeeded or not
+func RunEphemeral(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return fmt.Errorf("No command specified (Usage: `k3d run [options] -- <command> [args...]`)")
 	}
 
-	clusterSpec.Env = append(clusterSpec.Env, k3sURLEnvVar, k3sConnSecretEnvVar)
+	// use a random name, unless the user wants a specific one
+	if !c.IsSet("name") {
+		if err := c.Set("name", fmt.Sprintf("run-%s", strings.ToLower(GenerateRandomString(8)))); err != nil {
+			return err
+		}
+	}
+	// the kubeconfig must be available before running the command
+	if !c.IsSet("wait") {
+		if err := c.Set("wait", "0"); err != nil {
+			return err
+		}
+	}
 
-	if err := createNodes(clusterSpec, nodeRole, 0, c.Int("count")); err != nil {
+	if err := CreateCluster(c); err != nil {
 		return err
 	}
+	defer func() {
+		if err := DeleteCluster(c); err != nil {
+			log.Warningf("Couldn't delete the temporary cluster %s\n%+v", c.String("name"), err)
+		}
+	}()
 
-	return nil
-}
+	kubeConfigPath, err := getKubeConfig(c.String("name"), true)
+	if err != nil {
+		return err
+	}
 
-// createNodes helps creating multiple nodes at once with an incrementing suffix in the name
-func createNodes(clusterSpec *ClusterSpec, role string, suffixNumberStart int, count int) error {
-	for suffix := suffixNumberStart; suffix < suffixNumberStart+count; suffix++ {
-		containerID := ""
-		var err error
-		if role == "agent" {
-			containerID, err = createWorker(clusterSpec, suffix)
-		} else if role == "server" {
-			containerID, err = createServer(clusterSpec)
-		}
-		if err != nil {
-			log.Errorf("Failed to create %s-node", role)
-			return err
+	cmd := exec.Command(c.Args().First(), c.Args().Tail()...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", kubeConfigPath))
+
+	// the command gets the interrupts from the terminal: just make sure we survive them for cleaning up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	log.Printf("Running %v in cluster [%s]", c.Args(), c.String("name"))
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return cli.NewExitError(fmt.Sprintf("Command %v failed: %v", c.Args(), err), exitErr.ExitCode())
 		}
-		log.Infof("Created %s-node with ID %s", role, containerID)
+		return err
 	}
 	return nil
 }
@@ -8,11 +8,13 @@ package run
 import (
 	"archive/tar"
 	"bytes"
-	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,38 +22,112 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func createContainer(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
-	ctx := context.Background()
+// image pull policies (`--pull-policy`)
+const (
+	pullPolicyAlways       = "always"
+	pullPolicyIfNotPresent = "if-not-present"
+	pullPolicyNever        = "never"
+)
+
+// validatePullPolicy checks the value of `--pull-policy`
+func validatePullPolicy(policy string) error {
+	switch policy {
+	case pullPolicyAlways, pullPolicyIfNotPresent, pullPolicyNever:
+		return nil
+	}
+	return fmt.Errorf("Invalid pull policy [%s] (must be one of %s, %s or %s)", policy, pullPolicyAlways, pullPolicyIfNotPresent, pullPolicyNever)
+}
 
+// pullImage pulls an image, showing the output of docker only in verbose mode
+func pullImage(image string) error {
+	if err := checkOperation(); err != nil {
+		return err
+	}
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return "", fmt.Errorf("Couldn't create docker client\n%+v", err)
+		return fmt.Errorf("Couldn't create docker client\n%+v", err)
 	}
 
-	resp, err := docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
-	if client.IsErrNotFound(err) {
-		log.Printf("Pulling image %s...\n", config.Image)
-		reader, err := docker.ImagePull(ctx, config.Image, types.ImagePullOptions{})
+	log.Printf("Pulling image %s...\n", image)
+	reader, err := docker.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("Couldn't pull image %s\n%+v", image, err)
+	}
+	defer reader.Close()
+	if ll := log.GetLevel(); ll == log.DebugLevel {
+		_, err := io.Copy(os.Stdout, reader)
 		if err != nil {
-			return "", fmt.Errorf("Couldn't pull image %s\n%+v", config.Image, err)
+			log.Warningf("Couldn't get docker output\n%+v", err)
 		}
-		defer reader.Close()
-		if ll := log.GetLevel(); ll == log.DebugLevel {
-			_, err := io.Copy(os.Stdout, reader)
-			if err != nil {
-				log.Warningf("Couldn't get docker output\n%+v", err)
-			}
-		} else {
-			_, err := io.Copy(ioutil.Discard, reader)
-			if err != nil {
-				log.Warningf("Couldn't get docker output\n%+v", err)
-			}
+	} else {
+		_, err := io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			log.Warningf("Couldn't get docker output\n%+v", err)
 		}
+	}
+	return nil
+}
+
+// ensureImage applies a pull policy to an image before creating containers from it.
+// With `if-not-present`, the image is pulled by createContainer when it's missing.
+func ensureImage(image string, policy string) error {
+	switch policy {
+	case pullPolicyAlways:
+		return pullImage(image)
+	case pullPolicyNever:
+		ctx := operationContext()
+		docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return fmt.Errorf("Couldn't create docker client\n%+v", err)
+		}
+		if _, _, err := docker.ImageInspectWithRaw(ctx, image); client.IsErrNotFound(err) {
+			return fmt.Errorf("Image %s is not present locally, and the pull policy is '%s'", image, pullPolicyNever)
+		} else if err != nil {
+			return fmt.Errorf(" Couldn't inspect image %s\n%+v", image, err)
+		}
+	}
+	return nil
+}
+
+func createContainer(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (string, error) {
+	if err := checkOperation(); err != nil {
+		return "", err
+	}
+	ctx := operationContext()
+
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create docker client\n%+v", err)
+	}
+
+	var resp container.ContainerCreateCreatedBody
+	attempts := 0
+	create := func() (err error) {
+		attempts++
 		resp, err = docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
+		if errdefs.IsConflict(err) && attempts > 1 {
+			if existing, inspectErr := docker.ContainerInspect(ctx, containerName); inspectErr == nil && hasRequestedLabels(existing.Config.Labels, config.Labels) {
+				log.Warningf("Container %s was created by a failed attempt: using it", containerName)
+				resp.ID = existing.ID
+				return nil
+			}
+		}
+		return err
+	}
+	err = retryDocker(fmt.Sprintf("create container %s", containerName), create)
+	if client.IsErrNotFound(err) {
+		if err := pullImage(config.Image); err != nil {
+			return "", err
+		}
+		attempts = 0
+		err = retryDocker(fmt.Sprintf("create container %s", containerName), create)
 		if err != nil {
 			return "", fmt.Errorf(" Couldn't create container after pull %s\n%+v", containerName, err)
 		}
@@ -63,20 +139,20 @@ func createContainer(config *container.Config, hostConfig *container.HostConfig,
 }
 
 func startContainer(ID string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("Couldn't create docker client\n%+v", err)
 	}
 
-	if err := docker.ContainerStart(ctx, ID, types.ContainerStartOptions{}); err != nil {
-		return err
-	}
-
-	return nil
+	return retryDocker(fmt.Sprintf("start container %s", ID), func() error {
+		return docker.ContainerStart(ctx, ID, types.ContainerStartOptions{})
+	})
 }
 
-func createServer(spec *ClusterSpec) (string, error) {
+// createServer creates/starts a k3s server node. In an HA cluster, the server 0 initializes the embedded etcd
+// and the other ones join it.
+func createServer(spec *ClusterSpec, index int) (string, error) {
 	log.Printf("Creating server using %s...\n", spec.Image)
 
 	containerLabels := make(map[string]string)
@@ -84,8 +160,43 @@ func createServer(spec *ClusterSpec) (string, error) {
 	containerLabels["component"] = "server"
 	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
 	containerLabels["cluster"] = spec.ClusterName
+	if spec.RegistryEnabled {
+		containerLabels["registry"] = registryContainerName(spec.ClusterName, spec.RegistryPerCluster)
+	}
+	if spec.RegistryUse != "" {
+		containerLabels["registry-use"] = spec.RegistryUse
+	}
 
 	containerName := GetContainerName("server", spec.ClusterName, -1)
+	// the arguments given by the user come last, winning over the ones of k3d
+	serverArgs := append(spec.ServerResources.getKubeletArgs(), spec.ServerArgs...)
+	serverArgs = append(serverArgs, getNodeArgs(spec.NodeServerArgs, "server", index)...)
+	// the scoped arguments are recorded, so the servers added later get their own scope and not the one of this server
+	if len(spec.NodeServerArgs) > 0 {
+		nodeArgs, err := json.Marshal(getNodeArgSpecs(spec.NodeServerArgs))
+		if err != nil {
+			return "", err
+		}
+		containerLabels[serverNodeArgsLabel] = string(nodeArgs)
+	}
+	env := spec.Env
+	if spec.Servers > 1 {
+		containerLabels["server-index"] = strconv.Itoa(index)
+		if index > 0 {
+			containerName = GetContainerName("server", spec.ClusterName, index)
+		}
+		// with an external datastore, the servers only share the datastore
+		if spec.Datastore == nil && index == 0 {
+			serverArgs = append(serverArgs, "--cluster-init")
+		} else if spec.Datastore == nil {
+			serverArgs = append(serverArgs, "--server", fmt.Sprintf("https://%s:%s", GetContainerName("server", spec.ClusterName, -1), spec.APIPort.Port))
+		}
+	}
+	if spec.Datastore != nil {
+		env = append(append([]string{}, spec.Env...), getDatastoreEnv(spec.Datastore)...)
+		containerLabels["datastore"] = "external"
+		containerLabels["datastore-container"] = spec.Datastore.Container
+	}
 
 	// labels to be created to the server belong to roles
 	// all, server, master or <server-container-name>
@@ -95,23 +206,32 @@ func createServer(spec *ClusterSpec) (string, error) {
 	}
 	containerLabels = MergeLabels(containerLabels, serverLabels)
 
+	// record the parameters the cluster was created with
+	for k, v := range spec.creationLabels() {
+		containerLabels[k] = v
+	}
+
 	// ports to be assigned to the server belong to roles
 	// all, server, master or <server-container-name>
-	serverPorts, err := MergePortSpecs(spec.NodeToPortSpecMap, "server", containerName)
+	// (the other servers of an HA cluster only get the ports of their name, as the host ports can't be shared)
+	serverRole := "server"
+	if index > 0 {
+		serverRole = ""
+	}
+	serverPorts, err := MergePortSpecs(spec.NodeToPortSpecMap, serverRole, containerName)
 	if err != nil {
 		return "", err
 	}
 
-	hostIP := "0.0.0.0"
 	containerLabels["apihost"] = "localhost"
 	if spec.APIPort.Host != "" {
-		hostIP = spec.APIPort.HostIP
 		containerLabels["apihost"] = spec.APIPort.Host
 	}
 
-	apiPortSpec := fmt.Sprintf("%s:%s:%s/tcp", hostIP, spec.APIPort.Port, spec.APIPort.Port)
-
-	serverPorts = append(serverPorts, apiPortSpec)
+	// the API port of an HA cluster is published by its load balancer
+	if spec.Servers <= 1 {
+		serverPorts = append(serverPorts, getAPIPortSpec(spec))
+	}
 
 	serverPublishedPorts, err := CreatePublishedPorts(serverPorts)
 	if err != nil {
@@ -124,10 +244,9 @@ func createServer(spec *ClusterSpec) (string, error) {
 		Init:         &[]bool{true}[0],
 	}
 
-	if spec.AutoRestart {
-		hostConfig.RestartPolicy.Name = "unless-stopped"
-	}
+	hostConfig.RestartPolicy = spec.getRestartPolicy(true)
 
+	spec.ServerResources.addToHostConfig(hostConfig)
 	spec.Volumes.addVolumesToHostConfig(containerName, "server", hostConfig)
 
 	networkingConfig := &network.NetworkingConfig{
@@ -141,23 +260,52 @@ func createServer(spec *ClusterSpec) (string, error) {
 	config := &container.Config{
 		Hostname:     containerName,
 		Image:        spec.Image,
-		Cmd:          append([]string{"server"}, spec.ServerArgs...),
+		Cmd:          append([]string{"server"}, serverArgs...),
 		ExposedPorts: serverPublishedPorts.ExposedPorts,
-		Env:          spec.Env,
+		Env:          env,
 		Labels:       containerLabels,
 	}
+	setStopConfig(spec, config)
 	id, err := createContainer(config, hostConfig, networkingConfig, containerName)
 	if err != nil {
 		return "", fmt.Errorf(" Couldn't create container %s\n%+v", containerName, err)
 	}
 
+	// copy the k3s configuration file
+	if spec.K3sConfig != nil {
+		if err := writeK3sConfigInContainer(spec, "server", id); err != nil {
+			return "", err
+		}
+	}
+
+	// copy the certificates of the datastore
+	if spec.Datastore != nil {
+		if err := writeDatastoreTLSInContainer(spec.Datastore, id); err != nil {
+			return "", err
+		}
+	}
+
+	// copy the configuration of the existing nodes, when joining a running cluster
+	if spec.NodeConfigFrom != "" {
+		if err := copyNodeConfig(spec.NodeConfigFrom, id, append(nodeConfigPaths, defaultDatastoreTLSDir)); err != nil {
+			return "", err
+		}
+	}
+
 	// copy the registry configuration
-	if spec.RegistryEnabled || len(spec.RegistriesFile) > 0 {
+	if spec.RegistryEnabled || spec.RegistryUse != "" || len(spec.RegistriesFile) > 0 || len(spec.RegistryMirrors) > 0 || len(spec.ExtraRegistries) > 0 {
 		if err := writeRegistriesConfigInContainer(spec, id); err != nil {
 			return "", err
 		}
 	}
 
+	// seed the datastore with a snapshot
+	if spec.Snapshot != nil {
+		if err := seedServerDatastore(spec, id); err != nil {
+			return "", err
+		}
+	}
+
 	if err := startContainer(id); err != nil {
 		return "", fmt.Errorf(" Couldn't start container %s\n%+v", containerName, err)
 	}
@@ -165,6 +313,16 @@ func createServer(spec *ClusterSpec) (string, error) {
 	return id, nil
 }
 
+// setStopConfig sets the signal and the timeout used by docker for stopping a node,
+// giving k3s the time to flush its datastore (the default timeout of docker is 10s)
+func setStopConfig(spec *ClusterSpec, config *container.Config) {
+	config.StopSignal = spec.StopSignal
+	if spec.StopTimeout > 0 {
+		seconds := int(math.Ceil(spec.StopTimeout.Seconds()))
+		config.StopTimeout = &seconds
+	}
+}
+
 // createWorker creates/starts a k3s agent node that connects to the server
 func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 	containerLabels := make(map[string]string)
@@ -172,6 +330,12 @@ func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 	containerLabels["component"] = "worker"
 	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
 	containerLabels["cluster"] = spec.ClusterName
+	if spec.RegistryEnabled {
+		containerLabels["registry"] = registryContainerName(spec.ClusterName, spec.RegistryPerCluster)
+	}
+	if spec.RegistryUse != "" {
+		containerLabels["registry-use"] = spec.RegistryUse
+	}
 
 	containerName := GetContainerName("worker", spec.ClusterName, postfix)
 	env := spec.Env
@@ -184,7 +348,11 @@ func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 		}
 	}
 	if needServerURL {
-		env = append(spec.Env, fmt.Sprintf("K3S_URL=https://k3d-%s-server:%s", spec.ClusterName, spec.APIPort.Port))
+		serverName := GetContainerName("server", spec.ClusterName, -1)
+		if spec.Servers > 1 {
+			serverName = GetContainerName("serverlb", spec.ClusterName, -1)
+		}
+		env = append(spec.Env, fmt.Sprintf("K3S_URL=https://%s:%s", serverName, spec.APIPort.Port))
 	}
 
 	// labels to be created to the worker belong to roles
@@ -221,10 +389,9 @@ func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 		Init:         &[]bool{true}[0],
 	}
 
-	if spec.AutoRestart {
-		hostConfig.RestartPolicy.Name = "unless-stopped"
-	}
+	hostConfig.RestartPolicy = spec.getRestartPolicy(true)
 
+	spec.AgentResources.addToHostConfig(hostConfig)
 	spec.Volumes.addVolumesToHostConfig(containerName, "worker", hostConfig)
 
 	networkingConfig := &network.NetworkingConfig{
@@ -235,27 +402,47 @@ func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 		},
 	}
 
+	// the arguments given by the user come last, winning over the ones of k3d
+	agentArgs := append([]string{"agent"}, spec.AgentResources.getKubeletArgs()...)
+	agentArgs = append(agentArgs, spec.AgentArgs...)
+	agentArgs = append(agentArgs, getNodeArgs(spec.NodeAgentArgs, "worker", postfix)...)
+
 	config := &container.Config{
 		Hostname:     containerName,
 		Image:        spec.Image,
 		Env:          env,
-		Cmd:          append([]string{"agent"}, spec.AgentArgs...),
+		Cmd:          agentArgs,
 		Labels:       containerLabels,
 		ExposedPorts: workerPublishedPorts.ExposedPorts,
 	}
+	setStopConfig(spec, config)
 
 	id, err := createContainer(config, hostConfig, networkingConfig, containerName)
 	if err != nil {
 		return "", fmt.Errorf(" Couldn't create container %s\n%+v", containerName, err)
 	}
 
+	// copy the k3s configuration file
+	if spec.K3sConfig != nil {
+		if err := writeK3sConfigInContainer(spec, "worker", id); err != nil {
+			return "", err
+		}
+	}
+
 	// copy the registry configuration
-	if spec.RegistryEnabled || len(spec.RegistriesFile) > 0 {
+	if spec.RegistryEnabled || spec.RegistryUse != "" || len(spec.RegistriesFile) > 0 || len(spec.RegistryMirrors) > 0 || len(spec.ExtraRegistries) > 0 {
 		if err := writeRegistriesConfigInContainer(spec, id); err != nil {
 			return "", err
 		}
 	}
 
+	// copy the configuration of the existing nodes, when joining a running cluster
+	if spec.NodeConfigFrom != "" {
+		if err := copyNodeConfig(spec.NodeConfigFrom, id, nodeConfigPaths); err != nil {
+			return "", err
+		}
+	}
+
 	if err := startContainer(id); err != nil {
 		return "", fmt.Errorf(" Couldn't start container %s\n%+v", containerName, err)
 	}
@@ -264,12 +451,18 @@ func createWorker(spec *ClusterSpec, postfix int) (string, error) {
 
 // removeContainer tries to rm a container, selected by Docker ID, and does a rm -f if it fails (e.g. if container is still running)
 func removeContainer(ID string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
 	}
 
+	// the volumes taken over in an upgrade are not anonymous anymore: they are removed explicitly
+	takenVolumes := []string{}
+	if info, err := docker.ContainerInspect(ctx, ID); err == nil && info.Config.Labels[nodeVolumesLabel] != "" {
+		takenVolumes = strings.Split(info.Config.Labels[nodeVolumesLabel], ",")
+	}
+
 	options := types.ContainerRemoveOptions{
 		RemoveVolumes: true,
 		Force:         true,
@@ -278,12 +471,17 @@ func removeContainer(ID string) error {
 	if err := docker.ContainerRemove(ctx, ID, options); err != nil {
 		return fmt.Errorf(" Couldn't delete container [%s] -> %+v", ID, err)
 	}
+	for _, volume := range takenVolumes {
+		if err := deleteVolume(strings.Split(volume, ":")[0]); err != nil {
+			log.Warningf("Couldn't delete volume %s of container [%s]\n%+v", volume, ID, err)
+		}
+	}
 	return nil
 }
 
 // getContainerNetworks returns the networks a container is connected to
 func getContainerNetworks(ID string) (map[string]*network.EndpointSettings, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
@@ -298,7 +496,7 @@ func getContainerNetworks(ID string) (map[string]*network.EndpointSettings, erro
 
 // connectContainerToNetwork connects a container to a given network
 func connectContainerToNetwork(ID string, networkID string, aliases []string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -308,12 +506,14 @@ func connectContainerToNetwork(ID string, networkID string, aliases []string) er
 		Aliases: aliases,
 	}
 
-	return docker.NetworkConnect(ctx, networkID, ID, networkingConfig)
+	return retryDocker(fmt.Sprintf("connect container %s to network %s", ID, networkID), func() error {
+		return docker.NetworkConnect(ctx, networkID, ID, networkingConfig)
+	})
 }
 
 // disconnectContainerFromNetwork disconnects a container from a given network
 func disconnectContainerFromNetwork(ID string, networkID string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -323,7 +523,7 @@ func disconnectContainerFromNetwork(ID string, networkID string) error {
 }
 
 func waitForContainerLogMessage(containerID string, message string, timeoutSeconds int) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -340,7 +540,6 @@ func waitForContainerLogMessage(containerID string, message string, timeoutSecon
 		// scan container logs for a line that tells us that the required services are up and running
 		out, err := docker.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
 		if err != nil {
-			out.Close()
 			return fmt.Errorf("ERROR: couldn't get docker logs from container %s\n%+v", containerID, err)
 		}
 		buf := new(bytes.Buffer)
@@ -357,7 +556,7 @@ func waitForContainerLogMessage(containerID string, message string, timeoutSecon
 }
 
 func copyToContainer(ID string, dstPath string, content []byte) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -382,3 +581,97 @@ func copyToContainer(ID string, dstPath string, content []byte) error {
 	}
 	return nil
 }
+
+// execInContainer runs a command in a running container and returns its output
+func execInContainer(ID string, cmd []string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// using a TTY, stdout and stderr are not multiplexed in the output stream
+	execResponse, err := docker.ContainerExecCreate(ctx, ID, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create exec command for container [%s]\n%+v", ID, err)
+	}
+
+	// attaching starts the exec process
+	conn, err := docker.ContainerExecAttach(ctx, execResponse.ID, types.ExecStartCheck{Tty: true})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't attach to container [%s]\n%+v", ID, err)
+	}
+	defer conn.Close()
+
+	out, err := ioutil.ReadAll(conn.Reader)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't read output from container [%s]\n%+v", ID, err)
+	}
+	output := strings.ReplaceAll(string(out), "\r\n", "\n")
+
+	return output, waitForExec(docker, execResponse.ID, ID, cmd, output)
+}
+
+// execInContainerWithInput runs a command in a running container with some input on its stdin (e.g. a manifest
+// with secrets, kept out of the command line) and returns its output
+func execInContainerWithInput(ID string, cmd []string, input []byte) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// without a TTY, closing stdin sends an EOF to the command (but stdout and stderr are multiplexed)
+	execResponse, err := docker.ContainerExecCreate(ctx, ID, types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create exec command for container [%s]\n%+v", ID, err)
+	}
+
+	conn, err := docker.ContainerExecAttach(ctx, execResponse.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't attach to container [%s]\n%+v", ID, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		if _, err := conn.Conn.Write(input); err != nil {
+			log.Debugf("Couldn't write the input of %v in container [%s]: %+v", cmd, ID, err)
+		}
+		conn.CloseWrite()
+	}()
+
+	out := new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(out, out, conn.Reader); err != nil {
+		return "", fmt.Errorf(" Couldn't read output from container [%s]\n%+v", ID, err)
+	}
+	output := out.String()
+
+	return output, waitForExec(docker, execResponse.ID, ID, cmd, output)
+}
+
+// waitForExec waits for an exec command to exit, and fails if its exit code isn't 0
+func waitForExec(docker *client.Client, execID string, ID string, cmd []string, output string) error {
+	for {
+		execInspect, err := docker.ContainerExecInspect(operationContext(), execID)
+		if err != nil {
+			return fmt.Errorf(" Couldn't inspect exec command in container [%s]\n%+v", ID, err)
+		}
+		if !execInspect.Running {
+			if execInspect.ExitCode != 0 {
+				return fmt.Errorf("command %v failed in container [%s] with exit code %d:\n%s", cmd, ID, execInspect.ExitCode, output)
+			}
+			return nil
+		}
+		time.Sleep(time.Second / 10)
+	}
+}
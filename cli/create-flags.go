@@ -0,0 +1,166 @@
+package run
+
+/*
+ * The functions in this file make `k3d create` safe to run repeatedly: the flags a cluster is created with are
+ * recorded in the labels of its nodes, so creating it again with the same flags is a no-op, and with other
+ * flags fails with the differences (unless `--force` deletes it and creates it again).
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// ignoredCreateFlags are the flags of create which don't change the cluster created
+var ignoredCreateFlags = map[string]bool{
+	"channel-server":         true,
+	"name":                   true,
+	"force":                  true,
+	"help":                   true,
+	"keep-partial":           true,
+	"pull-policy":            true,
+	"registry-ready-timeout": true,
+	"timeout":                true,
+	"wait":                   true,
+	"wait-for":               true,
+}
+
+// plainCreateFlags are the flags of create taking strings recorded as they are, as they can't hold secrets.
+// The values of the other ones (`--env K3S_TOKEN=...`, `--server-arg --token=...`, the registry credentials and
+// headers, ...) are recorded as a hash only, as the labels of the nodes are visible to anyone with `docker inspect`:
+// booleans, numbers and durations are recorded as they are.
+var plainCreateFlags = map[string]bool{
+	"agents-cpus":              true,
+	"agents-memory":            true,
+	"api-port":                 true,
+	"channel":                  true,
+	"cpus":                     true,
+	"datastore-cafile":         true,
+	"datastore-certfile":       true,
+	"datastore-container":      true,
+	"datastore-keyfile":        true,
+	"gpus":                     true,
+	"image":                    true,
+	"k3s-config":               true,
+	"memory":                   true,
+	"node-label":               true,
+	"node-taint":               true,
+	"registries-file":          true,
+	"registry-bind-address":    true,
+	"registry-config":          true,
+	"registry-image":           true,
+	"registry-name":            true,
+	"registry-network":         true,
+	"registry-notify-events":   true,
+	"registry-port":            true,
+	"registry-pull-secrets":    true,
+	"registry-restart":         true,
+	"registry-use":             true,
+	"registry-volume":          true,
+	"registry-volume-dir":      true,
+	"registry-volume-max-size": true,
+	"restart-policy":           true,
+	"servers-cpus":             true,
+	"servers-memory":           true,
+	"size":                     true,
+	"snapshot":                 true,
+	"stop-signal":              true,
+	"volume":                   true,
+}
+
+// isPlainCreateFlag tells if the value of a flag of create can be recorded as it is
+func isPlainCreateFlag(flag cli.Flag, name string) bool {
+	switch flag.(type) {
+	case cli.BoolFlag, cli.IntFlag, cli.DurationFlag:
+		return true
+	}
+	return plainCreateFlags[name]
+}
+
+// hashCreateFlag returns the value of a flag of create recorded in the labels instead of a secret one
+func hashCreateFlag(value string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(value)))[:19]
+}
+
+// getCreateFlags returns the values of the flags of create which define the cluster, by flag name
+func getCreateFlags(c *cli.Context) map[string]string {
+	flags := map[string]string{}
+	for _, flag := range c.Command.Flags {
+		name := strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+		if ignoredCreateFlags[name] {
+			continue
+		}
+		value := c.String(name)
+		if _, ok := flag.(cli.StringSliceFlag); ok {
+			value = strings.Join(c.StringSlice(name), ", ")
+		}
+		if !isPlainCreateFlag(flag, name) && value != "" {
+			value = hashCreateFlag(value)
+		}
+		flags[name] = value
+	}
+	return flags
+}
+
+// getRecordedCreateFlags returns the flags of create recorded in the labels of a cluster (false when
+// created with an older version of k3d)
+func getRecordedCreateFlags(cluster Cluster) (map[string]string, bool) {
+	flags := map[string]string{}
+	if err := json.Unmarshal([]byte(cluster.server.Labels["spec.flags"]), &flags); err != nil {
+		return nil, false
+	}
+	return flags, true
+}
+
+// diffCreateFlags returns the lines of the differences between the recorded flags of a cluster and the requested ones.
+// The flags added to (or removed from) k3d since the cluster was created are not compared.
+func diffCreateFlags(recorded map[string]string, requested map[string]string) []string {
+	names := []string{}
+	for name := range requested {
+		if _, ok := recorded[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diff := []string{}
+	for _, name := range names {
+		if recorded[name] != requested[name] {
+			diff = append(diff, fmt.Sprintf("  --%s: [%s] -> [%s]", name, recorded[name], requested[name]))
+		}
+	}
+	return diff
+}
+
+// checkExistingCluster compares an existing cluster with the one requested: it's fine (a no-op) when they were
+// created with the same flags, and an error listing the differences otherwise
+func checkExistingCluster(cluster Cluster, requested map[string]string) error {
+	recorded, ok := getRecordedCreateFlags(cluster)
+	if !ok {
+		return fmt.Errorf(" Cluster %s already exists, and was created with an older version of k3d: its flags can't be compared (use --force to delete and create it again)", cluster.name)
+	}
+	if diff := diffCreateFlags(recorded, requested); len(diff) > 0 {
+		return fmt.Errorf(" Cluster %s already exists with different flags (use --force to delete and create it again):\n%s", cluster.name, strings.Join(diff, "\n"))
+	}
+	log.Printf("Cluster %s already exists with the same flags: nothing to do", cluster.name)
+	if cluster.status != "running" {
+		log.Warningf("Cluster %s is %s: start it with `%s start --name %s`", cluster.name, cluster.status, os.Args[0], cluster.name)
+	}
+	printClusterUsage(cluster.name)
+	return nil
+}
+
+// printClusterUsage tells how to use a cluster with kubectl
+func printClusterUsage(clusterName string) {
+	log.Printf(`You can now use the cluster with:
+
+export KUBECONFIG="$(%s get-kubeconfig --name='%s')"
+kubectl cluster-info`, os.Args[0], clusterName)
+}
@@ -0,0 +1,85 @@
+package run
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestDiffCreateFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		recorded  map[string]string
+		requested map[string]string
+		want      []string
+	}{
+		{
+			name:      "same flags",
+			recorded:  map[string]string{"workers": "1", "image": "rancher/k3s:v1.27.4-k3s1"},
+			requested: map[string]string{"workers": "1", "image": "rancher/k3s:v1.27.4-k3s1"},
+			want:      []string{},
+		},
+		{
+			name:      "different flags, sorted by name",
+			recorded:  map[string]string{"workers": "1", "image": "rancher/k3s:v1.27.4-k3s1", "api-port": "6550"},
+			requested: map[string]string{"workers": "2", "image": "rancher/k3s:v1.28.2-k3s1", "api-port": "6550"},
+			want: []string{
+				"  --image: [rancher/k3s:v1.27.4-k3s1] -> [rancher/k3s:v1.28.2-k3s1]",
+				"  --workers: [1] -> [2]",
+			},
+		},
+		{
+			name:      "flags added to k3d after the creation",
+			recorded:  map[string]string{"workers": "1"},
+			requested: map[string]string{"workers": "1", "self-heal": "true"},
+			want:      []string{},
+		},
+		{
+			name:      "flags removed from k3d since the creation",
+			recorded:  map[string]string{"workers": "1", "legacy": "x"},
+			requested: map[string]string{"workers": "1"},
+			want:      []string{},
+		},
+	}
+	for _, test := range tests {
+		if got := diffCreateFlags(test.recorded, test.requested); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: diffCreateFlags() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsPlainCreateFlag(t *testing.T) {
+	tests := []struct {
+		flag cli.Flag
+		want bool
+	}{
+		{cli.StringFlag{Name: "image, i"}, true},
+		{cli.StringSliceFlag{Name: "volume, v"}, true},
+		{cli.IntFlag{Name: "workers, w"}, true},
+		{cli.BoolFlag{Name: "self-heal"}, true},
+		{cli.StringSliceFlag{Name: "env, e"}, false},
+		{cli.StringSliceFlag{Name: "server-arg, x"}, false},
+		{cli.StringFlag{Name: "registry-proxy-password"}, false},
+	}
+	for _, test := range tests {
+		name := strings.Split(test.flag.GetName(), ",")[0]
+		if got := isPlainCreateFlag(test.flag, name); got != test.want {
+			t.Errorf("isPlainCreateFlag(%s) = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestHashCreateFlag(t *testing.T) {
+	hash := hashCreateFlag("K3S_TOKEN=secret")
+	if !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+12 {
+		t.Errorf("hashCreateFlag() = %q, want sha256: and 12 hex digits", hash)
+	}
+	if strings.Contains(hash, "secret") {
+		t.Errorf("hashCreateFlag() = %q leaks the value", hash)
+	}
+	if hashCreateFlag("K3S_TOKEN=secret") != hash || hashCreateFlag("K3S_TOKEN=other") == hash {
+		t.Errorf("hashCreateFlag() must be stable and tell the values apart")
+	}
+}
@@ -0,0 +1,280 @@
+package run
+
+/*
+ * The functions in this file serve a minimal, read-only web dashboard
+ * with the state of the clusters and the registries managed by k3d.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// how far back the dashboard looks for docker events
+const defaultDashboardEventsWindow = 30 * time.Minute
+
+// dashboardNode is the state of a node container
+type dashboardNode struct {
+	Name   string
+	Role   string
+	State  string
+	Status string
+	Ports  []string
+}
+
+// dashboardCluster is the state of a cluster
+type dashboardCluster struct {
+	Name    string
+	Image   string
+	Status  string
+	Workers string
+	Nodes   []dashboardNode
+}
+
+// dashboardRegistry is the state of a registry and its contents
+type dashboardRegistry struct {
+	registryInfo
+	Images []registryImage
+}
+
+// dashboardEvent is a docker event of a k3d container
+type dashboardEvent struct {
+	Time      string
+	Container string
+	Action    string
+}
+
+// dashboardState is everything shown in the dashboard
+type dashboardState struct {
+	Updated    string
+	Clusters   []dashboardCluster
+	Registries []dashboardRegistry
+	Events     []dashboardEvent
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>k3d dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.running { color: green; } .stopped, .exited, .unhealthy, .dead { color: red; }
+</style>
+</head>
+<body>
+<h1>k3d dashboard</h1>
+<p>Updated {{ .Updated }}</p>
+
+<h2>Clusters</h2>
+<table>
+<tr><th>NAME</th><th>IMAGE</th><th>STATUS</th><th>WORKERS</th><th>NODES</th></tr>
+{{ range .Clusters }}
+<tr>
+<td>{{ .Name }}</td><td>{{ .Image }}</td><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Workers }}</td>
+<td><table>
+{{ range .Nodes }}<tr><td>{{ .Name }}</td><td class="{{ .State }}">{{ .Status }}</td><td>{{ range .Ports }}{{ . }}<br>{{ end }}</td></tr>{{ end }}
+</table></td>
+</tr>
+{{ else }}<tr><td colspan="5">No clusters found</td></tr>{{ end }}
+</table>
+
+<h2>Registries</h2>
+<table>
+<tr><th>NAME</th><th>ADDRESS</th><th>STATUS</th><th>CACHE</th><th>CLUSTERS</th><th>IMAGES</th></tr>
+{{ range .Registries }}
+<tr>
+<td>{{ .Name }}</td><td>{{ .Address }}</td><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Cache }}</td>
+<td>{{ range .Clusters }}{{ . }}<br>{{ end }}</td>
+<td>{{ range .Images }}{{ .Repository }}:{{ .Tag }}<br>{{ end }}</td>
+</tr>
+{{ else }}<tr><td colspan="6">No registries found</td></tr>{{ end }}
+</table>
+
+<h2>Recent events</h2>
+<table>
+<tr><th>TIME</th><th>CONTAINER</th><th>EVENT</th></tr>
+{{ range .Events }}<tr><td>{{ .Time }}</td><td>{{ .Container }}</td><td>{{ .Action }}</td></tr>
+{{ else }}<tr><td colspan="3">No recent events</td></tr>{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// getNodePorts formats the ports published by a node container
+func getNodePorts(node types.Container) []string {
+	ports := []string{}
+	for _, port := range node.Ports {
+		if port.PublicPort == 0 {
+			continue
+		}
+		ports = append(ports, fmt.Sprintf("%s:%d->%d/%s", port.IP, port.PublicPort, port.PrivatePort, port.Type))
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// getRecentEvents returns the docker events of the k3d containers in the last 'window'
+func getRecentEvents(window time.Duration) ([]dashboardEvent, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	eFilter := filters.NewArgs()
+	eFilter.Add("type", "container")
+	eFilter.Add("label", "app=k3d")
+
+	now := time.Now()
+	messages, errs := docker.Events(ctx, types.EventsOptions{
+		Since:   strconv.FormatInt(now.Add(-window).Unix(), 10),
+		Until:   strconv.FormatInt(now.Unix(), 10),
+		Filters: eFilter,
+	})
+
+	recent := []dashboardEvent{}
+	for {
+		select {
+		case msg := <-messages:
+			// the exec events are noisy (we run kubectl inside of the nodes)
+			if msg.Type != events.ContainerEventType || strings.HasPrefix(msg.Action, "exec_") {
+				continue
+			}
+			recent = append(recent, dashboardEvent{
+				Time:      time.Unix(msg.Time, 0).Format("2006-01-02 15:04:05"),
+				Container: msg.Actor.Attributes["name"],
+				Action:    msg.Action,
+			})
+		case err := <-errs:
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf(" Couldn't get the docker events\n%+v", err)
+			}
+			// most recent first
+			for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+				recent[i], recent[j] = recent[j], recent[i]
+			}
+			return recent, nil
+		}
+	}
+}
+
+// getDashboardState collects the state of the clusters and the registries
+func getDashboardState() (*dashboardState, error) {
+	state := &dashboardState{Updated: time.Now().Format("2006-01-02 15:04:05")}
+
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cluster := clusters[name]
+		workersRunning := 0
+		for _, worker := range cluster.workers {
+			if worker.State == "running" {
+				workersRunning++
+			}
+		}
+		dc := dashboardCluster{
+			Name:    cluster.name,
+			Image:   cluster.image,
+			Status:  cluster.status,
+			Workers: fmt.Sprintf("%d/%d", workersRunning, len(cluster.workers)),
+		}
+		for _, node := range cluster.nodes() {
+			dc.Nodes = append(dc.Nodes, dashboardNode{
+				Name:   getNodeName(node),
+				Role:   node.Labels["component"],
+				State:  node.State,
+				Status: node.Status,
+				Ports:  getNodePorts(node),
+			})
+		}
+		state.Clusters = append(state.Clusters, dc)
+	}
+
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return nil, err
+	}
+	for _, registry := range registries {
+		info, err := getRegistryInfo(registry)
+		if err != nil {
+			return nil, err
+		}
+		dr := dashboardRegistry{registryInfo: *info}
+		if registry.State == "running" {
+			if api, err := getRegistryAPI(registry.ID); err == nil {
+				if dr.Images, err = getRegistryImages(api); err != nil {
+					log.Debugf("Couldn't list the images in registry %s: %+v", info.Name, err)
+				}
+			}
+		}
+		state.Registries = append(state.Registries, dr)
+	}
+
+	if state.Events, err = getRecentEvents(defaultDashboardEventsWindow); err != nil {
+		log.Warningln(err)
+	}
+
+	return state, nil
+}
+
+// serveDashboard serves the dashboard at 'listen' (`/` for the web UI and `/api/status` for the same data in JSON)
+func serveDashboard(listen string) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		state, err := getDashboardState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, state); err != nil {
+			log.Warningf("Couldn't render the dashboard\n%+v", err)
+		}
+	})
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		state, err := getDashboardState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			log.Warningf("Couldn't encode the dashboard state\n%+v", err)
+		}
+	})
+
+	log.Printf("Serving the dashboard at http://%s (press Ctrl+C to stop)", listen)
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,132 @@
+package run
+
+/*
+ * The functions in this file run the control plane of a cluster against an external datastore
+ * (`--datastore-endpoint`): MySQL, PostgreSQL or etcd, usually running in another container,
+ * as with the kine setups in production.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// directory of the certificates of the datastore in the servers
+const defaultDatastoreTLSDir = "/etc/rancher/k3s/datastore"
+
+// schemes of the datastore endpoints supported by k3s
+var datastoreSchemes = []string{"mysql://", "postgres://", "http://", "https://"}
+
+// datastore is the external datastore of the servers of a cluster
+type datastore struct {
+	Endpoint  string
+	Container string            // a container connected to the cluster network for serving the datastore
+	Files     map[string][]byte // the certificates, by their name in the servers
+}
+
+// parseDatastore checks the datastore flags and reads the certificates of the datastore
+func parseDatastore(endpoint, caFile, certFile, keyFile, containerName string) (*datastore, error) {
+	if endpoint == "" {
+		if caFile != "" || certFile != "" || keyFile != "" || containerName != "" {
+			return nil, fmt.Errorf("--datastore-cafile, --datastore-certfile, --datastore-keyfile and --datastore-container require --datastore-endpoint")
+		}
+		return nil, nil
+	}
+
+	known := false
+	for _, scheme := range datastoreSchemes {
+		if strings.HasPrefix(endpoint, scheme) {
+			known = true
+		}
+	}
+	if !known {
+		log.Warnf("Unknown scheme of datastore endpoint [%s] (expected one of %s): passing it to k3s anyway", endpoint, strings.Join(datastoreSchemes, ", "))
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--datastore-certfile and --datastore-keyfile go together")
+	}
+
+	ds := &datastore{Endpoint: endpoint, Container: containerName, Files: map[string][]byte{}}
+	for name, file := range map[string]string{"ca.crt": caFile, "client.crt": certFile, "client.key": keyFile} {
+		if file == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't read the datastore certificate %s\n%+v", file, err)
+		}
+		ds.Files[name] = content
+	}
+	return ds, nil
+}
+
+// getDatastoreEnv returns the environment of the servers using the datastore.
+// The endpoint goes in the environment rather than in the arguments, as it usually holds a password
+// and the arguments are recorded in the labels of the server.
+func getDatastoreEnv(ds *datastore) []string {
+	env := []string{fmt.Sprintf("K3S_DATASTORE_ENDPOINT=%s", ds.Endpoint)}
+	if _, ok := ds.Files["ca.crt"]; ok {
+		env = append(env, fmt.Sprintf("K3S_DATASTORE_CAFILE=%s", path.Join(defaultDatastoreTLSDir, "ca.crt")))
+	}
+	if _, ok := ds.Files["client.crt"]; ok {
+		env = append(env, fmt.Sprintf("K3S_DATASTORE_CERTFILE=%s", path.Join(defaultDatastoreTLSDir, "client.crt")))
+		env = append(env, fmt.Sprintf("K3S_DATASTORE_KEYFILE=%s", path.Join(defaultDatastoreTLSDir, "client.key")))
+	}
+	return env
+}
+
+// writeDatastoreTLSInContainer copies the certificates of the datastore into a server (before starting it)
+func writeDatastoreTLSInContainer(ds *datastore, ID string) error {
+	for name, content := range ds.Files {
+		if err := copyToContainer(ID, path.Join(defaultDatastoreTLSDir, name), content); err != nil {
+			return fmt.Errorf(" Couldn't copy the datastore certificate %s into container %s\n%+v", name, ID, err)
+		}
+	}
+	return nil
+}
+
+// connectDatastore connects the container of the datastore to the network of a cluster, with its name as alias
+func connectDatastore(clusterName string, containerName string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	info, err := docker.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return fmt.Errorf(" Couldn't find the datastore container %s\n%+v", containerName, err)
+	}
+	if !info.State.Running {
+		return fmt.Errorf("Datastore container %s is not running", containerName)
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+
+	netName := k3dNetworkName(clusterName)
+	if _, connected := info.NetworkSettings.Networks[netName]; connected {
+		return nil
+	}
+	log.Printf("Connecting the datastore container %s to the '%s' network...", name, netName)
+	if err := connectContainerToNetwork(info.ID, netName, []string{name}); err != nil {
+		return fmt.Errorf(" Couldn't connect the datastore container %s to the '%s' network\n%+v", name, netName, err)
+	}
+	return nil
+}
+
+// releaseDatastore disconnects the container of the datastore from the network of a cluster (without removing it)
+func releaseDatastore(clusterName string, containerName string) error {
+	if containerName == "" {
+		return nil
+	}
+	nid, err := getClusterNetwork(clusterName)
+	if err != nil {
+		return err
+	}
+	log.Printf("...Disconnecting the datastore container %s from the network", containerName)
+	return disconnectContainerFromNetwork(containerName, nid)
+}
@@ -0,0 +1,244 @@
+package run
+
+/*
+ * The functions in this file register a domain (`*.k3d.internal` by default, as `.local` is resolved with mDNS)
+ * in a local DNS resolver, so the clusters, their ingress hosts and the registries can be reached by name from the host.
+ * A dnsmasq container answers for the domain, and the providers plug it into the resolver of the host.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDNSContainerName = "k3d-dns"
+
+	// port of the dnsmasq container in 127.0.0.1 (it's only reachable from this machine): not 5353, which
+	// the mDNS responders (mDNSResponder, avahi) already listen on
+	defaultDNSPort = 15353
+)
+
+// dnsProvider plugs the dnsmasq container into the resolver of the host
+type dnsProvider struct {
+	Description string
+	// files written (or removed) for the domain, with their content
+	Files func(domain string, port int) map[string]string
+	// command run after changing the files (if any)
+	Reload []string
+}
+
+// dnsProviders are the providers available with `--provider`
+var dnsProviders = map[string]dnsProvider{
+	"dnsmasq": {
+		Description: "only run the dnsmasq container (configure your resolver yourself)",
+		Files:       func(string, int) map[string]string { return nil },
+	},
+	"systemd-resolved": {
+		Description: "forward the domain from the systemd-resolved stub (systemd >= 246)",
+		Files: func(domain string, port int) map[string]string {
+			return map[string]string{
+				path.Join("/etc/systemd/resolved.conf.d", domain+".conf"): fmt.Sprintf("[Resolve]\nDNS=127.0.0.1:%d\nDomains=~%s\n", port, domain),
+			}
+		},
+		Reload: []string{"systemctl", "restart", "systemd-resolved"},
+	},
+	"resolver": {
+		Description: "add the domain to /etc/resolver (macOS)",
+		Files: func(domain string, port int) map[string]string {
+			return map[string]string{
+				path.Join("/etc/resolver", domain): fmt.Sprintf("nameserver 127.0.0.1\nport %d\n", port),
+			}
+		},
+	},
+}
+
+// getDNSProviderNames returns the names of the providers, sorted
+func getDNSProviderNames() []string {
+	names := []string{}
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getDefaultDNSProvider guesses the provider for this machine
+func getDefaultDNSProvider() string {
+	if runtime.GOOS == "darwin" {
+		return "resolver"
+	}
+	if _, err := os.Stat("/run/systemd/resolve"); err == nil {
+		return "systemd-resolved"
+	}
+	return "dnsmasq"
+}
+
+// getDNSProvider returns a provider by name (or the default one for this machine when empty)
+func getDNSProvider(name string) (dnsProvider, error) {
+	if name == "" {
+		name = getDefaultDNSProvider()
+	}
+	provider, ok := dnsProviders[name]
+	if !ok {
+		return provider, fmt.Errorf("Invalid DNS provider [%s] (must be one of %v)", name, getDNSProviderNames())
+	}
+	log.Printf("Using the %s DNS provider: %s", name, provider.Description)
+	return provider, nil
+}
+
+// getDNSContainer returns the ID of the dnsmasq container (empty if not found)
+func getDNSContainer() (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("name", fmt.Sprintf("^/%s$", defaultDNSContainerName))
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", "component=dns")
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+	if len(containers) == 0 {
+		return "", nil
+	}
+	return containers[0].ID, nil
+}
+
+// createDNSContainer runs a dnsmasq container resolving every name in the domain to the host
+func createDNSContainer(domain string, port int, image string) error {
+	cid, err := getDNSContainer()
+	if err != nil {
+		return err
+	}
+	if cid != "" {
+		log.Printf("...Removing the existing %s container", defaultDNSContainerName)
+		if err := removeContainer(cid); err != nil {
+			return err
+		}
+	}
+
+	portSpecs := []string{
+		fmt.Sprintf("127.0.0.1:%d:53/udp", port),
+		fmt.Sprintf("127.0.0.1:%d:53/tcp", port),
+	}
+	publishedPorts, err := CreatePublishedPorts(portSpecs)
+	if err != nil {
+		return fmt.Errorf(" Couldn't parse the port specs %v\n%+v", portSpecs, err)
+	}
+
+	config := &container.Config{
+		Image:        image,
+		Entrypoint:   []string{"dnsmasq"},
+		Cmd:          []string{"-k", "--log-facility=-", "--no-resolv", "--no-hosts", fmt.Sprintf("--address=/%s/%s", domain, getRegistryHostIP())},
+		ExposedPorts: publishedPorts.ExposedPorts,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "dns",
+			"domain":    domain,
+			"port":      strconv.Itoa(port),
+		},
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: publishedPorts.PortBindings,
+		CapAdd:       []string{"NET_ADMIN"},
+	}
+	hostConfig.RestartPolicy.Name = "unless-stopped"
+
+	if err := ensureImage(image, pullPolicyIfNotPresent); err != nil {
+		return err
+	}
+	id, err := createContainer(config, hostConfig, &network.NetworkingConfig{}, defaultDNSContainerName)
+	if err != nil {
+		return fmt.Errorf(" Couldn't create the %s container\n%+v", defaultDNSContainerName, err)
+	}
+	return startContainer(id)
+}
+
+// reloadDNSProvider runs the reload command of a provider
+func reloadDNSProvider(provider dnsProvider) error {
+	if len(provider.Reload) == 0 {
+		return nil
+	}
+	log.Printf("...Running %v", provider.Reload)
+	if out, err := exec.Command(provider.Reload[0], provider.Reload[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf(" Couldn't run %v\n%s%+v", provider.Reload, out, err)
+	}
+	return nil
+}
+
+// setupDNS registers a domain in the resolver of the host
+func setupDNS(providerName string, domain string, port int, image string) error {
+	provider, err := getDNSProvider(providerName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("...Creating the %s container answering for *.%s", defaultDNSContainerName, domain)
+	if err := createDNSContainer(domain, port, image); err != nil {
+		return err
+	}
+
+	for filename, content := range provider.Files(domain, port) {
+		log.Printf("...Writing %s", filename)
+		if err := createDirIfNotExists(path.Dir(filename)); err != nil {
+			return fmt.Errorf(" Couldn't create %s (maybe you need to run this command as root?)\n%+v", path.Dir(filename), err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			return fmt.Errorf(" Couldn't write %s (maybe you need to run this command as root?)\n%+v", filename, err)
+		}
+	}
+	return reloadDNSProvider(provider)
+}
+
+// teardownDNS removes a domain from the resolver of the host, and the dnsmasq container
+func teardownDNS(providerName string, domain string) error {
+	provider, err := getDNSProvider(providerName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for filename := range provider.Files(domain, defaultDNSPort) {
+		if !fileExists(filename) {
+			continue
+		}
+		log.Printf("...Removing %s", filename)
+		if err := os.Remove(filename); err != nil {
+			return fmt.Errorf(" Couldn't remove %s (maybe you need to run this command as root?)\n%+v", filename, err)
+		}
+		changed = true
+	}
+	if changed {
+		if err := reloadDNSProvider(provider); err != nil {
+			return err
+		}
+	}
+
+	cid, err := getDNSContainer()
+	if err != nil {
+		return err
+	}
+	if cid != "" {
+		log.Printf("...Removing the %s container", defaultDNSContainerName)
+		return removeContainer(cid)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package run
+
+/*
+ * The functions in this file diagnose the environment k3d runs in (`k3d doctor`): the docker daemon,
+ * the kernel of its host (cgroups, inotify limits, modules), its memory and the host ports used by
+ * the clusters, reporting what would make `k3d create` fail, and how to fix it.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the oldest docker API the features of k3d work with (e.g. the init process and the healthchecks of the nodes)
+	minDockerAPIVersion = "1.25"
+
+	// the memory a cluster with a server and a worker needs to run a few workloads
+	minDockerMemory = 2 * units.GiB
+
+	// the inotify limits of the host, shared by all the containers: every node runs its own kubelet and containerd
+	minInotifyMaxUserWatches   = 524288
+	minInotifyMaxUserInstances = 512
+)
+
+// doctorScript is run in a helper container to read the kernel settings of the docker host,
+// which is a VM with Docker Desktop or docker-machine
+const doctorScript = `echo inotify-watches=$(cat /proc/sys/fs/inotify/max_user_watches)
+echo inotify-instances=$(cat /proc/sys/fs/inotify/max_user_instances)
+if [ -f /sys/fs/cgroup/cgroup.controllers ]; then echo cgroup=2; else echo cgroup=1; fi
+for m in overlay br_netfilter nf_conntrack ip_tables; do
+  if [ -d /sys/module/$m ]; then echo module-$m=1; fi
+done
+if grep -q overlay /proc/filesystems; then echo module-overlay=1; fi`
+
+// doctorModules are the kernel modules the nodes need, with what they are used for
+var doctorModules = []struct{ name, usage string }{
+	{"overlay", "the overlayfs snapshotter of containerd"},
+	{"br_netfilter", "the network policies and the services of Kubernetes"},
+	{"nf_conntrack", "kube-proxy"},
+	{"ip_tables", "kube-proxy and the load balancer of k3s"},
+}
+
+// finding is the outcome of a check of `k3d doctor`
+type finding struct {
+	check   string
+	problem bool   // the check failed
+	message string // what was found
+	fix     string // how to fix it, for the problems
+}
+
+// runDoctorScript runs doctorScript in a helper container using 'image', returning the settings it read
+func runDoctorScript(image string) (map[string]string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// using a TTY, stdout and stderr are not multiplexed in the logs
+	config := &container.Config{
+		Image:      image,
+		Entrypoint: []string{"sh", "-c"},
+		Cmd:        []string{doctorScript},
+		Tty:        true,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "helper",
+		},
+	}
+	name := fmt.Sprintf("%s-doctor-%s", defaultContainerNamePrefix, GenerateRandomString(5))
+	id, err := createContainer(config, &container.HostConfig{}, &network.NetworkingConfig{}, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Warningf("Couldn't remove the helper container %s\n%+v", name, err)
+		}
+	}()
+
+	statusCh, errCh := docker.ContainerWait(ctx, id, container.WaitConditionNextExit)
+	if err := startContainer(id); err != nil {
+		return nil, fmt.Errorf(" Couldn't start container %s\n%+v", name, err)
+	}
+	select {
+	case err := <-errCh:
+		return nil, fmt.Errorf(" Couldn't wait for container %s\n%+v", name, err)
+	case <-statusCh:
+	}
+
+	logs, err := docker.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true})
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't read the logs of container %s\n%+v", name, err)
+	}
+	defer logs.Close()
+	out, err := ioutil.ReadAll(logs)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't read the logs of container %s\n%+v", name, err)
+	}
+
+	settings := map[string]string{}
+	for _, line := range strings.Split(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n") {
+		if split := strings.SplitN(strings.TrimSpace(line), "=", 2); len(split) == 2 {
+			settings[split[0]] = split[1]
+		}
+	}
+	return settings, nil
+}
+
+// getK3sMinorVersion returns the minor version of Kubernetes of a k3s image (e.g. 17 for rancher/k3s:v1.17.4-k3s1)
+func getK3sMinorVersion(image string) (int, bool) {
+	match := regexp.MustCompile(`:v1\.(\d+)\.`).FindStringSubmatch(image)
+	if match == nil {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(match[1])
+	return minor, err == nil
+}
+
+// checkDocker checks the version of the docker daemon and the API version negotiated with it
+func checkDocker(docker *client.Client, info types.Info) []finding {
+	findings := []finding{}
+	docker.NegotiateAPIVersion(context.Background())
+	apiVersion := docker.ClientVersion()
+	if versions.LessThan(apiVersion, minDockerAPIVersion) {
+		findings = append(findings, finding{
+			check:   "docker",
+			problem: true,
+			message: fmt.Sprintf("docker %s only supports the API v%s (k3d needs v%s)", info.ServerVersion, apiVersion, minDockerAPIVersion),
+			fix:     "upgrade docker",
+		})
+	} else {
+		findings = append(findings, finding{
+			check:   "docker",
+			message: fmt.Sprintf("docker %s (%s, %s), API v%s", info.ServerVersion, info.OperatingSystem, info.Architecture, apiVersion),
+		})
+	}
+	if info.OSType != "" && info.OSType != "linux" {
+		findings = append(findings, finding{
+			check:   "docker",
+			problem: true,
+			message: fmt.Sprintf("docker runs %s containers", info.OSType),
+			fix:     "switch docker to Linux containers",
+		})
+	}
+	return findings
+}
+
+// checkCgroups checks the cgroup controllers of the docker host and their version
+func checkCgroups(info types.Info, settings map[string]string, image string) []finding {
+	findings := []finding{}
+	if !info.MemoryLimit || !info.CPUCfsQuota {
+		findings = append(findings, finding{
+			check:   "cgroups",
+			problem: true,
+			message: "the memory or cpu cgroup controllers are not enabled: the kubelet can't enforce the resources of the pods",
+			fix:     "enable them on the kernel command line of the docker host (`cgroup_enable=memory cgroup_memory=1`)",
+		})
+	}
+	version := settings["cgroup"]
+	if version == "" {
+		return findings
+	}
+	if minor, ok := getK3sMinorVersion(image); ok && version == "2" && minor < 20 {
+		findings = append(findings, finding{
+			check:   "cgroups",
+			problem: true,
+			message: fmt.Sprintf("the docker host uses cgroup v2, which k3s images older than v1.20 don't support (%s)", image),
+			fix:     "use a newer image (`k3d create --image`), or boot the docker host with `systemd.unified_cgroup_hierarchy=0`",
+		})
+		return findings
+	}
+	return append(findings, finding{
+		check:   "cgroups",
+		message: fmt.Sprintf("cgroup v%s (driver %s)", version, info.CgroupDriver),
+	})
+}
+
+// checkMemory checks the memory available to the containers
+func checkMemory(info types.Info) finding {
+	memory := units.BytesSize(float64(info.MemTotal))
+	if info.MemTotal < minDockerMemory {
+		return finding{
+			check:   "memory",
+			problem: true,
+			message: fmt.Sprintf("docker has %s of memory (a cluster with a server and a worker needs %s)", memory, units.BytesSize(minDockerMemory)),
+			fix:     "give more memory to the VM of docker (Docker Desktop: Settings > Resources)",
+		}
+	}
+	return finding{check: "memory", message: fmt.Sprintf("%s, %d CPUs", memory, info.NCPU)}
+}
+
+// checkInotify checks the inotify limits of the docker host
+func checkInotify(settings map[string]string) []finding {
+	findings := []finding{}
+	limits := []struct {
+		setting string
+		sysctl  string
+		min     int
+	}{
+		{"inotify-watches", "fs.inotify.max_user_watches", minInotifyMaxUserWatches},
+		{"inotify-instances", "fs.inotify.max_user_instances", minInotifyMaxUserInstances},
+	}
+	for _, limit := range limits {
+		value, err := strconv.Atoi(settings[limit.setting])
+		if err != nil {
+			continue
+		}
+		if value < limit.min {
+			findings = append(findings, finding{
+				check:   "inotify",
+				problem: true,
+				message: fmt.Sprintf("%s is %d: the nodes may fail with `too many open files`", limit.sysctl, value),
+				fix:     fmt.Sprintf("`sudo sysctl -w %s=%d` on the docker host", limit.sysctl, limit.min),
+			})
+		} else {
+			findings = append(findings, finding{check: "inotify", message: fmt.Sprintf("%s is %d", limit.sysctl, value)})
+		}
+	}
+	return findings
+}
+
+// checkModules checks the kernel modules needed by the nodes are loaded in the docker host
+func checkModules(info types.Info, settings map[string]string) []finding {
+	findings := []finding{}
+	loaded := []string{}
+	for _, module := range doctorModules {
+		// docker knows about br_netfilter, even when it is built into the kernel
+		if settings["module-"+module.name] == "1" || (module.name == "br_netfilter" && info.BridgeNfIptables) {
+			loaded = append(loaded, module.name)
+			continue
+		}
+		findings = append(findings, finding{
+			check:   "modules",
+			problem: true,
+			message: fmt.Sprintf("%s doesn't seem loaded, it is needed by %s", module.name, module.usage),
+			fix:     fmt.Sprintf("`sudo modprobe %s` on the docker host", module.name),
+		})
+	}
+	if len(loaded) > 0 {
+		findings = append(findings, finding{check: "modules", message: strings.Join(loaded, ", ")})
+	}
+	return findings
+}
+
+// checkHostPort checks a host port is not published by a container, nor used on this host (for a local docker)
+func checkHostPort(containers []types.Container, port int, usage string) finding {
+	check := fmt.Sprintf("port %d", port)
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if int(p.PublicPort) == port {
+				return finding{
+					check:   check,
+					problem: true,
+					message: fmt.Sprintf("published by container %s, it can't be the %s", getNodeName(c), usage),
+					fix:     fmt.Sprintf("stop the container, or choose another port for the %s", usage),
+				}
+			}
+		}
+	}
+	if !isRemoteDocker() {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return finding{
+				check:   check,
+				problem: true,
+				message: fmt.Sprintf("used by another process, it can't be the %s", usage),
+				fix:     fmt.Sprintf("stop the process, or choose another port for the %s", usage),
+			}
+		}
+		l.Close()
+	}
+	return finding{check: check, message: fmt.Sprintf("available for the %s", usage)}
+}
+
+// runDoctor runs all the checks of `k3d doctor` and prints their outcome, returning the number of problems found
+func runDoctor(image string, apiPort int, registryPort int) (int, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	info, err := docker.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't reach docker: is it running?\n%+v", err)
+	}
+
+	findings := checkDocker(docker, info)
+	settings, err := runDoctorScript(image)
+	if err != nil {
+		log.Warningf("Couldn't read the kernel settings of the docker host with image %s: skipping the checks of the cgroups, inotify and modules\n%+v", image, err)
+		settings = map[string]string{}
+	}
+	findings = append(findings, checkCgroups(info, settings, image)...)
+	findings = append(findings, checkMemory(info))
+	findings = append(findings, checkInotify(settings)...)
+	if len(settings) > 0 {
+		findings = append(findings, checkModules(info, settings)...)
+	}
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+	findings = append(findings, checkHostPort(containers, apiPort, "API port"))
+	// a free port is chosen for the registry with `--registry-port auto`
+	if registryPort != 0 {
+		findings = append(findings, checkHostPort(containers, registryPort, "registry port"))
+	}
+
+	// the warnings of the daemon (e.g. no swap limit support) don't prevent k3d from working
+	for _, w := range info.Warnings {
+		findings = append(findings, finding{check: "docker", message: strings.TrimPrefix(w, "WARNING: ")})
+	}
+
+	problems := 0
+	for _, f := range findings {
+		if f.problem {
+			problems++
+			log.Warningf("[%s] %s\n    -> %s", f.check, f.message, f.fix)
+		} else {
+			log.Printf("[%s] %s", f.check, f.message)
+		}
+	}
+	return problems, nil
+}
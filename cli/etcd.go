@@ -0,0 +1,225 @@
+package run
+
+/*
+ * The functions in this file manage the snapshots of the embedded etcd of a cluster (created with `--servers`
+ * or `--server-arg --cluster-init`), taken and restored by `k3d snapshot`.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// directories of the embedded etcd in the server container
+	etcdDataDir      = "/var/lib/rancher/k3s/server/db/etcd"
+	etcdSnapshotsDir = "/var/lib/rancher/k3s/server/db/snapshots"
+
+	// maximum time waited for the reset of the etcd cluster when restoring a snapshot
+	etcdRestoreTimeout = 300
+)
+
+// getEtcdServer returns the server of a cluster, checking that it runs the embedded etcd
+func getEtcdServer(clusterName string) (types.Container, error) {
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return types.Container{}, err
+	}
+	cluster, ok := clusters[clusterName]
+	if !ok {
+		return types.Container{}, fmt.Errorf("No cluster with name '%s' found", clusterName)
+	}
+	if cluster.server.State != "running" {
+		return types.Container{}, fmt.Errorf("The server of cluster %s is not running", clusterName)
+	}
+	if _, err := execInContainer(cluster.server.ID, []string{"test", "-d", etcdDataDir}); err != nil {
+		return types.Container{}, fmt.Errorf("Cluster %s doesn't use the embedded etcd (create it with `--servers` or `--server-arg --cluster-init`)", clusterName)
+	}
+	return cluster.server, nil
+}
+
+// listEtcdSnapshots returns the names of the snapshots in the server, the most recent first
+func listEtcdSnapshots(serverID string) ([]string, error) {
+	out, err := execInContainer(serverID, []string{"sh", "-c", fmt.Sprintf("ls -1t %s 2>/dev/null; true", etcdSnapshotsDir)})
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't list the etcd snapshots\n%+v", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// saveEtcdSnapshot takes a snapshot of the etcd of a cluster, returning its name in the snapshots of the server
+func saveEtcdSnapshot(clusterName string, name string) (string, error) {
+	server, err := getEtcdServer(clusterName)
+	if err != nil {
+		return "", err
+	}
+
+	// `k3s etcd-snapshot` only has subcommands since k3s v1.21
+	if _, err := execInContainer(server.ID, []string{"k3s", "etcd-snapshot", "save", "--name", name}); err != nil {
+		log.Debugf("`k3s etcd-snapshot save` failed, retrying with `k3s etcd-snapshot`: %+v", err)
+		if _, err := execInContainer(server.ID, []string{"k3s", "etcd-snapshot", "--name", name}); err != nil {
+			return "", fmt.Errorf(" Couldn't take the etcd snapshot\n%+v", err)
+		}
+	}
+
+	snapshots, err := listEtcdSnapshots(server.ID)
+	if err != nil {
+		return "", err
+	}
+	snapshot := ""
+	for _, s := range snapshots {
+		if strings.HasPrefix(s, name) {
+			snapshot = s
+			break
+		}
+	}
+	if snapshot == "" {
+		return "", fmt.Errorf("The etcd snapshot %s was not found in %s", name, etcdSnapshotsDir)
+	}
+	return snapshot, nil
+}
+
+// restoreEtcdSnapshot restores a snapshot (a file in the host, or the name of a snapshot in the server):
+// the nodes are stopped, the etcd cluster is reset with the snapshot on the first server in a helper container
+// and the nodes are started again, the other servers of an HA cluster rejoining it with an empty datastore
+func restoreEtcdSnapshot(clusterName string, snapshot string) error {
+	server, err := getEtcdServer(clusterName)
+	if err != nil {
+		return err
+	}
+
+	// a snapshot in the host is copied into the server first
+	snapshotPath := path.Join(etcdSnapshotsDir, path.Base(snapshot))
+	if fileExists(snapshot) {
+		content, err := ioutil.ReadFile(snapshot)
+		if err != nil {
+			return err
+		}
+		log.Printf("...Copying %s into the server", snapshot)
+		if err := copyToContainer(server.ID, snapshotPath, content); err != nil {
+			return fmt.Errorf(" Couldn't copy the snapshot into the server\n%+v", err)
+		}
+	} else if _, err := execInContainer(server.ID, []string{"test", "-f", snapshotPath}); err != nil {
+		return fmt.Errorf("No snapshot %s found in the host or in %s", snapshot, etcdSnapshotsDir)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	serverInfo, err := docker.ContainerInspect(ctx, server.ID)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect the server of cluster %s\n%+v", clusterName, err)
+	}
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return err
+	}
+	servers := clusters[clusterName].servers
+	workers := clusters[clusterName].workers
+
+	log.Println("...Stopping the nodes")
+	for _, worker := range workers {
+		if err := docker.ContainerStop(ctx, worker.ID, nil); err != nil {
+			return fmt.Errorf(" Couldn't stop worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+	for _, other := range servers {
+		if err := docker.ContainerStop(ctx, other.ID, nil); err != nil {
+			return fmt.Errorf(" Couldn't stop server %s\n%+v", getNodeName(other), err)
+		}
+	}
+	if err := docker.ContainerStop(ctx, server.ID, nil); err != nil {
+		return fmt.Errorf(" Couldn't stop the server of cluster %s\n%+v", clusterName, err)
+	}
+
+	log.Printf("...Restoring %s", path.Base(snapshotPath))
+	if err := resetEtcd(clusterName, serverInfo, snapshotPath); err != nil {
+		return fmt.Errorf(" Couldn't restore the snapshot (the nodes are stopped)\n%+v", err)
+	}
+
+	// the reset etcd cluster only has the first server as member: the others join it again as new members
+	for _, other := range servers {
+		log.Printf("...Wiping the datastore of server %s", getNodeName(other))
+		helperName := fmt.Sprintf("%s-%s-etcd-rejoin", defaultContainerNamePrefix, clusterName)
+		if err := runHelperContainer(helperName, other.Image, other.ID, nil, []string{"/bin/sh", "-c", fmt.Sprintf("rm -rf %s/*", k3sDatastoreDir)}); err != nil {
+			return fmt.Errorf(" Couldn't wipe the datastore of server %s (the nodes are stopped)\n%+v", getNodeName(other), err)
+		}
+	}
+
+	log.Println("...Starting the nodes")
+	if err := docker.ContainerStart(ctx, server.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't start the server of cluster %s\n%+v", clusterName, err)
+	}
+	if len(servers) > 0 {
+		if err := waitForKubectl(server.ID, etcdRestoreTimeout, "get", "nodes"); err != nil {
+			return fmt.Errorf(" The first server didn't come back with the restored snapshot (the other nodes are stopped)\n%+v", err)
+		}
+		for _, other := range servers {
+			if err := docker.ContainerStart(ctx, other.ID, types.ContainerStartOptions{}); err != nil {
+				return fmt.Errorf(" Couldn't start server %s\n%+v", getNodeName(other), err)
+			}
+		}
+	}
+	for _, worker := range workers {
+		if err := docker.ContainerStart(ctx, worker.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf(" Couldn't start worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+	return nil
+}
+
+// resetEtcd resets the etcd cluster of a stopped server with a snapshot in its data, in a helper container
+// using the data, the hostname (the name of the etcd member) and the environment (the token) of the server
+func resetEtcd(clusterName string, server types.ContainerJSON, snapshotPath string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	helperName := fmt.Sprintf("%s-%s-etcd-restore", defaultContainerNamePrefix, clusterName)
+	config := &container.Config{
+		Hostname: server.Config.Hostname,
+		Image:    server.Config.Image,
+		Env:      server.Config.Env,
+		Cmd:      []string{"server", "--cluster-reset", "--cluster-reset-restore-path=" + snapshotPath, "--disable-agent"},
+		Labels: map[string]string{
+			"app":       "k3d",
+			"cluster":   clusterName,
+			"component": "etcd-restore",
+		},
+	}
+	hostConfig := &container.HostConfig{
+		VolumesFrom: []string{server.ID},
+		Privileged:  true,
+	}
+	helperID, err := createContainer(config, hostConfig, &network.NetworkingConfig{}, helperName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := docker.ContainerRemove(ctx, helperID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Warningf("Couldn't remove the restore container %s\n%+v", helperName, err)
+		}
+	}()
+	if err := startContainer(helperID); err != nil {
+		return fmt.Errorf(" Couldn't start container %s\n%+v", helperName, err)
+	}
+	if err := waitForContainerLogMessage(helperID, "has been reset", etcdRestoreTimeout); err != nil {
+		return fmt.Errorf(" The etcd cluster wasn't reset (check the logs of %s)\n%+v", helperName, err)
+	}
+	// give k3s some time for exiting on its own before removing the container
+	time.Sleep(2 * time.Second)
+	return nil
+}
@@ -0,0 +1,216 @@
+package run
+
+/*
+ * The functions in this file report the health of a cluster at a glance (`k3d status`): the state of its
+ * containers, the readiness of its Kubernetes nodes, the API server reached with the generated kubeconfig,
+ * and the state of its load balancer, registry and status sidecar.
+ */
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// how long `k3d status` waits for the endpoints of a cluster to answer
+const defaultHealthTimeout = 5 * time.Second
+
+// nodeReadyJSONPath prints `<node>=<status of the Ready condition>` for every node
+const nodeReadyJSONPath = `jsonpath={range .items[*]}{.metadata.name}={.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}`
+
+// getNodesReadiness returns the status of the Ready condition of the Kubernetes nodes of a cluster, by node name
+func getNodesReadiness(serverID string) (map[string]string, error) {
+	out, err := kubectl(serverID, "get", "nodes", "-o", nodeReadyJSONPath)
+	if err != nil {
+		return nil, err
+	}
+	readiness := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if split := strings.SplitN(strings.TrimSpace(line), "=", 2); len(split) == 2 {
+			readiness[split[0]] = split[1]
+		}
+	}
+	return readiness, nil
+}
+
+// getKubeConfigServer returns the URL of the API server in a kubeconfig file
+func getKubeConfigServer(kubeConfigPath string) (string, error) {
+	content, err := ioutil.ReadFile(kubeConfigPath)
+	if err != nil {
+		return "", err
+	}
+	kubeConfig := struct {
+		Clusters []struct {
+			Cluster struct {
+				Server string `yaml:"server"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+	}{}
+	if err := yaml.Unmarshal(content, &kubeConfig); err != nil {
+		return "", fmt.Errorf(" Couldn't parse %s\n%+v", kubeConfigPath, err)
+	}
+	if len(kubeConfig.Clusters) == 0 || kubeConfig.Clusters[0].Cluster.Server == "" {
+		return "", fmt.Errorf("No server in %s", kubeConfigPath)
+	}
+	return kubeConfig.Clusters[0].Cluster.Server, nil
+}
+
+// checkAPIServer checks the API server answers at its URL in the kubeconfig of a cluster.
+// Any answer will do (an anonymous request is unauthorized): no credentials are sent.
+func checkAPIServer(server string) error {
+	httpClient := &http.Client{
+		Timeout: defaultHealthTimeout,
+		Transport: &http.Transport{
+			// the certificate of the cluster is checked by kubectl, not here
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := httpClient.Get(server + "/readyz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// getContainerHealth returns the state of a container, with its health when it has a healthcheck
+func getContainerHealth(docker *client.Client, ID string) (string, bool) {
+	c, err := docker.ContainerInspect(operationContext(), ID)
+	if err != nil {
+		return "missing", false
+	}
+	if c.State.Health != nil {
+		return fmt.Sprintf("%s (%s)", c.State.Status, c.State.Health.Status), c.State.Running && c.State.Health.Status != "unhealthy"
+	}
+	return c.State.Status, c.State.Running
+}
+
+// printClusterHealth prints the health of a cluster, returning the number of problems found
+func printClusterHealth(clusterName string) (int, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return 0, err
+	}
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	problems := 0
+
+	fmt.Printf("Cluster:        %s (%s)\n", cluster.name, cluster.status)
+	fmt.Printf("Image:          %s\n", cluster.image)
+
+	// the Kubernetes side, when the server is up
+	readiness := map[string]string{}
+	if cluster.server.State == "running" {
+		if readiness, err = getNodesReadiness(cluster.server.ID); err != nil {
+			log.Warningf("Couldn't get the Kubernetes nodes of cluster %s: is k3s up?\n%+v", clusterName, err)
+			readiness = map[string]string{}
+			problems++
+		}
+		api := ""
+		if kubeConfigPath, err := getKubeConfig(clusterName, false); err != nil {
+			api = fmt.Sprintf("no kubeconfig (%v)", err)
+			problems++
+		} else if server, err := getKubeConfigServer(kubeConfigPath); err != nil {
+			api = err.Error()
+			problems++
+		} else if err := checkAPIServer(server); err != nil {
+			api = fmt.Sprintf("%s unreachable (%v)", server, err)
+			problems++
+		} else {
+			api = fmt.Sprintf("%s reachable", server)
+		}
+		fmt.Printf("API:            %s\n", api)
+	} else {
+		fmt.Printf("API:            down (the server is %s)\n", cluster.server.State)
+		problems++
+	}
+
+	if lbID, err := getServerLBContainer(clusterName); err != nil {
+		return problems, err
+	} else if lbID != "" {
+		state, healthy := getContainerHealth(docker, lbID)
+		if !healthy {
+			problems++
+		}
+		fmt.Printf("Load balancer:  %s\n", state)
+	}
+
+	if registryName := cluster.server.Labels["registry"]; registryName != "" {
+		registry := ""
+		if registryID, err := getRegistryContainer(registryName); err != nil || registryID == "" {
+			registry = fmt.Sprintf("%s missing", registryName)
+			problems++
+		} else if state, running := getContainerHealth(docker, registryID); !running {
+			registry = fmt.Sprintf("%s %s", registryName, state)
+			problems++
+		} else if api, err := getRegistryAPI(registryID); err != nil {
+			registry = fmt.Sprintf("%s %s (not reachable from the host: %v)", registryName, state, err)
+		} else if _, err := getRegistryJSON(api, "/v2/", nil, &struct{}{}); err != nil {
+			registry = fmt.Sprintf("%s %s, %s not answering (%v)", registryName, state, api.url, err)
+			problems++
+		} else {
+			registry = fmt.Sprintf("%s %s, %s answering", registryName, state, api.url)
+		}
+		fmt.Printf("Registry:       %s\n", registry)
+	}
+
+	if statusID, err := getStatusContainer(clusterName); err != nil {
+		return problems, err
+	} else if statusID != "" {
+		sidecar := ""
+		if state, running := getContainerHealth(docker, statusID); !running {
+			sidecar = state
+			problems++
+		} else if url, err := getStatusURL(statusID); err != nil {
+			sidecar = fmt.Sprintf("%s (%v)", state, err)
+		} else if resp, err := (&http.Client{Timeout: defaultHealthTimeout}).Get(url); err != nil {
+			sidecar = fmt.Sprintf("%s, %s unreachable (%v)", state, url, err)
+			problems++
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				sidecar = fmt.Sprintf("%s, %s ready", state, url)
+			} else {
+				sidecar = fmt.Sprintf("%s, %s not ready", state, url)
+			}
+		}
+		fmt.Printf("Status sidecar: %s\n", sidecar)
+	}
+
+	fmt.Println()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_CENTER)
+	table.SetHeader([]string{"NODE", "ROLE", "CONTAINER", "KUBERNETES"})
+	for _, node := range cluster.nodes() {
+		name := getNodeName(node)
+		state, running := getContainerHealth(docker, node.ID)
+		ready := "-"
+		switch readiness[name] {
+		case "True":
+			ready = "Ready"
+		case "":
+			if running && len(readiness) > 0 {
+				ready = "not registered"
+			}
+		default:
+			ready = "NotReady"
+		}
+		if !running || (len(readiness) > 0 && ready != "Ready") {
+			problems++
+		}
+		table.Append([]string{name, node.Labels["component"], state, ready})
+	}
+	table.Render()
+	return problems, nil
+}
@@ -0,0 +1,146 @@
+package run
+
+/*
+ * The functions in this file manage the entries for the registry hostnames
+ * in the hosts file of the local machine.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hostsEntryMarker is appended to the entries in the hosts file managed by k3d
+const hostsEntryMarker = "# added by k3d"
+
+// GetDefaultHostsFile returns the path of the hosts file of the local machine
+func GetDefaultHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Windows\System32\drivers\etc\hosts`
+	}
+	return "/etc/hosts"
+}
+
+// getRegistryHostIP returns the IP address where the registries can be reached from this machine
+func getRegistryHostIP() string {
+	if machineIP, err := getDockerMachineIp(); err == nil && machineIP != "" {
+		return machineIP
+	}
+	return "127.0.0.1"
+}
+
+// getRegistryHostnames returns the hostnames of the registries managed by k3d (or only the given registry)
+func getRegistryHostnames(name string) ([]string, error) {
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames := []string{}
+	for _, registry := range registries {
+		if name != "" && getNodeName(registry) != name {
+			continue
+		}
+		if hostname := registry.Labels["hostname"]; hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	if len(hostnames) == 0 {
+		return nil, fmt.Errorf("No registries found")
+	}
+	return hostnames, nil
+}
+
+// hostsEntry returns the line in the hosts file for a hostname
+func hostsEntry(ip string, hostname string) string {
+	return fmt.Sprintf("%s %s %s", ip, hostname, hostsEntryMarker)
+}
+
+// isManagedHostsEntry checks if a line of the hosts file was added by k3d for a hostname
+func isManagedHostsEntry(line string, hostname string) bool {
+	if !strings.HasSuffix(strings.TrimSpace(line), hostsEntryMarker) {
+		return false
+	}
+	for _, field := range strings.Fields(line) {
+		if field == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHostsEntry checks if there is any entry for a hostname in the hosts file
+func hasHostsEntry(lines []string, hostname string) bool {
+	for _, line := range lines {
+		// skip comments and the IP address at the beginning of the line
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if field == hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// updateHostsFile adds (or removes) the entries for some hostnames in a hosts file
+func updateHostsFile(hostsFile string, hostnames []string, remove bool) error {
+	content, err := ioutil.ReadFile(hostsFile)
+	if err != nil {
+		return fmt.Errorf(" Couldn't read the hosts file %s\n%+v", hostsFile, err)
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+
+	changed := false
+	for _, hostname := range hostnames {
+		if remove {
+			kept := []string{}
+			for _, line := range lines {
+				if isManagedHostsEntry(line, hostname) {
+					log.Printf("...Removing the entry for %s", hostname)
+					changed = true
+					continue
+				}
+				kept = append(kept, line)
+			}
+			lines = kept
+			continue
+		}
+
+		if hasHostsEntry(lines, hostname) {
+			log.Printf("...%s already has an entry in %s", hostname, hostsFile)
+			continue
+		}
+		log.Printf("...Adding an entry for %s", hostname)
+		lines = append(lines, hostsEntry(getRegistryHostIP(), hostname))
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	info, err := os.Stat(hostsFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(hostsFile, []byte(strings.Join(lines, "\n")+"\n"), info.Mode()); err != nil {
+		return fmt.Errorf(" Couldn't write the hosts file %s (maybe you need to run this command as root/administrator?)\n%+v", hostsFile, err)
+	}
+	return nil
+}
+
+// printHostsEntries prints the entries that should be in the hosts file for some hostnames
+func printHostsEntries(hostnames []string) {
+	for _, hostname := range hostnames {
+		fmt.Println(hostsEntry(getRegistryHostIP(), hostname))
+	}
+}
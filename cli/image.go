@@ -1,7 +1,6 @@
 package run
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -19,9 +18,9 @@ const (
 	k3dToolsImage       = "docker.io/iwilltry42/k3d-tools:v0.0.1"
 )
 
-func importImage(clusterName string, images []string, noRemove bool) error {
+func importImage(clusterName string, images []string, noRemove bool, progress *progress) error {
 	// get a docker client
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -34,6 +33,7 @@ func importImage(clusterName string, images []string, noRemove bool) error {
 	}
 
 	//*** first, save the images using the local docker daemon
+	progress.start("save", 0)
 	log.Infof("Saving images %s from local docker daemon...", images)
 	toolsContainerName := fmt.Sprintf("k3d-%s-tools", clusterName)
 	tarFileName := fmt.Sprintf("%s/k3d-%s-images-%s.tar", imageBasePathRemote, clusterName, time.Now().Format("20060102150405"))
@@ -108,8 +108,7 @@ func importImage(clusterName string, images []string, noRemove bool) error {
 	if err != nil {
 		return fmt.Errorf(" Couldn't get cluster by name [%s]\n%+v", clusterName, err)
 	}
-	containerList := []types.Container{clusters[clusterName].server}
-	containerList = append(containerList, clusters[clusterName].workers...)
+	containerList := clusters[clusterName].nodes()
 
 	// *** second, import the images using ctr in the k3d nodes
 
@@ -133,9 +132,10 @@ func importImage(clusterName string, images []string, noRemove bool) error {
 
 	// import in each node separately
 	// TODO: import concurrently using goroutines or find a way to share the image cache
-	for _, container := range containerList {
+	for i, container := range containerList {
 
 		containerName := container.Names[0][1:] // trimming the leading "/" from name
+		progress.start(fmt.Sprintf("import-%s", containerName), 30+60*i/len(containerList))
 		log.Infof("Importing images %s in container [%s]", images, containerName)
 
 		// create exec configuration
@@ -176,6 +176,7 @@ func importImage(clusterName string, images []string, noRemove bool) error {
 
 	// remove tarball from inside the server container
 	if !noRemove {
+		progress.start("cleanup", 90)
 		log.Info("Cleaning up tarball")
 
 		execID, err := docker.ContainerExecCreate(ctx, clusters[clusterName].server.ID, types.ExecConfig{
@@ -0,0 +1,105 @@
+package run
+
+/*
+ * The functions in this file handle the interruption of `k3d create` (Ctrl-C, SIGTERM): the docker calls in
+ * flight (image pulls, container creations, ...) are cancelled, and what was already created for the cluster
+ * is rolled back, so that the next `k3d create` with the same name isn't blocked by orphans.
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleInterrupts cancels the docker calls in flight (see operationContext) and calls 'onInterrupt' on SIGINT or SIGTERM,
+// before exiting, until the returned function is called. Interrupting again exits right away.
+func handleInterrupts(onInterrupt func()) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-done:
+			return
+		case sig := <-signals:
+			signal.Stop(signals)
+			log.Warningf("Received %s", sig)
+			cancelOperation()
+			onInterrupt()
+			os.Exit(130)
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// removeClusterLeftovers removes the containers, networks and volumes labeled with a cluster that are left once
+// its nodes are removed (or before its server was created), but its registries and data volumes
+func removeClusterLeftovers(clusterName string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	clusterFilter := filters.NewArgs()
+	clusterFilter.Add("label", "app=k3d")
+	clusterFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: clusterFilter, All: true})
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the containers of cluster %s\n%+v", clusterName, err)
+	}
+	for _, c := range containers {
+		if c.Labels["component"] == "registry" {
+			continue
+		}
+		log.Printf("...Removing %s container %s", c.Labels["component"], getNodeName(c))
+		if err := removeContainer(c.ID); err != nil {
+			log.Warningln(err)
+		}
+	}
+
+	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: clusterFilter})
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the networks of cluster %s\n%+v", clusterName, err)
+	}
+	for _, n := range networks {
+		log.Printf("...Removing network %s", n.Name)
+		cids, err := getContainersInNetwork(n.ID)
+		if err != nil {
+			log.Warningf("Couldn't list the containers of network %s\n%+v", n.Name, err)
+		}
+		for _, cid := range cids {
+			if err := disconnectContainerFromNetwork(cid, n.ID); err != nil {
+				log.Warningf("Couldn't disconnect container %s from network %s\n%+v", cid, n.Name, err)
+			}
+		}
+		if err := docker.NetworkRemove(ctx, n.ID); err != nil {
+			log.Warningf("Couldn't remove network %s\n%+v", n.Name, err)
+		}
+	}
+
+	volumes, err := docker.VolumeList(ctx, clusterFilter)
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the volumes of cluster %s\n%+v", clusterName, err)
+	}
+	for _, vol := range volumes.Volumes {
+		if kind := getVolumeKind(vol); kind == "data" || kind == "registry" {
+			continue
+		}
+		log.Printf("...Removing volume %s", vol.Name)
+		if err := deleteVolume(vol.Name); err != nil {
+			log.Warningln(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package run
+
+/*
+ * The functions in this file handle the k3s configuration file (`--k3s-config`)
+ * copied into the nodes, merged with the settings k3d needs for running the cluster.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultK3sConfigPath is the configuration file loaded by k3s on startup
+const defaultK3sConfigPath = "/etc/rancher/k3s/config.yaml"
+
+// k3dManagedK3sConfigKeys are the settings k3d sets on its own for every role: they can't be overridden in the config file
+var k3dManagedK3sConfigKeys = map[string][]string{
+	"server": {"https-listen-port", "write-kubeconfig"},
+	"worker": {"server", "token", "token-file"},
+}
+
+// loadK3sConfig loads a k3s configuration file, warning about the settings k3d will replace
+func loadK3sConfig(filename string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't read the k3s config file %s\n%+v", filename, err)
+	}
+
+	k3sConfig := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &k3sConfig); err != nil {
+		return nil, fmt.Errorf(" Couldn't parse the k3s config file %s\n%+v", filename, err)
+	}
+
+	for _, keys := range k3dManagedK3sConfigKeys {
+		for _, key := range keys {
+			if _, ok := k3sConfig[key]; ok {
+				log.Warnf("'%s' in the k3s config file %s is managed by k3d: it will be ignored", key, filename)
+			}
+		}
+	}
+	return k3sConfig, nil
+}
+
+// k3sConfigForRole returns the content of the k3s config file for a node, without the settings managed by k3d for its role
+func k3sConfigForRole(k3sConfig map[string]interface{}, role string, spec *ClusterSpec) ([]byte, error) {
+	merged := map[string]interface{}{}
+	for k, v := range k3sConfig {
+		merged[k] = v
+	}
+	for _, key := range k3dManagedK3sConfigKeys[role] {
+		delete(merged, key)
+	}
+	if role == "server" {
+		merged["https-listen-port"] = spec.APIPort.Port
+	}
+
+	// keep a stable order of the keys in the file
+	keys := []string{}
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ordered := yaml.MapSlice{}
+	for _, k := range keys {
+		ordered = append(ordered, yaml.MapItem{Key: k, Value: merged[k]})
+	}
+	return yaml.Marshal(ordered)
+}
+
+// writeK3sConfigInContainer copies the k3s config file of the cluster into a node container
+func writeK3sConfigInContainer(spec *ClusterSpec, role string, ID string) error {
+	content, err := k3sConfigForRole(spec.K3sConfig, role, spec)
+	if err != nil {
+		return fmt.Errorf(" Couldn't generate the k3s config file\n%+v", err)
+	}
+	return copyToContainer(ID, defaultK3sConfigPath, content)
+}
@@ -0,0 +1,126 @@
+package run
+
+/*
+ * The functions in this file talk to the Kubernetes API of a cluster
+ * by running kubectl inside of its server container.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultWorkloadNamespace is the namespace used for workloads specified without one
+const defaultWorkloadNamespace = "default"
+
+// workload identifies a Kubernetes workload, like `deployment/myapp` in some namespace
+type workload struct {
+	Resource  string
+	Namespace string
+}
+
+// parseWorkload parses a workload specification with the format `kind/name[@namespace]`
+func parseWorkload(spec string) (*workload, error) {
+	w := &workload{Resource: spec, Namespace: defaultWorkloadNamespace}
+
+	if split := strings.Split(spec, "@"); len(split) == 2 {
+		w.Resource = split[0]
+		w.Namespace = split[1]
+	} else if len(split) > 2 {
+		return nil, fmt.Errorf("invalid workload spec [%s]: more than one namespace specified", spec)
+	}
+
+	if split := strings.Split(w.Resource, "/"); len(split) != 2 || split[0] == "" || split[1] == "" {
+		return nil, fmt.Errorf("invalid workload spec [%s]: the format is `kind/name[@namespace]`", spec)
+	}
+	if w.Namespace == "" {
+		return nil, fmt.Errorf("invalid workload spec [%s]: empty namespace", spec)
+	}
+
+	return w, nil
+}
+
+// kubectl runs a kubectl command in a server container
+func kubectl(serverID string, args ...string) (string, error) {
+	return execInContainer(serverID, append([]string{"kubectl"}, args...))
+}
+
+// kubectlWithInput runs kubectl in a server container with some input on its stdin (e.g. `apply -f -`)
+func kubectlWithInput(serverID string, input []byte, args ...string) (string, error) {
+	return execInContainerWithInput(serverID, append([]string{"kubectl"}, args...), input)
+}
+
+// waitForKubectl retries a kubectl command in a server container until it succeeds or the timeout is exceeded.
+// A timeout of 0 means waiting forever.
+func waitForKubectl(serverID string, timeoutSeconds int, args ...string) error {
+	start := time.Now()
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	for {
+		_, err := kubectl(serverID, args...)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("kubectl %v not successful yet: %+v", args, err)
+		if err := checkOperation(); err != nil {
+			return err
+		}
+
+		if timeout != 0 && time.Now().After(start.Add(timeout)) {
+			return fmt.Errorf("timeout of %d seconds exceeded while waiting for `kubectl %s`\n%+v", timeoutSeconds, strings.Join(args, " "), err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// waitForNodesReady waits for all the nodes of a cluster to be Ready
+func waitForNodesReady(serverID string, timeoutSeconds int) error {
+	return waitForKubectl(serverID, timeoutSeconds, "wait", "--for=condition=Ready", "nodes", "--all", "--timeout=10s")
+}
+
+// drainNode cordons a node and evicts its pods (but the ones of the daemonsets)
+func drainNode(serverID string, nodeName string, timeoutSeconds int) error {
+	args := []string{"drain", nodeName, "--ignore-daemonsets", "--delete-emptydir-data", "--force", fmt.Sprintf("--timeout=%ds", timeoutSeconds)}
+	_, err := kubectl(serverID, args...)
+	// kubectl before v1.20 only knows the deprecated name of the flag
+	if err != nil && strings.Contains(err.Error(), "unknown flag: --delete-emptydir-data") {
+		args[3] = "--delete-local-data"
+		_, err = kubectl(serverID, args...)
+	}
+	return err
+}
+
+// waitForNodeReadySince waits for a node to be Ready with a status reported after a point in time,
+// e.g. by the kubelet of a replaced node rather than the one it replaced
+func waitForNodeReadySince(serverID string, nodeName string, since time.Time, timeoutSeconds int) error {
+	start := time.Now()
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	for {
+		out, err := kubectl(serverID, "get", "node", nodeName,
+			"-o", `jsonpath={range .status.conditions[?(@.type=="Ready")]}{.status} {.lastHeartbeatTime}{end}`)
+		if err == nil {
+			split := strings.Fields(out)
+			if len(split) == 2 && split[0] == "True" {
+				if heartbeat, err := time.Parse(time.RFC3339, split[1]); err == nil && !heartbeat.Before(since.Truncate(time.Second)) {
+					return nil
+				}
+			}
+		}
+		log.Debugf("Node %s not ready yet (%s %v)", nodeName, strings.TrimSpace(out), err)
+		if err := checkOperation(); err != nil {
+			return err
+		}
+
+		if time.Now().After(start.Add(timeout)) {
+			return fmt.Errorf("timeout of %d seconds exceeded while waiting for node %s to be ready", timeoutSeconds, nodeName)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// waitForWorkload waits for the rollout of a workload to be complete and its pods to be available
+func waitForWorkload(serverID string, w *workload, timeoutSeconds int) error {
+	return waitForKubectl(serverID, timeoutSeconds, "rollout", "status", w.Resource, "--namespace", w.Namespace, "--timeout=10s")
+}
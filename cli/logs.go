@@ -0,0 +1,149 @@
+package run
+
+/*
+ * The functions in this file aggregate the logs of the nodes of a cluster (`k3d logs`), and optionally of its
+ * registry and load balancer, interleaved line by line with the name of their container as prefix.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// logPrefixColors are the ANSI colors of the prefixes of the containers, on a terminal
+var logPrefixColors = []int{36, 33, 32, 35, 34, 31}
+
+// logSource is a container whose logs are aggregated
+type logSource struct {
+	ID     string
+	prefix string
+}
+
+// logPrinter writes the lines of the logs of several containers, one at a time
+type logPrinter struct {
+	mutex sync.Mutex
+}
+
+// printLines writes the lines read from 'r' to 'w', with a prefix
+func (p *logPrinter) printLines(r io.Reader, w io.Writer, prefix string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		p.mutex.Lock()
+		fmt.Fprintf(w, "%s%s\n", prefix, scanner.Text())
+		p.mutex.Unlock()
+	}
+	return scanner.Err()
+}
+
+// getLogSources returns the containers of a cluster whose logs are aggregated: its nodes, and optionally
+// its registry and load balancer
+func getLogSources(clusterName string, withRegistry bool, withLB bool) ([]logSource, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	sources := []logSource{}
+	for _, node := range cluster.nodes() {
+		sources = append(sources, logSource{ID: node.ID, prefix: strings.TrimPrefix(getNodeName(node), fmt.Sprintf("%s-%s-", defaultContainerNamePrefix, clusterName))})
+	}
+	if withRegistry {
+		if ID, err := getClusterRegistryContainer(clusterName); err != nil {
+			return nil, err
+		} else if ID != "" {
+			sources = append(sources, logSource{ID: ID, prefix: "registry"})
+		}
+	}
+	if withLB {
+		if ID, err := getServerLBContainer(clusterName); err != nil {
+			return nil, err
+		} else if ID != "" {
+			sources = append(sources, logSource{ID: ID, prefix: "serverlb"})
+		}
+	}
+	return sources, nil
+}
+
+// printClusterLogs prints the logs of the containers of a cluster, interleaved, until they end
+// (or until interrupted, when following them)
+func printClusterLogs(clusterName string, options types.ContainerLogsOptions, withRegistry bool, withLB bool) error {
+	sources, err := getLogSources(clusterName, withRegistry, withLB)
+	if err != nil {
+		return err
+	}
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	width := 0
+	for _, source := range sources {
+		if len(source.prefix) > width {
+			width = len(source.prefix)
+		}
+	}
+	colored := isTerminal(os.Stdout)
+
+	options.ShowStdout = true
+	options.ShowStderr = true
+	printer := &logPrinter{}
+	errs := make(chan error, len(sources))
+	for i, source := range sources {
+		prefix := fmt.Sprintf("%-*s | ", width, source.prefix)
+		if colored {
+			prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", logPrefixColors[i%len(logPrefixColors)], prefix)
+		}
+		go func(source logSource, prefix string) {
+			info, err := docker.ContainerInspect(ctx, source.ID)
+			if err != nil {
+				errs <- fmt.Errorf(" Couldn't inspect container %s\n%+v", source.prefix, err)
+				return
+			}
+			logs, err := docker.ContainerLogs(ctx, source.ID, options)
+			if err != nil {
+				errs <- fmt.Errorf(" Couldn't get the logs of %s\n%+v", source.prefix, err)
+				return
+			}
+			defer logs.Close()
+			if info.Config.Tty {
+				errs <- printer.printLines(logs, os.Stdout, prefix)
+				return
+			}
+
+			// the lines of stdout and stderr are printed as they come
+			stdoutReader, stdoutWriter := io.Pipe()
+			stderrReader, stderrWriter := io.Pipe()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				stdoutReader.CloseWithError(printer.printLines(stdoutReader, os.Stdout, prefix))
+			}()
+			go func() {
+				defer wg.Done()
+				stderrReader.CloseWithError(printer.printLines(stderrReader, os.Stderr, prefix))
+			}()
+			_, err = stdcopy.StdCopy(stdoutWriter, stderrWriter, logs)
+			stdoutWriter.Close()
+			stderrWriter.Close()
+			wg.Wait()
+			errs <- err
+		}(source, prefix)
+	}
+
+	for range sources {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrintLines(t *testing.T) {
+	printer := &logPrinter{}
+
+	out := new(bytes.Buffer)
+	if err := printer.printLines(strings.NewReader("first\nsecond\nlast without newline"), out, "server-0 | "); err != nil {
+		t.Fatal(err)
+	}
+	expected := "server-0 | first\nserver-0 | second\nserver-0 | last without newline\n"
+	if out.String() != expected {
+		t.Errorf("printLines() = %q, want %q", out.String(), expected)
+	}
+}
+
+func TestPrintLinesInterleaved(t *testing.T) {
+	printer := &logPrinter{}
+	out := new(bytes.Buffer)
+
+	// the lines of several containers are written concurrently, but never mixed up
+	sources := map[string]string{"server-0 | ": "server", "worker-0 | ": "worker", "registry | ": "registry"}
+	writers := map[string]*io.PipeWriter{}
+	var wg sync.WaitGroup
+	for prefix := range sources {
+		r, w := io.Pipe()
+		writers[prefix] = w
+		wg.Add(1)
+		go func(r io.Reader, prefix string) {
+			defer wg.Done()
+			if err := printer.printLines(r, out, prefix); err != nil {
+				t.Error(err)
+			}
+		}(r, prefix)
+	}
+	for i := 0; i < 100; i++ {
+		for prefix, line := range sources {
+			// written in pieces, to be split in the middle of the lines
+			io.WriteString(writers[prefix], line[:2])
+			io.WriteString(writers[prefix], line[2:]+"\n")
+		}
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+	wg.Wait()
+
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		found := false
+		for prefix, content := range sources {
+			if line == prefix+content {
+				counts[prefix]++
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	for prefix := range sources {
+		if counts[prefix] != 100 {
+			t.Errorf("got %d lines with prefix %q, want 100", counts[prefix], prefix)
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package run
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultNetworkReadyTimeout is the maximum time waited for the aliases in a network to be resolvable
+const defaultNetworkReadyTimeout = 30 * time.Second
+
+// errProbeUnavailable is returned when a probe container can't be started (e.g. the image has no `nslookup`)
+var errProbeUnavailable = errors.New("probe container could not be started")
+
 func k3dNetworkName(clusterName string) string {
 	return fmt.Sprintf("k3d-%s", clusterName)
 }
@@ -17,7 +27,10 @@ func k3dNetworkName(clusterName string) string {
 // createClusterNetwork creates a docker network for a cluster that will be used
 // to let the server and worker containers communicate with each other easily.
 func createClusterNetwork(clusterName string) (string, error) {
-	ctx := context.Background()
+	if err := checkOperation(); err != nil {
+		return "", err
+	}
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -40,11 +53,26 @@ func createClusterNetwork(clusterName string) (string, error) {
 	}
 
 	// create the network with a set of labels and the cluster name as network name
-	resp, err := docker.NetworkCreate(ctx, k3dNetworkName(clusterName), types.NetworkCreate{
-		Labels: map[string]string{
-			"app":     "k3d",
-			"cluster": clusterName,
-		},
+	var resp types.NetworkCreateResponse
+	labels := map[string]string{
+		"app":     "k3d",
+		"cluster": clusterName,
+	}
+	attempts := 0
+	err = retryDocker(fmt.Sprintf("create network %s", k3dNetworkName(clusterName)), func() (err error) {
+		attempts++
+		resp, err = docker.NetworkCreate(ctx, k3dNetworkName(clusterName), types.NetworkCreate{
+			CheckDuplicate: true,
+			Labels:         labels,
+		})
+		if errdefs.IsConflict(err) && attempts > 1 {
+			if existing, inspectErr := docker.NetworkInspect(ctx, k3dNetworkName(clusterName), types.NetworkInspectOptions{}); inspectErr == nil && hasRequestedLabels(existing.Labels, labels) {
+				log.Warningf("Network %s was created by a failed attempt: using it", k3dNetworkName(clusterName))
+				resp.ID = existing.ID
+				return nil
+			}
+		}
+		return err
 	})
 	if err != nil {
 		return "", fmt.Errorf(" Couldn't create network\n%+v", err)
@@ -54,7 +82,7 @@ func createClusterNetwork(clusterName string) (string, error) {
 }
 
 func getClusterNetwork(clusterName string) (string, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -77,6 +105,26 @@ func getClusterNetwork(clusterName string) (string, error) {
 	return networks[0].ID, nil
 }
 
+// getClusterNetworkGateway returns the gateway of the network of a cluster: the address of the docker host in that network
+func getClusterNetworkGateway(clusterName string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	net, err := docker.NetworkInspect(ctx, k3dNetworkName(clusterName), types.NetworkInspectOptions{})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect the network of cluster %s\n%+v", clusterName, err)
+	}
+	for _, config := range net.IPAM.Config {
+		if config.Gateway != "" {
+			return config.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("No gateway found in the network of cluster %s", clusterName)
+}
+
 // deleteClusterNetwork deletes a docker network based on the name of a cluster it belongs to
 func deleteClusterNetwork(clusterName string) error {
 	nid, err := getClusterNetwork(clusterName)
@@ -88,7 +136,7 @@ func deleteClusterNetwork(clusterName string) error {
 		return nil
 	}
 
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -101,7 +149,7 @@ func deleteClusterNetwork(clusterName string) error {
 
 // getContainersInNetwork gets a list of containers connected to a network
 func getContainersInNetwork(nid string) ([]string, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create docker client\n%+v", err)
@@ -118,3 +166,89 @@ func getContainersInNetwork(nid string) ([]string, error) {
 	}
 	return cids, nil
 }
+
+// waitForNetworkAliases verifies that a cluster network exists and that some aliases can be resolved in it,
+// using short-lived probe containers (running 'image', that must provide `nslookup`).
+// It retries until all the aliases are resolvable or the timeout is exceeded.
+func waitForNetworkAliases(clusterName string, image string, aliases []string, timeout time.Duration) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	netName := k3dNetworkName(clusterName)
+	if _, err := docker.NetworkInspect(ctx, netName, types.NetworkInspectOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't find the network %s\n%+v", netName, err)
+	}
+
+	// the suffix keeps concurrent creations of the cluster from colliding
+	probeName := fmt.Sprintf("%s-%s-probe-%s", defaultContainerNamePrefix, clusterName, GenerateRandomString(5))
+	start := time.Now()
+	for _, alias := range aliases {
+		for {
+			resolved, err := probeNetworkAlias(netName, image, alias, probeName)
+			if err == errProbeUnavailable {
+				log.Warnf("Couldn't run `nslookup` using the image %s: skipping the check for %s", image, alias)
+				break
+			} else if err != nil {
+				return err
+			}
+			if resolved {
+				log.Debugf("%s is resolvable in network %s", alias, netName)
+				break
+			}
+			if time.Now().After(start.Add(timeout)) {
+				return fmt.Errorf("timeout of %s exceeded while waiting for %s to be resolvable in network %s", timeout, alias, netName)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
+
+// probeNetworkAlias runs a probe container in a network, checking if an alias can be resolved there
+func probeNetworkAlias(netName string, image string, alias string, probeName string) (bool, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	config := &container.Config{
+		Image:      image,
+		Entrypoint: []string{"nslookup", alias},
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "probe",
+		},
+	}
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			netName: {},
+		},
+	}
+
+	id, err := createContainer(config, &container.HostConfig{}, networkingConfig, probeName)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := removeContainer(id); err != nil {
+			log.Warningln(err)
+		}
+	}()
+
+	if err := startContainer(id); err != nil {
+		log.Debugf("Couldn't start probe container %s: %+v", probeName, err)
+		return false, errProbeUnavailable
+	}
+
+	statusCh, errCh := docker.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return false, fmt.Errorf(" Couldn't wait for probe container %s\n%+v", probeName, err)
+	case status := <-statusCh:
+		return status.StatusCode == 0, nil
+	}
+}
@@ -0,0 +1,166 @@
+package run
+
+/*
+ * The functions in this file scope the arguments of k3s (`--server-arg`, `--agent-arg`) to some nodes
+ * with node filters, e.g. `--agent-arg '--node-label=gpu=true@worker[1-2]'`, so individual nodes can get
+ * different kubelet or registration flags.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nodeArgFilterRegexp matches a node filter at the end of an argument: `@<role>[<index>]`, `@<role>[<first>-<last>]`
+// or `@<role>[*]`
+var nodeArgFilterRegexp = regexp.MustCompile(`^(.*)@(server|master|worker|agent)\[(\*|\d+|\d+-\d+)\]$`)
+
+// nodeArg is an argument of k3s given to a range of nodes of a role
+type nodeArg struct {
+	arg   string
+	spec  string // the argument with its filters, as given by the user
+	role  string // server or worker
+	first int
+	last  int // -1 for all the nodes from 'first'
+}
+
+// parseNodeArgs separates the arguments of k3s given to all the nodes of 'role' from the ones scoped
+// with node filters (several filters can be chained, e.g. `--node-taint=x=y:NoSchedule@worker[0]@worker[3]`)
+func parseNodeArgs(specs []string, role string) ([]string, []nodeArg, error) {
+	args := []string{}
+	filtered := []nodeArg{}
+	for _, spec := range specs {
+		match := nodeArgFilterRegexp.FindStringSubmatch(spec)
+		if match == nil {
+			args = append(args, spec)
+			continue
+		}
+		// the filters are peeled from the end of the argument
+		scoped := []nodeArg{}
+		arg := spec
+		for ; match != nil; match = nodeArgFilterRegexp.FindStringSubmatch(arg) {
+			arg = match[1]
+			filterRole := match[2]
+			if filterRole == "master" {
+				filterRole = "server"
+			} else if filterRole == "agent" {
+				filterRole = "worker"
+			}
+			if filterRole != role {
+				return nil, nil, fmt.Errorf("Invalid node filter in [%s]: only the %ss can be targeted", spec, role)
+			}
+			first, last := 0, -1
+			if match[3] != "*" {
+				bounds := strings.SplitN(match[3], "-", 2)
+				first, _ = strconv.Atoi(bounds[0])
+				last = first
+				if len(bounds) == 2 {
+					last, _ = strconv.Atoi(bounds[1])
+				}
+				if last < first {
+					return nil, nil, fmt.Errorf("Invalid node filter in [%s]: empty range [%s]", spec, match[3])
+				}
+			}
+			scoped = append(scoped, nodeArg{spec: spec, role: role, first: first, last: last})
+		}
+		for i := range scoped {
+			scoped[i].arg = arg
+		}
+		filtered = append(filtered, scoped...)
+	}
+	return args, filtered, nil
+}
+
+// validateNodeArgs checks the node filters of the arguments target nodes that will exist
+func validateNodeArgs(filtered []nodeArg, count int) error {
+	for _, a := range filtered {
+		if a.first >= count || a.last >= count {
+			return fmt.Errorf("Invalid node filter in [%s]: the cluster only has %d %s(s) (indexes start at 0)", a.spec, count, a.role)
+		}
+	}
+	return nil
+}
+
+// getNodeArgs returns the arguments scoped to the node 'index' of a role
+func getNodeArgs(filtered []nodeArg, role string, index int) []string {
+	args := []string{}
+	seen := map[string]bool{}
+	for _, a := range filtered {
+		if a.role != role || index < a.first || (a.last >= 0 && index > a.last) {
+			continue
+		}
+		// an argument with several filters matching a node is given once
+		if !seen[a.spec] {
+			seen[a.spec] = true
+			args = append(args, a.arg)
+		}
+	}
+	return args
+}
+
+// getNodeArgSpecs returns the arguments with their filters, as given by the user
+func getNodeArgSpecs(filtered []nodeArg) []string {
+	specs := []string{}
+	seen := map[string]bool{}
+	for _, a := range filtered {
+		if !seen[a.spec] {
+			seen[a.spec] = true
+			specs = append(specs, a.spec)
+		}
+	}
+	return specs
+}
+
+// taintEffects are the effects of the Kubernetes taints
+var taintEffects = map[string]bool{"NoSchedule": true, "PreferNoSchedule": true, "NoExecute": true}
+
+// validateNodeLabelOrTaint checks a node label (`key=value`) or taint (`key=value:Effect`) before giving it to k3s
+func validateNodeLabelOrTaint(flag string, value string) error {
+	keyValue := value
+	if flag == "node-taint" {
+		i := strings.LastIndex(value, ":")
+		if i < 0 || !taintEffects[value[i+1:]] {
+			return fmt.Errorf("Invalid --node-taint [%s]: the format is `key=value:Effect`, with NoSchedule, PreferNoSchedule or NoExecute", value)
+		}
+		keyValue = value[:i]
+	}
+	if split := strings.SplitN(keyValue, "=", 2); split[0] == "" || (flag == "node-label" && len(split) != 2) {
+		return fmt.Errorf("Invalid --%s [%s]: the format is `key=value`", flag, value)
+	}
+	return nil
+}
+
+// getNodeFlagArgs translates the values of a k3s flag given to some nodes (e.g. `--node-label gpu=true@worker[0]`)
+// into arguments of the servers and of the agents, with the node filters of their role.
+// The values without node filters are given to all the nodes.
+func getNodeFlagArgs(flag string, specs []string) ([]string, []string, error) {
+	serverArgs := []string{}
+	agentArgs := []string{}
+	for _, spec := range specs {
+		value := spec
+		filters := map[string]string{}
+		for match := nodeArgFilterRegexp.FindStringSubmatch(value); match != nil; match = nodeArgFilterRegexp.FindStringSubmatch(value) {
+			value = match[1]
+			role := map[string]string{"server": "server", "master": "server", "worker": "worker", "agent": "worker"}[match[2]]
+			filters[role] = fmt.Sprintf("@%s[%s]", role, match[3]) + filters[role]
+		}
+		if err := validateNodeLabelOrTaint(flag, value); err != nil {
+			return nil, nil, err
+		}
+		arg := fmt.Sprintf("--%s=%s", flag, value)
+		if len(filters) == 0 {
+			serverArgs = append(serverArgs, arg)
+			agentArgs = append(agentArgs, arg)
+			continue
+		}
+		if f, ok := filters["server"]; ok {
+			serverArgs = append(serverArgs, arg+f)
+		}
+		if f, ok := filters["worker"]; ok {
+			agentArgs = append(agentArgs, arg+f)
+		}
+	}
+	return serverArgs, agentArgs, nil
+}
@@ -0,0 +1,100 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeArgs(t *testing.T) {
+	tests := []struct {
+		specs        []string
+		role         string
+		wantArgs     []string
+		wantFiltered []nodeArg
+		wantErr      bool
+	}{
+		{
+			specs:        []string{"--disable=traefik", "--tls-san=k3d.local"},
+			role:         "server",
+			wantArgs:     []string{"--disable=traefik", "--tls-san=k3d.local"},
+			wantFiltered: []nodeArg{},
+		},
+		{
+			specs:    []string{"--node-label=gpu=true@worker[0]"},
+			role:     "worker",
+			wantArgs: []string{},
+			wantFiltered: []nodeArg{
+				{arg: "--node-label=gpu=true", spec: "--node-label=gpu=true@worker[0]", role: "worker", first: 0, last: 0},
+			},
+		},
+		{
+			specs:    []string{"--kubelet-arg=max-pods=50@agent[1-2]", "--disable=traefik"},
+			role:     "worker",
+			wantArgs: []string{"--disable=traefik"},
+			wantFiltered: []nodeArg{
+				{arg: "--kubelet-arg=max-pods=50", spec: "--kubelet-arg=max-pods=50@agent[1-2]", role: "worker", first: 1, last: 2},
+			},
+		},
+		{
+			specs:    []string{"--node-taint=x=y:NoSchedule@worker[0]@worker[3]"},
+			role:     "worker",
+			wantArgs: []string{},
+			wantFiltered: []nodeArg{
+				{arg: "--node-taint=x=y:NoSchedule", spec: "--node-taint=x=y:NoSchedule@worker[0]@worker[3]", role: "worker", first: 3, last: 3},
+				{arg: "--node-taint=x=y:NoSchedule", spec: "--node-taint=x=y:NoSchedule@worker[0]@worker[3]", role: "worker", first: 0, last: 0},
+			},
+		},
+		{
+			specs:    []string{"--etcd-arg=quota-backend-bytes=1@master[*]"},
+			role:     "server",
+			wantArgs: []string{},
+			wantFiltered: []nodeArg{
+				{arg: "--etcd-arg=quota-backend-bytes=1", spec: "--etcd-arg=quota-backend-bytes=1@master[*]", role: "server", first: 0, last: -1},
+			},
+		},
+		{specs: []string{"--node-label=a=b@worker[0]"}, role: "server", wantErr: true},
+		{specs: []string{"--node-label=a=b@worker[2-1]"}, role: "worker", wantErr: true},
+	}
+	for _, test := range tests {
+		args, filtered, err := parseNodeArgs(test.specs, test.role)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseNodeArgs(%q, %s): error %v, want error %v", test.specs, test.role, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("parseNodeArgs(%q, %s) args = %q, want %q", test.specs, test.role, args, test.wantArgs)
+		}
+		if !reflect.DeepEqual(filtered, test.wantFiltered) {
+			t.Errorf("parseNodeArgs(%q, %s) filtered = %+v, want %+v", test.specs, test.role, filtered, test.wantFiltered)
+		}
+	}
+}
+
+func TestGetNodeArgs(t *testing.T) {
+	_, filtered, err := parseNodeArgs([]string{
+		"--node-label=first=true@server[0]",
+		"--node-label=others=true@server[1-2]",
+		"--node-label=all=true@server[*]",
+		"--node-taint=x=y:NoSchedule@server[0]@server[0-1]",
+	}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		index int
+		want  []string
+	}{
+		{0, []string{"--node-label=first=true", "--node-label=all=true", "--node-taint=x=y:NoSchedule"}},
+		{1, []string{"--node-label=others=true", "--node-label=all=true", "--node-taint=x=y:NoSchedule"}},
+		{2, []string{"--node-label=others=true", "--node-label=all=true"}},
+		{5, []string{"--node-label=all=true"}},
+	}
+	for _, test := range tests {
+		if got := getNodeArgs(filtered, "server", test.index); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getNodeArgs(server, %d) = %q, want %q", test.index, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package run
+
+/*
+ * The functions in this file copy files and directories between the host and the nodes of a cluster (`k3d cp`),
+ * in both directions, like `docker cp`. A copy to the nodes can target several of them at once (e.g. a CA
+ * certificate for all the nodes), and the files are streamed as tar archives, so big files aren't held in memory.
+ */
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseNodePath splits a path in the nodes of a cluster, `NODE:PATH`, where NODE is a node or a group of nodes.
+// A local path has no NODE (a drive letter of Windows isn't one).
+func parseNodePath(arg string) (string, string, bool) {
+	split := strings.SplitN(arg, ":", 2)
+	if len(split) != 2 || len(split[0]) < 2 || strings.ContainsAny(split[0], `/\`) {
+		return "", arg, false
+	}
+	return split[0], split[1], true
+}
+
+// writeTar writes a file or a directory (recursively) to a tar archive, named 'name' in the archive
+func writeTar(srcPath string, name string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(srcPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcPath, file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// copyToNodes copies a local file or directory to the nodes of a cluster matching a specifier.
+// Like with `docker cp`, it's copied into 'dstPath' if that's an existing directory, and as 'dstPath' otherwise.
+func copyToNodes(clusterName string, specifier string, srcPath string, dstPath string) error {
+	if _, err := os.Lstat(srcPath); err != nil {
+		return fmt.Errorf(" Couldn't copy %s\n%+v", srcPath, err)
+	}
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	nodes, err := getNodesBySpecifier(cluster, specifier)
+	if err != nil {
+		return err
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	for _, node := range nodes {
+		dstDir, name := dstPath, filepath.Base(srcPath)
+		if stat, err := docker.ContainerStatPath(ctx, node.ID, dstPath); err != nil || !stat.Mode.IsDir() {
+			dstDir, name = path.Dir(dstPath), path.Base(dstPath)
+		}
+
+		// the archive is written while docker reads it
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeTar(srcPath, name, writer))
+		}()
+		err := docker.CopyToContainer(ctx, node.ID, dstDir, reader, types.CopyToContainerOptions{AllowOverwriteDirWithFile: true})
+		reader.CloseWithError(err)
+		if err != nil {
+			return fmt.Errorf(" Couldn't copy %s to %s:%s\n%+v", srcPath, getNodeName(node), dstPath, err)
+		}
+		log.Printf("Copied %s to %s:%s", srcPath, getNodeName(node), dstPath)
+	}
+	return nil
+}
+
+// isWithin tells if a path is 'dir' or is in it (lexically, the paths being clean)
+func isWithin(dir string, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// extractTar extracts a tar archive of a file or a directory named 'name' as 'dstPath'.
+// The symlinks of the archive can't point outside of 'dstPath', so the entries can't be written through them
+// anywhere else on the host (but a symlink copied alone, which is copied as it is).
+func extractTar(r io.Reader, name string, dstPath string) error {
+	dstPath = filepath.Clean(dstPath)
+	rootIsLink := false
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// the entries are renamed from 'name' to 'dstPath', and can't escape it
+		rel := strings.TrimPrefix(path.Clean(hdr.Name), name)
+		if rel != "" && !strings.HasPrefix(rel, "/") {
+			return fmt.Errorf("Unexpected entry %s in the archive of %s", hdr.Name, name)
+		}
+		target := filepath.Join(dstPath, filepath.FromSlash(path.Clean("/"+rel)))
+		if rootIsLink {
+			return fmt.Errorf("Unexpected entry %s in the archive of %s, which is a symlink", hdr.Name, name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// an existing symlink is replaced, not written through
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(target)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if target == dstPath {
+				rootIsLink = true
+			} else if link := filepath.FromSlash(hdr.Linkname); filepath.IsAbs(link) || !isWithin(dstPath, filepath.Join(filepath.Dir(target), link)) {
+				return fmt.Errorf("Symlink %s -> %s in the archive of %s points outside of %s", hdr.Name, hdr.Linkname, name, dstPath)
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("Skipping %s (not a file, a directory or a symlink)", hdr.Name)
+		}
+	}
+}
+
+// copyFromNode copies a file or directory of a node of a cluster to the host.
+// Like with `docker cp`, it's copied into 'dstPath' if that's an existing directory, and as 'dstPath' otherwise.
+func copyFromNode(clusterName string, specifier string, srcPath string, dstPath string) error {
+	node, err := getNode(clusterName, specifier)
+	if err != nil {
+		return err
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	content, stat, err := docker.CopyFromContainer(ctx, node.ID, srcPath)
+	if err != nil {
+		return fmt.Errorf(" Couldn't copy %s:%s\n%+v", getNodeName(node), srcPath, err)
+	}
+	defer content.Close()
+
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+		dstPath = filepath.Join(dstPath, stat.Name)
+	}
+	if err := extractTar(content, stat.Name, dstPath); err != nil {
+		return fmt.Errorf(" Couldn't copy %s:%s to %s\n%+v", getNodeName(node), srcPath, dstPath, err)
+	}
+	log.Printf("Copied %s:%s to %s", getNodeName(node), srcPath, dstPath)
+	return nil
+}
@@ -0,0 +1,136 @@
+package run
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseNodePath(t *testing.T) {
+	tests := []struct {
+		arg      string
+		wantNode string
+		wantPath string
+		wantOK   bool
+	}{
+		{"server:/etc/rancher", "server", "/etc/rancher", true},
+		{"worker-1:/var/log/pods", "worker-1", "/var/log/pods", true},
+		{"workers:relative", "workers", "relative", true},
+		{"/tmp/file", "", "/tmp/file", false},
+		{"./dir:with:colons", "", "./dir:with:colons", false},
+		{`C:\Users\k3d`, "", `C:\Users\k3d`, false},
+		{"c:/Users/k3d", "", "c:/Users/k3d", false},
+		{"file", "", "file", false},
+	}
+	for _, test := range tests {
+		node, path, ok := parseNodePath(test.arg)
+		if node != test.wantNode || path != test.wantPath || ok != test.wantOK {
+			t.Errorf("parseNodePath(%q) = %q, %q, %v, want %q, %q, %v", test.arg, node, path, ok, test.wantNode, test.wantPath, test.wantOK)
+		}
+	}
+}
+
+// tarEntries returns a tar archive of headers, the regular files having their name as content
+func tarEntries(t *testing.T, hdrs ...tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractTar(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "k3d-node-cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tests := []struct {
+		name    string
+		hdrs    []tar.Header
+		wantErr bool
+	}{
+		{
+			name: "directory with a symlink inside",
+			hdrs: []tar.Header{
+				{Name: "data", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "data/file", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+			},
+		},
+		{
+			name: "single symlink",
+			hdrs: []tar.Header{{Name: "data", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+		},
+		{
+			name: "relative symlink escaping",
+			hdrs: []tar.Header{
+				{Name: "data", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+				{Name: "data/link/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute symlink",
+			hdrs: []tar.Header{
+				{Name: "data", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: tmp},
+			},
+			wantErr: true,
+		},
+		{
+			name: "entries under a single symlink",
+			hdrs: []tar.Header{
+				{Name: "data", Typeflag: tar.TypeSymlink, Linkname: tmp},
+				{Name: "data/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "entry of another name",
+			hdrs:    []tar.Header{{Name: "other/file", Typeflag: tar.TypeReg, Mode: 0644}},
+			wantErr: true,
+		},
+	}
+	for i, test := range tests {
+		dstPath := filepath.Join(tmp, "dst", string('a'+rune(i)))
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := extractTar(tarEntries(t, test.hdrs...), "data", dstPath)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: extractTar() error %v, want error %v", test.name, err, test.wantErr)
+		}
+		if _, err := os.Lstat(filepath.Join(tmp, "dst", "escaped")); err == nil {
+			t.Errorf("%s: extractTar() wrote outside of the destination", test.name)
+		}
+		if _, err := os.Lstat(filepath.Join(tmp, "escaped")); err == nil {
+			t.Errorf("%s: extractTar() wrote outside of the destination", test.name)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "dst", "a", "link"))
+	if err != nil || string(content) != "data/file" {
+		t.Errorf("extractTar() didn't extract the file through the symlink: %q %v", content, err)
+	}
+}
@@ -0,0 +1,101 @@
+package run
+
+/*
+ * The functions in this file run a shell or a command in a node container (`k3d exec`), with the docker CLI
+ * when available for a real terminal (with job control, resizing, ...), and through the docker API otherwise.
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultNodeShell is the shell started in the nodes without a command (the k3s image has no bash)
+const defaultNodeShell = "sh"
+
+// isTerminal tells if a file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// getNode returns the node of a cluster matching a specifier, which must match a single node
+func getNode(clusterName string, specifier string) (types.Container, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return types.Container{}, err
+	}
+	nodes, err := getNodesBySpecifier(cluster, specifier)
+	if err != nil {
+		return types.Container{}, err
+	}
+	if len(nodes) > 1 {
+		names := []string{}
+		for _, node := range nodes {
+			names = append(names, getNodeName(node))
+		}
+		return types.Container{}, fmt.Errorf("[%s] matches several nodes of cluster %s: pick one of %s", specifier, clusterName, strings.Join(names, ", "))
+	}
+	return nodes[0], nil
+}
+
+// execInNode runs a command in a node of a cluster (a shell without command), attached to the terminal.
+// The error of a command failed with the docker CLI is an *exec.ExitError.
+func execInNode(clusterName string, specifier string, command []string) error {
+	node, err := getNode(clusterName, specifier)
+	if err != nil {
+		return err
+	}
+	if node.State != "running" {
+		return fmt.Errorf("Node %s is %s (start it with `%s start-node %s`)", getNodeName(node), node.State, os.Args[0], getNodeName(node))
+	}
+	if len(command) == 0 {
+		command = []string{defaultNodeShell}
+	}
+
+	dockerPath, err := exec.LookPath("docker")
+	if err != nil {
+		// without the docker CLI, the command gets no input and its output is printed once it's done
+		if len(command) == 1 && command[0] == defaultNodeShell {
+			return fmt.Errorf("The docker CLI is needed for an interactive shell (run a command instead, e.g. `%s exec %s -- ps`)", os.Args[0], getNodeName(node))
+		}
+		log.Debugf("docker CLI not found: running %v in node %s through the docker API", command, getNodeName(node))
+		out, err := execInContainer(node.ID, command)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	}
+
+	args := []string{"exec", "-i"}
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		args = append(args, "-t")
+	}
+	args = append(append(args, node.ID), command...)
+	cmd := exec.Command(dockerPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// getNodeNames returns the names of the nodes of all the clusters (e.g. for completing them in the shell)
+func getNodeNames() ([]string, error) {
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, cluster := range clusters {
+		for _, node := range cluster.nodes() {
+			names = append(names, getNodeName(node))
+		}
+	}
+	return names, nil
+}
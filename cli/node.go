@@ -0,0 +1,401 @@
+package run
+
+/*
+ * The functions in this file manage single nodes of a running cluster: the nodes added with `k3d add-node`
+ * get the configuration of the existing nodes (registries, certificates) and, for servers, join the
+ * etcd cluster (or the external datastore) of the cluster.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeConfigPaths are the files written by k3d in the nodes, copied from an existing node into the new ones
+var nodeConfigPaths = []string{
+	defaultFullRegistriesPath,
+	defaultNodeRegistryTLSDir,
+}
+
+// copyNodeConfig copies the configuration written by k3d in a node into another one (before starting it),
+// skipping the files the node doesn't have
+func copyNodeConfig(srcID string, dstID string, paths []string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	for _, p := range paths {
+		reader, _, err := docker.CopyFromContainer(ctx, srcID, p)
+		if client.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf(" Couldn't copy %s from container %s\n%+v", p, srcID, err)
+		}
+		log.Debugf("Copying %s into the new node", p)
+		err = docker.CopyToContainer(ctx, dstID, path.Dir(p), reader, types.CopyToContainerOptions{})
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf(" Couldn't copy %s into container %s\n%+v", p, dstID, err)
+		}
+	}
+	return nil
+}
+
+// getServerIndex returns the index of a server in its cluster (0 for the server that created the cluster)
+func getServerIndex(server types.Container) int {
+	index, err := strconv.Atoi(server.Labels["server-index"])
+	if err != nil {
+		return 0
+	}
+	return index
+}
+
+// getNextServerIndex returns the first unused index for a new server of a cluster
+func getNextServerIndex(clusterName string) (int, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", "component=server")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	servers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't list the servers of cluster %s\n%+v", clusterName, err)
+	}
+
+	next := 1
+	for _, server := range servers {
+		if index := getServerIndex(server); index >= next {
+			next = index + 1
+		}
+	}
+	return next, nil
+}
+
+// canAddServers checks if servers can join a cluster: it needs the embedded etcd or an external datastore
+func canAddServers(server types.ContainerJSON) bool {
+	if server.Config.Labels["datastore"] == "external" || server.Config.Labels["server-index"] != "" {
+		return true
+	}
+	for _, arg := range server.Config.Cmd {
+		if arg == "--cluster-init" {
+			return true
+		}
+	}
+	return false
+}
+
+// serverNodeArgsLabel records the --server-arg values scoped with node filters on the servers (as a JSON list)
+const serverNodeArgsLabel = "server-node-args"
+
+// getJoiningServerSpec fills the spec of the servers joining a cluster with the settings of its first server:
+// the same arguments (but the ones initializing the cluster, and the ones scoped to the first server),
+// environment, token and datastore
+func getJoiningServerSpec(spec *ClusterSpec, server types.ContainerJSON) {
+	args := []string{}
+	cmd := server.Config.Cmd
+	if len(cmd) > 0 && cmd[0] == "server" {
+		cmd = cmd[1:]
+	}
+	cmd = stripServerNodeArgs(spec, server, cmd)
+	for i := 0; i < len(cmd); i++ {
+		switch cmd[i] {
+		case "--cluster-init":
+			continue
+		case "--server":
+			i++
+			continue
+		}
+		args = append(args, cmd[i])
+	}
+	spec.ServerArgs = append(args, spec.ServerArgs...)
+
+	env := []string{}
+	hasToken := false
+	secret := ""
+	for _, e := range server.Config.Env {
+		split := strings.SplitN(e, "=", 2)
+		switch split[0] {
+		case "K3S_DATASTORE_ENDPOINT":
+			spec.Datastore = &datastore{Endpoint: split[1], Container: server.Config.Labels["datastore-container"]}
+			continue
+		case "K3S_TOKEN":
+			hasToken = true
+		case "K3S_CLUSTER_SECRET":
+			secret = split[1]
+		}
+		env = append(env, e)
+	}
+	// clusters created with a single server only have the secret, which is the token
+	if !hasToken && secret != "" {
+		env = append(env, fmt.Sprintf("K3S_TOKEN=%s", secret))
+	}
+	spec.Env = append(env, spec.Env...)
+
+	// the servers are in HA mode from now on
+	spec.Servers = 2
+	// the new servers get the restart policy of the first one
+	if policy := server.HostConfig.RestartPolicy; policy.Name != "" {
+		spec.RestartPolicy = policy.Name
+		if policy.Name == "on-failure" && policy.MaximumRetryCount > 0 {
+			spec.RestartPolicy = fmt.Sprintf("on-failure:%d", policy.MaximumRetryCount)
+		}
+	}
+	if apiHost := server.Config.Labels["apihost"]; apiHost != "localhost" {
+		spec.APIPort.Host = apiHost
+	}
+}
+
+// stripServerNodeArgs removes from the arguments of a server the ones scoped to it with node filters, which come
+// after its other arguments, and gives the scoped arguments to the spec of the joining servers, for their own index
+func stripServerNodeArgs(spec *ClusterSpec, server types.ContainerJSON, cmd []string) []string {
+	specs := []string{}
+	if err := json.Unmarshal([]byte(server.Config.Labels[serverNodeArgsLabel]), &specs); err != nil || len(specs) == 0 {
+		return cmd
+	}
+	_, filtered, err := parseNodeArgs(specs, "server")
+	if err != nil {
+		log.Warningf("Couldn't parse the scoped arguments of server %s, the new servers get all its arguments\n%+v", strings.TrimLeft(server.Name, "/"), err)
+		return cmd
+	}
+	index, _ := strconv.Atoi(server.Config.Labels["server-index"])
+	scoped := getNodeArgs(filtered, "server", index)
+
+	// the scoped arguments are the last ones before --cluster-init or --server
+	end := len(cmd)
+	for i, arg := range cmd {
+		if arg == "--cluster-init" || arg == "--server" {
+			end = i
+			break
+		}
+	}
+	start := end - len(scoped)
+	if start < 0 {
+		return cmd
+	}
+	for i, arg := range scoped {
+		if cmd[start+i] != arg {
+			return cmd
+		}
+	}
+	spec.NodeServerArgs = append(spec.NodeServerArgs, filtered...)
+	return append(append([]string{}, cmd[:start]...), cmd[end:]...)
+}
+
+// addServers creates servers joining a cluster, one at a time, and adds them to its load balancer (if it has one)
+func addServers(spec *ClusterSpec, count int, timeoutSeconds int) error {
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+	start, err := getNextServerIndex(spec.ClusterName)
+	if err != nil {
+		return err
+	}
+
+	for index := start; index < start+count; index++ {
+		id, err := createServer(spec, index)
+		if err != nil {
+			return err
+		}
+		name := GetContainerName("server", spec.ClusterName, index)
+		log.Printf("Waiting for server %s to join the cluster...", name)
+		if err := waitForContainerLogMessage(id, "Wrote kubeconfig", timeoutSeconds); err != nil {
+			return fmt.Errorf(" Server %s didn't come up\n%+v", name, err)
+		}
+	}
+	return updateServerLB(spec)
+}
+
+// getServerAPIPort returns the API port of a server, from its arguments
+func getServerAPIPort(server types.ContainerJSON) string {
+	for i, arg := range server.Config.Cmd {
+		if arg == "--https-listen-port" && i+1 < len(server.Config.Cmd) {
+			return server.Config.Cmd[i+1]
+		}
+	}
+	// the default of k3s
+	return "6443"
+}
+
+// deleteNodes removes nodes from a running cluster: drains them (if asked), deletes them from Kubernetes and
+// removes their containers, with their volumes. The server that created the cluster can't be removed, and
+// the servers sharing an embedded etcd can't lose its quorum (unless forced).
+func deleteNodes(clusterName string, specifiers []string, drain bool, drainTimeout int, force bool) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	nodes := []types.Container{}
+	selected := map[string]bool{}
+	for _, specifier := range specifiers {
+		matched, err := getNodesBySpecifier(cluster, specifier)
+		if err != nil {
+			return err
+		}
+		for _, node := range matched {
+			if !selected[node.ID] {
+				selected[node.ID] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	serversRemoved := 0
+	for _, node := range nodes {
+		if node.ID == cluster.server.ID {
+			return fmt.Errorf("Node %s created cluster %s and can't be removed (use `k3d delete` for removing the cluster)", getNodeName(node), clusterName)
+		}
+		if node.Labels["component"] == "server" {
+			serversRemoved++
+		}
+	}
+	if err := checkEtcdQuorum(cluster, serversRemoved, force); err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		name := getNodeName(node)
+		if drain {
+			log.Printf("...Draining node %s", name)
+			if err := drainNode(cluster.server.ID, name, drainTimeout); err != nil {
+				return fmt.Errorf(" Couldn't drain node %s (remove it without --drain if it's broken)\n%+v", name, err)
+			}
+		}
+
+		log.Printf("...Removing node %s", name)
+		if _, err := kubectl(cluster.server.ID, "delete", "node", name, "--ignore-not-found"); err != nil {
+			log.Warningf("Couldn't delete node %s from Kubernetes: you may want to `kubectl delete node %s`\n%+v", name, name, err)
+		}
+		if err := removeContainer(node.ID); err != nil {
+			return err
+		}
+	}
+
+	// the removed servers leave the load balancer
+	if serversRemoved > 0 {
+		ctx := operationContext()
+		docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+		}
+		server, err := docker.ContainerInspect(ctx, cluster.server.ID)
+		if err != nil {
+			return fmt.Errorf(" Couldn't inspect the server of cluster %s\n%+v", clusterName, err)
+		}
+		if err := updateServerLB(&ClusterSpec{ClusterName: clusterName, APIPort: apiPort{Port: getServerAPIPort(server)}}); err != nil {
+			return err
+		}
+	}
+
+	if err := recordClusterSpec(clusterName); err != nil {
+		log.Warningf("Couldn't record the configuration of the cluster without the removed nodes\n%+v", err)
+	}
+	return nil
+}
+
+// checkEtcdQuorum checks the servers left after removing some of them are still a quorum of the members
+// of the embedded etcd (a majority), without which the cluster stops working
+func checkEtcdQuorum(cluster Cluster, serversRemoved int, force bool) error {
+	if serversRemoved == 0 || cluster.server.Labels["datastore"] == "external" {
+		return nil
+	}
+	servers := 1 + len(cluster.servers)
+	quorum := servers/2 + 1
+	if servers-serversRemoved >= quorum {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("Removing %d of the %d servers of cluster %s would leave %d, less than the quorum of its etcd (%d): remove them one at a time, or use --force", serversRemoved, servers, cluster.name, servers-serversRemoved, quorum)
+	}
+	log.Warningf("Removing %d of the %d servers of cluster %s, its etcd loses its quorum (%d)", serversRemoved, servers, cluster.name, quorum)
+	return nil
+}
+
+// getNodeClusterName returns the name of the cluster of a node container (with or without its `k3d-` prefix)
+func getNodeClusterName(nodeName string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	for _, name := range []string{nodeName, fmt.Sprintf("%s-%s", defaultContainerNamePrefix, nodeName)} {
+		node, err := docker.ContainerInspect(ctx, name)
+		if client.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf(" Couldn't inspect container %s\n%+v", name, err)
+		}
+		if node.Config.Labels["app"] != "k3d" || node.Config.Labels["cluster"] == "" {
+			return "", fmt.Errorf("Container %s is not a node of a k3d cluster", name)
+		}
+		return node.Config.Labels["cluster"], nil
+	}
+	return "", fmt.Errorf("No node %s found", nodeName)
+}
+
+// stopNodes stops nodes of a cluster, leaving the other ones running
+func stopNodes(clusterName string, specifiers []string, timeout *time.Duration) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	for _, specifier := range specifiers {
+		nodes, err := getNodesBySpecifier(cluster, specifier)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			log.Printf("...Stopping node %s", getNodeName(node))
+			if err := docker.ContainerStop(ctx, node.ID, timeout); err != nil {
+				return fmt.Errorf(" Couldn't stop node %s\n%+v", getNodeName(node), err)
+			}
+		}
+	}
+	return nil
+}
+
+// startNodes starts stopped nodes of a cluster
+func startNodes(clusterName string, specifiers []string) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	for _, specifier := range specifiers {
+		nodes, err := getNodesBySpecifier(cluster, specifier)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			log.Printf("...Starting node %s", getNodeName(node))
+			if err := startContainer(node.ID); err != nil {
+				return fmt.Errorf(" Couldn't start node %s\n%+v", getNodeName(node), err)
+			}
+		}
+	}
+	return nil
+}
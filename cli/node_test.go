@@ -0,0 +1,79 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestGetJoiningServerSpec(t *testing.T) {
+	server := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{Name: "/k3d-dev-server", HostConfig: &container.HostConfig{}},
+		Config: &container.Config{
+			Cmd: []string{"server", "--https-listen-port", "6443", "--disable=traefik",
+				"--node-label=first=true", "--node-label=all=true", "--cluster-init"},
+			Env: []string{"K3S_CLUSTER_SECRET=secret"},
+			Labels: map[string]string{
+				"apihost":           "localhost",
+				"server-index":      "0",
+				serverNodeArgsLabel: `["--node-label=first=true@server[0]","--node-label=all=true@server[*]"]`,
+			},
+		},
+	}
+	spec := &ClusterSpec{}
+	getJoiningServerSpec(spec, server)
+
+	wantArgs := []string{"--https-listen-port", "6443", "--disable=traefik"}
+	if !reflect.DeepEqual(spec.ServerArgs, wantArgs) {
+		t.Errorf("ServerArgs = %q, want %q", spec.ServerArgs, wantArgs)
+	}
+	if got, want := getNodeArgs(spec.NodeServerArgs, "server", 1), []string{"--node-label=all=true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("arguments of server 1 = %q, want %q", got, want)
+	}
+	if want := []string{"K3S_CLUSTER_SECRET=secret", "K3S_TOKEN=secret"}; !reflect.DeepEqual(spec.Env, want) {
+		t.Errorf("Env = %q, want %q", spec.Env, want)
+	}
+
+	// servers created by older versions of k3d have no scoped arguments recorded
+	delete(server.Config.Labels, serverNodeArgsLabel)
+	spec = &ClusterSpec{}
+	getJoiningServerSpec(spec, server)
+	wantArgs = []string{"--https-listen-port", "6443", "--disable=traefik", "--node-label=first=true", "--node-label=all=true"}
+	if !reflect.DeepEqual(spec.ServerArgs, wantArgs) {
+		t.Errorf("ServerArgs without recorded scoped arguments = %q, want %q", spec.ServerArgs, wantArgs)
+	}
+}
+
+func TestGetRecordedNodeResources(t *testing.T) {
+	flags := map[string]string{"memory": "2g", "cpus": "2", "agents-memory": "1g", "servers-cpus": "", "gpus": ""}
+
+	agent, err := getRecordedNodeResources(flags, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Memory != 1<<30 || agent.NanoCPUs != 2e9 || agent.GPUs != nil {
+		t.Errorf("agent resources = %+v, want 1g and 2 CPUs", agent)
+	}
+
+	server, err := getRecordedNodeResources(flags, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Memory != 2<<30 || server.NanoCPUs != 2e9 {
+		t.Errorf("server resources = %+v, want 2g and 2 CPUs", server)
+	}
+
+	none, err := getRecordedNodeResources(map[string]string{}, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Memory != 0 || none.NanoCPUs != 0 {
+		t.Errorf("resources without limits = %+v, want none", none)
+	}
+
+	if _, err := getRecordedNodeResources(map[string]string{"gpus": "some"}, "agent"); err == nil {
+		t.Errorf("expected an error for invalid recorded GPUs")
+	}
+}
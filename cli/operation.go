@@ -0,0 +1,77 @@
+package run
+
+/*
+ * The functions in this file give the docker calls of the operation in progress (e.g. `k3d create --timeout`)
+ * a shared context: when the operation times out or is interrupted, the calls in flight (image pulls, copies,
+ * container creations, ...) are aborted right away instead of running to completion.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the context of the docker calls of the operation in progress (a background context outside of operations)
+var (
+	operationCtx       = context.Background()
+	operationCancel    = func() {}
+	operationCancelled bool // for good: nothing is created anymore, even by the operations cleaning up
+	operationMutex     sync.Mutex
+)
+
+// operationContext returns the context of the docker calls, cancelled when the operation in progress
+// times out or is interrupted
+func operationContext() context.Context {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	return operationCtx
+}
+
+// startOperation starts an operation within 'parent' (e.g. the operation in progress), with a timeout
+// (0 for none), until the returned function is called, which restores the previous operation
+func startOperation(parent context.Context, timeout time.Duration) func() {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	previousCtx, previousCancel := operationCtx, operationCancel
+	if timeout > 0 {
+		operationCtx, operationCancel = context.WithTimeout(parent, timeout)
+	} else {
+		operationCtx, operationCancel = context.WithCancel(parent)
+	}
+	cancel := operationCancel
+	return func() {
+		operationMutex.Lock()
+		defer operationMutex.Unlock()
+		cancel()
+		operationCtx, operationCancel = previousCtx, previousCancel
+	}
+}
+
+// cancelOperation aborts the docker calls of the operation in progress, and stops the creation of anything
+// by the next ones (e.g. by the code that was waiting for the aborted calls while the cleanup runs)
+func cancelOperation() {
+	operationMutex.Lock()
+	defer operationMutex.Unlock()
+	operationCancelled = true
+	operationCancel()
+}
+
+// checkOperation returns the error of the operation in progress once it timed out or was cancelled,
+// for the loops waiting for something to stop waiting, and before creating anything
+func checkOperation() error {
+	operationMutex.Lock()
+	cancelled := operationCancelled
+	operationMutex.Unlock()
+	if cancelled {
+		return fmt.Errorf("operation cancelled")
+	}
+	switch operationContext().Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timeout of the operation exceeded")
+	case context.Canceled:
+		return fmt.Errorf("operation cancelled")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package run
+
+/*
+ * The functions in this file pause the clusters (`k3d pause`): the processes of their containers are frozen
+ * with the cgroup freezer, releasing the CPU but keeping everything in memory, so unpausing is instant
+ * and nothing is lost, unlike stopping the containers.
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// pauseCluster pauses (or unpauses) the containers of a cluster: its nodes, their load balancer and sidecars,
+// and its dedicated registries (the registries shared with other clusters keep running)
+func pauseCluster(clusterName string, unpause bool) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the containers of cluster %s\n%+v", clusterName, err)
+	}
+
+	for _, c := range containers {
+		name := strings.TrimPrefix(c.Names[0], "/")
+		switch {
+		case unpause && c.State == "paused":
+			log.Printf("...Unpausing %s", name)
+			if err := docker.ContainerUnpause(ctx, c.ID); err != nil {
+				return fmt.Errorf(" Couldn't unpause container %s\n%+v", name, err)
+			}
+		case !unpause && c.State == "running":
+			log.Printf("...Pausing %s", name)
+			if err := docker.ContainerPause(ctx, c.ID); err != nil {
+				return fmt.Errorf(" Couldn't pause container %s\n%+v", name, err)
+			}
+		default:
+			log.Debugf("Skipping container %s (%s)", name, c.State)
+		}
+	}
+	return nil
+}
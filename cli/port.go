@@ -8,6 +8,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// largePortRange is the number of ports in a published range above which we warn the user:
+// docker runs a proxy process for every published port, so huge ranges slow down the container start
+const largePortRange = 1000
+
 // mapNodesToPortSpecs maps nodes to portSpecs
 func mapNodesToPortSpecs(specs []string, createdNodes []string) (map[string][]string, error) {
 
@@ -63,10 +67,14 @@ func CreatePublishedPorts(specs []string) (*PublishedPorts, error) {
 func validatePortSpecs(specs []string) error {
 	for _, spec := range specs {
 		atSplit := strings.Split(spec, "@")
-		_, err := nat.ParsePortSpec(atSplit[0])
+		// port ranges (like `8000-8010:8000-8010`) are expanded into one mapping per port
+		portMappings, err := nat.ParsePortSpec(atSplit[0])
 		if err != nil {
 			return fmt.Errorf("Invalid port specification [%s] in port mapping [%s]\n%+v", atSplit[0], spec, err)
 		}
+		if len(portMappings) > largePortRange {
+			log.Warningf("Port mapping [%s] publishes %d ports: the nodes may take a long time to start", spec, len(portMappings))
+		}
 		if len(atSplit) > 0 {
 			for i := 1; i < len(atSplit); i++ {
 				if err := ValidateHostname(atSplit[i]); err != nil {
@@ -105,9 +113,14 @@ func (p PublishedPorts) Offset(offset int) *PublishedPorts {
 	for k, v := range p.PortBindings {
 		bindings := make([]nat.PortBinding, len(v))
 		for i, b := range v {
-			port, _ := nat.ParsePort(b.HostPort)
 			bindings[i].HostIP = b.HostIP
-			bindings[i].HostPort = fmt.Sprintf("%d", port*offset)
+			// a host port range is kept when a single container port is published in any port of the range
+			start, end, _ := nat.ParsePortRange(b.HostPort)
+			if start != end {
+				bindings[i].HostPort = fmt.Sprintf("%d-%d", start*uint64(offset), start*uint64(offset)+end-start)
+				continue
+			}
+			bindings[i].HostPort = fmt.Sprintf("%d", int(start)*offset)
 		}
 		newPortBindings[k] = bindings
 	}
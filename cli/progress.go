@@ -0,0 +1,99 @@
+package run
+
+/*
+ * The functions in this file emit machine-readable progress events (`--progress-fd`),
+ * one JSON object per line, so other tools can follow long operations without parsing the logs.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressEvent is a line in the progress stream
+type progressEvent struct {
+	Time      string `json:"time"`
+	Operation string `json:"operation"`
+	Phase     string `json:"phase"`
+	Status    string `json:"status"` // started, completed or failed
+	Percent   int    `json:"percent"`
+	Error     string `json:"error,omitempty"`
+}
+
+// where the progress events are written (nil when disabled)
+var (
+	progressOutput io.Writer
+	progressMutex  sync.Mutex
+)
+
+// SetProgressFD enables the progress events, written to the file descriptor 'fd'
+// (opened by the caller, e.g. `k3d --progress-fd 3 create 3>progress.json`)
+func SetProgressFD(fd int) error {
+	if fd <= 2 {
+		return fmt.Errorf("Invalid progress file descriptor %d (stdin, stdout and stderr can't be used)", fd)
+	}
+	f := os.NewFile(uintptr(fd), "progress")
+	if f == nil {
+		return fmt.Errorf("Invalid progress file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("Progress file descriptor %d is not open\n%+v", fd, err)
+	}
+	progressOutput = f
+	return nil
+}
+
+// emitProgress writes an event to the progress stream, if enabled
+func emitProgress(event progressEvent) {
+	if progressOutput == nil {
+		return
+	}
+	event.Time = time.Now().Format(time.RFC3339)
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// the progress stream is best effort: a reader going away must not break the operation
+	_, _ = progressOutput.Write(append(line, '\n'))
+}
+
+// progress follows the phases of an operation: starting a phase completes the previous one
+type progress struct {
+	operation string
+	phase     string
+	percent   int
+}
+
+// newProgress starts following an operation (`create`, `delete`, `import`...)
+func newProgress(operation string) *progress {
+	return &progress{operation: operation}
+}
+
+// start completes the current phase and starts a new one, at the given percentage of the operation
+func (p *progress) start(phase string, percent int) {
+	if p.phase != "" {
+		emitProgress(progressEvent{Operation: p.operation, Phase: p.phase, Status: "completed", Percent: percent})
+	}
+	p.phase = phase
+	p.percent = percent
+	emitProgress(progressEvent{Operation: p.operation, Phase: phase, Status: "started", Percent: percent})
+}
+
+// finish completes the operation, or reports the error in the current phase
+func (p *progress) finish(err error) {
+	if err != nil {
+		emitProgress(progressEvent{Operation: p.operation, Phase: p.phase, Status: "failed", Percent: p.percent, Error: err.Error()})
+		return
+	}
+	if p.phase != "" {
+		emitProgress(progressEvent{Operation: p.operation, Phase: p.phase, Status: "completed", Percent: 100})
+	}
+	emitProgress(progressEvent{Operation: p.operation, Phase: "done", Status: "completed", Percent: 100})
+}
@@ -0,0 +1,149 @@
+package run
+
+/*
+ * The functions in this file remove what crashed k3d runs leave behind (`k3d prune`): the
+ * containers, networks and volumes labeled with a cluster that doesn't exist anymore (no node container of any
+ * role left), the helper containers not running and the registries not used by any cluster.
+ */
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// transientComponents are the containers k3d removes once their job is done, left behind by crashed runs only
+var transientComponents = map[string]bool{
+	"helper":       true,
+	"probe":        true,
+	"etcd-restore": true,
+	"tools":        true,
+}
+
+// nodeComponents are the containers keeping a cluster alive: the servers and the workers, including the
+// workers joined to a server not managed by k3d (`add-node --k3s`), whose cluster has no k3d server
+var nodeComponents = map[string]bool{
+	"server": true,
+	"worker": true,
+}
+
+// getClustersWithNodes returns the names of the clusters with a node container left
+func getClustersWithNodes(containers []types.Container) map[string]bool {
+	clusters := map[string]bool{}
+	for _, c := range containers {
+		if nodeComponents[c.Labels["component"]] && c.Labels["cluster"] != "" {
+			clusters[c.Labels["cluster"]] = true
+		}
+	}
+	return clusters
+}
+
+// isOrphan tells if k3d resources with these labels belong to a cluster that doesn't exist anymore
+func isOrphan(labels map[string]string, clustersWithNodes map[string]bool) bool {
+	name, ok := labels["cluster"]
+	if !ok || name == "" {
+		return false
+	}
+	return !clustersWithNodes[name]
+}
+
+// PruneOrphans removes the leftovers of clusters that don't exist anymore, keeping the existing clusters
+func PruneOrphans(c *cli.Context) error {
+	log.Println("Removing the leftovers of clusters that don't exist anymore")
+	pruned, err := pruneOrphans(c.Bool("keep-registry-volume"))
+	if err != nil {
+		return err
+	}
+	log.Infof("Removed %d leftovers", pruned)
+	return nil
+}
+
+// pruneOrphans removes the k3d containers, networks and volumes left behind by crashed runs,
+// returning the number of resources removed
+func pruneOrphans(keepRegistryVolume bool) (int, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	k3dFilter := filters.NewArgs()
+	k3dFilter.Add("label", "app=k3d")
+	pruned := 0
+
+	// the containers first, as they use the networks and the volumes
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: k3dFilter, All: true})
+	if err != nil {
+		return pruned, fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+	clusters := getClustersWithNodes(containers)
+	for _, c := range containers {
+		component := c.Labels["component"]
+		// the registries are kept while a cluster uses them, see below
+		if component == "registry" {
+			continue
+		}
+		transient := transientComponents[component] && c.State != "running"
+		if !transient && !isOrphan(c.Labels, clusters) {
+			continue
+		}
+		log.Printf("...Removing %s container %s", component, getNodeName(c))
+		if err := removeContainer(c.ID); err != nil {
+			log.Warningln(err)
+			continue
+		}
+		pruned++
+	}
+
+	registries, err := pruneOrphanRegistries(keepRegistryVolume)
+	pruned += len(registries)
+	if err != nil {
+		return pruned, err
+	}
+
+	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{Filters: k3dFilter})
+	if err != nil {
+		return pruned, fmt.Errorf(" Couldn't list networks\n%+v", err)
+	}
+	for _, n := range networks {
+		if !isOrphan(n.Labels, clusters) {
+			continue
+		}
+		log.Printf("...Removing network %s", n.Name)
+		cids, err := getContainersInNetwork(n.ID)
+		if err != nil {
+			log.Warningf("Couldn't list the containers of network %s\n%+v", n.Name, err)
+		}
+		for _, cid := range cids {
+			if err := disconnectContainerFromNetwork(cid, n.ID); err != nil {
+				log.Warningf("Couldn't disconnect container %s from network %s\n%+v", cid, n.Name, err)
+			}
+		}
+		if err := docker.NetworkRemove(ctx, n.ID); err != nil {
+			log.Warningf("Couldn't remove network %s\n%+v", n.Name, err)
+			continue
+		}
+		pruned++
+	}
+
+	volumes, err := docker.VolumeList(ctx, k3dFilter)
+	if err != nil {
+		return pruned, fmt.Errorf(" Couldn't list volumes\n%+v", err)
+	}
+	for _, vol := range volumes.Volumes {
+		// the data volumes hold user data, and the registry volumes go with their registry
+		if kind := getVolumeKind(vol); kind == "data" || kind == "registry" || !isOrphan(vol.Labels, clusters) {
+			continue
+		}
+		log.Printf("...Removing volume %s", vol.Name)
+		if err := deleteVolume(vol.Name); err != nil {
+			log.Warningln(err)
+			continue
+		}
+		pruned++
+	}
+	return pruned, nil
+}
@@ -0,0 +1,148 @@
+package run
+
+/*
+ * The functions in this file take care of creating imagePullSecrets
+ * in the clusters out of the credentials in the registries file.
+ */
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultPullSecretName is the name of the secret created with the registries credentials
+const defaultPullSecretName = "k3d-registry-credentials"
+
+// dockerConfigAuth is an entry in the `auths` section of a docker config.json
+type dockerConfigAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfigJSON is the content of a `kubernetes.io/dockerconfigjson` secret
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigAuth `json:"auths"`
+}
+
+// getRegistriesCredentials extracts the credentials from the `configs` section of a registries file
+func getRegistriesCredentials(registries *Registry) map[string]dockerConfigAuth {
+	credentials := map[string]dockerConfigAuth{}
+
+	for host, config := range registries.Configs {
+		if config.Auth == nil {
+			continue
+		}
+
+		auth := dockerConfigAuth{
+			Username:      config.Auth.Username,
+			Password:      config.Auth.Password,
+			Auth:          config.Auth.Auth,
+			IdentityToken: config.Auth.IdentityToken,
+		}
+		if auth.Auth == "" && auth.Username != "" {
+			auth.Auth = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		}
+		if auth.Auth == "" && auth.IdentityToken == "" {
+			continue
+		}
+		credentials[host] = auth
+	}
+
+	return credentials
+}
+
+// createPullSecrets creates a dockerconfigjson secret with the credentials in the registries file
+// in some namespaces, and adds it to the imagePullSecrets of the default ServiceAccount there
+func createPullSecrets(serverID string, spec *ClusterSpec, namespaces []string, timeoutSeconds int) error {
+	registries, err := loadRegistriesFile(spec.RegistriesFile, getRegistriesFileVars(spec))
+	if err != nil {
+		return err
+	}
+
+	credentials := getRegistriesCredentials(registries)
+	if len(credentials) == 0 {
+		log.Warnln("No registry credentials found in the registries file: no imagePullSecrets will be created")
+		return nil
+	}
+
+	dockerConfig, err := json.Marshal(dockerConfigJSON{Auths: credentials})
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		log.Printf("...Creating imagePullSecret %s in namespace %s", defaultPullSecretName, namespace)
+
+		// the default ServiceAccount is created asynchronously, along with the namespace
+		if namespace != defaultWorkloadNamespace {
+			if _, err := kubectl(serverID, "get", "namespace", namespace); err != nil {
+				if _, err := kubectl(serverID, "create", "namespace", namespace); err != nil {
+					return fmt.Errorf(" Couldn't create namespace %s\n%+v", namespace, err)
+				}
+			}
+		}
+		if err := waitForKubectl(serverID, timeoutSeconds, "get", "serviceaccount", "default", "--namespace", namespace); err != nil {
+			return err
+		}
+
+		// the credentials go through stdin, out of the command line (and of its errors), and applying the
+		// secret updates it when it exists already
+		if _, err := kubectlWithInput(serverID, getPullSecretManifest(namespace, dockerConfig), "apply", "-f", "-"); err != nil {
+			return fmt.Errorf(" Couldn't create secret %s in namespace %s\n%+v", defaultPullSecretName, namespace, err)
+		}
+
+		if err := addPullSecretToServiceAccount(serverID, namespace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPullSecretManifest returns the manifest of the dockerconfigjson secret with the credentials of the registries
+func getPullSecretManifest(namespace string, dockerConfig []byte) []byte {
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "kubernetes.io/dockerconfigjson",
+		"metadata": map[string]string{
+			"name":      defaultPullSecretName,
+			"namespace": namespace,
+		},
+		"data": map[string]string{
+			".dockerconfigjson": base64.StdEncoding.EncodeToString(dockerConfig),
+		},
+	})
+	return manifest
+}
+
+// addPullSecretToServiceAccount adds the secret to the imagePullSecrets of the default ServiceAccount of a
+// namespace, keeping the ones it has, unless it's there already
+func addPullSecretToServiceAccount(serverID string, namespace string) error {
+	out, err := kubectl(serverID, "get", "serviceaccount", "default", "--namespace", namespace, "--output", "jsonpath={.imagePullSecrets[*].name}")
+	if err != nil {
+		return fmt.Errorf(" Couldn't get the default ServiceAccount in namespace %s\n%+v", namespace, err)
+	}
+	names := strings.Fields(out)
+	for _, name := range names {
+		if name == defaultPullSecretName {
+			return nil
+		}
+	}
+
+	// a JSON patch can only append to the list when there is one
+	patch := fmt.Sprintf(`[{"op":"add","path":"/imagePullSecrets/-","value":{"name":"%s"}}]`, defaultPullSecretName)
+	if len(names) == 0 {
+		patch = fmt.Sprintf(`[{"op":"add","path":"/imagePullSecrets","value":[{"name":"%s"}]}]`, defaultPullSecretName)
+	}
+	if _, err := kubectl(serverID, "patch", "serviceaccount", "default", "--namespace", namespace, "--type", "json", "--patch", patch); err != nil {
+		return fmt.Errorf(" Couldn't add the imagePullSecret to the default ServiceAccount in namespace %s\n%+v", namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package run
+
+/*
+ * The functions in this file push local images to the k3d registry,
+ * tagging them with the registry address the nodes pull from.
+ */
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// pushMessage is a message in the progress stream of an image push
+type pushMessage struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// getRegistryImageReference returns the reference of a local image in a registry (`<registry>/<path>:<tag>`)
+func getRegistryImageReference(registryAddress string, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("Invalid image reference %q\n%+v", image, err)
+	}
+
+	// keep the short names of the images from the Docker Hub (`library/nginx` -> `nginx`)
+	imagePath := reference.Path(named)
+	if reference.Domain(named) == defaultDockerHubAddress {
+		imagePath = strings.TrimPrefix(imagePath, "library/")
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		return "", fmt.Errorf("Can't push image %s: use a tag instead of the digest %s", image, canonical.Digest())
+	}
+	tagged := reference.TagNameOnly(named).(reference.Tagged)
+
+	return fmt.Sprintf("%s/%s:%s", registryAddress, imagePath, tagged.Tag()), nil
+}
+
+// getClusterRegistryName returns the name of the registry container used by a cluster
+func getClusterRegistryName(clusterName string) (string, error) {
+	cid, err := getClusterRegistryContainer(clusterName)
+	if err != nil {
+		return "", err
+	}
+	if cid == "" {
+		return "", fmt.Errorf("No registry found for cluster %s", clusterName)
+	}
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return "", err
+	}
+	for _, registry := range registries {
+		if registry.ID == cid {
+			return getNodeName(registry), nil
+		}
+	}
+	return "", fmt.Errorf("No registry found for cluster %s", clusterName)
+}
+
+// pushImageToRegistry tags a local image with the address of a registry and pushes it there.
+// It returns the reference of the image in the registry, which can be used in the clusters.
+func pushImageToRegistry(registryName string, image string) (string, error) {
+	cid, err := getRegistryContainer(registryName)
+	if err != nil {
+		return "", err
+	}
+	if cid == "" {
+		return "", fmt.Errorf("No registry container %s found", registryName)
+	}
+
+	// the nodes pull from `<registry hostname>:<host port>`
+	hostname, err := getRegistryHostname(cid)
+	if err != nil {
+		return "", err
+	}
+	registryURL, err := getRegistryURL(cid)
+	if err != nil {
+		return "", err
+	}
+	_, port, err := net.SplitHostPort(registryURL.Host)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := getRegistryImageReference(fmt.Sprintf("%s:%s", hostname, port), image)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	log.Printf("...Tagging %s as %s", image, target)
+	if err := docker.ImageTag(ctx, image, target); err != nil {
+		return "", fmt.Errorf(" Couldn't tag image %s\n%+v", image, err)
+	}
+
+	log.Printf("...Pushing %s", target)
+	reader, err := docker.ImagePush(ctx, target, types.ImagePushOptions{
+		// the k3d registry doesn't use authentication, but the API requires some auth config
+		RegistryAuth: base64.URLEncoding.EncodeToString([]byte("{}")),
+	})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't push image %s\n%+v", target, err)
+	}
+	defer reader.Close()
+
+	// errors during the push are only reported in the progress stream
+	decoder := json.NewDecoder(reader)
+	for {
+		msg := pushMessage{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf(" Couldn't read the output of the push\n%+v", err)
+		}
+		if msg.Error != "" {
+			if registryURL.Scheme == "https" {
+				return "", fmt.Errorf(" Couldn't push image %s (make sure %s resolves to this machine and docker has the certificates of the registry in /etc/docker/certs.d/%s:%s)\n%s", target, hostname, hostname, port, msg.Error)
+			}
+			return "", fmt.Errorf(" Couldn't push image %s (make sure %s resolves to this machine and is an insecure registry in docker)\n%s", target, hostname, msg.Error)
+		}
+		log.Debugln(msg.Status)
+	}
+
+	return target, nil
+}
@@ -0,0 +1,154 @@
+package run
+
+/*
+ * The functions in this file check the readiness conditions of a new cluster given to `create --wait-for`,
+ * so that `create --wait` returns only once the cluster is actually usable: the API server reachable from the
+ * host, all the nodes Ready, and the rollouts of the components deployed by k3s (or of any workload) complete.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readinessComponents are the deployments of k3s which can be waited for by name
+var readinessComponents = map[string]string{
+	"coredns":        "deployment/coredns@kube-system",
+	"traefik":        "deployment/traefik@kube-system",
+	"metrics-server": "deployment/metrics-server@kube-system",
+}
+
+// readinessCondition is a condition to wait for: `api`, `nodes`, a component of k3s or a workload
+type readinessCondition struct {
+	name     string
+	workload *workload // nil for `api` and `nodes`
+}
+
+// parseReadinessConditions parses the values of --wait-for (comma separated or new flag per condition).
+// `all` is short for api, nodes and the components of k3s.
+func parseReadinessConditions(specs []string) ([]readinessCondition, error) {
+	names := []string{}
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if name == "all" {
+				names = append(names, "api", "nodes", "coredns", "traefik", "metrics-server")
+			} else if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	conditions := []readinessCondition{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		condition := readinessCondition{name: name}
+		switch {
+		case name == "api" || name == "nodes":
+		case readinessComponents[name] != "":
+			condition.workload, _ = parseWorkload(readinessComponents[name])
+		case strings.Contains(name, "/"):
+			w, err := parseWorkload(name)
+			if err != nil {
+				return nil, err
+			}
+			condition.workload = w
+		default:
+			return nil, fmt.Errorf("Invalid value for '--wait-for' [%s]: use api, nodes, coredns, traefik, metrics-server, all or `kind/name[@namespace]`", name)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// isComponentDisabled tells if a component of k3s is disabled by the arguments of the servers
+// (`--no-deploy traefik`, `--disable=traefik,metrics-server`, ...)
+func isComponentDisabled(serverArgs []string, component string) bool {
+	for i, arg := range serverArgs {
+		value := ""
+		for _, flag := range []string{"--no-deploy", "--disable"} {
+			if arg == flag && i+1 < len(serverArgs) {
+				value = serverArgs[i+1]
+			} else if strings.HasPrefix(arg, flag+"=") {
+				value = strings.TrimPrefix(arg, flag+"=")
+			}
+		}
+		for _, disabled := range strings.Split(value, ",") {
+			if strings.TrimSpace(disabled) == component {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitForAPIServer waits for the API server to answer at its URL in the kubeconfig of a cluster.
+// A timeout of 0 means waiting forever.
+func waitForAPIServer(clusterName string, timeoutSeconds int) error {
+	start := time.Now()
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	for {
+		kubeConfigPath, err := getKubeConfig(clusterName, false)
+		if err == nil {
+			var server string
+			if server, err = getKubeConfigServer(kubeConfigPath); err == nil {
+				if err = checkAPIServer(server); err == nil {
+					return nil
+				}
+			}
+		}
+		log.Debugf("API server of cluster %s not reachable yet: %+v", clusterName, err)
+		if err := checkOperation(); err != nil {
+			return err
+		}
+
+		if timeout != 0 && time.Now().After(start.Add(timeout)) {
+			return fmt.Errorf("timeout of %d seconds exceeded while waiting for the API server to be reachable\n%+v", timeoutSeconds, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// waitForReadiness waits for the readiness conditions of a new cluster, one after the other,
+// within a shared timeout (0 waits forever)
+func waitForReadiness(clusterName string, serverID string, serverArgs []string, conditions []readinessCondition, timeoutSeconds int) error {
+	deadline := time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+	remaining := func() int {
+		if timeoutSeconds == 0 {
+			return 0
+		}
+		// a timeout of 0 would wait forever: always try once more
+		if seconds := int(time.Until(deadline).Seconds()); seconds > 0 {
+			return seconds
+		}
+		return 1
+	}
+
+	for _, condition := range conditions {
+		var err error
+		switch {
+		case condition.name == "api":
+			log.Printf("Waiting for the API server of cluster %s to be reachable", clusterName)
+			err = waitForAPIServer(clusterName, remaining())
+		case condition.name == "nodes":
+			log.Printf("Waiting for the nodes of cluster %s to be ready", clusterName)
+			err = waitForNodesReady(serverID, remaining())
+		case readinessComponents[condition.name] != "" && isComponentDisabled(serverArgs, condition.name):
+			log.Printf("Not waiting for %s, disabled in cluster %s", condition.name, clusterName)
+		default:
+			log.Printf("Waiting for the rollout of %s in namespace %s", condition.workload.Resource, condition.workload.Namespace)
+			err = waitForWorkload(serverID, condition.workload, remaining())
+		}
+		if err != nil {
+			return fmt.Errorf("ERROR: cluster %s not ready (%s)\n%+v", clusterName, condition.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package run
+
+/*
+ * The functions in this file validate the registries files given by the users
+ * against the k3s schema, before copying them into the nodes.
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// validateRegistriesFile checks the content of a registries file against the k3s schema,
+// reporting the unknown fields and the wrong types with their line
+func validateRegistriesFile(filename string, content []byte) error {
+	registries := Registry{}
+	if err := yaml.UnmarshalStrict(content, &registries); err != nil {
+		return fmt.Errorf("Invalid registries file %s\n%+v", filename, err)
+	}
+
+	problems := []string{}
+	for name, mirror := range registries.Mirrors {
+		// k3s falls back to the registry itself, and to https for the endpoints without scheme
+		if len(mirror.Endpoints) == 0 {
+			log.Warningf("Registries file %s: mirrors.%s has no endpoint, the images are pulled from %s itself", filename, name, name)
+		}
+		for _, endpoint := range mirror.Endpoints {
+			if !strings.Contains(endpoint, "://") {
+				log.Warningf("Registries file %s: mirrors.%s.endpoint %q has no scheme, k3s uses https", filename, name, endpoint)
+				endpoint = "https://" + endpoint
+			}
+			if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				problems = append(problems, fmt.Sprintf("mirrors.%s.endpoint: %q is not an http(s) URL", name, endpoint))
+			}
+		}
+	}
+	for name, config := range registries.Configs {
+		if config.TLS != nil && (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+			problems = append(problems, fmt.Sprintf("configs.%s.tls: cert_file and key_file must be set together", name))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Invalid registries file %s\n  %s", filename, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
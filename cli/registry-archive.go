@@ -0,0 +1,140 @@
+package run
+
+/*
+ * The functions in this file export the storage of a registry to a tarball
+ * and import it back (in the same or in another machine), for seeding a cache.
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// isGzipFile checks if an archive must be compressed, from its name
+func isGzipFile(filename string) bool {
+	return strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".tgz")
+}
+
+// exportRegistry writes the storage of a registry to a tarball ('-' for stdout),
+// compressed with gzip when its name ends with `.gz` or `.tgz`
+func exportRegistry(name string, filename string) error {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// the archive contains the `registry` directory, with the storage of the registry
+	reader, _, err := docker.CopyFromContainer(ctx, cid, defaultRegistryMountPath)
+	if err != nil {
+		return fmt.Errorf(" Couldn't read the storage of registry %s\n%+v", name, err)
+	}
+	defer reader.Close()
+
+	var out io.Writer = os.Stdout
+	var f *os.File
+	if filename != "-" {
+		if f, err = os.Create(filename); err != nil {
+			return fmt.Errorf(" Couldn't create %s\n%+v", filename, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	var gz *gzip.Writer
+	if isGzipFile(filename) {
+		gz = gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+
+	if _, err := io.Copy(out, reader); err != nil {
+		return fmt.Errorf(" Couldn't write the registry archive\n%+v", err)
+	}
+	// the end of the compressed stream is only written when closing it
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf(" Couldn't write the registry archive\n%+v", err)
+		}
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf(" Couldn't write %s\n%+v", filename, err)
+		}
+	}
+	return nil
+}
+
+// importRegistry copies the contents of a tarball created by exportRegistry ('-' for stdin) into the storage
+// of a registry, and restarts the registry if running (so it doesn't serve stale metadata from its cache).
+// The existing images are kept, unless the archive contains the same repositories.
+func importRegistry(name string, filename string) error {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	var in io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf(" Couldn't open %s\n%+v", filename, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	// accept compressed archives whatever their name (e.g. when reading from stdin)
+	buffered := bufio.NewReader(in)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf(" Couldn't decompress %s\n%+v", filename, err)
+		}
+		defer gz.Close()
+		in = gz
+	} else {
+		in = buffered
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	if err := docker.CopyToContainer(ctx, cid, path.Dir(defaultRegistryMountPath), in, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't copy the archive into registry %s\n%+v", name, err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, cid)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect registry container %s\n%+v", name, err)
+	}
+	if registry.State.Running {
+		log.Printf("...Restarting registry %s", name)
+		if err := docker.ContainerRestart(ctx, cid, nil); err != nil {
+			return fmt.Errorf(" Couldn't restart registry %s\n%+v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package run
+
+/*
+ * The functions in this file take care of keeping the registry's
+ * pull-through cache warm with the images used in the clusters.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// media types accepted when fetching manifests from the registry
+var registryManifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// registryDescriptor is a reference to some content in the registry (a blob or a manifest)
+type registryDescriptor struct {
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	Platform struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+// registryManifest covers both image manifests and manifest lists (indexes)
+type registryManifest struct {
+	MediaType string               `json:"mediaType"`
+	Config    registryDescriptor   `json:"config"`
+	Layers    []registryDescriptor `json:"layers"`
+	Manifests []registryDescriptor `json:"manifests"`
+}
+
+// registryCacheAuth are the Docker Hub credentials used by the pull-through cache
+type registryCacheAuth struct {
+	Username string
+	Password string
+}
+
+// getRegistryCacheAuth gets the credentials for the pull-through cache from the command line flags
+// (or their environment variables), reading the password from a file if requested
+func getRegistryCacheAuth(c *cli.Context) (*registryCacheAuth, error) {
+	auth := &registryCacheAuth{
+		Username: c.String("registry-cache-user"),
+		Password: c.String("registry-cache-password"),
+	}
+
+	if c.IsSet("registry-cache-password-file") {
+		if auth.Password != "" {
+			return nil, fmt.Errorf("--registry-cache-password and --registry-cache-password-file are mutually exclusive")
+		}
+		content, err := ioutil.ReadFile(c.String("registry-cache-password-file"))
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't read the registry cache password file\n%+v", err)
+		}
+		auth.Password = strings.TrimSpace(string(content))
+	}
+
+	if auth.Username == "" && auth.Password == "" {
+		return nil, nil
+	}
+	if auth.Username == "" || auth.Password == "" {
+		return nil, fmt.Errorf("Both a user and a password are required for the registry cache credentials")
+	}
+	if c.IsSet("registry-config") {
+		return nil, fmt.Errorf("The registry cache credentials can't be used with --registry-config: put them in the `proxy` section of the configuration file")
+	}
+	return auth, nil
+}
+
+// defaultRegistryConfig is the configuration file of the registry image, which the credentials of the cache are added to
+const defaultRegistryConfig = `version: 0.1
+log:
+  fields:
+    service: registry
+storage:
+  cache:
+    blobdescriptor: inmemory
+  filesystem:
+    rootdirectory: /var/lib/registry
+http:
+  addr: :5000
+  headers:
+    X-Content-Type-Options: [nosniff]
+health:
+  storagedriver:
+    enabled: true
+    interval: 10s
+    threshold: 3
+`
+
+// getRegistryCacheConfig returns the configuration file of a cache pulling with credentials: they are written
+// into the registry container, instead of its environment shown by `docker inspect`
+func getRegistryCacheConfig(auth *registryCacheAuth) ([]byte, error) {
+	proxy, err := yaml.Marshal(map[string]map[string]string{
+		"proxy": {
+			"remoteurl": fmt.Sprintf("https://%s", defaultDockerRegistryHubAddress),
+			"username":  auth.Username,
+			"password":  auth.Password,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(defaultRegistryConfig), proxy...), nil
+}
+
+// getRegistryHostAddress returns the address where a registry container can be reached from the host
+func getRegistryHostAddress(ID string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	c, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+
+	internalPort := defaultRegistryPort
+	if port, ok := c.Config.Labels["internal-port"]; ok {
+		if internalPort, err = strconv.Atoi(port); err != nil {
+			return "", fmt.Errorf("invalid internal port label in registry container %s\n%+v", ID, err)
+		}
+	}
+
+	bindings := c.HostConfig.PortBindings[nat.Port(fmt.Sprintf("%d/tcp", internalPort))]
+	if len(bindings) == 0 {
+		return "", fmt.Errorf("registry container %s does not publish port %d", ID, internalPort)
+	}
+
+	host := bindings[0].HostIP
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+		if machineIP, err := getDockerMachineIp(); err == nil && machineIP != "" {
+			host = machineIP
+		}
+	}
+
+	return net.JoinHostPort(host, bindings[0].HostPort), nil
+}
+
+// isRegistryCache checks if a registry container is running as a pull-through cache
+func isRegistryCache(ID string) (bool, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	c, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+
+	for _, env := range c.Config.Env {
+		if strings.HasPrefix(env, "REGISTRY_PROXY_REMOTEURL=") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getClusterWorkloadImages returns the images used by the pods running in a cluster
+func getClusterWorkloadImages(clusterName string) ([]string, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := execInContainer(cluster.server.ID, []string{
+		"kubectl", "get", "pods", "--all-namespaces",
+		"-o", "jsonpath={.items[*].spec.initContainers[*].image} {.items[*].spec.containers[*].image}",
+	})
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't list the workload images in cluster %s\n%+v", clusterName, err)
+	}
+
+	images := []string{}
+	seen := map[string]bool{}
+	for _, image := range strings.Fields(out) {
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// refreshRegistryCache pulls some images through the registry cache at 'registry'.
+// Only images from the Docker Hub are cached, so any other image is skipped.
+func refreshRegistryCache(registry *registryAPI, images []string) error {
+	failed := 0
+	for _, image := range images {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			log.Warningf("Skipping invalid image reference %q: %+v", image, err)
+			continue
+		}
+		if reference.Domain(named) != defaultDockerHubAddress {
+			log.Debugf("Skipping %s: not an image from the Docker Hub", image)
+			continue
+		}
+
+		ref := ""
+		if canonical, ok := named.(reference.Canonical); ok {
+			ref = canonical.Digest().String()
+		} else if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+			ref = tagged.Tag()
+		}
+
+		log.Printf("...Refreshing %s", image)
+		if err := pullThroughRegistry(registry, reference.Path(named), ref); err != nil {
+			log.Warningf("Couldn't refresh %s in the registry cache\n%+v", image, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to refresh %d image(s) in the registry cache", failed)
+	}
+	return nil
+}
+
+// pullThroughRegistry fetches a manifest and all the blobs it references from the registry,
+// making a pull-through cache store them
+func pullThroughRegistry(registry *registryAPI, repository, ref string) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", registry.url, repository, ref), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestMediaTypes, ", "))
+
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q fetching manifest %s:%s", resp.Status, repository, ref)
+	}
+
+	manifest := registryManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return fmt.Errorf(" Couldn't decode manifest %s:%s\n%+v", repository, ref, err)
+	}
+
+	// a manifest list: only follow the manifests for the platform of the nodes
+	if len(manifest.Manifests) > 0 {
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				if err := pullThroughRegistry(registry, repository, m.Digest); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	blobs := append([]registryDescriptor{manifest.Config}, manifest.Layers...)
+	for _, blob := range blobs {
+		if blob.Digest == "" {
+			continue
+		}
+		if err := fetchRegistryBlob(registry, repository, blob.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchRegistryBlob downloads (and discards) a blob from the registry
+func fetchRegistryBlob(registry *registryAPI, repository, digest string) error {
+	resp, err := registry.client.Get(fmt.Sprintf("%s/v2/%s/blobs/%s", registry.url, repository, digest))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q fetching blob %s@%s", resp.Status, repository, digest)
+	}
+
+	// the cache only stores the blob once it has been read completely
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return fmt.Errorf(" Couldn't read blob %s@%s\n%+v", repository, digest, err)
+	}
+	return nil
+}
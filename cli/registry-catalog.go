@@ -0,0 +1,155 @@
+package run
+
+/*
+ * The functions in this file list the contents of a registry
+ * using its v2 catalog and tags API.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+)
+
+// registryCatalog is the response of the `/v2/_catalog` endpoint
+type registryCatalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// registryTags is the response of the `/v2/<repository>/tags/list` endpoint
+type registryTags struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// registryImage is a tag of a repository in the registry
+type registryImage struct {
+	Repository string
+	Tag        string
+	Digest     string
+	Size       int64
+}
+
+// getRegistryJSON gets some JSON from the API of a registry
+func getRegistryJSON(registry *registryAPI, apiPath string, accept []string, v interface{}) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, registry.url+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q getting %s", resp.Status, apiPath)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf(" Couldn't decode the response of %s\n%+v", apiPath, err)
+	}
+	return resp.Header, nil
+}
+
+// getRegistryImageSize returns the digest of a tag and the size of its image (config and layers).
+// For multi-platform images, the size is the one of the image for the platform of the nodes.
+func getRegistryImageSize(registry *registryAPI, repository, ref string) (string, int64, error) {
+	manifest := registryManifest{}
+	header, err := getRegistryJSON(registry, fmt.Sprintf("/v2/%s/manifests/%s", repository, ref), registryManifestMediaTypes, &manifest)
+	if err != nil {
+		return "", 0, err
+	}
+	digest := header.Get("Docker-Content-Digest")
+
+	if len(manifest.Manifests) > 0 {
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				_, size, err := getRegistryImageSize(registry, repository, m.Digest)
+				return digest, size, err
+			}
+		}
+		return digest, 0, nil
+	}
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return digest, size, nil
+}
+
+// getRegistryImages lists all the tags of all the repositories in a registry
+func getRegistryImages(registry *registryAPI) ([]registryImage, error) {
+	catalog := registryCatalog{}
+	if _, err := getRegistryJSON(registry, "/v2/_catalog?n=10000", nil, &catalog); err != nil {
+		return nil, fmt.Errorf(" Couldn't get the catalog of the registry\n%+v", err)
+	}
+
+	images := []registryImage{}
+	for _, repository := range catalog.Repositories {
+		tags := registryTags{}
+		if _, err := getRegistryJSON(registry, fmt.Sprintf("/v2/%s/tags/list", repository), nil, &tags); err != nil {
+			log.Warningf("Couldn't get the tags of %s\n%+v", repository, err)
+			continue
+		}
+
+		for _, tag := range tags.Tags {
+			digest, size, err := getRegistryImageSize(registry, repository, tag)
+			if err != nil {
+				log.Warningf("Couldn't get the manifest of %s:%s\n%+v", repository, tag, err)
+			}
+			images = append(images, registryImage{Repository: repository, Tag: tag, Digest: digest, Size: size})
+		}
+	}
+	return images, nil
+}
+
+// printRegistryImages prints the repositories and tags stored in a registry
+func printRegistryImages(name string) error {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	registry, err := getRegistryAPI(cid)
+	if err != nil {
+		return err
+	}
+
+	images, err := getRegistryImages(registry)
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("No images found in registry %s", name)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"REPOSITORY", "TAG", "DIGEST", "SIZE"})
+
+	for _, image := range images {
+		size := ""
+		if image.Size > 0 {
+			size = units.HumanSize(float64(image.Size))
+		}
+		table.Append([]string{image.Repository, image.Tag, image.Digest, size})
+	}
+
+	table.Render()
+	return nil
+}
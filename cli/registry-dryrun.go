@@ -0,0 +1,118 @@
+package run
+
+/*
+ * The functions in this file print what would be sent to docker for creating a registry
+ * (`k3d registry create --dry-run`), without creating anything.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"gopkg.in/yaml.v2"
+)
+
+// registryDryRun is everything printed by a dry run
+type registryDryRun struct {
+	Name             string                    `json:"name"`
+	Config           *container.Config         `json:"config"`
+	HostConfig       *container.HostConfig     `json:"hostConfig"`
+	NetworkingConfig *network.NetworkingConfig `json:"networkingConfig"`
+	// the registries.yaml written in the nodes of the clusters using the registry
+	RegistriesYAML string `json:"registriesYAML"`
+}
+
+// maskedSecret replaces the secrets in a dry run
+const maskedSecret = "***"
+
+// maskRegistrySpecSecrets returns a copy of the spec of a registry, with its secrets masked:
+// the password of the Docker Hub for the cache and the headers of the webhooks
+func maskRegistrySpecSecrets(spec ClusterSpec) ClusterSpec {
+	if spec.RegistryCacheAuth != nil {
+		spec.RegistryCacheAuth = &registryCacheAuth{Username: spec.RegistryCacheAuth.Username, Password: maskedSecret}
+	}
+	endpoints := []registryNotificationEndpoint{}
+	for _, endpoint := range spec.RegistryNotify {
+		if len(endpoint.Headers) > 0 {
+			headers := map[string][]string{}
+			for name := range endpoint.Headers {
+				headers[name] = []string{maskedSecret}
+			}
+			endpoint.Headers = headers
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	spec.RegistryNotify = endpoints
+	return spec
+}
+
+// maskRegistriesAuths masks the credentials in the `configs` section of a registries configuration
+func maskRegistriesAuths(registries *Registry) {
+	for host, config := range registries.Configs {
+		if config.Auth == nil {
+			continue
+		}
+		auth := *config.Auth
+		for _, secret := range []*string{&auth.Password, &auth.Auth, &auth.IdentityToken} {
+			if *secret != "" {
+				*secret = maskedSecret
+			}
+		}
+		config.Auth = &auth
+		registries.Configs[host] = config
+	}
+}
+
+// printRegistryDryRun prints the configuration of the container of a new registry (in json or yaml),
+// and the registries.yaml of the nodes using it, with their secrets masked
+func printRegistryDryRun(spec ClusterSpec, format string) error {
+	spec = maskRegistrySpecSecrets(spec)
+	config, hostConfig, networkingConfig, err := getRegistryContainerConfig(spec)
+	if err != nil {
+		return err
+	}
+
+	nodeSpec := spec
+	nodeSpec.RegistryEnabled = true
+	registries, err := getRegistriesConfig(&nodeSpec)
+	if err != nil {
+		return err
+	}
+	maskRegistriesAuths(registries)
+	registriesYAML, err := yaml.Marshal(registries)
+	if err != nil {
+		return err
+	}
+
+	dryRun := registryDryRun{
+		Name:             registryContainerName(spec.ClusterName, spec.RegistryPerCluster),
+		Config:           config,
+		HostConfig:       hostConfig,
+		NetworkingConfig: networkingConfig,
+		RegistriesYAML:   string(registriesYAML),
+	}
+	out, err := json.MarshalIndent(dryRun, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+	case "yaml":
+		// JSON is YAML: convert it for keeping the names of the docker API
+		var v interface{}
+		if err := yaml.Unmarshal(out, &v); err != nil {
+			return err
+		}
+		if out, err = yaml.Marshal(v); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid format [%s] (must be one of json or yaml)", format)
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
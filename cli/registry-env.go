@@ -0,0 +1,144 @@
+package run
+
+/*
+ * The functions in this file print the environment and the configuration snippets
+ * needed by the builders running on the host (docker buildx, podman, buildah...) for pushing to a registry.
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// formats of `k3d registry env`
+var registryEnvFormats = []string{"all", "env", "buildkit", "podman", "docker"}
+
+// registryEnv is what the builders on the host need to know for pushing to a registry
+type registryEnv struct {
+	Address  string   // `<hostname>:<host port>`, the address the nodes pull from
+	NoProxy  []string // hosts that must not go through a proxy
+	Hostname string   // hostname of the registry (`registry.localhost` by default)
+	TLS      bool     // the registry requires the client certificate of its CA (`--registry-mtls`)
+}
+
+// getRegistryURL returns the URL of the API of a registry container, reached from the host:
+// plain http, or https with mutual TLS
+func getRegistryURL(ID string) (*url.URL, error) {
+	api, err := getRegistryAPI(ID)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(api.url)
+}
+
+// getRegistryEnv gets the addresses of a registry from the state of its container
+func getRegistryEnv(name string) (*registryEnv, error) {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	if cid == "" {
+		return nil, fmt.Errorf("No registry container %s found", name)
+	}
+
+	hostname, err := getRegistryHostname(cid)
+	if err != nil {
+		return nil, err
+	}
+	registryURL, err := getRegistryURL(cid)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(registryURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	noProxy := []string{hostname}
+	for _, h := range []string{host, "localhost", "127.0.0.1"} {
+		if h != hostname && !contains(noProxy, h) {
+			noProxy = append(noProxy, h)
+		}
+	}
+
+	return &registryEnv{
+		Address:  net.JoinHostPort(hostname, port),
+		NoProxy:  noProxy,
+		Hostname: hostname,
+		TLS:      registryURL.Scheme == "https",
+	}, nil
+}
+
+// contains checks if a list of strings contains some value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// printRegistryEnv prints the environment variables and/or the configuration snippets for a registry.
+// The `env` format can be evaluated by a shell (`eval $(k3d registry env --format env)`).
+func printRegistryEnv(name string, format string) error {
+	if !contains(registryEnvFormats, format) {
+		return fmt.Errorf("Invalid format [%s] (must be one of %s)", format, strings.Join(registryEnvFormats, ", "))
+	}
+
+	env, err := getRegistryEnv(name)
+	if err != nil {
+		return err
+	}
+	all := format == "all"
+	noProxy := strings.Join(env.NoProxy, ",")
+
+	if all || format == "env" {
+		if all {
+			fmt.Printf("# Environment (`eval $(k3d registry env --format env)`)\n")
+		}
+		fmt.Printf("export K3D_REGISTRY=%s\n", env.Address)
+		fmt.Printf("export NO_PROXY=\"${NO_PROXY:+$NO_PROXY,}%s\"\n", noProxy)
+		fmt.Printf("export no_proxy=\"${no_proxy:+$no_proxy,}%s\"\n", noProxy)
+	}
+	// a registry with mutual TLS is trusted with its CA and client certificate (`~/.config/k3d/<cluster>/registry-tls`),
+	// copied where docker, podman and buildah look for them
+	dockerCertsDir := path.Join("/etc/docker/certs.d", env.Address)
+	if all || format == "buildkit" {
+		if all {
+			fmt.Printf("\n# docker buildx: buildkitd.toml (`docker buildx create --config buildkitd.toml --driver-opt env.no_proxy=%s`)\n", noProxy)
+		}
+		if env.TLS {
+			fmt.Printf("[registry.%q]\n  ca = [%q]\n  [[registry.%q.keypair]]\n    key = %q\n    cert = %q\n", env.Address,
+				path.Join(dockerCertsDir, registryTLSCAFile), env.Address, path.Join(dockerCertsDir, registryTLSClientKeyFile), path.Join(dockerCertsDir, registryTLSClientCertFile))
+		} else {
+			fmt.Printf("[registry.%q]\n  http = true\n  insecure = true\n", env.Address)
+		}
+	}
+	if all || format == "podman" {
+		if all {
+			fmt.Printf("\n# podman and buildah: /etc/containers/registries.conf (or ~/.config/containers/registries.conf)\n")
+		}
+		if env.TLS {
+			fmt.Printf("# the certificates go to %s\n", path.Join("/etc/containers/certs.d", env.Address))
+		}
+		fmt.Printf("[[registry]]\nlocation = %q\ninsecure = %t\n", env.Address, !env.TLS)
+	}
+	if all || format == "docker" {
+		if env.TLS {
+			if all {
+				fmt.Printf("\n# docker: the certificates go to %s\n", dockerCertsDir)
+			}
+			fmt.Printf("sudo mkdir -p %s && sudo cp ~/.config/k3d/<cluster>/registry-tls/* %s/\n", dockerCertsDir, dockerCertsDir)
+		} else {
+			if all {
+				fmt.Printf("\n# docker: /etc/docker/daemon.json (only needed when %s doesn't resolve to 127.0.0.1)\n", env.Hostname)
+			}
+			fmt.Printf("{\n  \"insecure-registries\": [%q]\n}\n", env.Address)
+		}
+	}
+	return nil
+}
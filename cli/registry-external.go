@@ -0,0 +1,154 @@
+package run
+
+/*
+ * The functions in this file adopt registries not managed by k3d (`--registry-use`):
+ * a running registry container connected to the cluster network, or a remote registry URL.
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// isRegistryURL checks if a `--registry-use` value is the URL of a remote registry (instead of a container name)
+func isRegistryURL(registry string) bool {
+	return strings.HasPrefix(registry, "http://") || strings.HasPrefix(registry, "https://")
+}
+
+// adoptRegistry connects a running registry container to the network of a cluster, and fills the
+// registry name and ports of the spec with the ones of the container. Remote registries are only validated.
+func adoptRegistry(spec *ClusterSpec) error {
+	if isRegistryURL(spec.RegistryUse) {
+		u, err := url.Parse(spec.RegistryUse)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid registry URL [%s]", spec.RegistryUse)
+		}
+		log.Printf("Using the remote registry %s", u.Host)
+		return nil
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, spec.RegistryUse)
+	if err != nil {
+		return fmt.Errorf(" Couldn't find the registry container %s\n%+v", spec.RegistryUse, err)
+	}
+	if !registry.State.Running {
+		return fmt.Errorf("Registry container %s is not running", spec.RegistryUse)
+	}
+	name := strings.TrimPrefix(registry.Name, "/")
+
+	// the registry listens on a port exposed by the container (5000 preferred), and is published on some host port
+	spec.RegistryName = name
+	spec.RegistryInternalPort = 0
+	spec.RegistryPort = 0
+	for port := range registry.Config.ExposedPorts {
+		if port.Proto() == "tcp" && (spec.RegistryInternalPort == 0 || port.Int() == defaultRegistryPort) {
+			spec.RegistryInternalPort = port.Int()
+		}
+	}
+	if spec.RegistryInternalPort == 0 {
+		spec.RegistryInternalPort = defaultRegistryPort
+	}
+	for port, bindings := range registry.HostConfig.PortBindings {
+		if port.Int() == spec.RegistryInternalPort && len(bindings) > 0 {
+			if spec.RegistryPort, err = strconv.Atoi(bindings[0].HostPort); err != nil {
+				return fmt.Errorf("Invalid host port %q published by registry container %s", bindings[0].HostPort, name)
+			}
+		}
+	}
+	if spec.RegistryPort == 0 {
+		spec.RegistryPort = spec.RegistryInternalPort
+	}
+
+	netName := k3dNetworkName(spec.ClusterName)
+	if _, connected := registry.NetworkSettings.Networks[netName]; !connected {
+		log.Printf("Connecting the registry container %s to the '%s' network...", name, netName)
+		if err := connectContainerToNetwork(registry.ID, netName, []string{name}); err != nil {
+			return fmt.Errorf(" Couldn't connect the registry container %s to the '%s' network\n%+v", name, netName, err)
+		}
+	}
+	return nil
+}
+
+// getExternalRegistryMirrors returns the mirror entries for an adopted registry.
+// Images of a registry container can be referenced by its name or (like kind does) by `localhost:<host port>`.
+func getExternalRegistryMirrors(spec *ClusterSpec) map[string]Mirror {
+	if isRegistryURL(spec.RegistryUse) {
+		u, _ := url.Parse(spec.RegistryUse)
+		return map[string]Mirror{
+			u.Host: {Endpoints: []string{fmt.Sprintf("%s://%s", u.Scheme, u.Host)}},
+		}
+	}
+	mirror := Mirror{Endpoints: []string{fmt.Sprintf("http://%s:%d", spec.RegistryName, spec.RegistryInternalPort)}}
+	return map[string]Mirror{
+		fmt.Sprintf("%s:%d", spec.RegistryName, spec.RegistryPort): mirror,
+		fmt.Sprintf("localhost:%d", spec.RegistryPort):             mirror,
+	}
+}
+
+// well-known names of the registry containers created by other local cluster tools
+var knownLocalRegistryNames = []string{"kind-registry", "registry.localhost", "registry"}
+
+// detectLocalRegistry looks for a running registry container not managed by k3d:
+// one with a well-known name (like kind's `kind-registry`), or any container running the `registry` image
+func detectLocalRegistry() (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+
+	candidates := []string{}
+	for _, c := range containers {
+		if c.Labels["app"] == "k3d" || len(c.Names) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(c.Names[0], "/")
+		for _, known := range knownLocalRegistryNames {
+			if name == known {
+				return name, nil
+			}
+		}
+		if named, err := reference.ParseNormalizedNamed(c.Image); err == nil && reference.FamiliarName(named) == "registry" {
+			candidates = append(candidates, name)
+		}
+	}
+
+	if len(candidates) > 1 {
+		log.Warnf("Found several registry containers %v: adopting %s (use --registry-use for choosing another one)", candidates, candidates[0])
+	}
+	if len(candidates) > 0 {
+		return candidates[0], nil
+	}
+	return "", nil
+}
+
+// releaseExternalRegistry disconnects an adopted registry container from the network of a cluster (without removing it)
+func releaseExternalRegistry(clusterName string, registry string) error {
+	if registry == "" || isRegistryURL(registry) {
+		return nil
+	}
+	nid, err := getClusterNetwork(clusterName)
+	if err != nil {
+		return err
+	}
+	log.Printf("...Disconnecting the registry container %s from the network", registry)
+	return disconnectContainerFromNetwork(registry, nid)
+}
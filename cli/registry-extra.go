@@ -0,0 +1,220 @@
+package run
+
+/*
+ * The functions in this file manage the additional registries of a cluster (`--add-registry`):
+ * dedicated registries (e.g. a pull-through cache next to a writable private registry) created along with
+ * the cluster, each with its own container and volume, and all of them in the registries configuration of the nodes.
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// label of the additional registries, telling them apart from the registry of the cluster
+const extraRegistryLabel = "extra-registry"
+
+// extraRegistry is an additional registry of a cluster
+type extraRegistry struct {
+	Name  string
+	Port  int
+	Cache bool // a pull-through cache of the Docker Hub
+}
+
+// parseExtraRegistries parses the `--add-registry` values (Format: `<name>:<port>[:cache]`)
+func parseExtraRegistries(specs []string) ([]extraRegistry, error) {
+	registries := []extraRegistry{}
+	names := map[string]bool{}
+	ports := map[int]bool{}
+	for _, spec := range specs {
+		split := strings.Split(spec, ":")
+		if len(split) < 2 || len(split) > 3 || split[0] == "" || (len(split) == 3 && split[2] != "cache") {
+			return nil, fmt.Errorf("Invalid registry [%s] (Format: <name>:<port>[:cache])", spec)
+		}
+		port, err := parseRegistryPort(split[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port of registry [%s]\n%+v", spec, err)
+		}
+		if port == 0 {
+			return nil, fmt.Errorf("Invalid port of registry [%s]: the additional registries need a fixed port", spec)
+		}
+		if names[split[0]] || ports[port] {
+			return nil, fmt.Errorf("Registry [%s] has the same name or port as another registry", spec)
+		}
+		names[split[0]] = true
+		ports[port] = true
+		registries = append(registries, extraRegistry{Name: split[0], Port: port, Cache: len(split) == 3})
+	}
+	return registries, nil
+}
+
+// clusterContainerRoles are the roles in the names of the containers k3d creates for a cluster (`k3d-<cluster>-<role>`),
+// the indexed ones having several containers (`k3d-<cluster>-<role>-<index>`, e.g. the workers added later with add-node)
+var clusterContainerRoles = map[string]bool{
+	"server":        true,
+	"worker":        true,
+	"serverlb":      false,
+	"registry":      false,
+	"status":        false,
+	"etcd-restore":  false,
+	"etcd-rejoin":   false,
+	"reset":         false,
+	"restore":       false,
+	"rename":        false,
+	"volume-filter": false,
+}
+
+// isClusterContainerRole checks if the name of an additional registry would give its container the name
+// of another container of the cluster, existing or created later
+func isClusterContainerRole(name string) bool {
+	if strings.HasPrefix(name, "probe-") {
+		return true
+	}
+	for role, indexed := range clusterContainerRoles {
+		if name == role {
+			return true
+		}
+		if index := strings.TrimPrefix(name, role+"-"); indexed && index != name {
+			if _, err := strconv.Atoi(index); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateExtraRegistries checks that the additional registries don't clash with the registry of the cluster,
+// nor with the names of the other containers of the cluster
+func validateExtraRegistries(spec *ClusterSpec) error {
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	for _, r := range spec.ExtraRegistries {
+		containerName := extraRegistryContainerName(spec.ClusterName, r.Name)
+		if isClusterContainerRole(r.Name) {
+			return fmt.Errorf("Registry %s would have the name of another container of the cluster (%s): choose another name", r.Name, containerName)
+		}
+		if _, err := docker.ContainerInspect(operationContext(), containerName); err == nil {
+			return fmt.Errorf("Registry %s would have the name of the existing container %s: choose another name", r.Name, containerName)
+		} else if !client.IsErrNotFound(err) {
+			return fmt.Errorf(" Couldn't check the name of registry %s\n%+v", r.Name, err)
+		}
+		if !spec.RegistryEnabled {
+			continue
+		}
+		if r.Name == spec.RegistryName || r.Port == spec.RegistryPort {
+			return fmt.Errorf("Registry %s:%d has the same name or port as the registry of the cluster (%s:%d)", r.Name, r.Port, spec.RegistryName, spec.RegistryPort)
+		}
+	}
+	return nil
+}
+
+// extraRegistryContainerName returns the name of the container of an additional registry
+func extraRegistryContainerName(clusterName string, registryName string) string {
+	return fmt.Sprintf("%s-%s-%s", defaultContainerNamePrefix, clusterName, registryName)
+}
+
+// getExtraRegistrySpec returns the spec of an additional registry: a dedicated registry with its own volume,
+// sharing the image, the pull policy, the bind addresses and the restart policy of the cluster
+func getExtraRegistrySpec(spec *ClusterSpec, r extraRegistry) ClusterSpec {
+	containerName := extraRegistryContainerName(spec.ClusterName, r.Name)
+	registrySpec := ClusterSpec{
+		AutoRestart:          spec.AutoRestart,
+		ClusterName:          spec.ClusterName,
+		PullPolicy:           spec.PullPolicy,
+		RegistryBindIPs:      spec.RegistryBindIPs,
+		RegistryCacheEnabled: r.Cache,
+		RegistryContainer:    containerName,
+		RegistryEnabled:      true,
+		RegistryImage:        spec.RegistryImage,
+		RegistryLabels:       []string{extraRegistryLabel + "=true"},
+		RegistryName:         r.Name,
+		RegistryPerCluster:   true,
+		RegistryPort:         r.Port,
+		RegistryPrivileged:   spec.RegistryPrivileged,
+		RegistryRestart:      spec.RegistryRestart,
+		RegistryVolume:       containerName + "-data",
+		RestartPolicy:        spec.RestartPolicy,
+	}
+	if r.Cache {
+		registrySpec.RegistryCacheAuth = spec.RegistryCacheAuth
+	}
+	return registrySpec
+}
+
+// createExtraRegistries creates the additional registries of a cluster, and waits for them to be ready
+func createExtraRegistries(spec *ClusterSpec, readyTimeout int) error {
+	names := []string{}
+	for _, r := range spec.ExtraRegistries {
+		registryID, err := createRegistry(getExtraRegistrySpec(spec, r))
+		if err != nil {
+			return err
+		}
+		log.Printf("Waiting for the registry %s to be ready...", r.Name)
+		if err := waitForRegistryReady(registryID, readyTimeout); err != nil {
+			return err
+		}
+		names = append(names, r.Name)
+	}
+
+	registryImage := spec.RegistryImage
+	if registryImage == "" {
+		registryImage = defaultRegistryImage
+	}
+	log.Printf("Waiting for %v to be resolvable in the cluster network...", names)
+	return waitForNetworkAliases(spec.ClusterName, registryImage, names, defaultNetworkReadyTimeout)
+}
+
+// addExtraRegistryMirrors adds the additional registries to the registries configuration of the nodes:
+// each registry is a mirror of itself, and the caches are mirrors of the Docker Hub
+func addExtraRegistryMirrors(privRegistries *Registry, spec *ClusterSpec) {
+	if len(spec.ExtraRegistries) > 0 && len(privRegistries.Mirrors) == 0 {
+		privRegistries.Mirrors = map[string]Mirror{}
+	}
+	for _, r := range spec.ExtraRegistries {
+		registrySpec := getExtraRegistrySpec(spec, r)
+		endpoint := fmt.Sprintf("%s://%s:%d", registryScheme(&registrySpec), r.Name, defaultRegistryPort)
+		externalAddress := fmt.Sprintf("%s:%d", r.Name, r.Port)
+		privRegistries.Mirrors[externalAddress] = withRewrites(Mirror{
+			Endpoints: []string{endpoint},
+		}, privRegistries.Mirrors[externalAddress], spec.RegistryRewrite)
+
+		if r.Cache {
+			mirror := privRegistries.Mirrors[defaultDockerHubAddress]
+			mirror.Endpoints = append(mirror.Endpoints, endpoint)
+			privRegistries.Mirrors[defaultDockerHubAddress] = withRewrites(mirror, mirror, spec.RegistryRewrite)
+		}
+	}
+}
+
+// removeExtraRegistries removes the additional registries of a cluster (and their volumes, unless kept)
+func removeExtraRegistries(clusterName string, keepRegistryVolume bool) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", "component=registry")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	cFilter.Add("label", extraRegistryLabel+"=true")
+	registries, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the registries of cluster %s\n%+v", clusterName, err)
+	}
+	for _, registry := range registries {
+		if err := removeRegistry(registry.ID, keepRegistryVolume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package run
+
+/*
+ * The functions in this file configure the notification endpoints of the registry,
+ * so some webhooks are called when images are pushed to (or pulled from) the registry.
+ * (see https://docs.docker.com/registry/notifications/)
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// actions the registry sends notifications for
+var registryNotificationActions = []string{"push", "pull", "mount", "delete"}
+
+// default events notified when not specified
+const defaultRegistryNotificationEvents = "push"
+
+// registryNotificationEndpoint is an entry in the `notifications.endpoints` section of the registry configuration
+type registryNotificationEndpoint struct {
+	Name      string              `yaml:"name"`
+	URL       string              `yaml:"url"`
+	Headers   map[string][]string `yaml:"headers,omitempty"`
+	Timeout   string              `yaml:"timeout"`
+	Threshold int                 `yaml:"threshold"`
+	Backoff   string              `yaml:"backoff"`
+	Ignore    struct {
+		Actions []string `yaml:"actions,omitempty"`
+	} `yaml:"ignore,omitempty"`
+}
+
+// parseRegistryNotifications creates the notification endpoints for some webhook URLs.
+// The headers (with the format `Name: value`) and the events (a comma-separated list of actions)
+// are the same for all the endpoints.
+func parseRegistryNotifications(urls []string, headers []string, events string) ([]registryNotificationEndpoint, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	headersMap := map[string][]string{}
+	for _, header := range headers {
+		split := strings.SplitN(header, ":", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			return nil, fmt.Errorf("Invalid notification header [%s]: the format is `Name: value`", header)
+		}
+		name := strings.TrimSpace(split[0])
+		headersMap[name] = append(headersMap[name], strings.TrimSpace(split[1]))
+	}
+
+	if events == "" {
+		events = defaultRegistryNotificationEvents
+	}
+	notified := map[string]bool{}
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		valid := false
+		for _, action := range registryNotificationActions {
+			if event == action {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid notification event [%s]: must be one of %v", event, registryNotificationActions)
+		}
+		notified[event] = true
+	}
+
+	endpoints := []registryNotificationEndpoint{}
+	for i, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("Invalid notification URL [%s]: must be an http(s) URL", u)
+		}
+
+		endpoint := registryNotificationEndpoint{
+			Name:      fmt.Sprintf("k3d-webhook-%d", i),
+			URL:       u,
+			Timeout:   "1s",
+			Threshold: 5,
+			Backoff:   "1s",
+		}
+		if len(headersMap) > 0 {
+			endpoint.Headers = headersMap
+		}
+		for _, action := range registryNotificationActions {
+			if !notified[action] {
+				endpoint.Ignore.Actions = append(endpoint.Ignore.Actions, action)
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// registryNotificationsEnv returns the environment variable for configuring the notification endpoints in the registry.
+// The registry parses the values of the configuration overrides as YAML, so the whole list can be set at once.
+func registryNotificationsEnv(endpoints []registryNotificationEndpoint) (string, error) {
+	d, err := yaml.Marshal(endpoints)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("REGISTRY_NOTIFICATIONS_ENDPOINTS=%s", string(d)), nil
+}
@@ -0,0 +1,70 @@
+package run
+
+/*
+ * The functions in this file simulate an outage of a registry (`k3d registry outage`),
+ * for checking that the nodes fail over to the next endpoints of their mirrors.
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// failoverMirror returns a mirror trying the local registry first, and the upstream registry when it doesn't answer
+func failoverMirror(registryEndpoint string, upstream string) Mirror {
+	return Mirror{
+		Endpoints: []string{
+			registryEndpoint,
+			fmt.Sprintf("https://%s", upstream),
+		},
+	}
+}
+
+// simulateRegistryOutage stops a registry for some time, starting it again afterwards (or when interrupted)
+func simulateRegistryOutage(name string, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("Invalid outage duration [%s]", duration)
+	}
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// catch the interrupts before stopping the registry: it must always be started again
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	log.Printf("...Stopping registry %s for %s", name, duration)
+	if err := docker.ContainerStop(ctx, cid, nil); err != nil {
+		return fmt.Errorf(" Couldn't stop registry %s\n%+v", name, err)
+	}
+
+	select {
+	case <-time.After(duration):
+	case sig := <-signals:
+		log.Printf("Got %s: ending the outage", sig)
+	}
+
+	log.Printf("...Starting registry %s", name)
+	if err := docker.ContainerStart(ctx, cid, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't start registry %s (start it with `docker start %s`)\n%+v", name, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package run
+
+/*
+ * The functions in this file keep the storage of a registry under a size quota,
+ * deleting the least recently pulled images and running the garbage collector.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+)
+
+// path of the blobs in the storage of the registry
+const registryBlobsPath = "/var/lib/registry/docker/registry/v2/blobs"
+
+// registryManifestUsage is a manifest in the registry, with the last time it was pulled
+type registryManifestUsage struct {
+	Repository string
+	Digest     string
+	Tags       []string
+	Size       int64
+	LastAccess int64 // unix time
+}
+
+// parseRegistryMaxSize parses a size quota like `10GB` (an empty value means no quota)
+func parseRegistryMaxSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	bytes, err := units.FromHumanSize(size)
+	if err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("Invalid registry max size [%s] (use something like `10GB`)", size)
+	}
+	return bytes, nil
+}
+
+// validateRegistryMaxSize rejects a size quota on a pull-through cache: a proxy registry refuses the
+// deletes of `k3d registry prune` (it expires what it cached by itself, a week after caching it)
+func validateRegistryMaxSize(maxSize int64, cache bool) error {
+	if maxSize > 0 && cache {
+		return fmt.Errorf("A size quota is not supported on cache registries: they don't allow deleting images, and expire the cached ones by themselves")
+	}
+	return nil
+}
+
+// getRegistryMaxSize returns the size quota a registry container was created with (0 if it has none)
+func getRegistryMaxSize(labels map[string]string) (int64, error) {
+	maxSize, ok := labels["max-size"]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(maxSize, 10, 64)
+}
+
+// registryBlobDataPath returns the path of the data of a blob in the storage of the registry
+func registryBlobDataPath(digest string) (string, error) {
+	split := strings.SplitN(digest, ":", 2)
+	if len(split) != 2 || len(split[1]) < 2 {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return path.Join(registryBlobsPath, split[0], split[1][:2], split[1], "data"), nil
+}
+
+// getRegistryManifestsUsage lists the manifests in a registry, with the time they were last pulled
+// (obtained from the access time of the manifests in the registry storage)
+func getRegistryManifestsUsage(ID string, registry *registryAPI) ([]*registryManifestUsage, error) {
+	images, err := getRegistryImages(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := map[string]*registryManifestUsage{}
+	paths := map[string]string{}
+	for _, image := range images {
+		if image.Digest == "" {
+			continue
+		}
+		key := image.Repository + "@" + image.Digest
+		if m, ok := manifests[key]; ok {
+			m.Tags = append(m.Tags, image.Tag)
+			continue
+		}
+		dataPath, err := registryBlobDataPath(image.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifests[key] = &registryManifestUsage{Repository: image.Repository, Digest: image.Digest, Tags: []string{image.Tag}, Size: image.Size}
+		paths[dataPath] = image.Digest
+	}
+	if len(manifests) == 0 {
+		return nil, nil
+	}
+
+	// stat all the manifests at once (missing files are just skipped)
+	statPaths := []string{}
+	for p := range paths {
+		statPaths = append(statPaths, p)
+	}
+	out, err := execInContainer(ID, []string{"sh", "-c", fmt.Sprintf("stat -c '%%X %%n' %s 2>/dev/null; true", strings.Join(statPaths, " "))})
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't get the access times of the manifests\n%+v", err)
+	}
+	accessTimes := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		atime, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		accessTimes[paths[fields[1]]] = atime
+	}
+
+	usage := []*registryManifestUsage{}
+	for _, m := range manifests {
+		m.LastAccess = accessTimes[m.Digest]
+		usage = append(usage, m)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].LastAccess < usage[j].LastAccess
+	})
+	return usage, nil
+}
+
+// deleteRegistryManifest deletes a manifest (and all the tags pointing to it) using the registry API
+func deleteRegistryManifest(registry *registryAPI, repository string, digest string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v2/%s/manifests/%s", registry.url, repository, digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("the registry doesn't allow deleting images (it must be created with a max size)")
+	}
+	return fmt.Errorf("unexpected status %q deleting %s@%s", resp.Status, repository, digest)
+}
+
+// pruneRegistry deletes the least recently pulled images of a registry until its storage is under 'maxSize' bytes
+// (or the quota the registry was created with, when 0), and returns the space reclaimed (in KiB)
+func pruneRegistry(name string, maxSize int64, dryRun bool) (int, error) {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return 0, err
+	}
+	if cid == "" {
+		return 0, fmt.Errorf("No registry container %s found", name)
+	}
+	cache, err := isRegistryCache(cid)
+	if err != nil {
+		return 0, err
+	}
+	if cache {
+		return 0, fmt.Errorf("Pruning is not supported on cache registries: registry %s is a pull-through cache, which doesn't allow deleting images and expires the cached ones by itself", name)
+	}
+
+	if maxSize == 0 {
+		registries, err := getRegistryContainers()
+		if err != nil {
+			return 0, err
+		}
+		for _, registry := range registries {
+			if registry.ID == cid {
+				if maxSize, err = getRegistryMaxSize(registry.Labels); err != nil {
+					return 0, fmt.Errorf("invalid max-size label in registry %s\n%+v", name, err)
+				}
+			}
+		}
+	}
+	if maxSize == 0 {
+		return 0, fmt.Errorf("Registry %s has no max size: use --max-size", name)
+	}
+
+	sizeKiB, err := getRegistryStorageSize(cid)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't get the size of the registry storage\n%+v", err)
+	}
+	excess := int64(sizeKiB)*1024 - maxSize
+	if excess <= 0 {
+		log.Printf("...The registry uses %s of %s: nothing to prune", units.HumanSize(float64(sizeKiB)*1024), units.HumanSize(float64(maxSize)))
+		return 0, nil
+	}
+	log.Printf("...The registry uses %s of %s: pruning at least %s", units.HumanSize(float64(sizeKiB)*1024), units.HumanSize(float64(maxSize)), units.HumanSize(float64(excess)))
+
+	registry, err := getRegistryAPI(cid)
+	if err != nil {
+		return 0, err
+	}
+	manifests, err := getRegistryManifestsUsage(cid, registry)
+	if err != nil {
+		return 0, err
+	}
+
+	// the sizes of the images are an estimation: the layers can be shared by several images
+	for _, m := range manifests {
+		if excess <= 0 {
+			break
+		}
+		log.Printf("...Deleting %s:%s (%s)", m.Repository, strings.Join(m.Tags, ","), units.HumanSize(float64(m.Size)))
+		if !dryRun {
+			if err := deleteRegistryManifest(registry, m.Repository, m.Digest); err != nil {
+				return 0, fmt.Errorf(" Couldn't delete %s@%s\n%+v", m.Repository, m.Digest, err)
+			}
+		}
+		excess -= m.Size
+	}
+
+	if dryRun {
+		return 0, nil
+	}
+	return garbageCollectRegistry(name, false, false)
+}
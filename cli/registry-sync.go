@@ -0,0 +1,337 @@
+package run
+
+/*
+ * The functions in this file copy the contents of a k3d registry to a remote registry (`k3d registry sync`),
+ * e.g. for promoting the images built and tested locally: the manifests and the blobs are copied
+ * with the v2 API of the registries, without going through the docker daemon.
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registrySyncTarget is the remote registry the images are copied to
+type registrySyncTarget struct {
+	Scheme   string
+	Host     string
+	Prefix   string // repository prefix of the copied images (e.g. `team/staging`)
+	Username string
+	Password string
+
+	authorizations map[string]string // Authorization header, by repository
+}
+
+// parseRegistrySyncTarget parses the destination of `k3d registry sync` (Format: `<host>[:<port>][/<prefix>]`)
+func parseRegistrySyncTarget(dest string, insecure bool) (*registrySyncTarget, error) {
+	target := &registrySyncTarget{Scheme: "https", authorizations: map[string]string{}}
+	if insecure || strings.HasPrefix(dest, "http://") {
+		target.Scheme = "http"
+	}
+	dest = strings.TrimPrefix(strings.TrimPrefix(dest, "https://"), "http://")
+	split := strings.SplitN(strings.Trim(dest, "/"), "/", 2)
+	if split[0] == "" {
+		return nil, fmt.Errorf("Invalid destination [%s] (Format: <host>[:<port>][/<prefix>])", dest)
+	}
+	target.Host = split[0]
+	if len(split) == 2 {
+		target.Prefix = split[1]
+	}
+	return target, nil
+}
+
+// repository returns the name of a repository of the local registry in the remote registry
+func (t *registrySyncTarget) repository(repository string) string {
+	if t.Prefix == "" {
+		return repository
+	}
+	return t.Prefix + "/" + repository
+}
+
+// parseAuthChallenge parses a `WWW-Authenticate` header (e.g. `Bearer realm="...",service="..."`)
+func parseAuthChallenge(header string) (string, map[string]string) {
+	split := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	params := map[string]string{}
+	if len(split) == 2 {
+		for _, param := range strings.Split(split[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], "\"")
+			}
+		}
+	}
+	return strings.ToLower(split[0]), params
+}
+
+// authorize gets the Authorization header for pushing to a repository of the remote registry:
+// none for an open registry, basic auth, or a token from the auth server of the registry
+func (t *registrySyncTarget) authorize(repository string) error {
+	if _, ok := t.authorizations[repository]; ok {
+		return nil
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s://%s/v2/", t.Scheme, t.Host))
+	if err != nil {
+		return fmt.Errorf(" Couldn't reach registry %s\n%+v", t.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.authorizations[repository] = ""
+		return nil
+	}
+
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "basic":
+		if t.Username == "" {
+			return fmt.Errorf("Registry %s requires credentials: use --user and --password", t.Host)
+		}
+		t.authorizations[repository] = "Basic " + base64.StdEncoding.EncodeToString([]byte(t.Username+":"+t.Password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("Unsupported authentication [%s] of registry %s", scheme, t.Host)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Invalid token realm [%s] of registry %s", params["realm"], t.Host)
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull,push", repository))
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if t.Username != "" {
+		req.SetBasicAuth(t.Username, t.Password)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf(" Couldn't get a token from %s\n%+v", tokenURL.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q getting a token for %s from %s", resp.Status, repository, tokenURL.Host)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf(" Couldn't decode the token of %s\n%+v", tokenURL.Host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	t.authorizations[repository] = "Bearer " + token.Token
+	return nil
+}
+
+// do sends a request for a repository to the remote registry, with its authorization
+func (t *registrySyncTarget) do(repository string, method string, apiPath string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	if err := t.authorize(repository); err != nil {
+		return nil, err
+	}
+	target := apiPath
+	if !strings.HasPrefix(apiPath, "http://") && !strings.HasPrefix(apiPath, "https://") {
+		target = fmt.Sprintf("%s://%s%s", t.Scheme, t.Host, apiPath)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	if auth := t.authorizations[repository]; auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// getRegistryManifest gets a manifest from the local registry, as is, with its media type and digest
+func getRegistryManifest(registry *registryAPI, repository, ref string) ([]byte, string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", registry.url, repository, ref), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestMediaTypes, ", "))
+
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("unexpected status %q fetching manifest %s:%s", resp.Status, repository, ref)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return content, resp.Header.Get("Content-Type"), resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// syncRegistryBlob copies a blob from the local registry to the remote one, unless it's there already
+func syncRegistryBlob(registry *registryAPI, target *registrySyncTarget, repository string, blob registryDescriptor) error {
+	destRepository := target.repository(repository)
+	resp, err := target.do(destRepository, http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", destRepository, blob.Digest), nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		log.Debugf("Blob %s already in %s", blob.Digest, destRepository)
+		return nil
+	}
+
+	resp, err = target.do(destRepository, http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", destRepository), nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %q starting the upload of blob %s", resp.Status, blob.Digest)
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("Invalid upload location [%s] for blob %s\n%+v", resp.Header.Get("Location"), blob.Digest, err)
+	}
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location.RawQuery = query.Encode()
+
+	src, err := registry.client.Get(fmt.Sprintf("%s/v2/%s/blobs/%s", registry.url, repository, blob.Digest))
+	if err != nil {
+		return err
+	}
+	defer src.Body.Close()
+	if src.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q fetching blob %s", src.Status, blob.Digest)
+	}
+
+	// a monolithic upload, streaming the blob from the local registry
+	resp, err = target.do(destRepository, http.MethodPut, location.String(), src.Body, src.ContentLength, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %q uploading blob %s", resp.Status, blob.Digest)
+	}
+	return nil
+}
+
+// syncRegistryManifest copies a manifest and everything it references from the local registry to the remote one
+func syncRegistryManifest(registry *registryAPI, target *registrySyncTarget, repository, ref string) error {
+	content, mediaType, digest, err := getRegistryManifest(registry, repository, ref)
+	if err != nil {
+		return err
+	}
+	destRepository := target.repository(repository)
+
+	resp, err := target.do(destRepository, http.MethodHead, fmt.Sprintf("/v2/%s/manifests/%s", destRepository, ref), nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && digest != "" && resp.Header.Get("Docker-Content-Digest") == digest {
+		log.Debugf("%s:%s is up to date in %s", repository, ref, target.Host)
+		return nil
+	}
+
+	manifest := registryManifest{}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf(" Couldn't decode manifest %s:%s\n%+v", repository, ref, err)
+	}
+	// a manifest list: all the platforms are copied, as the remote registry serves other machines
+	for _, m := range manifest.Manifests {
+		if err := syncRegistryManifest(registry, target, repository, m.Digest); err != nil {
+			return err
+		}
+	}
+	if len(manifest.Manifests) == 0 {
+		for _, blob := range append([]registryDescriptor{manifest.Config}, manifest.Layers...) {
+			if err := syncRegistryBlob(registry, target, repository, blob); err != nil {
+				return err
+			}
+		}
+	}
+
+	resp, err = target.do(destRepository, http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", destRepository, ref), bytes.NewReader(content), int64(len(content)), mediaType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %q pushing manifest %s:%s\n%s", resp.Status, destRepository, ref, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// syncRegistry copies the repositories and tags of a registry (matching the patterns, if any) to a remote registry
+func syncRegistry(name string, target *registrySyncTarget, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid image pattern [%s]\n%+v", pattern, err)
+		}
+	}
+
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+	registry, err := getRegistryAPI(cid)
+	if err != nil {
+		return err
+	}
+
+	images, err := getRegistryImages(registry)
+	if err != nil {
+		return err
+	}
+
+	copied, failed := 0, 0
+	for _, image := range images {
+		ref := fmt.Sprintf("%s:%s", image.Repository, image.Tag)
+		if len(patterns) > 0 && !matchImagePatterns(patterns, image.Repository) && !matchImagePatterns(patterns, ref) {
+			continue
+		}
+		log.Printf("...Copying %s to %s/%s:%s", ref, target.Host, target.repository(image.Repository), image.Tag)
+		if err := syncRegistryManifest(registry, target, image.Repository, image.Tag); err != nil {
+			log.Warningf("Couldn't copy %s\n%+v", ref, err)
+			failed++
+			continue
+		}
+		copied++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to copy %d image(s) to %s", failed, target.Host)
+	}
+	if copied == 0 {
+		return fmt.Errorf("No images to copy found in registry %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package run
+
+/*
+ * The functions in this file set up mutual TLS between the nodes and the registry (`--registry-mtls`):
+ * a CA issues a server certificate for the registry and a client certificate for the nodes, the registry only
+ * accepts the clients with a certificate of the CA, and the nodes get the CA and the client certificate
+ * with the matching tls section in their registries configuration.
+ */
+
+import (
+	"archive/tar"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+const (
+	// directory of the certificates in the registry container
+	defaultRegistryTLSDir = "/etc/docker/registry/tls"
+
+	// directory of the CA and the client certificate in the nodes
+	defaultNodeRegistryTLSDir = "/etc/rancher/k3s/registry-tls"
+
+	// the certificates are only used in test environments: they are made to outlive the clusters
+	registryTLSValidity = 10 * 365 * 24 * time.Hour
+)
+
+// names of the files of the certificates (the names expected by docker in /etc/docker/certs.d/<registry>)
+const (
+	registryTLSCAFile         = "ca.crt"
+	registryTLSServerCertFile = "server.cert"
+	registryTLSServerKeyFile  = "server.key"
+	registryTLSClientCertFile = "client.cert"
+	registryTLSClientKeyFile  = "client.key"
+)
+
+// registryTLSClientFiles are the files copied into the nodes (and the host)
+var registryTLSClientFiles = []string{registryTLSCAFile, registryTLSClientCertFile, registryTLSClientKeyFile}
+
+// getRegistryTLSEnv returns the environment of a registry requiring the client certificates of the CA
+func getRegistryTLSEnv() []string {
+	return []string{
+		fmt.Sprintf("REGISTRY_HTTP_TLS_CERTIFICATE=%s", path.Join(defaultRegistryTLSDir, registryTLSServerCertFile)),
+		fmt.Sprintf("REGISTRY_HTTP_TLS_KEY=%s", path.Join(defaultRegistryTLSDir, registryTLSServerKeyFile)),
+		fmt.Sprintf("REGISTRY_HTTP_TLS_CLIENTCAS_0=%s", path.Join(defaultRegistryTLSDir, registryTLSCAFile)),
+	}
+}
+
+// getNodeRegistryTLSConfig returns the tls section of the registries configuration of the nodes
+func getNodeRegistryTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		CAFile:   path.Join(defaultNodeRegistryTLSDir, registryTLSCAFile),
+		CertFile: path.Join(defaultNodeRegistryTLSDir, registryTLSClientCertFile),
+		KeyFile:  path.Join(defaultNodeRegistryTLSDir, registryTLSClientKeyFile),
+	}
+}
+
+// issueCertificate creates a key and a certificate signed by a CA (self-signed when the CA is nil), PEM-encoded
+func issueCertificate(template *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey) ([]byte, []byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-1 * time.Hour)
+	template.NotAfter = time.Now().Add(registryTLSValidity)
+	if ca == nil {
+		ca, caKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		key, nil
+}
+
+// generateRegistryTLS creates a CA, a server certificate for the names of the registry and a client certificate.
+// The key of the CA is not kept: no other certificate can be issued afterwards.
+func generateRegistryTLS(registryName string, names []string) (map[string][]byte, error) {
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("k3d registry CA (%s)", registryName)},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caPEM, _, caKey, err := issueCertificate(caTemplate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create the CA of the registry\n%+v", err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: registryName},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range append(names, "localhost", "127.0.0.1", "::1") {
+		if ip := net.ParseIP(name); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, name)
+		}
+	}
+	serverPEM, serverKeyPEM, _, err := issueCertificate(serverTemplate, caTemplate, caKey)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create the certificate of the registry\n%+v", err)
+	}
+
+	clientTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "k3d"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientPEM, clientKeyPEM, _, err := issueCertificate(clientTemplate, caTemplate, caKey)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create the client certificate of the registry\n%+v", err)
+	}
+
+	return map[string][]byte{
+		registryTLSCAFile:         caPEM,
+		registryTLSServerCertFile: serverPEM,
+		registryTLSServerKeyFile:  serverKeyPEM,
+		registryTLSClientCertFile: clientPEM,
+		registryTLSClientKeyFile:  clientKeyPEM,
+	}, nil
+}
+
+// getRegistryTLSNames returns the names the registry is reached with, for its server certificate
+func getRegistryTLSNames(spec ClusterSpec) []string {
+	names := []string{spec.RegistryName, registryContainerName(spec.ClusterName, spec.RegistryPerCluster)}
+	for _, n := range spec.RegistryNetworks {
+		names = append(names, n.Aliases...)
+	}
+	if hostIP := getRegistryHostIP(); hostIP != "" {
+		names = append(names, hostIP)
+	}
+	return names
+}
+
+// writeRegistryTLSInContainer copies new certificates into a registry container (before starting it)
+func writeRegistryTLSInContainer(spec ClusterSpec, ID string) error {
+	files, err := generateRegistryTLS(spec.RegistryName, getRegistryTLSNames(spec))
+	if err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err := copyToContainer(ID, path.Join(defaultRegistryTLSDir, name), content); err != nil {
+			return fmt.Errorf(" Couldn't copy %s into the registry\n%+v", name, err)
+		}
+	}
+	return nil
+}
+
+// readRegistryTLSFiles reads the certificates of a registry from its container
+func readRegistryTLSFiles(ID string) (map[string][]byte, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	reader, _, err := docker.CopyFromContainer(ctx, ID, defaultRegistryTLSDir)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't copy %s from the registry\n%+v", defaultRegistryTLSDir, err)
+	}
+	defer reader.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf(" Couldn't read %s from the registry\n%+v", defaultRegistryTLSDir, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if files[path.Base(hdr.Name)], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range registryTLSClientFiles {
+		if _, ok := files[name]; !ok {
+			return nil, fmt.Errorf("No %s found in %s in the registry", name, defaultRegistryTLSDir)
+		}
+	}
+	return files, nil
+}
+
+// writeRegistryTLSInNode copies the CA and the client certificate of a registry into a node
+func writeRegistryTLSInNode(registryID string, ID string) error {
+	files, err := readRegistryTLSFiles(registryID)
+	if err != nil {
+		return err
+	}
+	for _, name := range registryTLSClientFiles {
+		if err := copyToContainer(ID, path.Join(defaultNodeRegistryTLSDir, name), files[name]); err != nil {
+			return fmt.Errorf(" Couldn't copy %s into container %s\n%+v", name, ID, err)
+		}
+	}
+	return nil
+}
+
+// writeRegistryTLSInDir copies the CA and the client certificate of a registry into a directory of the host
+func writeRegistryTLSInDir(registryID string, dir string) error {
+	files, err := readRegistryTLSFiles(registryID)
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExists(dir); err != nil {
+		return err
+	}
+	for _, name := range registryTLSClientFiles {
+		if err := ioutil.WriteFile(path.Join(dir, name), files[name], 0600); err != nil {
+			return fmt.Errorf(" Couldn't write %s\n%+v", path.Join(dir, name), err)
+		}
+	}
+	return nil
+}
+
+// getRegistryTLSClientConfig returns the TLS configuration for connecting to a registry with its client certificate
+func getRegistryTLSClientConfig(registryID string, serverName string) (*tls.Config, error) {
+	files, err := readRegistryTLSFiles(registryID)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(files[registryTLSClientCertFile], files[registryTLSClientKeyFile])
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't load the client certificate of the registry\n%+v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(files[registryTLSCAFile])
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   serverName,
+	}, nil
+}
+
+// registryAPI is the API of a registry container, reached from the host on its published port
+type registryAPI struct {
+	url    string // the base URL, e.g. `http://localhost:5000`
+	client *http.Client
+}
+
+// getRegistryAPI returns the base URL of the API of a registry container and the HTTP client for it:
+// a registry with mutual TLS is reached with https, and its client certificate
+func getRegistryAPI(ID string) (*registryAPI, error) {
+	address, err := getRegistryHostAddress(ID)
+	if err != nil {
+		return nil, err
+	}
+	mtls, err := isRegistryMTLS(ID)
+	if err != nil {
+		return nil, err
+	}
+	if !mtls {
+		return &registryAPI{url: "http://" + address, client: &http.Client{}}, nil
+	}
+
+	hostname, err := getRegistryHostname(ID)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := getRegistryTLSClientConfig(ID, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return &registryAPI{
+		url:    "https://" + address,
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// isRegistryMTLS checks if a registry requires the client certificates of its CA
+func isRegistryMTLS(ID string) (bool, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+	return registry.Config.Labels["mtls"] == "true", nil
+}
+
+// registryScheme returns the scheme used by the nodes for reaching the registry of a cluster
+func registryScheme(spec *ClusterSpec) string {
+	if spec.RegistryMTLS {
+		return "https"
+	}
+	return "http"
+}
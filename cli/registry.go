@@ -1,11 +1,20 @@
 package run
 
 import (
-	"context"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -13,7 +22,9 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	"github.com/mitchellh/go-homedir"
+	"github.com/olekukonko/tablewriter"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -23,14 +34,25 @@ const (
 
 	defaultRegistryImage = "registry:2"
 
+	// the image of the containers probing the free ports of the docker host
+	defaultProbeImage = "docker.io/library/busybox:1.31"
+
 	// Default registry port, both for the external and the internal ports
-	// Note well, that the internal port is never changed.
+	// (the internal port can be changed with `--registry-internal-port`)
 	defaultRegistryPort = 5000
 
 	defaultFullRegistriesPath = "/etc/rancher/k3s/registries.yaml"
 
 	defaultRegistryMountPath = "/var/lib/registry"
 
+	// by default, the registry is reachable on all the host interfaces
+	defaultRegistryBindAddress = "0.0.0.0"
+
+	defaultRegistryConfigPath = "/etc/docker/registry/config.yml"
+
+	// internal port of the debug server of the registry (metrics, pprof...), published with `--registry-debug-port`
+	defaultRegistryDebugPort = 5001
+
 	defaultDockerHubAddress = "docker.io"
 
 	defaultDockerRegistryHubAddress = "registry-1.docker.io"
@@ -59,12 +81,43 @@ type Registry struct {
 
 	// Configs are configs for each registry.
 	// The key is the FDQN or IP of the registry.
-	Configs map[string]interface{} `toml:"configs" yaml:"configs"`
+	Configs map[string]RegistryConfig `toml:"configs" yaml:"configs"`
 
 	// Auths are registry endpoint to auth config mapping. The registry endpoint must
 	// be a valid url with host specified.
 	// DEPRECATED: Use Configs instead. Remove in containerd 1.4.
-	Auths map[string]interface{} `toml:"auths" yaml:"auths"`
+	Auths map[string]AuthConfig `toml:"auths" yaml:"auths"`
+}
+
+// RegistryConfig contains configuration used to communicate with the registry.
+type RegistryConfig struct {
+	// Auth contains information to authenticate to the registry.
+	Auth *AuthConfig `toml:"auth" yaml:"auth,omitempty"`
+	// TLS is a pair of CA/Cert/Key which then are used when creating the transport
+	// that communicates with the registry.
+	TLS *TLSConfig `toml:"tls" yaml:"tls,omitempty"`
+}
+
+// AuthConfig contains the config related to authentication to a specific registry
+type AuthConfig struct {
+	// Username is the username to login the registry.
+	Username string `toml:"username" yaml:"username,omitempty"`
+	// Password is the password to login the registry.
+	Password string `toml:"password" yaml:"password,omitempty"`
+	// Auth is a base64 encoded string from the concatenation of the username,
+	// a colon, and the password.
+	Auth string `toml:"auth" yaml:"auth,omitempty"`
+	// IdentityToken is used to authenticate the user and get
+	// an access token for the registry.
+	IdentityToken string `toml:"identitytoken" yaml:"identity_token,omitempty"`
+}
+
+// TLSConfig contains the CA/Cert/Key used for a registry
+type TLSConfig struct {
+	CAFile             string `toml:"ca_file" yaml:"ca_file,omitempty"`
+	CertFile           string `toml:"cert_file" yaml:"cert_file,omitempty"`
+	KeyFile            string `toml:"key_file" yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify" yaml:"insecure_skip_verify,omitempty"`
 }
 
 // Mirror contains the config related to the registry mirror
@@ -74,6 +127,217 @@ type Mirror struct {
 	// with host specified.
 	// The scheme, host and path from the endpoint URL will be used.
 	Endpoints []string `toml:"endpoint" yaml:"endpoint"`
+
+	// Rewrites are regular expressions (and their replacements) applied to the
+	// repository of the images pulled from the mirror (e.g. `^library/(.*)` -> `cache/$1`).
+	Rewrites map[string]string `toml:"rewrite" yaml:"rewrite,omitempty"`
+}
+
+// parseRegistryRewrites parses the `--registry-rewrite` values (Format: `REGEX=REPLACEMENT`)
+func parseRegistryRewrites(specs []string) (map[string]string, error) {
+	rewrites := map[string]string{}
+	for _, spec := range specs {
+		split := strings.SplitN(spec, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, fmt.Errorf("Invalid registry rewrite [%s] (Format: REGEX=REPLACEMENT)", spec)
+		}
+		if _, err := regexp.Compile(split[0]); err != nil {
+			return nil, fmt.Errorf("Invalid registry rewrite [%s]\n%+v", spec, err)
+		}
+		rewrites[split[0]] = split[1]
+	}
+	return rewrites, nil
+}
+
+// parseRegistryMirrors parses the `--registry-mirror` values (Format: `UPSTREAM=ENDPOINT`),
+// keeping the order of the endpoints given for the same upstream registry
+func parseRegistryMirrors(specs []string) (map[string][]string, error) {
+	mirrors := map[string][]string{}
+	for _, spec := range specs {
+		split := strings.SplitN(spec, "=", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" || strings.Contains(split[0], "://") {
+			return nil, fmt.Errorf("Invalid registry mirror [%s] (Format: UPSTREAM=ENDPOINT, e.g. gcr.io=https://mirror.corp.local)", spec)
+		}
+		endpoint := split[1]
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid registry mirror [%s]: %q is not an http(s) URL", spec, endpoint)
+		}
+		mirrors[split[0]] = append(mirrors[split[0]], endpoint)
+	}
+	return mirrors, nil
+}
+
+// withRewrites returns a mirror with the rewrite rules of the registries file for the same host (if any),
+// plus the ones given in the command line (which take precedence)
+func withRewrites(mirror Mirror, fileMirror Mirror, rewrites map[string]string) Mirror {
+	if len(fileMirror.Rewrites) == 0 && len(rewrites) == 0 {
+		return mirror
+	}
+	mirror.Rewrites = map[string]string{}
+	for k, v := range fileMirror.Rewrites {
+		mirror.Rewrites[k] = v
+	}
+	for k, v := range rewrites {
+		mirror.Rewrites[k] = v
+	}
+	return mirror
+}
+
+// registryContainerName returns the name of the registry container used by a cluster:
+// the shared one, or a dedicated `k3d-<cluster>-registry` when running in per-cluster mode
+func registryContainerName(clusterName string, perCluster bool) string {
+	if perCluster {
+		return fmt.Sprintf("%s-%s-registry", defaultContainerNamePrefix, clusterName)
+	}
+	return defaultRegistryContainerName
+}
+
+// parseRegistryPort parses the value of a registry port flag: a port number, or `auto` (or 0) for a free port
+func parseRegistryPort(portSpec string) (int, error) {
+	if portSpec == "auto" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(portSpec)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid registry port [%s]: must be a number or `auto`", portSpec)
+	}
+	if port < 0 || port > 65535 {
+		return 0, fmt.Errorf("Registry port %d out of range", port)
+	}
+	return port, nil
+}
+
+// getFreeHostPort asks docker for a free port of the docker host (remote or not): a short-lived probe container
+// publishes a port without host port, so the daemon binds an ephemeral one, which is read back and released.
+// The probe image is pulled according to 'pullPolicy'.
+func getFreeHostPort(pullPolicy string) (int, error) {
+	if err := ensureImage(defaultProbeImage, pullPolicy); err != nil {
+		return 0, err
+	}
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	probePort := nat.Port("65535/tcp")
+	config := &container.Config{
+		Image:        defaultProbeImage,
+		Cmd:          []string{"sleep", "30"},
+		ExposedPorts: nat.PortSet{probePort: struct{}{}},
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "probe",
+		},
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{probePort: []nat.PortBinding{{HostPort: ""}}},
+	}
+	// concurrent creations probe at the same time
+	probeName := fmt.Sprintf("%s-port-probe-%s", defaultContainerNamePrefix, GenerateRandomString(5))
+	id, err := createContainer(config, hostConfig, &network.NetworkingConfig{}, probeName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := removeContainer(id); err != nil {
+			log.Warningln(err)
+		}
+	}()
+
+	if err := startContainer(id); err != nil {
+		return 0, fmt.Errorf(" Couldn't start probe container %s\n%+v", probeName, err)
+	}
+	probe, err := docker.ContainerInspect(ctx, id)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't inspect probe container %s\n%+v", probeName, err)
+	}
+	for _, binding := range probe.NetworkSettings.Ports[probePort] {
+		if port, err := strconv.Atoi(binding.HostPort); err == nil && port > 0 {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("Probe container %s didn't get a host port", probeName)
+}
+
+// resolveRegistryPorts completes the registry ports in a spec with the ones of the existing registry container
+// (when there is one), and chooses a free host port for the registry when it was set to `auto`
+func resolveRegistryPorts(spec *ClusterSpec) error {
+	if spec.RegistryInternalPort == 0 {
+		spec.RegistryInternalPort = defaultRegistryPort
+	}
+
+	cid, err := getRegistryContainer(registryContainerName(spec.ClusterName, spec.RegistryPerCluster))
+	if err != nil {
+		return err
+	}
+	if cid != "" {
+		// the nodes must use the port the existing registry listens on
+		internalPort, err := getRegistryInternalPort(cid)
+		if err != nil {
+			return err
+		}
+		if internalPort != spec.RegistryInternalPort {
+			log.Warnf("The existing registry listens on the internal port %d: using it instead of %d", internalPort, spec.RegistryInternalPort)
+			spec.RegistryInternalPort = internalPort
+		}
+
+		if spec.RegistryPort == 0 {
+			address, err := getRegistryHostAddress(cid)
+			if err != nil {
+				return err
+			}
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			spec.RegistryPort, err = strconv.Atoi(port)
+			log.Printf("Using the port %d of the existing registry", spec.RegistryPort)
+			return err
+		}
+		return nil
+	}
+
+	// the registry image is checked against the pull policy before probing anything
+	image := spec.RegistryImage
+	if image == "" {
+		image = defaultRegistryImage
+	}
+	if err := ensureImage(image, spec.PullPolicy); err != nil {
+		return err
+	}
+	if spec.RegistryPort == 0 {
+		spec.RegistryPort, err = getFreeHostPort(spec.PullPolicy)
+		if err != nil {
+			return err
+		}
+		log.Printf("Selected free port %d for the registry", spec.RegistryPort)
+	}
+	return nil
+}
+
+// getRegistryInternalPort returns the port a registry container listens on inside of the networks
+func getRegistryInternalPort(ID string) (int, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+
+	// registries created before the "internal-port" label existed use the default port
+	internalPort, ok := registry.Config.Labels["internal-port"]
+	if !ok {
+		return defaultRegistryPort, nil
+	}
+	return strconv.Atoi(internalPort)
 }
 
 // getGlobalRegistriesConfFilename gets the global registries file that will be used in all the servers/workers
@@ -87,24 +351,158 @@ func getGlobalRegistriesConfFilename() (string, error) {
 	return path.Join(homeDir, ".k3d", "registries.yaml"), nil
 }
 
-// writeRegistriesConfigInContainer creates a valid registries configuration file in a container
-func writeRegistriesConfigInContainer(spec *ClusterSpec, ID string) error {
-	registryInternalAddress := fmt.Sprintf("%s:%d", spec.RegistryName, defaultRegistryPort)
-	registryExternalAddress := fmt.Sprintf("%s:%d", spec.RegistryName, spec.RegistryPort)
+// registriesFileVars are the variables available in the registries file, used as a template
+// (e.g. `endpoint: ["http://{{ .HostGateway }}:5000"]`)
+type registriesFileVars struct {
+	ClusterName     string // name of the cluster
+	RegistryName    string // hostname of the k3d registry
+	RegistryAddress string // address of the k3d registry in the cluster network (`name:port`)
+	HostGateway     string // address of the docker host in the cluster network
+}
+
+// getRegistriesFileVars gets the values of the variables in the registries file for a cluster
+func getRegistriesFileVars(spec *ClusterSpec) *registriesFileVars {
+	if spec.RegistriesFile == "" {
+		return nil
+	}
+
+	registryInternalPort := spec.RegistryInternalPort
+	if registryInternalPort == 0 {
+		registryInternalPort = defaultRegistryPort
+	}
+	vars := &registriesFileVars{
+		ClusterName:     spec.ClusterName,
+		RegistryName:    spec.RegistryName,
+		RegistryAddress: fmt.Sprintf("%s:%d", spec.RegistryName, registryInternalPort),
+	}
+
+	gateway, err := getClusterNetworkGateway(spec.ClusterName)
+	if err != nil {
+		log.Warnf("Couldn't get the host gateway for the registries file: %+v", err)
+	} else {
+		vars.HostGateway = gateway
+	}
+	return vars
+}
 
+// loadRegistriesFile loads a registries file, returning an empty configuration if no file is given.
+// The file is expanded as a template with the given variables (when not nil).
+func loadRegistriesFile(filename string, vars *registriesFileVars) (*Registry, error) {
 	privRegistries := &Registry{}
+	if len(filename) == 0 {
+		return privRegistries, nil
+	}
 
-	// load the base registry file
-	if len(spec.RegistriesFile) > 0 {
-		log.Printf("Using registries definitions from %q...\n", spec.RegistriesFile)
-		privRegistryFile, err := ioutil.ReadFile(spec.RegistriesFile)
+	privRegistryFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err // the file must exist at this point
+	}
+
+	if vars != nil {
+		tmpl, err := template.New(path.Base(filename)).Parse(string(privRegistryFile))
 		if err != nil {
-			return err // the file must exist at this point
+			return nil, fmt.Errorf(" Couldn't parse the registries file %s as a template\n%+v", filename, err)
 		}
-		if err := yaml.Unmarshal(privRegistryFile, &privRegistries); err != nil {
-			return err
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, vars); err != nil {
+			return nil, fmt.Errorf(" Couldn't expand the registries file %s\n%+v", filename, err)
+		}
+		privRegistryFile = buf.Bytes()
+	}
+
+	if err := validateRegistriesFile(filename, privRegistryFile); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(privRegistryFile, &privRegistries); err != nil {
+		return nil, err
+	}
+	return privRegistries, nil
+}
+
+// mergeAuthConfig merges two auth configs, the fields set in 'src' overriding the ones of 'dst'
+func mergeAuthConfig(dst *AuthConfig, src *AuthConfig) *AuthConfig {
+	if src == nil {
+		return dst
+	}
+	if dst == nil {
+		merged := *src
+		return &merged
+	}
+	merged := *dst
+	if src.Username != "" {
+		merged.Username = src.Username
+	}
+	if src.Password != "" {
+		merged.Password = src.Password
+	}
+	if src.Auth != "" {
+		merged.Auth = src.Auth
+	}
+	if src.IdentityToken != "" {
+		merged.IdentityToken = src.IdentityToken
+	}
+	return &merged
+}
+
+// mergeTLSConfig merges two TLS configs, the fields set in 'src' overriding the ones of 'dst'
+func mergeTLSConfig(dst *TLSConfig, src *TLSConfig) *TLSConfig {
+	if src == nil {
+		return dst
+	}
+	if dst == nil {
+		merged := *src
+		return &merged
+	}
+	merged := *dst
+	if src.CAFile != "" {
+		merged.CAFile = src.CAFile
+	}
+	if src.CertFile != "" {
+		merged.CertFile = src.CertFile
+	}
+	if src.KeyFile != "" {
+		merged.KeyFile = src.KeyFile
+	}
+	if src.InsecureSkipVerify {
+		merged.InsecureSkipVerify = true
+	}
+	return &merged
+}
+
+// mergeRegistryConfigs merges the configs generated by k3d into the ones of a registries configuration: the fields
+// set by k3d override the ones of the registries file, which keeps the others (e.g. the auth of a registry getting a TLS config)
+func mergeRegistryConfigs(registries *Registry, configs map[string]RegistryConfig) {
+	if len(configs) > 0 && len(registries.Configs) == 0 {
+		registries.Configs = map[string]RegistryConfig{}
+	}
+	for host, config := range configs {
+		existing := registries.Configs[host]
+		registries.Configs[host] = RegistryConfig{
+			Auth: mergeAuthConfig(existing.Auth, config.Auth),
+			TLS:  mergeTLSConfig(existing.TLS, config.TLS),
 		}
 	}
+}
+
+// getRegistriesConfig returns the registries configuration of the nodes of a cluster:
+// the registries file plus the mirrors of the registries used by the cluster
+func getRegistriesConfig(spec *ClusterSpec) (*Registry, error) {
+	registryInternalPort := spec.RegistryInternalPort
+	if registryInternalPort == 0 {
+		registryInternalPort = defaultRegistryPort
+	}
+	registryInternalAddress := fmt.Sprintf("%s:%d", spec.RegistryName, registryInternalPort)
+	registryExternalAddress := fmt.Sprintf("%s:%d", spec.RegistryName, spec.RegistryPort)
+	registryEndpoint := fmt.Sprintf("%s://%s", registryScheme(spec), registryInternalAddress)
+
+	// load the base registry file
+	if len(spec.RegistriesFile) > 0 {
+		log.Printf("Using registries definitions from %q...\n", spec.RegistriesFile)
+	}
+	privRegistries, err := loadRegistriesFile(spec.RegistriesFile, getRegistriesFileVars(spec))
+	if err != nil {
+		return nil, err
+	}
 
 	if spec.RegistryEnabled {
 		if len(privRegistries.Mirrors) == 0 {
@@ -112,51 +510,82 @@ func writeRegistriesConfigInContainer(spec *ClusterSpec, ID string) error {
 		}
 
 		// then add the private registry
-		privRegistries.Mirrors[registryExternalAddress] = Mirror{
-			Endpoints: []string{fmt.Sprintf("http://%s", registryInternalAddress)},
+		privRegistries.Mirrors[registryExternalAddress] = withRewrites(Mirror{
+			Endpoints: []string{registryEndpoint},
+		}, privRegistries.Mirrors[registryExternalAddress], spec.RegistryRewrite)
+
+		// with mutual TLS, the nodes authenticate with the client certificate of the registry
+		if spec.RegistryMTLS {
+			mergeRegistryConfigs(privRegistries, map[string]RegistryConfig{
+				registryInternalAddress: {TLS: getNodeRegistryTLSConfig()},
+			})
 		}
 
 		// with the cache, redirect all the PULLs to the Docker Hub to the local registry
-		if spec.RegistryCacheEnabled {
-			privRegistries.Mirrors[defaultDockerHubAddress] = Mirror{
-				Endpoints: []string{fmt.Sprintf("http://%s", registryInternalAddress)},
-			}
+		// (and in failover mode, to the Docker Hub itself when the local registry doesn't answer)
+		if spec.RegistryFailover {
+			privRegistries.Mirrors[defaultDockerHubAddress] = withRewrites(failoverMirror(registryEndpoint, defaultDockerRegistryHubAddress),
+				privRegistries.Mirrors[defaultDockerHubAddress], spec.RegistryRewrite)
+		} else if spec.RegistryCacheEnabled {
+			privRegistries.Mirrors[defaultDockerHubAddress] = withRewrites(Mirror{
+				Endpoints: []string{registryEndpoint},
+			}, privRegistries.Mirrors[defaultDockerHubAddress], spec.RegistryRewrite)
 		}
 	}
 
-	d, err := yaml.Marshal(&privRegistries)
-	if err != nil {
-		return err
+	// a registry not managed by k3d
+	if spec.RegistryUse != "" {
+		if len(privRegistries.Mirrors) == 0 {
+			privRegistries.Mirrors = map[string]Mirror{}
+		}
+		for address, mirror := range getExternalRegistryMirrors(spec) {
+			privRegistries.Mirrors[address] = withRewrites(mirror, privRegistries.Mirrors[address], spec.RegistryRewrite)
+		}
 	}
 
-	return copyToContainer(ID, defaultFullRegistriesPath, d)
-}
+	// the additional registries of the cluster
+	addExtraRegistryMirrors(privRegistries, spec)
 
-// createRegistry creates a registry, or connect the k3d network to an existing one
-func createRegistry(spec ClusterSpec) (string, error) {
-	netName := k3dNetworkName(spec.ClusterName)
+	// the mirrors given in the command line (keeping the rewrites of the registries file)
+	if len(spec.RegistryMirrors) > 0 && len(privRegistries.Mirrors) == 0 {
+		privRegistries.Mirrors = map[string]Mirror{}
+	}
+	for upstream, endpoints := range spec.RegistryMirrors {
+		privRegistries.Mirrors[upstream] = withRewrites(Mirror{Endpoints: endpoints}, privRegistries.Mirrors[upstream], nil)
+	}
 
-	// first, check we have not already started a registry (for example, for a different k3d cluster)
-	// all the k3d clusters should share the same private registry, so if we already have a registry just connect
-	// it to the network of this cluster.
-	cid, err := getRegistryContainer()
+	return privRegistries, nil
+}
+
+// writeRegistriesConfigInContainer creates a valid registries configuration file in a container
+func writeRegistriesConfigInContainer(spec *ClusterSpec, ID string) error {
+	privRegistries, err := getRegistriesConfig(spec)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	if cid != "" {
-		// TODO: we should check given-registry-name == existing-registry-name
-		log.Printf("Registry already present: ensuring that it's running and connecting it to the '%s' network...\n", netName)
-		if err := startContainer(cid); err != nil {
-			log.Warnf("Failed to start registry container. Try starting it manually via `docker start %s`", cid)
+	// the CA and the client certificate of a registry with mutual TLS
+	if spec.RegistryEnabled && spec.RegistryMTLS {
+		registryID, err := getRegistryContainer(registryContainerName(spec.ClusterName, spec.RegistryPerCluster))
+		if err != nil {
+			return err
 		}
-		if err := connectRegistryToNetwork(cid, netName, []string{spec.RegistryName}); err != nil {
-			return "", err
+		if err := writeRegistryTLSInNode(registryID, ID); err != nil {
+			return err
 		}
-		return cid, nil
 	}
 
-	log.Printf("Creating Registry as %s:%d...\n", spec.RegistryName, spec.RegistryPort)
+	d, err := yaml.Marshal(&privRegistries)
+	if err != nil {
+		return err
+	}
+
+	return copyToContainer(ID, defaultFullRegistriesPath, d)
+}
+
+// getRegistryContainerConfig returns the configuration of the container of a new registry
+func getRegistryContainerConfig(spec ClusterSpec) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	netName := k3dNetworkName(spec.ClusterName)
 
 	containerLabels := make(map[string]string)
 
@@ -166,65 +595,114 @@ func createRegistry(spec ClusterSpec) (string, error) {
 	}
 	containerLabels["created"] = time.Now().Format("2006-01-02 15:04:05")
 	containerLabels["hostname"] = spec.RegistryName
+	containerLabels["port"] = strconv.Itoa(spec.RegistryPort)
+
+	registryImage := spec.RegistryImage
+	if registryImage == "" {
+		registryImage = defaultRegistryImage
+	}
+	containerLabels["image"] = registryImage
+	if spec.RegistryPerCluster {
+		containerLabels["cluster"] = spec.ClusterName
+	}
+	// a standalone registry is not removed along with the clusters using it
+	if spec.ClusterName == "" {
+		containerLabels["standalone"] = "true"
+	}
+
+	registryInternalPort := spec.RegistryInternalPort
+	if registryInternalPort == 0 {
+		registryInternalPort = defaultRegistryPort
+	}
+	containerLabels["internal-port"] = strconv.Itoa(registryInternalPort)
+	if spec.RegistryMaxSize > 0 {
+		containerLabels["max-size"] = strconv.FormatInt(spec.RegistryMaxSize, 10)
+	}
 
-	registryPortSpec := fmt.Sprintf("0.0.0.0:%d:%d/tcp", spec.RegistryPort, defaultRegistryPort)
-	registryPublishedPorts, err := CreatePublishedPorts([]string{registryPortSpec})
+	bindAddresses := spec.RegistryBindIPs
+	if len(bindAddresses) == 0 {
+		bindAddresses = []string{defaultRegistryBindAddress}
+	}
+	registryPortSpecs := []string{}
+	for _, bindAddress := range bindAddresses {
+		registryPortSpecs = append(registryPortSpecs, fmt.Sprintf("%s:%d/tcp", net.JoinHostPort(bindAddress, strconv.Itoa(spec.RegistryPort)), registryInternalPort))
+		if spec.RegistryDebugPort > 0 {
+			registryPortSpecs = append(registryPortSpecs, fmt.Sprintf("%s:%d/tcp", net.JoinHostPort(bindAddress, strconv.Itoa(spec.RegistryDebugPort)), defaultRegistryDebugPort))
+		}
+	}
+	if spec.RegistryDebugPort > 0 {
+		containerLabels["debug-port"] = strconv.Itoa(spec.RegistryDebugPort)
+	}
+	if spec.RegistryMTLS {
+		containerLabels["mtls"] = "true"
+	}
+	registryPublishedPorts, err := CreatePublishedPorts(registryPortSpecs)
 	if err != nil {
-		log.Fatalf("Error: failed to parse port specs %+v \n%+v", registryPortSpec, err)
+		return nil, nil, nil, fmt.Errorf(" Couldn't parse the port specs %+v\n%+v", registryPortSpecs, err)
 	}
 
+	// the registry only serves files from its volume: it gets no capability, unless it has to bind a privileged port
 	hostConfig := &container.HostConfig{
 		PortBindings: registryPublishedPorts.PortBindings,
-		Privileged:   true,
 		Init:         &[]bool{true}[0],
+		CapDrop:      []string{"ALL"},
+		SecurityOpt:  []string{"no-new-privileges"},
+	}
+	if registryInternalPort < 1024 {
+		hostConfig.CapAdd = []string{"NET_BIND_SERVICE"}
+	}
+	if spec.RegistryPrivileged {
+		hostConfig.Privileged = true
+		hostConfig.CapDrop, hostConfig.CapAdd, hostConfig.SecurityOpt = nil, nil, nil
+		containerLabels["privileged"] = "true"
 	}
 
-	if spec.AutoRestart {
-		hostConfig.RestartPolicy.Name = "unless-stopped"
+	if spec.RegistryRestart != "" {
+		hostConfig.RestartPolicy, _ = parseRestartPolicy(spec.RegistryRestart)
+	} else {
+		hostConfig.RestartPolicy = spec.getRestartPolicy(false)
 	}
 
 	spec.Volumes = &Volumes{} // we do not need in the registry any of the volumes used by the other containers
 	if spec.RegistryVolume != "" {
-		vol, err := getVolume(spec.RegistryVolume, map[string]string{})
-		if err != nil {
-			return "", fmt.Errorf(" Couldn't check if volume %s exists: %w", spec.RegistryVolume, err)
-		}
-		if vol != nil {
-			log.Printf("Using existing volume %s for the Registry\n", spec.RegistryVolume)
-		} else {
-			log.Printf("Creating Registry volume %s...\n", spec.RegistryVolume)
-
-			// assign some labels (so we can recognize the volume later on)
-			volLabels := map[string]string{
-				"registry-name": spec.RegistryName,
-				"registry-port": strconv.Itoa(spec.RegistryPort),
-			}
-			for k, v := range defaultRegistryVolumeLabels {
-				volLabels[k] = v
-			}
-			_, err := createVolume(spec.RegistryVolume, volLabels)
-			if err != nil {
-				return "", fmt.Errorf(" Couldn't create volume %s for registry: %w", spec.RegistryVolume, err)
-			}
-		}
 		mount := fmt.Sprintf("%s:%s", spec.RegistryVolume, defaultRegistryMountPath)
 		hostConfig.Binds = []string{mount}
 	}
 
+	// a host directory is written with the user and the group of this user (Docker Desktop maps them already,
+	// and they mean nothing on a remote docker host), so the blobs can be inspected, backed up and removed without root
+	runAsUser := ""
+	if spec.RegistryVolumeDir != "" {
+		hostConfig.Binds = []string{fmt.Sprintf("%s:%s", spec.RegistryVolumeDir, defaultRegistryMountPath)}
+		containerLabels["volume-dir"] = spec.RegistryVolumeDir
+		if runtime.GOOS == "linux" && !isRemoteDocker() {
+			runAsUser = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+		}
+	}
+
+	// mount the user-supplied configuration file in place of the default one
+	if spec.RegistryConfig != "" {
+		log.Printf("Using registry configuration from %q...\n", spec.RegistryConfig)
+		hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s:ro", spec.RegistryConfig, defaultRegistryConfigPath))
+		containerLabels["config"] = spec.RegistryConfig
+	}
+
 	// connect the registry to this k3d network
-	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
+	networkingConfig := &network.NetworkingConfig{}
+	if spec.ClusterName != "" {
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
 			netName: {
 				Aliases: []string{spec.RegistryName},
 			},
-		},
+		}
 	}
 
 	config := &container.Config{
 		Hostname:     spec.RegistryName,
-		Image:        defaultRegistryImage,
+		Image:        registryImage,
 		ExposedPorts: registryPublishedPorts.ExposedPorts,
 		Labels:       containerLabels,
+		User:         runAsUser,
 	}
 
 	// we can enable the cache in the Registry by just adding a new env variable
@@ -233,47 +711,339 @@ func createRegistry(spec ClusterSpec) (string, error) {
 		log.Printf("Activating pull-through cache to Docker Hub\n")
 		cacheConfigKey := "REGISTRY_PROXY_REMOTEURL"
 		cacheConfigValues := fmt.Sprintf("https://%s", defaultDockerRegistryHubAddress)
-		config.Env = []string{fmt.Sprintf("%s=%s", cacheConfigKey, cacheConfigValues)}
+		config.Env = append(config.Env, fmt.Sprintf("%s=%s", cacheConfigKey, cacheConfigValues))
+
+		// authenticated pulls from the Docker Hub (note: never log the password): the credentials
+		// go to the configuration file of the registry, written when the container is created
+		if spec.RegistryCacheAuth != nil {
+			log.Printf("Using the Docker Hub credentials of user '%s' in the cache\n", spec.RegistryCacheAuth.Username)
+		}
 	}
 
-	id, err := createContainer(config, hostConfig, networkingConfig, defaultRegistryContainerName)
-	if err != nil {
-		return "", fmt.Errorf(" Couldn't create registry container %s\n%w", defaultRegistryContainerName, err)
+	// call some webhooks on the registry events
+	if len(spec.RegistryNotify) > 0 {
+		log.Printf("Sending registry notifications to %d endpoint(s)\n", len(spec.RegistryNotify))
+		notificationsEnv, err := registryNotificationsEnv(spec.RegistryNotify)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf(" Couldn't configure the registry notifications\n%w", err)
+		}
+		config.Env = append(config.Env, notificationsEnv)
 	}
 
-	if err := startContainer(id); err != nil {
-		return "", fmt.Errorf(" Couldn't start container %s\n%w", defaultRegistryContainerName, err)
+	// images can only be pruned (for enforcing the max size) when deletes are enabled
+	if spec.RegistryMaxSize > 0 {
+		config.Env = append(config.Env, "REGISTRY_STORAGE_DELETE_ENABLED=true")
 	}
 
-	return id, nil
-}
+	// make the registry listen on a non-default internal port
+	if registryInternalPort != defaultRegistryPort {
+		config.Env = append(config.Env, fmt.Sprintf("REGISTRY_HTTP_ADDR=0.0.0.0:%d", registryInternalPort))
+	}
 
-// getRegistryContainer looks for the registry container
-func getRegistryContainer() (string, error) {
-	ctx := context.Background()
-	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return "", fmt.Errorf("Couldn't create docker client\n%+v", err)
+	// expose the Prometheus metrics (and the pprof endpoints) of the registry on the debug server
+	// (see https://docs.docker.com/registry/configuration/#debug)
+	if spec.RegistryDebugPort > 0 {
+		log.Printf("Publishing the registry metrics on port %d\n", spec.RegistryDebugPort)
+		config.Env = append(config.Env,
+			fmt.Sprintf("REGISTRY_HTTP_DEBUG_ADDR=0.0.0.0:%d", defaultRegistryDebugPort),
+			"REGISTRY_HTTP_DEBUG_PROMETHEUS_ENABLED=true",
+			"REGISTRY_HTTP_DEBUG_PROMETHEUS_PATH=/metrics")
 	}
 
-	cFilter := filters.NewArgs()
-	cFilter.Add("name", defaultRegistryContainerName)
-	// filter with the standard list of labels of our registry
-	for k, v := range defaultRegistryContainerLabels {
-		cFilter.Add("label", fmt.Sprintf("%s=%s", k, v))
+	// only accept the clients with a certificate of the CA of the registry
+	if spec.RegistryMTLS {
+		log.Printf("Requiring client certificates in the registry (mutual TLS)\n")
+		config.Env = append(config.Env, getRegistryTLSEnv()...)
 	}
 
-	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
-	if err != nil {
-		return "", fmt.Errorf(" Couldn't list containers: %w", err)
+	// labels and environment variables given by the user (the environment overrides the settings above,
+	// but the labels used by k3d are kept)
+	for _, label := range spec.RegistryLabels {
+		key, value := splitLabel(label)
+		if _, exists := containerLabels[key]; exists {
+			log.Warnf("Ignoring the registry label %s: it's managed by k3d", key)
+			continue
+		}
+		containerLabels[key] = value
 	}
-	if len(containers) == 0 {
+	config.Env = append(config.Env, spec.RegistryEnv...)
+
+	return config, hostConfig, networkingConfig, nil
+}
+
+// parseRegistryVolumeDir returns the absolute path of the host directory of the registry storage
+// (`--registry-volume-dir`), which can't be used along with a volume
+func parseRegistryVolumeDir(dir string, volume string) (string, error) {
+	if dir == "" {
 		return "", nil
 	}
-	return containers[0].ID, nil
+	if volume != "" {
+		return "", fmt.Errorf("A registry volume (%s) and a host directory (%s) can't be used together", volume, dir)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't get the absolute path of %s\n%+v", dir, err)
+	}
+	return abs, nil
 }
 
-// connectRegistryToNetwork connects the registry container to a given network
+// ensureRegistryVolume creates the volume of a registry (given with `--registry-volume`) if it doesn't exist,
+// or its host directory (given with `--registry-volume-dir`)
+func ensureRegistryVolume(spec ClusterSpec) error {
+	if spec.RegistryVolumeDir != "" {
+		// on a remote docker host, the directory is on that host (and created by docker)
+		if isRemoteDocker() {
+			log.Warnf("Not creating the registry directory %s: docker runs on %s, where it's created by docker (owned by root) if it doesn't exist", spec.RegistryVolumeDir, os.Getenv("DOCKER_HOST"))
+			return nil
+		}
+		// created by us and not by docker, so it's owned by this user
+		if err := createDirIfNotExists(spec.RegistryVolumeDir); err != nil {
+			return fmt.Errorf(" Couldn't create the registry directory %s\n%+v", spec.RegistryVolumeDir, err)
+		}
+		return nil
+	}
+	if spec.RegistryVolume == "" {
+		return nil
+	}
+	vol, err := getVolume(spec.RegistryVolume, map[string]string{})
+	if err != nil {
+		return fmt.Errorf(" Couldn't check if volume %s exists: %w", spec.RegistryVolume, err)
+	}
+	if vol != nil {
+		log.Printf("Using existing volume %s for the Registry\n", spec.RegistryVolume)
+	} else {
+		log.Printf("Creating Registry volume %s...\n", spec.RegistryVolume)
+
+		// assign some labels (so we can recognize the volume later on)
+		volLabels := map[string]string{
+			"registry-name": spec.RegistryName,
+			"registry-port": strconv.Itoa(spec.RegistryPort),
+		}
+		for k, v := range defaultRegistryVolumeLabels {
+			volLabels[k] = v
+		}
+		if spec.RegistryPerCluster {
+			volLabels["cluster"] = spec.ClusterName
+		}
+		_, err := createVolume(spec.RegistryVolume, volLabels)
+		if err != nil {
+			return fmt.Errorf(" Couldn't create volume %s for registry: %w", spec.RegistryVolume, err)
+		}
+	}
+	return nil
+}
+
+// createRegistry creates a registry, or connect the k3d network to an existing one.
+// Without a cluster name in the spec, a standalone registry is created (not connected to any k3d network).
+func createRegistry(spec ClusterSpec) (string, error) {
+	netName := k3dNetworkName(spec.ClusterName)
+	registryContainerName := registryContainerName(spec.ClusterName, spec.RegistryPerCluster)
+	if spec.RegistryContainer != "" {
+		registryContainerName = spec.RegistryContainer
+	}
+
+	// first, check we have not already started a registry (for example, for a different k3d cluster)
+	// all the k3d clusters should share the same private registry, so if we already have a registry just connect
+	// it to the network of this cluster.
+	// (a dedicated registry has a per-cluster name, so it will never be found here)
+	cid, err := getRegistryContainer(registryContainerName)
+	if err != nil {
+		return "", err
+	}
+
+	if cid != "" && spec.ClusterName == "" {
+		return "", fmt.Errorf("Registry %s already exists", registryContainerName)
+	}
+
+	if cid != "" {
+		log.Printf("Registry already present: ensuring that it's running and connecting it to the '%s' network...\n", netName)
+		if spec.RegistryConfig != "" {
+			log.Warnf("Registry already present: ignoring the registry config %s", spec.RegistryConfig)
+		}
+		if len(spec.RegistryNotify) > 0 {
+			log.Warnln("Registry already present: ignoring the notification endpoints")
+		}
+		if spec.RegistryDebugPort > 0 {
+			log.Warnln("Registry already present: ignoring the debug port")
+		}
+		if spec.RegistryVolumeDir != "" {
+			log.Warnf("Registry already present: ignoring the registry directory %s", spec.RegistryVolumeDir)
+		}
+		if len(spec.RegistryLabels) > 0 || len(spec.RegistryEnv) > 0 {
+			log.Warnln("Registry already present: ignoring the labels and the environment variables")
+		}
+		if mtls, err := isRegistryMTLS(cid); err != nil {
+			return "", err
+		} else if mtls != spec.RegistryMTLS {
+			return "", fmt.Errorf("The existing registry %s doesn't match --registry-mtls=%t: use the same setting, or a dedicated registry with `--registry-per-cluster`", registryContainerName, spec.RegistryMTLS)
+		}
+		if err := startContainer(cid); err != nil {
+			log.Warnf("Failed to start registry container. Try starting it manually via `docker start %s`", cid)
+		}
+		if spec.RegistryRestart != "" {
+			if err := updateRestartPolicy(cid, spec.RegistryRestart); err != nil {
+				return "", err
+			}
+		}
+
+		// the existing registry could have been created with a different name: make it reachable
+		// in this cluster with both names (the nodes will use the one given for this cluster)
+		aliases := []string{spec.RegistryName}
+		existingName, err := getRegistryHostname(cid)
+		if err != nil {
+			return "", err
+		}
+		if existingName != "" && existingName != spec.RegistryName && spec.RegistryMTLS {
+			return "", fmt.Errorf("The certificate of the existing registry %s is only valid for %s: create this cluster with `--registry-name %s`", registryContainerName, existingName, existingName)
+		}
+		if existingName != "" && existingName != spec.RegistryName {
+			log.Warnf("The existing registry %s was created as %s, but this cluster uses the name %s: adding %s as an alias in the '%s' network.",
+				registryContainerName, existingName, spec.RegistryName, spec.RegistryName, netName)
+			log.Warnf("Make sure you push your images using the name the nodes use (%s), or delete this cluster and create it again with `--registry-name %s`.",
+				spec.RegistryName, existingName)
+			aliases = append(aliases, existingName)
+		}
+
+		if err := connectRegistryToNetwork(cid, netName, aliases); err != nil {
+			return "", fmt.Errorf(" Couldn't connect the registry to the '%s' network with the aliases %v (try `--registry-name %s` or a dedicated registry with `--registry-per-cluster`)\n%w",
+				netName, aliases, existingName, err)
+		}
+		if err := connectRegistryToUserNetworks(cid, spec.RegistryName, spec.RegistryNetworks); err != nil {
+			return "", err
+		}
+		return cid, nil
+	}
+
+	log.Printf("Creating Registry as %s:%d...\n", spec.RegistryName, spec.RegistryPort)
+
+	config, hostConfig, networkingConfig, err := getRegistryContainerConfig(spec)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureRegistryVolume(spec); err != nil {
+		return "", err
+	}
+
+	if err := ensureImage(config.Image, spec.PullPolicy); err != nil {
+		return "", err
+	}
+
+	id, err := createContainer(config, hostConfig, networkingConfig, registryContainerName)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create registry container %s\n%w", registryContainerName, err)
+	}
+
+	if spec.RegistryMTLS {
+		log.Printf("...Creating the certificates of the registry")
+		if err := writeRegistryTLSInContainer(spec, id); err != nil {
+			return "", err
+		}
+	}
+
+	if spec.RegistryCacheEnabled && spec.RegistryCacheAuth != nil {
+		registryConfig, err := getRegistryCacheConfig(spec.RegistryCacheAuth)
+		if err != nil {
+			return "", fmt.Errorf(" Couldn't generate the configuration of the registry cache\n%w", err)
+		}
+		if err := copyToContainer(id, defaultRegistryConfigPath, registryConfig); err != nil {
+			return "", fmt.Errorf(" Couldn't write the configuration of the registry cache\n%w", err)
+		}
+	}
+
+	if err := startContainer(id); err != nil {
+		return "", fmt.Errorf(" Couldn't start container %s\n%w", registryContainerName, err)
+	}
+
+	if err := connectRegistryToUserNetworks(id, spec.RegistryName, spec.RegistryNetworks); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// waitForRegistryReady waits for the API of a registry container to answer on its published port
+// (the container is running some time before the registry accepts connections, and the nodes could fail their first pulls)
+func waitForRegistryReady(ID string, timeoutSeconds int) error {
+	// the published port is the one of the docker host, which isn't reachable as localhost from here
+	if isRemoteDocker() {
+		log.Debugf("Not waiting for the API of the registry: docker runs on %s", os.Getenv("DOCKER_HOST"))
+		return nil
+	}
+	registry, err := getRegistryAPI(ID)
+	if err != nil {
+		return err
+	}
+	registry.client.Timeout = 2 * time.Second
+
+	start := time.Now()
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	for {
+		resp, err := registry.client.Get(registry.url + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			// a registry requiring authentication is ready too
+			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnauthorized {
+				return nil
+			}
+			err = fmt.Errorf("unexpected status %q", resp.Status)
+		}
+		log.Debugf("Registry at %s not ready yet: %+v", registry.url, err)
+		if err := checkOperation(); err != nil {
+			return err
+		}
+
+		if timeout != 0 && time.Now().After(start.Add(timeout)) {
+			return fmt.Errorf("timeout of %d seconds exceeded while waiting for the registry at %s\n%+v", timeoutSeconds, registry.url, err)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// getRegistryContainer looks for the registry container with the given name
+func getRegistryContainer(name string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	// the name filter matches substrings, so anchor it to the full container name
+	cFilter.Add("name", fmt.Sprintf("^/%s$", name))
+	// filter with the standard list of labels of our registry
+	for k, v := range defaultRegistryContainerLabels {
+		cFilter.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't list containers: %w", err)
+	}
+	if len(containers) == 0 {
+		return "", nil
+	}
+	return containers[0].ID, nil
+}
+
+// getRegistryHostname returns the hostname a registry container was created with
+func getRegistryHostname(ID string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+	if hostname, ok := registry.Config.Labels["hostname"]; ok {
+		return hostname, nil
+	}
+	return registry.Config.Hostname, nil
+}
+
+// connectRegistryToNetwork connects the registry container to a given network
 func connectRegistryToNetwork(ID string, networkID string, aliases []string) error {
 	if err := connectContainerToNetwork(ID, networkID, aliases); err != nil {
 		return err
@@ -281,12 +1051,166 @@ func connectRegistryToNetwork(ID string, networkID string, aliases []string) err
 	return nil
 }
 
+// registryNetwork is a user-defined docker network the registry is attached to (besides the k3d networks)
+type registryNetwork struct {
+	Name    string
+	Aliases []string
+}
+
+// parseRegistryNetworks parses the `--registry-network` values (Format: `<network>[:<alias>[,<alias>...]]`)
+func parseRegistryNetworks(specs []string) ([]registryNetwork, error) {
+	networks := []registryNetwork{}
+	for _, spec := range specs {
+		split := strings.SplitN(spec, ":", 2)
+		if split[0] == "" {
+			return nil, fmt.Errorf("Invalid registry network [%s] (Format: <network>[:<alias>[,<alias>...]])", spec)
+		}
+		n := registryNetwork{Name: split[0]}
+		if len(split) == 2 {
+			for _, alias := range strings.Split(split[1], ",") {
+				if alias == "" {
+					return nil, fmt.Errorf("Invalid registry network [%s]: empty alias", spec)
+				}
+				n.Aliases = append(n.Aliases, alias)
+			}
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// connectRegistryToUserNetworks attaches the registry to user-defined networks, so it's reachable from other containers
+// (like compose stacks or dev containers) with the aliases of each network (by default, the registry name)
+func connectRegistryToUserNetworks(ID string, registryName string, networks []registryNetwork) error {
+	if len(networks) == 0 {
+		return nil
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+
+	for _, n := range networks {
+		if _, connected := registry.NetworkSettings.Networks[n.Name]; connected {
+			log.Printf("Registry already connected to the '%s' network\n", n.Name)
+			continue
+		}
+		aliases := n.Aliases
+		if len(aliases) == 0 {
+			aliases = []string{registryName}
+		}
+		log.Printf("Connecting the registry to the '%s' network as %v...\n", n.Name, aliases)
+		if err := connectContainerToNetwork(ID, n.Name, aliases); err != nil {
+			return fmt.Errorf(" Couldn't connect the registry to the '%s' network (it must exist already)\n%+v", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseRestartPolicy parses a docker restart policy (`no`, `always`, `unless-stopped` or `on-failure[:MAX-RETRIES]`)
+func parseRestartPolicy(policy string) (container.RestartPolicy, error) {
+	split := strings.SplitN(policy, ":", 2)
+	restartPolicy := container.RestartPolicy{Name: split[0]}
+	switch {
+	case len(split) == 1 && (split[0] == "no" || split[0] == "always" || split[0] == "unless-stopped"):
+	case split[0] == "on-failure":
+		if len(split) == 2 {
+			retries, err := strconv.Atoi(split[1])
+			if err != nil || retries < 0 {
+				return restartPolicy, fmt.Errorf("Invalid maximum retry count in the restart policy [%s]", policy)
+			}
+			restartPolicy.MaximumRetryCount = retries
+		}
+	default:
+		return restartPolicy, fmt.Errorf("Invalid restart policy [%s] (must be one of no, always, unless-stopped or on-failure[:MAX-RETRIES])", policy)
+	}
+	return restartPolicy, nil
+}
+
+// getRestartPolicy returns the restart policy of the containers of a cluster: the one given with --restart-policy,
+// or unless-stopped with --auto-restart, or on-failure for the nodes with --self-heal
+func (spec *ClusterSpec) getRestartPolicy(node bool) container.RestartPolicy {
+	switch {
+	case spec.RestartPolicy != "":
+		policy, _ := parseRestartPolicy(spec.RestartPolicy)
+		return policy
+	case spec.AutoRestart:
+		return container.RestartPolicy{Name: "unless-stopped"}
+	case node && spec.SelfHeal:
+		return container.RestartPolicy{Name: "on-failure"}
+	}
+	return container.RestartPolicy{}
+}
+
+// updateRestartPolicy changes the restart policy of an existing container
+func updateRestartPolicy(ID string, policy string) error {
+	restartPolicy, err := parseRestartPolicy(policy)
+	if err != nil {
+		return err
+	}
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	if _, err := docker.ContainerUpdate(ctx, ID, container.UpdateConfig{RestartPolicy: restartPolicy}); err != nil {
+		return fmt.Errorf(" Couldn't set the restart policy %s in container %s\n%+v", policy, ID, err)
+	}
+	return nil
+}
+
+// validateRegistryDebugPort checks the host port the debug server of the registry is published on (0 disables it),
+// and that the registry doesn't listen on the internal port of the debug server
+func validateRegistryDebugPort(port int, registryPort int, internalPort int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("Invalid registry debug port [%d]", port)
+	}
+	if port != 0 && port == registryPort {
+		return fmt.Errorf("The registry debug port [%d] must be different from the registry port", port)
+	}
+	if port != 0 && internalPort == defaultRegistryDebugPort {
+		return fmt.Errorf("The registry internal port [%d] is the one of the debug server of the registry: choose another internal port", internalPort)
+	}
+	return nil
+}
+
+// parseRegistryBindIPs parses the comma-separated host addresses the registry port is published on
+// (IPv4 or IPv6, with or without brackets: e.g. `127.0.0.1,[::1]` for dual-stack publishing on the loopback)
+func parseRegistryBindIPs(spec string) ([]string, error) {
+	addresses := []string{}
+	for _, address := range strings.Split(spec, ",") {
+		address = strings.TrimSpace(address)
+		ip := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("Invalid registry bind address [%s] (must be an IP address, like 127.0.0.1 or ::1)", address)
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses, nil
+}
+
+// getClusterRegistryContainer looks for the registry container used by a cluster,
+// preferring a dedicated registry over the shared one
+func getClusterRegistryContainer(clusterName string) (string, error) {
+	cid, err := getRegistryContainer(registryContainerName(clusterName, true))
+	if err != nil || cid != "" {
+		return cid, err
+	}
+	return getRegistryContainer(registryContainerName(clusterName, false))
+}
+
 // disconnectRegistryFromNetwork disconnects the Registry from a Network
-// if the Registry container is not connected to any more networks, it is stopped
+// if the Registry is not used by any other cluster anymore, it is removed
 func disconnectRegistryFromNetwork(name string, keepRegistryVolume bool) error {
 	// disconnect the registry from this cluster's network
 	netName := k3dNetworkName(name)
-	cid, err := getRegistryContainer()
+	cid, err := getClusterRegistryContainer(name)
 	if err != nil {
 		return err
 	}
@@ -299,38 +1223,83 @@ func disconnectRegistryFromNetwork(name string, keepRegistryVolume bool) error {
 		return err
 	}
 
-	// check if the registry is not connected to any other networks.
-	// in that case, we can safely stop the registry container
-	networks, err := getContainerNetworks(cid)
+	// check if the registry is not used by any other cluster.
+	// in that case, we can safely remove the registry container
+	users, err := getRegistryUsers(cid)
 	if err != nil {
 		return err
 	}
-	if len(networks) == 0 {
-		log.Printf("...Removing the Registry\n")
-		volName, err := getVolumeMountedIn(cid, defaultRegistryMountPath)
-		if err != nil {
-			log.Printf("...warning: could not detect registry volume\n")
+	if len(users) == 0 {
+		if standalone, err := isStandaloneRegistry(cid); err != nil || standalone {
+			return err
 		}
+		return removeRegistry(cid, keepRegistryVolume)
+	}
+	log.Debugf("...Keeping the Registry: still used by clusters %v", users)
+
+	return nil
+}
+
+// getRegistryUsers returns the names of the existing clusters using a registry container:
+// the ones referencing it in their labels and the ones whose network it is connected to
+func getRegistryUsers(ID string) ([]string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+	registryName := strings.TrimPrefix(registry.Name, "/")
 
-		if err := removeContainer(cid); err != nil {
-			log.Println(err)
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, cluster := range clusters {
+		if cluster.server.Labels["registry"] == registryName {
+			users = append(users, cluster.name)
+			continue
 		}
+		// clusters created before the "registry" label existed
+		if _, ok := registry.NetworkSettings.Networks[k3dNetworkName(cluster.name)]; ok {
+			users = append(users, cluster.name)
+		}
+	}
+	return users, nil
+}
 
-		// check if the volume mounted in /var/lib/registry was managed by us. In that case (and only if
-		// the user does not want to keep the volume alive), delete the registry volume
-		if volName != "" {
-			vol, err := getVolume(volName, defaultRegistryVolumeLabels)
-			if err != nil {
-				return fmt.Errorf(" Couldn't remove volume for registry %s\n%w", defaultRegistryContainerName, err)
-			}
-			if vol != nil {
-				if keepRegistryVolume {
-					log.Printf("...(keeping the Registry volume %s)\n", volName)
-				} else {
-					log.Printf("...Removing the Registry volume %s\n", volName)
-					if err := deleteVolume(volName); err != nil {
-						return fmt.Errorf(" Couldn't remove volume for registry %s\n%w", defaultRegistryContainerName, err)
-					}
+// removeRegistry removes a registry container, along with its volume if it was managed by k3d
+func removeRegistry(ID string, keepRegistryVolume bool) error {
+	log.Printf("...Removing the Registry\n")
+	volName, err := getVolumeMountedIn(ID, defaultRegistryMountPath)
+	if err != nil {
+		log.Printf("...warning: could not detect registry volume\n")
+	}
+
+	if err := removeContainer(ID); err != nil {
+		log.Println(err)
+	}
+
+	// check if the volume mounted in /var/lib/registry was managed by us. In that case (and only if
+	// the user does not want to keep the volume alive), delete the registry volume
+	if volName != "" {
+		vol, err := getVolume(volName, defaultRegistryVolumeLabels)
+		if err != nil {
+			return fmt.Errorf(" Couldn't remove volume for registry %s\n%w", ID, err)
+		}
+		if vol != nil {
+			if keepRegistryVolume {
+				log.Printf("...(keeping the Registry volume %s)\n", volName)
+			} else {
+				log.Printf("...Removing the Registry volume %s\n", volName)
+				if err := deleteVolume(volName); err != nil {
+					return fmt.Errorf(" Couldn't remove volume for registry %s\n%w", ID, err)
 				}
 			}
 		}
@@ -338,3 +1307,273 @@ func disconnectRegistryFromNetwork(name string, keepRegistryVolume bool) error {
 
 	return nil
 }
+
+// isStandaloneRegistry checks if a registry was created independently of any cluster
+func isStandaloneRegistry(ID string) (bool, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	registry, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't inspect registry container %s\n%+v", ID, err)
+	}
+	return registry.Config.Labels["standalone"] == "true", nil
+}
+
+// getRegistryContainers returns all the registry containers managed by k3d
+func getRegistryContainers() ([]types.Container, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	for k, v := range defaultRegistryContainerLabels {
+		cFilter.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't list containers: %w", err)
+	}
+	return containers, nil
+}
+
+// pruneOrphanRegistries removes the registries not used by any existing cluster, returning their names
+func pruneOrphanRegistries(keepRegistryVolume bool) ([]string, error) {
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, registry := range registries {
+		name := getNodeName(registry)
+		users, err := getRegistryUsers(registry.ID)
+		if err != nil {
+			return pruned, err
+		}
+		if len(users) > 0 {
+			log.Debugf("Registry %s is used by clusters %v", name, users)
+			continue
+		}
+		if registry.Labels["standalone"] == "true" {
+			log.Debugf("Registry %s was created with `k3d registry create`: keeping it", name)
+			continue
+		}
+
+		log.Printf("Registry %s is not used by any cluster", name)
+		if err := removeRegistry(registry.ID, keepRegistryVolume); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, name)
+	}
+	return pruned, nil
+}
+
+// getRegistryStorageSize returns the size (in KiB) of the storage of a registry container
+func getRegistryStorageSize(ID string) (int, error) {
+	out, err := execInContainer(ID, []string{"du", "-sk", defaultRegistryMountPath})
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected output from du: %q", out)
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// garbageCollectRegistry runs the garbage collector of the registry and returns the space reclaimed (in KiB)
+func garbageCollectRegistry(name string, deleteUntagged bool, dryRun bool) (int, error) {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return 0, err
+	}
+	if cid == "" {
+		return 0, fmt.Errorf("No registry container %s found", name)
+	}
+
+	sizeBefore, err := getRegistryStorageSize(cid)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't get the size of the registry storage\n%+v", err)
+	}
+
+	cmd := []string{"registry", "garbage-collect", defaultRegistryConfigPath}
+	if deleteUntagged {
+		cmd = append(cmd, "--delete-untagged")
+	}
+	if dryRun {
+		cmd = append(cmd, "--dry-run")
+	}
+	out, err := execInContainer(cid, cmd)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't run the garbage collector in registry %s\n%+v", name, err)
+	}
+	log.Debugln(out)
+
+	sizeAfter, err := getRegistryStorageSize(cid)
+	if err != nil {
+		return 0, fmt.Errorf(" Couldn't get the size of the registry storage\n%+v", err)
+	}
+
+	return sizeBefore - sizeAfter, nil
+}
+
+// the anonymous volumes are named with 64 hexadecimal characters
+var anonymousVolumeRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// registryInfo summarizes the state of a registry container
+type registryInfo struct {
+	Name     string
+	Hostname string
+	Address  string
+	Image    string
+	Status   string
+	Cache    bool
+	Clusters []string
+	Metrics  string
+	Volume   string // the volume (or host directory) of the storage, empty for an anonymous volume
+}
+
+// getRegistryInfo collects the state of a registry container
+func getRegistryInfo(registry types.Container) (*registryInfo, error) {
+	info := &registryInfo{
+		Name:     getNodeName(registry),
+		Hostname: registry.Labels["hostname"],
+		Image:    registry.Image,
+		Status:   registry.State,
+	}
+
+	internalPort := strconv.Itoa(defaultRegistryPort)
+	if port, ok := registry.Labels["internal-port"]; ok {
+		internalPort = port
+	}
+	for _, port := range registry.Ports {
+		if strconv.Itoa(int(port.PrivatePort)) == internalPort && port.PublicPort != 0 {
+			info.Address = fmt.Sprintf("%s:%d", info.Hostname, port.PublicPort)
+		}
+		if port.PrivatePort == defaultRegistryDebugPort && port.PublicPort != 0 {
+			info.Metrics = fmt.Sprintf("http://%s:%d/metrics", info.Hostname, port.PublicPort)
+		}
+	}
+
+	for _, mount := range registry.Mounts {
+		if mount.Destination != defaultRegistryMountPath {
+			continue
+		}
+		if mount.Type == "bind" {
+			info.Volume = mount.Source
+		} else if !anonymousVolumeRegexp.MatchString(mount.Name) {
+			info.Volume = mount.Name
+		}
+	}
+
+	var err error
+	if info.Cache, err = isRegistryCache(registry.ID); err != nil {
+		return nil, err
+	}
+	if info.Clusters, err = getRegistryUsers(registry.ID); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// printRegistries prints a table with the registries managed by k3d
+func printRegistries() error {
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return err
+	}
+	if len(registries) == 0 {
+		return fmt.Errorf("No registries found")
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_CENTER)
+	table.SetHeader([]string{"NAME", "ADDRESS", "STATUS", "CACHE", "VOLUME", "CLUSTERS"})
+
+	for _, registry := range registries {
+		info, err := getRegistryInfo(registry)
+		if err != nil {
+			return err
+		}
+		table.Append([]string{info.Name, info.Address, info.Status, strconv.FormatBool(info.Cache), info.Volume, strings.Join(info.Clusters, ",")})
+	}
+
+	table.Render()
+	return nil
+}
+
+// printRegistryStatus prints the detailed state of a registry
+func printRegistryStatus(name string) error {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return err
+	}
+	for _, registry := range registries {
+		if registry.ID != cid {
+			continue
+		}
+		info, err := getRegistryInfo(registry)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Name:     %s\n", info.Name)
+		fmt.Printf("Address:  %s\n", info.Address)
+		fmt.Printf("Image:    %s\n", info.Image)
+		fmt.Printf("Status:   %s\n", info.Status)
+		fmt.Printf("Cache:    %t\n", info.Cache)
+		fmt.Printf("Clusters: %s\n", strings.Join(info.Clusters, ","))
+		if info.Volume != "" {
+			fmt.Printf("Volume:   %s\n", info.Volume)
+		}
+		if info.Metrics != "" {
+			fmt.Printf("Metrics:  %s\n", info.Metrics)
+		}
+		if info.Status == "running" {
+			if size, err := getRegistryStorageSize(cid); err == nil {
+				fmt.Printf("Storage:  %d KiB\n", size)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("No registry container %s found", name)
+}
+
+// deleteRegistry removes a registry, refusing to do so if some cluster still uses it (unless forced)
+func deleteRegistry(name string, keepRegistryVolume bool, force bool) error {
+	cid, err := getRegistryContainer(name)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("No registry container %s found", name)
+	}
+
+	users, err := getRegistryUsers(cid)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		if !force {
+			return fmt.Errorf("Registry %s is still used by clusters %v (use --force to delete it anyway)", name, users)
+		}
+		log.Warnf("Deleting registry %s, still used by clusters %v", name, users)
+	}
+
+	return removeRegistry(cid, keepRegistryVolume)
+}
@@ -0,0 +1,128 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	tests := []struct {
+		specs   []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			specs: []string{},
+			want:  map[string][]string{},
+		},
+		{
+			specs: []string{"docker.io=https://mirror.corp.local"},
+			want:  map[string][]string{"docker.io": {"https://mirror.corp.local"}},
+		},
+		{
+			specs: []string{"gcr.io=mirror.corp.local:5000"},
+			want:  map[string][]string{"gcr.io": {"https://mirror.corp.local:5000"}},
+		},
+		{
+			specs: []string{"docker.io=http://a.local:5000", "docker.io=https://b.local", "quay.io=http://c.local"},
+			want: map[string][]string{
+				"docker.io": {"http://a.local:5000", "https://b.local"},
+				"quay.io":   {"http://c.local"},
+			},
+		},
+		{specs: []string{"docker.io"}, wantErr: true},
+		{specs: []string{"=https://mirror.corp.local"}, wantErr: true},
+		{specs: []string{"docker.io="}, wantErr: true},
+		{specs: []string{"https://docker.io=https://mirror.corp.local"}, wantErr: true},
+		{specs: []string{"docker.io=ftp://mirror.corp.local"}, wantErr: true},
+		{specs: []string{"docker.io=https://"}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseRegistryMirrors(test.specs)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseRegistryMirrors(%q): error %v, want error %v", test.specs, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRegistryMirrors(%q) = %v, want %v", test.specs, got, test.want)
+		}
+	}
+}
+
+func TestIsClusterContainerRole(t *testing.T) {
+	tests := map[string]bool{
+		"server":        true,
+		"server-2":      true,
+		"worker-0":      true,
+		"worker-12":     true,
+		"serverlb":      true,
+		"registry":      true,
+		"probe-x8k2p":   true,
+		"cache":         false,
+		"server-mirror": false,
+		"workers":       false,
+		"serverlb-1":    false,
+		"private":       false,
+	}
+	for name, want := range tests {
+		if got := isClusterContainerRole(name); got != want {
+			t.Errorf("isClusterContainerRole(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestGetRegistryCacheConfig(t *testing.T) {
+	content, err := getRegistryCacheConfig(&registryCacheAuth{Username: "me", Password: "s3cr3t: #not a comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := struct {
+		Storage map[string]interface{} `yaml:"storage"`
+		Proxy   map[string]string      `yaml:"proxy"`
+	}{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		t.Fatalf("invalid configuration: %v\n%s", err, content)
+	}
+	want := map[string]string{"remoteurl": "https://registry-1.docker.io", "username": "me", "password": "s3cr3t: #not a comment"}
+	if !reflect.DeepEqual(config.Proxy, want) {
+		t.Errorf("proxy = %v, want %v", config.Proxy, want)
+	}
+	if _, ok := config.Storage["filesystem"]; !ok {
+		t.Errorf("the default storage is missing:\n%s", content)
+	}
+}
+
+func TestMergeRegistryConfigs(t *testing.T) {
+	registries := &Registry{
+		Configs: map[string]RegistryConfig{
+			"registry.localhost:5000": {
+				Auth: &AuthConfig{Username: "me", Password: "secret"},
+				TLS:  &TLSConfig{CAFile: "/etc/ssl/old-ca.crt", InsecureSkipVerify: true},
+			},
+			"other.localhost:5000": {Auth: &AuthConfig{Username: "other"}},
+		},
+	}
+	mergeRegistryConfigs(registries, map[string]RegistryConfig{
+		"registry.localhost:5000": {TLS: &TLSConfig{CAFile: "/etc/ssl/ca.crt", CertFile: "/etc/ssl/client.cert"}},
+		"new.localhost:5000":      {TLS: &TLSConfig{KeyFile: "/etc/ssl/client.key"}},
+	})
+	want := map[string]RegistryConfig{
+		"registry.localhost:5000": {
+			Auth: &AuthConfig{Username: "me", Password: "secret"},
+			TLS:  &TLSConfig{CAFile: "/etc/ssl/ca.crt", CertFile: "/etc/ssl/client.cert", InsecureSkipVerify: true},
+		},
+		"other.localhost:5000": {Auth: &AuthConfig{Username: "other"}},
+		"new.localhost:5000":   {TLS: &TLSConfig{KeyFile: "/etc/ssl/client.key"}},
+	}
+	if !reflect.DeepEqual(registries.Configs, want) {
+		t.Errorf("configs = %+v, want %+v", registries.Configs, want)
+	}
+
+	empty := &Registry{}
+	mergeRegistryConfigs(empty, nil)
+	if empty.Configs != nil {
+		t.Errorf("configs = %+v, want nil", empty.Configs)
+	}
+}
@@ -0,0 +1,357 @@
+package run
+
+/*
+ * The functions in this file rename a cluster (`k3d rename`): docker can't rename networks and volumes,
+ * nor change the labels of containers, so the containers, the network and the volumes of the cluster are
+ * re-created with the new name, taking over the data of the old ones, and the old ones are removed.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// renameClusterString replaces the names of the containers and volumes of a cluster in a string
+func renameClusterString(s string, src, dst string) string {
+	return strings.ReplaceAll(s, fmt.Sprintf("%s-%s-", defaultContainerNamePrefix, src), fmt.Sprintf("%s-%s-", defaultContainerNamePrefix, dst))
+}
+
+// getRenameOrder ranks the containers of a cluster for re-creating them: the nodes (the server first),
+// the registries, the other containers, and the ones sharing the volumes of another container last
+func getRenameOrder(info types.ContainerJSON) int {
+	switch {
+	case len(info.HostConfig.VolumesFrom) > 0:
+		return 4
+	case info.Config.Labels["component"] == "server":
+		return 0
+	case info.Config.Labels["component"] == "worker":
+		return 1
+	case info.Config.Labels["component"] == "registry":
+		return 2
+	}
+	return 3
+}
+
+// getRenamedContainerConfig returns the configuration of a container of a cluster re-created with the new name
+func getRenamedContainerConfig(info types.ContainerJSON, src, dst string, volumeNames map[string]string, ids map[string]string) (*container.Config, *container.HostConfig, *network.NetworkingConfig) {
+	config := *info.Config
+	config.Hostname = renameClusterString(config.Hostname, src, dst)
+	config.Cmd = []string{}
+	for _, arg := range info.Config.Cmd {
+		config.Cmd = append(config.Cmd, renameClusterString(arg, src, dst))
+	}
+	config.Env = []string{}
+	for _, env := range info.Config.Env {
+		config.Env = append(config.Env, renameClusterString(env, src, dst))
+	}
+	volumes := getNodeVolumes(info)
+	config.Labels = map[string]string{}
+	for k, v := range info.Config.Labels {
+		config.Labels[k] = v
+	}
+	config.Labels["cluster"] = dst
+	config.Labels[nodeVolumesLabel] = getTakenVolumes(info, volumes)
+
+	hostConfig := *info.HostConfig
+	hostConfig.Binds = []string{}
+	for _, bind := range info.HostConfig.Binds {
+		split := strings.SplitN(bind, ":", 2)
+		if newName, ok := volumeNames[split[0]]; ok && len(split) == 2 {
+			bind = newName + ":" + split[1]
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+	hostConfig.Binds = append(hostConfig.Binds, volumes...)
+	hostConfig.VolumesFrom = []string{}
+	for _, from := range info.HostConfig.VolumesFrom {
+		if id, ok := ids[from]; ok {
+			from = id
+		}
+		hostConfig.VolumesFrom = append(hostConfig.VolumesFrom, from)
+	}
+	if string(hostConfig.NetworkMode) == k3dNetworkName(src) {
+		hostConfig.NetworkMode = container.NetworkMode(k3dNetworkName(dst))
+	}
+
+	aliases := []string{}
+	if settings, ok := info.NetworkSettings.Networks[k3dNetworkName(src)]; ok {
+		for _, alias := range settings.Aliases {
+			// the short ID is added by docker to every container
+			if !strings.HasPrefix(info.ID, alias) {
+				aliases = append(aliases, renameClusterString(alias, src, dst))
+			}
+		}
+	}
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			k3dNetworkName(dst): {
+				Aliases: aliases,
+			},
+		},
+	}
+	return &config, &hostConfig, networkingConfig
+}
+
+// renameCluster re-creates the containers, the network, the volumes and the directory of a cluster with a new name
+func renameCluster(src, dst string, timeoutSeconds int) error {
+	cluster, err := getCluster(src)
+	if err != nil {
+		return err
+	}
+	if _, err := getCluster(dst); err == nil {
+		return fmt.Errorf("Cluster %s already exists", dst)
+	}
+	if len(cluster.servers) > 0 {
+		return fmt.Errorf("Cluster %s has %d servers: renaming the members of the embedded etcd is not supported", src, len(cluster.servers)+1)
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	/*
+	 * (1) The containers of the cluster, and the other containers in its network (shared registries, datastore)
+	 */
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", src))
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the containers of cluster %s\n%+v", src, err)
+	}
+	infos := []types.ContainerJSON{}
+	owned := map[string]bool{}
+	for _, c := range containers {
+		info, err := docker.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return fmt.Errorf(" Couldn't inspect container %s\n%+v", c.ID, err)
+		}
+		infos = append(infos, info)
+		owned[info.ID] = true
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return getRenameOrder(infos[i]) < getRenameOrder(infos[j])
+	})
+
+	srcNetwork, err := getClusterNetwork(src)
+	if err != nil {
+		return err
+	}
+	cids, err := getContainersInNetwork(srcNetwork)
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the containers of network %s\n%+v", k3dNetworkName(src), err)
+	}
+	externals := []types.ContainerJSON{}
+	for _, cid := range cids {
+		if owned[cid] {
+			continue
+		}
+		info, err := docker.ContainerInspect(ctx, cid)
+		if err != nil {
+			return fmt.Errorf(" Couldn't inspect container %s\n%+v", cid, err)
+		}
+		externals = append(externals, info)
+	}
+
+	log.Printf("...Stopping the containers of cluster %s", src)
+	for _, info := range infos {
+		if info.State.Running {
+			if err := docker.ContainerStop(ctx, info.ID, nil); err != nil {
+				return fmt.Errorf(" Couldn't stop container %s\n%+v", info.Name, err)
+			}
+		}
+	}
+
+	/*
+	 * (2) The new network and volumes (and containers), removed if anything fails
+	 */
+	volumeNames := map[string]string{}
+	ids := map[string]string{}
+	rollback := func() {
+		log.Printf("Restoring cluster %s", src)
+		for _, id := range ids {
+			// the volumes belong to the old containers
+			if err := docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+				log.Warningln(err)
+			}
+		}
+		for _, newName := range volumeNames {
+			if err := deleteVolume(newName); err != nil {
+				log.Warningln(err)
+			}
+		}
+		if err := deleteClusterNetwork(dst); err != nil {
+			log.Warningln(err)
+		}
+		for _, info := range infos {
+			if info.State.Running {
+				if err := startContainer(info.ID); err != nil {
+					log.Warningf("Couldn't start container %s\n%+v", info.Name, err)
+				}
+			}
+		}
+	}
+
+	if _, err := createClusterNetwork(dst); err != nil {
+		rollback()
+		return err
+	}
+
+	volumes, err := getK3dVolumes(src)
+	if err != nil {
+		rollback()
+		return err
+	}
+	for _, vol := range volumes {
+		newName := renameClusterString(vol.Name, src, dst)
+		if newName == vol.Name {
+			log.Warningf("Volume %s keeps its name (and stays labelled as a volume of cluster %s)", vol.Name, src)
+			continue
+		}
+		labels := map[string]string{}
+		for k, v := range vol.Labels {
+			labels[k] = v
+		}
+		labels["cluster"] = dst
+		log.Printf("...Copying volume %s to %s", vol.Name, newName)
+		if _, err := createVolume(newName, labels); err != nil {
+			rollback()
+			return fmt.Errorf(" Couldn't create volume %s\n%+v", newName, err)
+		}
+		volumeNames[vol.Name] = newName
+		helperName := fmt.Sprintf("%s-%s-rename", defaultContainerNamePrefix, dst)
+		if err := runHelperContainer(helperName, cluster.server.Image, "", []string{vol.Name + ":/from", newName + ":/to"},
+			[]string{"/bin/sh", "-c", "cp -a /from/. /to/"}); err != nil {
+			rollback()
+			return fmt.Errorf(" Couldn't copy volume %s\n%+v", vol.Name, err)
+		}
+	}
+
+	serverNames := []string{}
+	for _, info := range infos {
+		config, hostConfig, networkingConfig := getRenamedContainerConfig(info, src, dst, volumeNames, ids)
+		name := renameClusterString(strings.TrimPrefix(info.Name, "/"), src, dst)
+		log.Printf("...Creating %s", name)
+		id, err := createContainer(config, hostConfig, networkingConfig, name)
+		if err != nil {
+			rollback()
+			return err
+		}
+		ids[info.ID] = id
+
+		switch info.Config.Labels["component"] {
+		case "server":
+			serverNames = append(serverNames, name)
+			err = copyNodeConfig(info.ID, id, nodeUpgradePaths)
+		case "worker":
+			err = copyNodeConfig(info.ID, id, nodeUpgradePaths)
+		case "registry":
+			err = copyNodeConfig(info.ID, id, []string{defaultRegistryTLSDir})
+		case "serverlb":
+			spec := &ClusterSpec{APIPort: apiPort{Port: getServerAPIPort(infos[0])}}
+			err = copyToContainer(id, "/etc/nginx/nginx.conf", []byte(getServerLBConfig(spec, serverNames)))
+		}
+		if err != nil {
+			rollback()
+			return fmt.Errorf(" Couldn't copy the files of %s\n%+v", name, err)
+		}
+	}
+
+	/*
+	 * (3) Switching to the new containers
+	 */
+	for _, info := range externals {
+		name := strings.TrimPrefix(info.Name, "/")
+		aliases := []string{}
+		if settings, ok := info.NetworkSettings.Networks[k3dNetworkName(src)]; ok {
+			for _, alias := range settings.Aliases {
+				if !strings.HasPrefix(info.ID, alias) {
+					aliases = append(aliases, alias)
+				}
+			}
+		}
+		log.Printf("...Moving %s to the network %s", name, k3dNetworkName(dst))
+		if err := connectContainerToNetwork(info.ID, k3dNetworkName(dst), aliases); err != nil {
+			log.Warningf("Couldn't connect %s to network %s\n%+v", name, k3dNetworkName(dst), err)
+		}
+		if err := disconnectContainerFromNetwork(info.ID, srcNetwork); err != nil {
+			log.Warningf("Couldn't disconnect %s from network %s\n%+v", name, k3dNetworkName(src), err)
+		}
+	}
+
+	for _, info := range infos {
+		if info.State.Running {
+			if err := startContainer(ids[info.ID]); err != nil {
+				log.Warningf("Couldn't start %s\n%+v", renameClusterString(strings.TrimPrefix(info.Name, "/"), src, dst), err)
+			}
+		}
+	}
+
+	log.Printf("...Removing the containers, the network and the volumes of cluster %s", src)
+	for _, info := range infos {
+		// the volumes belong to the new containers now
+		if err := docker.ContainerRemove(ctx, info.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Warningln(err)
+		}
+	}
+	for oldName := range volumeNames {
+		if err := deleteVolume(oldName); err != nil {
+			log.Warningln(err)
+		}
+	}
+	if err := deleteClusterNetwork(src); err != nil {
+		log.Warningln(err)
+	}
+
+	/*
+	 * (4) The directory of the cluster, its kubeconfig (re-created on the next `get-kubeconfig`) and its nodes
+	 */
+	srcDir, _ := getClusterDir(src)
+	dstDir, err := getClusterDir(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(srcDir, dstDir); err != nil {
+		log.Warningf("Couldn't rename the directory of the cluster: creating a new one\n%+v", err)
+		createClusterDir(dst)
+	}
+	if err := writeClusterDirInfo(dst); err != nil {
+		log.Warningln(err)
+	}
+	if err := os.Remove(path.Join(dstDir, "kubeconfig.yaml")); err != nil && !os.IsNotExist(err) {
+		log.Warningln(err)
+	}
+
+	// the renamed nodes join the cluster as new nodes
+	if cluster.server.State == "running" {
+		serverID := ids[cluster.server.ID]
+		if err := waitForContainerLogMessage(serverID, "Wrote kubeconfig", timeoutSeconds); err != nil {
+			return fmt.Errorf(" Server of cluster %s didn't come up\n%+v", dst, err)
+		}
+		for _, node := range cluster.nodes() {
+			if _, err := kubectl(serverID, "delete", "node", getNodeName(node), "--ignore-not-found"); err != nil {
+				log.Warningf("Couldn't delete the old node %s: you may want to `kubectl delete node %s`\n%+v", getNodeName(node), getNodeName(node), err)
+			}
+		}
+	}
+
+	if err := recordClusterSpec(dst); err != nil {
+		log.Warningf("Couldn't record the configuration of cluster %s\n%+v", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package run
+
+/*
+ * The functions in this file reset a cluster to a clean state (`k3d reset`), wiping the
+ * workloads and the datastore but keeping the containers, their network, volumes and registries.
+ */
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// the datastore of k3s (sqlite or the embedded etcd) in the server
+const k3sDatastoreDir = "/var/lib/rancher/k3s/server/db"
+
+// runHelperContainer runs a command in a temporary container sharing the volumes of another one
+// (or mounting some volumes), and waits for it
+func runHelperContainer(name string, image string, volumesFrom string, binds []string, cmd []string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	config := &container.Config{
+		Image:      image,
+		Entrypoint: cmd[:1],
+		Cmd:        cmd[1:],
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "helper",
+		},
+	}
+	hostConfig := &container.HostConfig{
+		Binds: binds,
+	}
+	if volumesFrom != "" {
+		hostConfig.VolumesFrom = []string{volumesFrom}
+	}
+	id, err := createContainer(config, hostConfig, &network.NetworkingConfig{}, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Warningf("Couldn't remove the helper container %s\n%+v", name, err)
+		}
+	}()
+
+	statusCh, errCh := docker.ContainerWait(ctx, id, container.WaitConditionNextExit)
+	if err := startContainer(id); err != nil {
+		return fmt.Errorf(" Couldn't start container %s\n%+v", name, err)
+	}
+	select {
+	case err := <-errCh:
+		return fmt.Errorf(" Couldn't wait for container %s\n%+v", name, err)
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return fmt.Errorf("Command %v failed in container %s with exit code %d", cmd, name, status.StatusCode)
+		}
+	}
+	return nil
+}
+
+// resetCluster stops the nodes of a cluster, wipes the datastore of the server (replacing it by the one of
+// a sqlite snapshot, if given) and starts the nodes again.
+// The certificates, the token and the kubeconfig of the cluster are kept.
+func resetCluster(clusterName string, snapshotFile string) error {
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return err
+	}
+	cluster, ok := clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("No cluster with name '%s' found", clusterName)
+	}
+	if cluster.server.Labels["datastore"] == "external" {
+		return fmt.Errorf("Cluster %s uses an external datastore: reset it with the tools of the datastore", clusterName)
+	}
+	if len(cluster.servers) > 0 {
+		return fmt.Errorf("Cluster %s has %d servers: resetting the datastore of an HA cluster is not supported", clusterName, len(cluster.servers)+1)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	log.Println("...Stopping the nodes")
+	for _, worker := range cluster.workers {
+		if err := docker.ContainerStop(ctx, worker.ID, nil); err != nil {
+			return fmt.Errorf(" Couldn't stop worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+	if err := docker.ContainerStop(ctx, cluster.server.ID, nil); err != nil {
+		return fmt.Errorf(" Couldn't stop the server of cluster %s\n%+v", clusterName, err)
+	}
+
+	log.Println("...Wiping the datastore")
+	helperName := fmt.Sprintf("%s-%s-reset", defaultContainerNamePrefix, clusterName)
+	if err := runHelperContainer(helperName, cluster.server.Image, cluster.server.ID, nil, []string{"/bin/sh", "-c", fmt.Sprintf("rm -rf %s/*", k3sDatastoreDir)}); err != nil {
+		return fmt.Errorf(" Couldn't wipe the datastore (the nodes are stopped)\n%+v", err)
+	}
+	if snapshotFile != "" {
+		log.Printf("...Copying the datastore of %s", snapshotFile)
+		if err := copySnapshotDatastore(snapshotFile, cluster.server.ID); err != nil {
+			return fmt.Errorf(" Couldn't copy the snapshot into the server (the nodes are stopped)\n%+v", err)
+		}
+	}
+
+	log.Println("...Starting the nodes")
+	if err := docker.ContainerStart(ctx, cluster.server.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't start the server of cluster %s\n%+v", clusterName, err)
+	}
+	for _, worker := range cluster.workers {
+		if err := docker.ContainerStart(ctx, worker.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf(" Couldn't start worker %s\n%+v", getNodeName(worker), err)
+		}
+	}
+	return nil
+}
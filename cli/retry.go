@@ -0,0 +1,91 @@
+package run
+
+/*
+ * The functions in this file retry the docker operations creating a cluster (creating and starting containers,
+ * creating and connecting networks) when the daemon fails transiently, e.g. with a connection reset, instead of
+ * failing (and rolling back) the whole creation. A name conflict is not retried: after a failed attempt, it's
+ * the object created by the daemon for that attempt when it has the labels requested.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	log "github.com/sirupsen/logrus"
+)
+
+// how many times a docker operation is attempted, and the delay before the first retry (doubled after every attempt)
+var (
+	dockerRetryAttempts = 3
+	dockerRetryBackoff  = time.Second
+)
+
+// transientDockerErrors are the messages of the errors of the daemon (or of the connection to it) worth a retry
+var transientDockerErrors = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected EOF",
+	"i/o timeout",
+	"TLS handshake timeout",
+}
+
+// SetDockerRetries configures the retries of the docker operations (`--docker-retries`, `--docker-retry-backoff`)
+func SetDockerRetries(attempts int, backoff time.Duration) error {
+	if attempts < 1 {
+		return fmt.Errorf("Invalid value for '--docker-retries' (set '%d'): at least one attempt is needed", attempts)
+	}
+	if backoff < 0 {
+		return fmt.Errorf("Negative value for '--docker-retry-backoff' not allowed (set '%s')", backoff)
+	}
+	dockerRetryAttempts = attempts
+	dockerRetryBackoff = backoff
+	return nil
+}
+
+// isTransientDockerError tells if a docker operation may succeed when retried
+func isTransientDockerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if client.IsErrConnectionFailed(err) || errdefs.IsUnavailable(err) {
+		return true
+	}
+	for _, message := range transientDockerErrors {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRequestedLabels tells if an object conflicting with the creation retried has the labels requested, i.e. if it's
+// the one created by the daemon in an attempt which failed on our side (e.g. with a connection reset)
+func hasRequestedLabels(labels map[string]string, requested map[string]string) bool {
+	if len(requested) == 0 {
+		return false
+	}
+	for k, v := range requested {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// retryDocker runs a docker operation until it succeeds, fails with a permanent error, or runs out of attempts
+func retryDocker(operation string, fn func() error) error {
+	backoff := dockerRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= dockerRetryAttempts || !isTransientDockerError(err) {
+			return err
+		}
+		log.Warningf("Couldn't %s (attempt %d/%d), retrying in %s: %v", operation, attempt, dockerRetryAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
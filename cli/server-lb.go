@@ -0,0 +1,233 @@
+package run
+
+/*
+ * The functions in this file manage the control plane of the HA clusters (`--servers`): the servers share
+ * the embedded etcd of the first one, and a load balancer in front of them publishes the API port,
+ * so the kubeconfig and the workers keep working when any of the servers is down.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// image of the load balancer in front of the servers of an HA cluster
+	defaultServerLBImage = "docker.io/library/nginx:stable-alpine"
+
+	// maximum time waited for each server of an HA cluster to join, when `--wait` is not set
+	defaultServerJoinTimeout = 300
+)
+
+// getAPIPortSpec returns the port spec publishing the API port on the host
+func getAPIPortSpec(spec *ClusterSpec) string {
+	hostIP := "0.0.0.0"
+	if spec.APIPort.Host != "" {
+		hostIP = spec.APIPort.HostIP
+	}
+	return fmt.Sprintf("%s:%s:%s/tcp", hostIP, spec.APIPort.Port, spec.APIPort.Port)
+}
+
+// getServerLBConfig returns the nginx configuration of the load balancer: a TCP proxy
+// to the API port of the servers, skipping the servers not answering
+func getServerLBConfig(spec *ClusterSpec, serverNames []string) string {
+	var b bytes.Buffer
+	b.WriteString("worker_processes 1;\nevents { worker_connections 1024; }\nstream {\n  upstream servers {\n")
+	for _, name := range serverNames {
+		fmt.Fprintf(&b, "    server %s:%s max_fails=1 fail_timeout=10s;\n", name, spec.APIPort.Port)
+	}
+	b.WriteString("  }\n  server {\n")
+	fmt.Fprintf(&b, "    listen %s;\n    proxy_pass servers;\n    proxy_connect_timeout 2s;\n", spec.APIPort.Port)
+	b.WriteString("  }\n}\n")
+	return b.String()
+}
+
+// createServerLB creates/starts the load balancer in front of the servers of an HA cluster
+func createServerLB(spec *ClusterSpec, serverNames []string) (string, error) {
+	containerName := GetContainerName("serverlb", spec.ClusterName, -1)
+
+	publishedPorts, err := CreatePublishedPorts([]string{getAPIPortSpec(spec)})
+	if err != nil {
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: publishedPorts.PortBindings,
+		Init:         &[]bool{true}[0],
+	}
+	hostConfig.RestartPolicy = spec.getRestartPolicy(false)
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			k3dNetworkName(spec.ClusterName): {
+				Aliases: []string{containerName},
+			},
+		},
+	}
+
+	config := &container.Config{
+		Hostname:     containerName,
+		Image:        defaultServerLBImage,
+		ExposedPorts: publishedPorts.ExposedPorts,
+		Labels: map[string]string{
+			"app":       "k3d",
+			"component": "serverlb",
+			"cluster":   spec.ClusterName,
+		},
+	}
+
+	if err := ensureImage(defaultServerLBImage, spec.PullPolicy); err != nil {
+		return "", err
+	}
+	id, err := createContainer(config, hostConfig, networkingConfig, containerName)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create container %s\n%+v", containerName, err)
+	}
+
+	if err := copyToContainer(id, "/etc/nginx/nginx.conf", []byte(getServerLBConfig(spec, serverNames))); err != nil {
+		return "", fmt.Errorf(" Couldn't copy the configuration of the load balancer\n%+v", err)
+	}
+
+	if err := startContainer(id); err != nil {
+		return "", fmt.Errorf(" Couldn't start container %s\n%+v", containerName, err)
+	}
+
+	return id, nil
+}
+
+// getServerLBContainer returns the ID of the load balancer of a cluster (empty if it's not an HA cluster)
+func getServerLBContainer(clusterName string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", "component=serverlb")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+	if len(containers) == 0 {
+		return "", nil
+	}
+	return containers[0].ID, nil
+}
+
+// removeServerLB removes the load balancer of a cluster, if there is one
+func removeServerLB(clusterName string) error {
+	cid, err := getServerLBContainer(clusterName)
+	if err != nil || cid == "" {
+		return err
+	}
+	log.Println("...Removing the load balancer of the servers")
+	return removeContainer(cid)
+}
+
+// updateServerLB sets the current servers of a cluster in its load balancer (if it has one), restarting it
+func updateServerLB(spec *ClusterSpec) error {
+	lbID, err := getServerLBContainer(spec.ClusterName)
+	if err != nil || lbID == "" {
+		return err
+	}
+	cluster, err := getCluster(spec.ClusterName)
+	if err != nil {
+		return err
+	}
+	names := []string{getNodeName(cluster.server)}
+	for _, server := range cluster.servers {
+		names = append(names, getNodeName(server))
+	}
+	sort.Strings(names[1:])
+
+	log.Printf("Updating the load balancer with the servers %v...", names)
+	if err := copyToContainer(lbID, "/etc/nginx/nginx.conf", []byte(getServerLBConfig(spec, names))); err != nil {
+		return fmt.Errorf(" Couldn't copy the configuration of the load balancer\n%+v", err)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	if err := docker.ContainerRestart(ctx, lbID, nil); err != nil {
+		return fmt.Errorf(" Couldn't restart the load balancer of cluster %s\n%+v", spec.ClusterName, err)
+	}
+	return nil
+}
+
+// createHAServers creates the servers of an HA cluster one at a time, each one joining the etcd
+// cluster after the previous one is up, and waits for all of them to be in the cluster.
+// It returns the IDs of the servers, the one that initialized the cluster first.
+func createHAServers(spec *ClusterSpec, timeoutSeconds int) ([]string, error) {
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+
+	ids := []string{}
+	names := []string{}
+	for i := 0; i < spec.Servers; i++ {
+		id, err := createServer(spec, i)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+		name := GetContainerName("server", spec.ClusterName, i)
+		if i == 0 {
+			name = GetContainerName("server", spec.ClusterName, -1)
+		}
+		names = append(names, name)
+
+		log.Printf("Waiting for server %s to be up...", name)
+		if err := waitForContainerLogMessage(id, "Wrote kubeconfig", timeoutSeconds); err != nil {
+			return ids, fmt.Errorf(" Server %s didn't come up\n%+v", name, err)
+		}
+	}
+
+	log.Printf("Waiting for the %d servers to be in the cluster...", spec.Servers)
+	if err := waitForServers(ids[0], spec.Servers, timeoutSeconds); err != nil {
+		return ids, err
+	}
+
+	if _, err := createServerLB(spec, names); err != nil {
+		return ids, err
+	}
+	return ids, nil
+}
+
+// waitForServers waits for a number of servers to be Ready nodes of the cluster (the etcd quorum being there)
+func waitForServers(serverID string, count int, timeoutSeconds int) error {
+	start := time.Now()
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	ready := 0
+	for {
+		out, err := kubectl(serverID, "get", "nodes", "--selector", "node-role.kubernetes.io/master",
+			"-o", `jsonpath={range .items[*]}{.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}`)
+		if err == nil {
+			ready = strings.Count(out, "True")
+			if ready >= count {
+				return nil
+			}
+		}
+		log.Debugf("%d/%d servers ready (%v)", ready, count, err)
+
+		if time.Now().After(start.Add(timeout)) {
+			return fmt.Errorf("timeout of %d seconds exceeded while waiting for the servers: %d/%d ready", timeoutSeconds, ready, count)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
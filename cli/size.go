@@ -0,0 +1,219 @@
+package run
+
+/*
+ * The functions in this file handle the cluster size presets (`--size`)
+ * and the resource limits of the node containers (`--memory`, `--cpus`, and per role `--servers-memory`, ...),
+ * and the GPUs given to them (`--gpus`).
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+// clusterSize is a preset for the number of nodes of a cluster and their resources
+type clusterSize struct {
+	Workers int
+	Memory  string // per node
+	CPUs    string // per node
+}
+
+// clusterSizes are the presets available with `--size`
+var clusterSizes = map[string]clusterSize{
+	"small":  {Workers: 0, Memory: "1g", CPUs: "1"},
+	"medium": {Workers: 2, Memory: "2g", CPUs: "2"},
+	"large":  {Workers: 4, Memory: "4g", CPUs: "4"},
+}
+
+// nodeResources are the resource limits of every node container (0 means no limit)
+type nodeResources struct {
+	Memory   int64 // bytes
+	NanoCPUs int64
+
+	// the resources of the docker host reserved for the system in the kubelet, for the allocatable resources of
+	// the node to be its limits: the kubelet reads the capacity of the host, not of its container
+	SystemReserved string
+
+	GPUs *container.DeviceRequest // the GPUs of the docker host given to the node
+}
+
+// minGPUAPIVersion is the docker API which knows about the device requests: older APIs ignore them silently
+const minGPUAPIVersion = "1.40"
+
+// getClusterSizeNames returns the names of the presets, sorted
+func getClusterSizeNames() []string {
+	names := []string{}
+	for name := range clusterSizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyClusterSize sets the flags of a size preset (`--workers`, `--memory` and `--cpus`)
+// that were not explicitly given in the command line
+func applyClusterSize(c *cli.Context) error {
+	name := c.String("size")
+	if name == "" {
+		return nil
+	}
+	size, ok := clusterSizes[name]
+	if !ok {
+		return fmt.Errorf("Invalid cluster size [%s] (must be one of %v)", name, getClusterSizeNames())
+	}
+
+	presets := map[string]string{
+		"workers": strconv.Itoa(size.Workers),
+		"memory":  size.Memory,
+		"cpus":    size.CPUs,
+	}
+	for flag, value := range presets {
+		if c.IsSet(flag) {
+			continue
+		}
+		if err := c.Set(flag, value); err != nil {
+			return fmt.Errorf(" Couldn't apply the '%s' size to --%s\n%+v", name, flag, err)
+		}
+	}
+	return nil
+}
+
+// parseNodeResources parses the resource limits of the nodes (e.g. `2g` and `1.5`)
+func parseNodeResources(memory string, cpus string) (nodeResources, error) {
+	resources := nodeResources{}
+	if memory != "" {
+		bytes, err := units.RAMInBytes(memory)
+		if err != nil || bytes <= 0 {
+			return resources, fmt.Errorf("Invalid memory limit [%s] (use something like `2g`)", memory)
+		}
+		resources.Memory = bytes
+	}
+	if cpus != "" {
+		n, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || n <= 0 {
+			return resources, fmt.Errorf("Invalid CPU limit [%s] (use something like `1.5`)", cpus)
+		}
+		resources.NanoCPUs = int64(n * 1e9)
+	}
+	return resources, nil
+}
+
+// override returns the resource limits with the ones given for a role (e.g. `--servers-memory`), when they are
+func (r nodeResources) override(memory string, cpus string) (nodeResources, error) {
+	roleResources, err := parseNodeResources(memory, cpus)
+	if err != nil {
+		return r, err
+	}
+	if roleResources.Memory == 0 {
+		roleResources.Memory = r.Memory
+	}
+	if roleResources.NanoCPUs == 0 {
+		roleResources.NanoCPUs = r.NanoCPUs
+	}
+	roleResources.GPUs = r.GPUs
+	return roleResources, nil
+}
+
+// getRecordedNodeResources returns the resource limits of the nodes of a role ("server" or "agent") recorded at the
+// creation of a cluster: `--memory`, `--cpus`, their overrides for the role (e.g. `--agents-memory`) and `--gpus`
+func getRecordedNodeResources(flags map[string]string, role string) (nodeResources, error) {
+	resources, err := parseNodeResources(flags["memory"], flags["cpus"])
+	if err != nil {
+		return resources, err
+	}
+	if flags["gpus"] != "" {
+		if resources.GPUs, err = parseGPUs(flags["gpus"]); err != nil {
+			return resources, err
+		}
+	}
+	prefix := "agents"
+	if role == "server" {
+		prefix = "servers"
+	}
+	return resources.override(flags[prefix+"-memory"], flags[prefix+"-cpus"])
+}
+
+// setSystemReserved computes the resources of the docker host to reserve for the kubelet to report the limits
+func (r *nodeResources) setSystemReserved() error {
+	if r.Memory == 0 && r.NanoCPUs == 0 {
+		return nil
+	}
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	info, err := docker.Info(operationContext())
+	if err != nil {
+		return fmt.Errorf(" Couldn't get the resources of the docker host\n%+v", err)
+	}
+
+	reserved := []string{}
+	if hostCPUs := int64(info.NCPU) * 1e9; r.NanoCPUs > 0 && r.NanoCPUs < hostCPUs {
+		reserved = append(reserved, fmt.Sprintf("cpu=%dm", (hostCPUs-r.NanoCPUs)/1e6))
+	}
+	if r.Memory > 0 && r.Memory < info.MemTotal {
+		reserved = append(reserved, fmt.Sprintf("memory=%dMi", (info.MemTotal-r.Memory)/units.MiB))
+	}
+	if len(reserved) > 0 {
+		r.SystemReserved = strings.Join(reserved, ",")
+	}
+	return nil
+}
+
+// getKubeletArgs returns the arguments of k3s making the kubelet of a node report its limits
+func (r nodeResources) getKubeletArgs() []string {
+	if r.SystemReserved == "" {
+		return []string{}
+	}
+	return []string{fmt.Sprintf("--kubelet-arg=system-reserved=%s", r.SystemReserved)}
+}
+
+// parseGPUs parses the GPUs given to the nodes, as `docker run --gpus` does: `all`, a number of GPUs,
+// or `device=<ID>[,<ID>...]`
+func parseGPUs(gpus string) (*container.DeviceRequest, error) {
+	request := &container.DeviceRequest{Capabilities: [][]string{{"gpu"}}}
+	switch {
+	case gpus == "all":
+		request.Count = -1
+	case strings.HasPrefix(gpus, "device="):
+		request.DeviceIDs = strings.Split(strings.TrimPrefix(gpus, "device="), ",")
+	default:
+		count, err := strconv.Atoi(gpus)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("Invalid GPUs [%s] (use `all`, a number of GPUs or `device=<ID>[,<ID>...]`)", gpus)
+		}
+		request.Count = count
+	}
+	return request, nil
+}
+
+// checkGPUSupport checks the docker daemon can give GPUs to the containers
+func checkGPUSupport() error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	docker.NegotiateAPIVersion(ctx)
+	if versions.LessThan(docker.ClientVersion(), minGPUAPIVersion) {
+		return fmt.Errorf("--gpus needs docker >= 19.03 (API v%s), the docker daemon only supports the API v%s", minGPUAPIVersion, docker.ClientVersion())
+	}
+	return nil
+}
+
+// addToHostConfig sets the resource limits (and the GPUs) in the host config of a node container
+func (r nodeResources) addToHostConfig(hostConfig *container.HostConfig) {
+	hostConfig.Memory = r.Memory
+	hostConfig.NanoCPUs = r.NanoCPUs
+	if r.GPUs != nil {
+		hostConfig.DeviceRequests = []container.DeviceRequest{*r.GPUs}
+	}
+}
@@ -0,0 +1,349 @@
+package run
+
+/*
+ * The functions in this file save the datastore of a cluster into a file of the host (`k3d snapshot save`),
+ * restore it in the cluster (`k3d snapshot restore`, which restores the etcd snapshots taken by k3s too)
+ * and seed new clusters with it (`k3d create --snapshot`).
+ * A snapshot is a tar archive with the token of the cluster and either a copy of the sqlite database
+ * of the server, or a snapshot of its embedded etcd taken by k3s.
+ */
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the token of the cluster in the server: k3s only accepts the datastore of a cluster with its token
+	k3sServerTokenFile = "/var/lib/rancher/k3s/server/token"
+
+	// entries of a snapshot archive, relative to the data of the k3s server
+	snapshotTokenEntry     = "token"
+	snapshotDatastoreEntry = "db/"
+	snapshotEtcdEntry      = "db/snapshots/"
+)
+
+// clusterSnapshot is a snapshot file taken with `k3d snapshot save`
+type clusterSnapshot struct {
+	file  string
+	token string // the token of the cluster the snapshot was taken in
+	etcd  string // the name of the etcd snapshot (empty for a sqlite snapshot)
+}
+
+// getTokenSecret returns the secret of a k3s token (without the hash of the CA of the full token format)
+func getTokenSecret(token string) string {
+	token = strings.TrimSpace(token)
+	return token[strings.LastIndex(token, ":")+1:]
+}
+
+// readClusterSnapshot checks a snapshot file and returns what it holds
+func readClusterSnapshot(file string) (*clusterSnapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't open snapshot %s\n%+v", file, err)
+	}
+	defer f.Close()
+
+	snapshot := &clusterSnapshot{file: file}
+	sqlite := false
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf(" Couldn't read snapshot %s\n%+v", file, err)
+		}
+		switch {
+		case hdr.Name == snapshotTokenEntry:
+			token, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf(" Couldn't read the token of snapshot %s\n%+v", file, err)
+			}
+			snapshot.token = strings.TrimSpace(string(token))
+		case strings.HasPrefix(hdr.Name, snapshotEtcdEntry) && hdr.Typeflag == tar.TypeReg:
+			snapshot.etcd = path.Base(hdr.Name)
+		case hdr.Name == snapshotDatastoreEntry+"state.db":
+			sqlite = true
+		}
+	}
+	if snapshot.token == "" || (snapshot.etcd == "" && !sqlite) {
+		return nil, fmt.Errorf("%s is not a snapshot taken with `k3d snapshot save`", file)
+	}
+	return snapshot, nil
+}
+
+// isClusterSnapshot tells if a file is a snapshot taken with `k3d snapshot save`: a tar archive starting with the token
+func isClusterSnapshot(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hdr, err := tar.NewReader(f).Next()
+	return err == nil && hdr.Name == snapshotTokenEntry
+}
+
+// addToArchive copies a file or a directory of a container into a tar archive, prefixing its entries
+// (a path the container doesn't have is skipped)
+func addToArchive(tw *tar.Writer, ID string, srcPath string, prefix string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	reader, _, err := docker.CopyFromContainer(ctx, ID, srcPath)
+	if client.IsErrNotFound(err) {
+		log.Debugf("Container %s has no %s", ID, srcPath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(" Couldn't copy %s from container %s\n%+v", srcPath, ID, err)
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf(" Couldn't read %s from container %s\n%+v", srcPath, ID, err)
+		}
+		hdr.Name = prefix + hdr.Name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf(" Couldn't write %s in the archive\n%+v", hdr.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf(" Couldn't write %s in the archive\n%+v", hdr.Name, err)
+		}
+	}
+}
+
+// writeClusterSnapshot writes the token and the datastore of a server into a snapshot archive: a snapshot
+// of the embedded etcd taken by k3s, or a copy of the sqlite database taken while the server is paused
+func writeClusterSnapshot(tw *tar.Writer, clusterName string, serverID string) error {
+	if err := addToArchive(tw, serverID, k3sServerTokenFile, ""); err != nil {
+		return err
+	}
+
+	if _, err := execInContainer(serverID, []string{"test", "-d", etcdDataDir}); err == nil {
+		snapshot, err := saveEtcdSnapshot(clusterName, fmt.Sprintf("k3d-%s", clusterName))
+		if err != nil {
+			return err
+		}
+		return addToArchive(tw, serverID, path.Join(etcdSnapshotsDir, snapshot), snapshotEtcdEntry)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	log.Println("...Pausing the server while copying the sqlite database")
+	if err := docker.ContainerPause(ctx, serverID); err != nil {
+		return fmt.Errorf(" Couldn't pause the server of cluster %s\n%+v", clusterName, err)
+	}
+	defer func() {
+		if err := docker.ContainerUnpause(ctx, serverID); err != nil {
+			log.Warningf("Couldn't unpause the server of cluster %s: use `k3d unpause --name %s`\n%+v", clusterName, clusterName, err)
+		}
+	}()
+	return addToArchive(tw, serverID, k3sDatastoreDir, "")
+}
+
+// saveClusterSnapshot saves the datastore of a cluster into a snapshot file, returning its path
+func saveClusterSnapshot(clusterName string, output string) (string, error) {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return "", err
+	}
+	if cluster.server.Labels["datastore"] == "external" {
+		return "", fmt.Errorf("Cluster %s uses an external datastore: back it up with the tools of the datastore", clusterName)
+	}
+	if cluster.server.State != "running" {
+		return "", fmt.Errorf("The server of cluster %s is not running", clusterName)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("k3d-%s-%s.snapshot", clusterName, time.Now().Format("20060102-150405"))
+	}
+	// the snapshot holds the token of the cluster, and the CA keys in its datastore
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create %s\n%+v", output, err)
+	}
+	tw := tar.NewWriter(f)
+	err = writeClusterSnapshot(tw, clusterName, cluster.server.ID)
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+	return output, nil
+}
+
+// copySnapshotDatastore copies the datastore of a snapshot (the sqlite database or the etcd snapshot)
+// into the data of a server, which doesn't have to be running
+func copySnapshotDatastore(file string, ID string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf(" Couldn't open snapshot %s\n%+v", file, err)
+	}
+	defer f.Close()
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// the datastore is streamed from the snapshot to the container, as it can be big
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(writeSnapshotDatastore(f, file, pw))
+	}()
+	if err := docker.CopyToContainer(ctx, ID, path.Dir(k3sServerDataDir), pr, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf(" Couldn't copy the datastore of %s into container %s\n%+v", file, ID, err)
+	}
+	return nil
+}
+
+// writeSnapshotDatastore writes the entries of the datastore of a snapshot into a tar archive of the data of a server
+func writeSnapshotDatastore(r io.Reader, file string, w io.Writer) error {
+	// the data of the server don't exist before k3s starts for the first time
+	prefix := path.Base(k3sServerDataDir) + "/"
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf(" Couldn't read snapshot %s\n%+v", file, err)
+		}
+		if !strings.HasPrefix(hdr.Name, snapshotDatastoreEntry) {
+			continue
+		}
+		hdr.Name = prefix + hdr.Name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// restoreClusterSnapshot restores a snapshot in the cluster it was taken in (or in a clone of it),
+// stopping the nodes while the datastore of the server is replaced
+func restoreClusterSnapshot(clusterName string, file string) error {
+	// an etcd snapshot taken by k3s: a file of the host or the name of a snapshot in the server
+	if !isClusterSnapshot(file) {
+		return restoreEtcdSnapshot(clusterName, file)
+	}
+
+	snapshot, err := readClusterSnapshot(file)
+	if err != nil {
+		return err
+	}
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	if cluster.server.State != "running" {
+		return fmt.Errorf("The server of cluster %s is not running", clusterName)
+	}
+
+	token, err := execInContainer(cluster.server.ID, []string{"cat", k3sServerTokenFile})
+	if err != nil {
+		return fmt.Errorf(" Couldn't read the token of cluster %s\n%+v", clusterName, err)
+	}
+	if getTokenSecret(token) != getTokenSecret(snapshot.token) {
+		return fmt.Errorf("Snapshot %s was taken in another cluster, with another token: seed a new cluster with it (`k3d create --snapshot %s`)", file, file)
+	}
+
+	_, err = execInContainer(cluster.server.ID, []string{"test", "-d", etcdDataDir})
+	usesEtcd := err == nil
+	if snapshot.etcd == "" {
+		if usesEtcd {
+			return fmt.Errorf("Snapshot %s holds a sqlite database, but cluster %s uses the embedded etcd", file, clusterName)
+		}
+		return resetCluster(clusterName, file)
+	}
+	if !usesEtcd {
+		return fmt.Errorf("Snapshot %s holds an etcd snapshot, but cluster %s doesn't use the embedded etcd", file, clusterName)
+	}
+	log.Printf("...Copying %s into the server", snapshot.etcd)
+	if err := copySnapshotDatastore(file, cluster.server.ID); err != nil {
+		return err
+	}
+	return restoreEtcdSnapshot(clusterName, snapshot.etcd)
+}
+
+// seedServerDatastore copies the datastore of a snapshot into a new server, before it's started:
+// an etcd snapshot is restored with the data of the server, in a helper container
+func seedServerDatastore(spec *ClusterSpec, ID string) error {
+	log.Printf("...Seeding the datastore with %s", spec.Snapshot.file)
+	if err := copySnapshotDatastore(spec.Snapshot.file, ID); err != nil {
+		return err
+	}
+	if spec.Snapshot.etcd == "" {
+		return nil
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	server, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return fmt.Errorf(" Couldn't inspect the server of cluster %s\n%+v", spec.ClusterName, err)
+	}
+	return resetEtcd(spec.ClusterName, server, path.Join(etcdSnapshotsDir, spec.Snapshot.etcd))
+}
+
+// deleteSnapshotNodes deletes the nodes of the cluster a snapshot (or a backup) was taken in from a cluster seeded with it:
+// the nodes with other names than the ones of the cluster, which won't be Ready anymore
+func deleteSnapshotNodes(serverID string, names []string, timeoutSeconds int) error {
+	if err := waitForKubectl(serverID, timeoutSeconds, "get", "nodes"); err != nil {
+		return err
+	}
+	out, err := kubectl(serverID, "get", "nodes", "-o", "jsonpath={.items[*].metadata.name}")
+	if err != nil {
+		return fmt.Errorf(" Couldn't list the nodes\n%+v", err)
+	}
+
+	keep := map[string]bool{}
+	for _, name := range names {
+		keep[name] = true
+	}
+	for _, node := range strings.Fields(out) {
+		if keep[node] {
+			continue
+		}
+		log.Printf("...Deleting node %s of the cluster the snapshot was taken in", node)
+		if _, err := kubectl(serverID, "delete", "node", node, "--ignore-not-found"); err != nil {
+			return fmt.Errorf(" Couldn't delete node %s\n%+v", node, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package run
+
+/*
+ * The functions in this file export the state of the clusters and the registries (`k3d state export`),
+ * as JSON or as Prometheus metrics for the textfile collector of the node_exporter.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportedNode is the state of a node container
+type exportedNode struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Up   bool   `json:"up"`
+	// unix timestamps of the creation of the container and of its last start or stop
+	Created         int64 `json:"created"`
+	LastStateChange int64 `json:"lastStateChange"`
+}
+
+// exportedCluster is the state of a cluster
+type exportedCluster struct {
+	Name   string         `json:"name"`
+	Image  string         `json:"image"`
+	Status string         `json:"status"`
+	Nodes  []exportedNode `json:"nodes"`
+}
+
+// exportedRegistry is the state of a registry
+type exportedRegistry struct {
+	Name         string   `json:"name"`
+	Up           bool     `json:"up"`
+	StorageBytes int64    `json:"storageBytes"` // only when running
+	Clusters     []string `json:"clusters"`
+}
+
+// exportedState is everything exported by `k3d state export`
+type exportedState struct {
+	Timestamp  int64              `json:"timestamp"`
+	Clusters   []exportedCluster  `json:"clusters"`
+	Registries []exportedRegistry `json:"registries"`
+}
+
+// getLastStateChange returns the unix timestamp of the last start or stop of a container
+func getLastStateChange(docker *client.Client, ID string) int64 {
+	info, err := docker.ContainerInspect(operationContext(), ID)
+	if err != nil || info.State == nil {
+		log.Debugf("Couldn't inspect container %s: %+v", ID, err)
+		return 0
+	}
+	var last int64
+	for _, t := range []string{info.State.StartedAt, info.State.FinishedAt} {
+		if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil && parsed.Unix() > last {
+			last = parsed.Unix()
+		}
+	}
+	return last
+}
+
+// getExportedState collects the state of the clusters and the registries
+func getExportedState() (*exportedState, error) {
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	state := &exportedState{
+		Timestamp:  time.Now().Unix(),
+		Clusters:   []exportedCluster{},
+		Registries: []exportedRegistry{},
+	}
+
+	clusters, err := getClusters(true, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		ec := exportedCluster{Name: cluster.name, Image: cluster.image, Status: cluster.status}
+		for _, node := range cluster.nodes() {
+			ec.Nodes = append(ec.Nodes, exportedNode{
+				Name:            getNodeName(node),
+				Role:            node.Labels["component"],
+				Up:              node.State == "running",
+				Created:         node.Created,
+				LastStateChange: getLastStateChange(docker, node.ID),
+			})
+		}
+		state.Clusters = append(state.Clusters, ec)
+	}
+	sort.Slice(state.Clusters, func(i, j int) bool {
+		return state.Clusters[i].Name < state.Clusters[j].Name
+	})
+
+	registries, err := getRegistryContainers()
+	if err != nil {
+		return nil, err
+	}
+	for _, registry := range registries {
+		er := exportedRegistry{Name: getNodeName(registry), Up: registry.State == "running"}
+		if er.Clusters, err = getRegistryUsers(registry.ID); err != nil {
+			return nil, err
+		}
+		if er.Up {
+			if size, err := getRegistryStorageSize(registry.ID); err == nil {
+				er.StorageBytes = int64(size) * 1024
+			} else {
+				log.Debugf("Couldn't get the storage size of registry %s: %+v", er.Name, err)
+			}
+		}
+		state.Registries = append(state.Registries, er)
+	}
+	return state, nil
+}
+
+// escapePrometheusLabel escapes a label value for the Prometheus text format
+func escapePrometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// boolToInt converts a boolean to a metric value
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// formatPrometheusState formats the state as Prometheus metrics (text format)
+func formatPrometheusState(state *exportedState) []byte {
+	buf := new(bytes.Buffer)
+	metric := func(name string, help string) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	q := escapePrometheusLabel
+
+	metric("k3d_clusters", "Number of k3d clusters.")
+	fmt.Fprintf(buf, "k3d_clusters %d\n", len(state.Clusters))
+
+	metric("k3d_cluster_info", "Image and status of a k3d cluster.")
+	for _, c := range state.Clusters {
+		fmt.Fprintf(buf, "k3d_cluster_info{cluster=\"%s\",image=\"%s\",status=\"%s\"} 1\n", q(c.Name), q(c.Image), q(c.Status))
+	}
+
+	metric("k3d_node_up", "Whether a node container is running.")
+	for _, c := range state.Clusters {
+		for _, n := range c.Nodes {
+			fmt.Fprintf(buf, "k3d_node_up{cluster=\"%s\",node=\"%s\",role=\"%s\"} %d\n", q(c.Name), q(n.Name), q(n.Role), boolToInt(n.Up))
+		}
+	}
+
+	metric("k3d_node_created_timestamp_seconds", "Creation time of a node container.")
+	for _, c := range state.Clusters {
+		for _, n := range c.Nodes {
+			fmt.Fprintf(buf, "k3d_node_created_timestamp_seconds{cluster=\"%s\",node=\"%s\"} %d\n", q(c.Name), q(n.Name), n.Created)
+		}
+	}
+
+	metric("k3d_node_last_state_change_timestamp_seconds", "Time of the last start or stop of a node container.")
+	for _, c := range state.Clusters {
+		for _, n := range c.Nodes {
+			fmt.Fprintf(buf, "k3d_node_last_state_change_timestamp_seconds{cluster=\"%s\",node=\"%s\"} %d\n", q(c.Name), q(n.Name), n.LastStateChange)
+		}
+	}
+
+	metric("k3d_registry_up", "Whether a registry container is running.")
+	for _, r := range state.Registries {
+		fmt.Fprintf(buf, "k3d_registry_up{registry=\"%s\"} %d\n", q(r.Name), boolToInt(r.Up))
+	}
+
+	metric("k3d_registry_clusters", "Number of clusters using a registry.")
+	for _, r := range state.Registries {
+		fmt.Fprintf(buf, "k3d_registry_clusters{registry=\"%s\"} %d\n", q(r.Name), len(r.Clusters))
+	}
+
+	metric("k3d_registry_storage_bytes", "Size of the storage of a running registry.")
+	for _, r := range state.Registries {
+		if r.Up {
+			fmt.Fprintf(buf, "k3d_registry_storage_bytes{registry=\"%s\"} %d\n", q(r.Name), r.StorageBytes)
+		}
+	}
+
+	metric("k3d_state_export_timestamp_seconds", "Time of the last export of the k3d state.")
+	fmt.Fprintf(buf, "k3d_state_export_timestamp_seconds %d\n", state.Timestamp)
+
+	return buf.Bytes()
+}
+
+// exportState writes the state in a format (prometheus or json) to a file ('-' for stdout).
+// The file is replaced atomically, so the textfile collector never reads a partial file.
+func exportState(format string, output string) error {
+	state, err := getExportedState()
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	switch format {
+	case "prometheus":
+		content = formatPrometheusState(state)
+	case "json":
+		if content, err = json.MarshalIndent(state, "", "  "); err != nil {
+			return err
+		}
+		content = append(content, '\n')
+	default:
+		return fmt.Errorf("Invalid format [%s] (must be one of prometheus or json)", format)
+	}
+
+	if output == "" || output == "-" {
+		_, err := os.Stdout.Write(content)
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output))
+	if err != nil {
+		return fmt.Errorf(" Couldn't create a temporary file next to %s\n%+v", output, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf(" Couldn't write %s\n%+v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		return fmt.Errorf(" Couldn't write %s\n%+v", output, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package run
+
+/*
+ * The functions in this file manage the status sidecar of a cluster: a small container
+ * that reports the readiness of the cluster over HTTP on a host port, so it can be polled
+ * without kubectl (e.g. `curl -f http://localhost:<port>/readyz`).
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// port the status sidecar listens on inside of the container
+	defaultStatusInternalPort = 8080
+
+	// admin kubeconfig written by the k3s server (in the /var/lib/rancher/k3s volume shared with the sidecar)
+	defaultStatusKubeconfigPath = "/var/lib/rancher/k3s/server/cred/admin.kubeconfig"
+
+	// seconds between readiness checks
+	defaultStatusInterval = 5
+)
+
+// statusScript is run in the sidecar (using the busybox applets and kubectl of the k3s image):
+// `/readyz` exists (HTTP 200) while all the nodes of the cluster are Ready, and it's removed (HTTP 404) otherwise
+const statusScript = `mkdir -p /www && httpd -p %d -h /www
+while true; do
+  if kubectl --kubeconfig %s --server https://%s:%s wait --for=condition=Ready nodes --all --timeout=10s >/dev/null 2>&1; then
+    echo ok > /www/readyz.tmp && mv /www/readyz.tmp /www/readyz
+  else
+    rm -f /www/readyz
+  fi
+  sleep %d
+done`
+
+// createStatusContainer creates the status sidecar of a cluster, publishing its HTTP endpoint in a host port
+func createStatusContainer(spec *ClusterSpec, serverID string, hostPort int) (string, error) {
+	containerName := GetContainerName("status", spec.ClusterName, -1)
+	serverName := GetContainerName("server", spec.ClusterName, -1)
+
+	containerLabels := map[string]string{
+		"app":       "k3d",
+		"component": "status",
+		"cluster":   spec.ClusterName,
+	}
+
+	publishedPorts, err := CreatePublishedPorts([]string{fmt.Sprintf("%d:%d/tcp", hostPort, defaultStatusInternalPort)})
+	if err != nil {
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: publishedPorts.PortBindings,
+		VolumesFrom:  []string{serverID},
+		Init:         &[]bool{true}[0],
+	}
+	hostConfig.RestartPolicy = spec.getRestartPolicy(false)
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			k3dNetworkName(spec.ClusterName): {
+				Aliases: []string{containerName},
+			},
+		},
+	}
+
+	config := &container.Config{
+		Hostname:     containerName,
+		Image:        spec.Image,
+		Entrypoint:   []string{"/bin/sh", "-c"},
+		Cmd:          []string{fmt.Sprintf(statusScript, defaultStatusInternalPort, defaultStatusKubeconfigPath, serverName, spec.APIPort.Port, defaultStatusInterval)},
+		ExposedPorts: publishedPorts.ExposedPorts,
+		Labels:       containerLabels,
+	}
+
+	id, err := createContainer(config, hostConfig, networkingConfig, containerName)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create container %s\n%+v", containerName, err)
+	}
+
+	if err := startContainer(id); err != nil {
+		return "", fmt.Errorf(" Couldn't start container %s\n%+v", containerName, err)
+	}
+
+	return id, nil
+}
+
+// getStatusContainer returns the ID of the status sidecar of a cluster (empty if it has none)
+func getStatusContainer(clusterName string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	cFilter := filters.NewArgs()
+	cFilter.Add("label", "app=k3d")
+	cFilter.Add("label", "component=status")
+	cFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{Filters: cFilter, All: true})
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't list containers\n%+v", err)
+	}
+	if len(containers) == 0 {
+		return "", nil
+	}
+	return containers[0].ID, nil
+}
+
+// getStatusURL returns the URL of the readiness endpoint of a status sidecar
+func getStatusURL(ID string) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	c, err := docker.ContainerInspect(ctx, ID)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect status container %s\n%+v", ID, err)
+	}
+
+	for port, bindings := range c.HostConfig.PortBindings {
+		if port.Int() != defaultStatusInternalPort || len(bindings) == 0 {
+			continue
+		}
+		host := "localhost"
+		if machineIP, err := getDockerMachineIp(); err == nil && machineIP != "" {
+			host = machineIP
+		}
+		return fmt.Sprintf("http://%s:%s/readyz", host, strings.TrimSpace(bindings[0].HostPort)), nil
+	}
+	return "", fmt.Errorf("status container %s does not publish port %d", ID, defaultStatusInternalPort)
+}
+
+// removeStatusContainer removes the status sidecar of a cluster, if there is one
+func removeStatusContainer(clusterName string) error {
+	cid, err := getStatusContainer(clusterName)
+	if err != nil || cid == "" {
+		return err
+	}
+	log.Println("...Removing status sidecar")
+	return removeContainer(cid)
+}
@@ -1,6 +1,8 @@
 package run
 
 import (
+	"time"
+
 	"github.com/docker/docker/api/types"
 	"github.com/docker/go-connections/nat"
 )
@@ -30,28 +32,74 @@ type Cluster struct {
 	status      string
 	serverPorts []string
 	server      types.Container
+	servers     []types.Container // the other servers of an HA cluster
 	workers     []types.Container
 }
 
+// nodes returns the node containers of a cluster: the servers first, then the workers
+func (c Cluster) nodes() []types.Container {
+	nodes := append([]types.Container{c.server}, c.servers...)
+	return append(nodes, c.workers...)
+}
+
 // ClusterSpec defines the specs for a cluster that's up for creation
 type ClusterSpec struct {
 	AgentArgs            []string
+	AgentResources       nodeResources
 	APIPort              apiPort
 	AutoRestart          bool
+	Channel              string // the release channel of k3s the image was resolved from, with its release
 	ClusterName          string
+	CreateFlags          map[string]string // the flags of create defining the cluster, recorded in its labels
+	Datastore            *datastore
 	Env                  []string
+	ExtraRegistries      []extraRegistry
+	NodeAgentArgs        []nodeArg // the arguments of the agents scoped to some workers
+	NodeConfigFrom       string    // the node the configuration of the new nodes is copied from
+	NodeServerArgs       []nodeArg // the arguments of the servers scoped to some servers
 	NodeToLabelSpecMap   map[string][]string
 	Image                string
+	K3sConfig            map[string]interface{}
 	NodeToPortSpecMap    map[string][]string
 	PortAutoOffset       int
+	PullPolicy           string
 	RegistriesFile       string
+	RegistryBindIPs      []string
 	RegistryEnabled      bool
 	RegistryCacheEnabled bool
+	RegistryCacheAuth    *registryCacheAuth
+	RegistryConfig       string
+	RegistryContainer    string
+	RegistryDebugPort    int
+	RegistryEnv          []string
+	RegistryFailover     bool
+	RegistryImage        string
+	RegistryInternalPort int
+	RegistryLabels       []string
+	RegistryMaxSize      int64
+	RegistryMirrors      map[string][]string
+	RegistryMTLS         bool
 	RegistryName         string
+	RegistryNetworks     []registryNetwork
+	RegistryNotify       []registryNotificationEndpoint
+	RegistryPerCluster   bool
 	RegistryPort         int
+	RegistryPrivileged   bool
+	RegistryRestart      string
+	RegistryRewrite      map[string]string
+	RegistryUse          string
 	RegistryVolume       string
+	RegistryVolumeDir    string
+	RestartPolicy        string // the restart policy of all the containers of the cluster (`--restart-policy`)
+	SelfHeal             bool   // docker restarts the nodes that die unexpectedly
 	ServerArgs           []string
+	ServerResources      nodeResources
+	Servers              int
+	Snapshot             *clusterSnapshot // the snapshot the datastore of the server is seeded with
+	StopSignal           string
+	StopTimeout          time.Duration
 	Volumes              *Volumes
+	Workers              int
 }
 
 // PublishedPorts is a struct used for exposing container ports on the host system
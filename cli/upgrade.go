@@ -0,0 +1,231 @@
+package run
+
+/*
+ * The functions in this file upgrade the k3s version of a running cluster (`k3d upgrade`): the node containers
+ * are replaced one at a time by containers of the new image, with the same configuration, network and volumes,
+ * so the state of the cluster (the data of the servers, the token) survives the upgrade.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// label of the upgraded nodes listing the volumes taken over from the containers they replaced,
+// removed with the node like its anonymous volumes
+const nodeVolumesLabel = "node-volumes"
+
+// nodeUpgradePaths are the files of the nodes, out of their volumes, taken over by the new containers
+var nodeUpgradePaths = []string{
+	"/etc/rancher/k3s",
+}
+
+// getNodeVolumes returns the anonymous volumes of a node (the data of k3s, declared by the image),
+// that the new container takes over (the ones taken over in a previous upgrade are in its binds already)
+func getNodeVolumes(node types.ContainerJSON) []string {
+	bound := map[string]bool{}
+	for _, bind := range node.HostConfig.Binds {
+		if split := strings.Split(bind, ":"); len(split) >= 2 {
+			bound[split[1]] = true
+		}
+	}
+
+	volumes := []string{}
+	for _, mount := range node.Mounts {
+		if mount.Type == "volume" && !bound[mount.Destination] {
+			volumes = append(volumes, fmt.Sprintf("%s:%s", mount.Name, mount.Destination))
+		}
+	}
+	return volumes
+}
+
+// getTakenVolumes returns the value of the label listing the volumes taken over by the new container of a node
+func getTakenVolumes(node types.ContainerJSON, volumes []string) string {
+	taken := volumes
+	if previous := node.Config.Labels[nodeVolumesLabel]; previous != "" {
+		taken = append(strings.Split(previous, ","), volumes...)
+	}
+	return strings.Join(taken, ",")
+}
+
+// getUpgradedNodeConfig returns the configuration of the container replacing a node: the one of the node,
+// without what came from its image
+func getUpgradedNodeConfig(node types.ContainerJSON, oldImage types.ImageInspect, image string, volumes []string) *container.Config {
+	config := *node.Config
+	config.Image = image
+
+	imageEnv := map[string]bool{}
+	if oldImage.Config != nil {
+		for _, env := range oldImage.Config.Env {
+			imageEnv[env] = true
+		}
+		if strings.Join(config.Entrypoint, " ") == strings.Join(oldImage.Config.Entrypoint, " ") {
+			config.Entrypoint = nil
+		}
+	}
+	config.Env = []string{}
+	for _, env := range node.Config.Env {
+		if !imageEnv[env] {
+			config.Env = append(config.Env, env)
+		}
+	}
+
+	config.Labels = map[string]string{}
+	for k, v := range node.Config.Labels {
+		config.Labels[k] = v
+	}
+	config.Labels[nodeVolumesLabel] = getTakenVolumes(node, volumes)
+	return &config
+}
+
+// upgradeNode replaces a node by a container of another image, returning the ID of the new container.
+// The node is kept (renamed and stopped) until the new container is started, and restored if it doesn't start.
+func upgradeNode(clusterName string, node types.Container, image string, timeoutSeconds int) (string, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	info, err := docker.ContainerInspect(ctx, node.ID)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect node %s\n%+v", getNodeName(node), err)
+	}
+	oldImage, _, err := docker.ImageInspectWithRaw(ctx, info.Image)
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't inspect the image of node %s\n%+v", getNodeName(node), err)
+	}
+
+	name := strings.TrimPrefix(info.Name, "/")
+	volumes := getNodeVolumes(info)
+	config := getUpgradedNodeConfig(info, oldImage, image, volumes)
+	hostConfig := *info.HostConfig
+	hostConfig.Binds = append(append([]string{}, info.HostConfig.Binds...), volumes...)
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			k3dNetworkName(clusterName): {
+				Aliases: []string{name},
+			},
+		},
+	}
+
+	log.Printf("...Replacing node %s", name)
+	oldName := name + "-upgrading"
+	if err := docker.ContainerRename(ctx, info.ID, oldName); err != nil {
+		return "", fmt.Errorf(" Couldn't rename node %s\n%+v", name, err)
+	}
+	if err := docker.ContainerStop(ctx, info.ID, nil); err != nil {
+		return "", fmt.Errorf(" Couldn't stop node %s\n%+v", name, err)
+	}
+
+	id, err := createContainer(config, &hostConfig, networkingConfig, name)
+	if err == nil {
+		err = copyNodeConfig(info.ID, id, nodeUpgradePaths)
+	}
+	if err == nil {
+		err = startContainer(id)
+	}
+	if err == nil && node.Labels["component"] == "server" {
+		err = waitForContainerLogMessage(id, "Wrote kubeconfig", timeoutSeconds)
+	}
+	if err != nil {
+		log.Warningf("Node %s didn't come up with image %s: restoring it", name, image)
+		if id != "" {
+			// the volumes belong to the old node
+			if err := docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+				log.Warningf("Couldn't remove the new container %s\n%+v", name, err)
+			}
+		}
+		if err := docker.ContainerRename(ctx, info.ID, name); err != nil {
+			log.Warningf("Couldn't rename %s back to %s\n%+v", oldName, name, err)
+		} else if err := startContainer(info.ID); err != nil {
+			log.Warningf("Couldn't restart node %s\n%+v", name, err)
+		}
+		return "", fmt.Errorf(" Couldn't replace node %s\n%+v", name, err)
+	}
+
+	// the volumes belong to the new node now
+	if err := docker.ContainerRemove(ctx, info.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+		log.Warningf("Couldn't remove the old container %s\n%+v", oldName, err)
+	}
+	return id, nil
+}
+
+// upgradeCluster replaces the nodes of a cluster, one at a time, by containers of another k3s image:
+// the servers first (the one that created the cluster, then the other ones), then the workers.
+// With the rolling strategy, the workers are drained before being replaced, and each replaced node
+// has to be Ready before the next one is replaced, so the workloads keep running.
+func upgradeCluster(clusterName string, image string, pullPolicy string, timeoutSeconds int, rolling bool) error {
+	cluster, err := getCluster(clusterName)
+	if err != nil {
+		return err
+	}
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultServerJoinTimeout
+	}
+
+	// the image is pulled upfront, not while a node is down
+	if err := ensureImage(image, pullPolicy); err != nil {
+		return err
+	}
+	if pullPolicy == pullPolicyIfNotPresent {
+		ctx := operationContext()
+		docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+		}
+		if _, _, err := docker.ImageInspectWithRaw(ctx, image); client.IsErrNotFound(err) {
+			if err := pullImage(image); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the server running kubectl for the rolling strategy (replaced too)
+	serverID := cluster.server.ID
+	for _, node := range cluster.nodes() {
+		name := getNodeName(node)
+		if node.Image == image {
+			log.Printf("...Node %s already runs %s", name, image)
+			continue
+		}
+
+		if rolling && node.Labels["component"] == "worker" {
+			log.Printf("...Draining node %s", name)
+			if err := drainNode(serverID, name, timeoutSeconds); err != nil {
+				return fmt.Errorf(" Couldn't drain node %s\n%+v", name, err)
+			}
+		}
+
+		replaced := time.Now()
+		id, err := upgradeNode(clusterName, node, image, timeoutSeconds)
+		if err != nil {
+			return err
+		}
+		if node.ID == cluster.server.ID {
+			serverID = id
+		}
+
+		if rolling {
+			log.Printf("...Waiting for node %s to be ready", name)
+			if err := waitForNodeReadySince(serverID, name, replaced, timeoutSeconds); err != nil {
+				return err
+			}
+			if _, err := kubectl(serverID, "uncordon", name); err != nil {
+				return fmt.Errorf(" Couldn't uncordon node %s\n%+v", name, err)
+			}
+		}
+	}
+
+	if err := recordClusterSpec(clusterName); err != nil {
+		log.Warningf("Couldn't record the configuration of the upgraded cluster\n%+v", err)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package run
+
+/*
+ * The functions in this file detect the configuration drift of a cluster (`k3d verify`): the docker configuration
+ * of the nodes (ports, mounts, env, networks) and the attachment of the registry are recorded when the cluster
+ * is created, and compared with the live containers to find the ones changed out-of-band.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// clusterSpecFile is the file of the cluster directory with the recorded configuration of the cluster
+const clusterSpecFile = "spec.json"
+
+// nodeSpec is the docker configuration of a node, as checked by `k3d verify`
+type nodeSpec struct {
+	Ports    []string `json:"ports"`
+	Mounts   []string `json:"mounts"`
+	Env      []string `json:"env"`
+	Networks []string `json:"networks"`
+}
+
+// registrySpec is the attachment of the registry of a cluster
+type registrySpec struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`
+}
+
+// recordedClusterSpec is the content of the spec file of a cluster
+type recordedClusterSpec struct {
+	Nodes    map[string]nodeSpec `json:"nodes"`
+	Registry *registrySpec       `json:"registry,omitempty"`
+}
+
+// getNetworkNames returns the names of the networks a container is connected to, sorted
+func getNetworkNames(info types.ContainerJSON) []string {
+	networks := []string{}
+	if info.NetworkSettings != nil {
+		for name := range info.NetworkSettings.Networks {
+			networks = append(networks, name)
+		}
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// getClusterRegistryNetworks returns the networks a registry is connected to for a cluster: the network of the
+// cluster and the ones of its `--registry-network` (a shared registry is also connected to the other clusters)
+func getClusterRegistryNetworks(cluster Cluster) map[string]bool {
+	networks := map[string]bool{k3dNetworkName(cluster.name): true}
+	if flags, ok := getRecordedCreateFlags(cluster); ok && flags["registry-network"] != "" {
+		for _, spec := range strings.Split(flags["registry-network"], ", ") {
+			networks[strings.SplitN(spec, ":", 2)[0]] = true
+		}
+	}
+	return networks
+}
+
+// filterNetworks returns the networks of a list which are in a set
+func filterNetworks(names []string, networks map[string]bool) []string {
+	filtered := []string{}
+	for _, name := range names {
+		if networks[name] {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// getNodeSpec returns the docker configuration of a node container
+func getNodeSpec(docker *client.Client, ID string) (nodeSpec, error) {
+	spec := nodeSpec{Ports: []string{}, Mounts: []string{}, Env: []string{}}
+	info, err := docker.ContainerInspect(operationContext(), ID)
+	if err != nil {
+		return spec, fmt.Errorf(" Couldn't inspect container %s\n%+v", ID, err)
+	}
+
+	for port, bindings := range info.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			spec.Ports = append(spec.Ports, fmt.Sprintf("%s:%s->%s", binding.HostIP, binding.HostPort, port))
+		}
+	}
+	for _, mount := range info.Mounts {
+		src := mount.Source
+		if mount.Type == "volume" {
+			src = mount.Name
+		}
+		m := fmt.Sprintf("%s:%s", src, mount.Destination)
+		if !mount.RW {
+			m += ":ro"
+		}
+		spec.Mounts = append(spec.Mounts, m)
+	}
+	spec.Env = append(spec.Env, info.Config.Env...)
+	spec.Networks = getNetworkNames(info)
+
+	sort.Strings(spec.Ports)
+	sort.Strings(spec.Mounts)
+	sort.Strings(spec.Env)
+	return spec, nil
+}
+
+// getLiveClusterSpec returns the configuration of the containers of a cluster, as running now
+func getLiveClusterSpec(clusterName string) (*recordedClusterSpec, error) {
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	cluster, ok := clusters[clusterName]
+	if !ok {
+		return nil, fmt.Errorf("No cluster with name '%s' found", clusterName)
+	}
+
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	spec := &recordedClusterSpec{Nodes: map[string]nodeSpec{}}
+	for _, node := range cluster.nodes() {
+		if spec.Nodes[getNodeName(node)], err = getNodeSpec(docker, node.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	cid, err := getClusterRegistryContainer(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if cid != "" {
+		info, err := docker.ContainerInspect(operationContext(), cid)
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't inspect the registry of cluster %s\n%+v", clusterName, err)
+		}
+		networks := filterNetworks(getNetworkNames(info), getClusterRegistryNetworks(cluster))
+		spec.Registry = &registrySpec{Name: info.Name[1:], Networks: networks}
+	}
+	return spec, nil
+}
+
+// getClusterSpecPath returns the path of the spec file of a cluster
+func getClusterSpecPath(clusterName string) (string, error) {
+	clusterDir, err := getClusterDir(clusterName)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(clusterDir, clusterSpecFile), nil
+}
+
+// recordClusterSpec saves the configuration of the containers of a cluster in the cluster directory.
+// It is only readable by the user, as the env of the nodes holds the secret of the cluster.
+func recordClusterSpec(clusterName string) error {
+	spec, err := getLiveClusterSpec(clusterName)
+	if err != nil {
+		return err
+	}
+	specPath, err := getClusterSpecPath(clusterName)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(specPath, append(content, '\n'), 0600); err != nil {
+		return fmt.Errorf(" Couldn't write %s\n%+v", specPath, err)
+	}
+	return nil
+}
+
+// loadClusterSpec reads the recorded configuration of a cluster
+func loadClusterSpec(clusterName string) (*recordedClusterSpec, error) {
+	specPath, err := getClusterSpecPath(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if !fileExists(specPath) {
+		return nil, fmt.Errorf("No configuration recorded for cluster %s in %s (was it created with an older version of k3d?)", clusterName, specPath)
+	}
+	content, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+	spec := &recordedClusterSpec{}
+	if err := json.Unmarshal(content, spec); err != nil {
+		return nil, fmt.Errorf(" Couldn't parse %s\n%+v", specPath, err)
+	}
+	return spec, nil
+}
+
+// diffStrings returns the lines of the diff of two sorted lists: `-` for the missing values, `+` for the new ones
+func diffStrings(what string, expected []string, actual []string) []string {
+	diff := []string{}
+	inExpected := map[string]bool{}
+	for _, v := range expected {
+		inExpected[v] = true
+	}
+	inActual := map[string]bool{}
+	for _, v := range actual {
+		inActual[v] = true
+	}
+	for _, v := range expected {
+		if !inActual[v] {
+			diff = append(diff, fmt.Sprintf("  - %s: %s", what, v))
+		}
+	}
+	for _, v := range actual {
+		if !inExpected[v] {
+			diff = append(diff, fmt.Sprintf("  + %s: %s", what, v))
+		}
+	}
+	return diff
+}
+
+// diffClusterSpecs returns the differences between the recorded and the live configuration of a cluster, by container
+func diffClusterSpecs(expected *recordedClusterSpec, actual *recordedClusterSpec) map[string][]string {
+	drift := map[string][]string{}
+	for name, e := range expected.Nodes {
+		a, ok := actual.Nodes[name]
+		if !ok {
+			drift[name] = []string{"  - node removed"}
+			continue
+		}
+		diff := diffStrings("port", e.Ports, a.Ports)
+		diff = append(diff, diffStrings("mount", e.Mounts, a.Mounts)...)
+		diff = append(diff, diffStrings("env", e.Env, a.Env)...)
+		diff = append(diff, diffStrings("network", e.Networks, a.Networks)...)
+		if len(diff) > 0 {
+			drift[name] = diff
+		}
+	}
+	for name := range actual.Nodes {
+		if _, ok := expected.Nodes[name]; !ok {
+			drift[name] = []string{"  + node added (outside of `k3d add-node`)"}
+		}
+	}
+
+	switch {
+	case expected.Registry == nil && actual.Registry != nil:
+		drift[actual.Registry.Name] = []string{"  + registry attached"}
+	case expected.Registry != nil && actual.Registry == nil:
+		drift[expected.Registry.Name] = []string{"  - registry removed"}
+	case expected.Registry != nil:
+		if diff := diffStrings("network", expected.Registry.Networks, actual.Registry.Networks); len(diff) > 0 {
+			drift[actual.Registry.Name] = diff
+		}
+	}
+	return drift
+}
+
+// verifyCluster compares the live configuration of a cluster with the recorded one, printing the differences.
+// It returns whether the cluster has drifted.
+func verifyCluster(clusterName string) (bool, error) {
+	expected, err := loadClusterSpec(clusterName)
+	if err != nil {
+		return false, err
+	}
+	actual, err := getLiveClusterSpec(clusterName)
+	if err != nil {
+		return false, err
+	}
+	// the specs recorded by older versions of k3d have all the networks of a shared registry
+	if expected.Registry != nil {
+		cluster, err := getCluster(clusterName)
+		if err != nil {
+			return false, err
+		}
+		expected.Registry.Networks = filterNetworks(expected.Registry.Networks, getClusterRegistryNetworks(cluster))
+	}
+
+	drift := diffClusterSpecs(expected, actual)
+	if len(drift) == 0 {
+		log.Printf("Cluster %s matches its recorded configuration", clusterName)
+		return false, nil
+	}
+	names := []string{}
+	for name := range drift {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+		for _, line := range drift[name] {
+			fmt.Println(line)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,173 @@
+package run
+
+/*
+ * The functions in this file list the tags of the k3s image (`k3d list-versions`), from the tags API of Docker Hub,
+ * with the release channels of k3s whose latest release they are, to help picking a value for `--image`.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultK3sTagsServer lists the tags of the k3s image (the tags API of Docker Hub)
+const DefaultK3sTagsServer = "https://hub.docker.com/v2/repositories/rancher/k3s/tags"
+
+// how many pages of tags are read at most, as the architecture specific tags make it long
+const maxK3sTagsPages = 20
+
+// k3sTagRegexp matches the tags of releases of k3s (but the architecture specific ones), e.g. `v1.27.4-k3s1`
+// or `v1.28.0-rc1-k3s1`
+var k3sTagRegexp = regexp.MustCompile(`^v(\d+)\.(\d+)\.(\d+)(?:-rc(\d+))?-k3s(\d+)$`)
+
+// k3sMinorRegexp matches a minor version of Kubernetes, e.g. `v1.27` or `1.27`
+var k3sMinorRegexp = regexp.MustCompile(`^v?\d+\.\d+$`)
+
+// k3sVersion is a tag of the k3s image
+type k3sVersion struct {
+	tag     string
+	numbers []int // major, minor, patch, release candidate (0 for a release) and k3s release
+}
+
+// parseK3sVersion parses a tag of the k3s image, returning nil for the tags which aren't the one of a release
+func parseK3sVersion(tag string) *k3sVersion {
+	match := k3sTagRegexp.FindStringSubmatch(tag)
+	if match == nil {
+		return nil
+	}
+	version := &k3sVersion{tag: tag}
+	for _, number := range match[1:] {
+		n, _ := strconv.Atoi(number) // an empty release candidate is a release
+		version.numbers = append(version.numbers, n)
+	}
+	return version
+}
+
+// isPreRelease tells if a version is a release candidate
+func (v *k3sVersion) isPreRelease() bool {
+	return v.numbers[3] != 0
+}
+
+// newerThan tells if a version is newer than another one
+func (v *k3sVersion) newerThan(other *k3sVersion) bool {
+	for i := range v.numbers {
+		a, b := v.numbers[i], other.numbers[i]
+		// a release is newer than its release candidates
+		if i == 3 && (a == 0) != (b == 0) {
+			return a == 0
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+// getK3sTags returns the tags of the k3s image containing a string, following the pages of the tags API
+func getK3sTags(tagsServer string, filter string) ([]string, error) {
+	query := url.Values{}
+	query.Set("page_size", "100")
+	if filter != "" {
+		query.Set("name", filter)
+	}
+	next := fmt.Sprintf("%s?%s", tagsServer, query.Encode())
+
+	httpClient := &http.Client{Timeout: defaultChannelTimeout}
+	tags := []string{}
+	for page := 0; next != "" && page < maxK3sTagsPages; page++ {
+		resp, err := httpClient.Get(next)
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't get the tags of the k3s image from %s\n%+v", tagsServer, err)
+		}
+		result := struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		}{}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf(" Couldn't get the tags of the k3s image from %s: %s", tagsServer, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't parse the tags of the k3s image from %s\n%+v", tagsServer, err)
+		}
+		for _, tag := range result.Results {
+			tags = append(tags, tag.Name)
+		}
+		next = result.Next
+	}
+	if next != "" {
+		log.Warnf("Only read the first %d pages of the tags of the k3s image from %s: older versions may be missing", maxK3sTagsPages, tagsServer)
+	}
+	return tags, nil
+}
+
+// listK3sVersions prints the releases of k3s with an image, newest first, optionally of a minor version
+// of Kubernetes only, with the release channels whose latest release they are
+func listK3sVersions(tagsServer string, channelServer string, minor string, preReleases bool, limit int) error {
+	filter := ""
+	if minor != "" {
+		if !k3sMinorRegexp.MatchString(minor) {
+			return fmt.Errorf("Invalid value for '--minor' [%s]: use a minor version of Kubernetes, e.g. v1.27", minor)
+		}
+		filter = fmt.Sprintf("v%s.", strings.TrimPrefix(minor, "v"))
+	}
+
+	tags, err := getK3sTags(tagsServer, filter)
+	if err != nil {
+		return err
+	}
+	versions := []*k3sVersion{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		version := parseK3sVersion(tag)
+		if version == nil || seen[tag] || !strings.HasPrefix(tag, filter) || (version.isPreRelease() && !preReleases) {
+			continue
+		}
+		seen[tag] = true
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("No k3s image found for Kubernetes %s", minor)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].newerThan(versions[j])
+	})
+	if limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+
+	// the channels are only a hint: the tags are listed without them if the channel server can't be reached
+	channelsByTag := map[string][]string{}
+	if channels, err := getK3sChannels(channelServer); err != nil {
+		log.Warningln(err)
+	} else {
+		for _, channel := range channels {
+			tag := getK3sImageTag(channel.Latest)
+			channelsByTag[tag] = append(channelsByTag[tag], channel.Name)
+		}
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_CENTER)
+	table.SetHeader([]string{"TAG", "KUBERNETES", "CHANNELS"})
+	for _, version := range versions {
+		kubernetes := fmt.Sprintf("v%d.%d.%d", version.numbers[0], version.numbers[1], version.numbers[2])
+		table.Append([]string{version.tag, kubernetes, strings.Join(channelsByTag[version.tag], ", ")})
+	}
+	table.Render()
+	return nil
+}
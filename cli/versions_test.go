@@ -0,0 +1,61 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseK3sVersion(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want []int
+	}{
+		{"v1.27.4-k3s1", []int{1, 27, 4, 0, 1}},
+		{"v1.28.0-rc1-k3s1", []int{1, 28, 0, 1, 1}},
+		{"v1.21.14-k3s12", []int{1, 21, 14, 0, 12}},
+		{"v1.27.4-k3s1-amd64", nil},
+		{"latest", nil},
+		{"v1.27.4", nil},
+		{"1.27.4-k3s1", nil},
+	}
+	for _, test := range tests {
+		version := parseK3sVersion(test.tag)
+		if test.want == nil {
+			if version != nil {
+				t.Errorf("parseK3sVersion(%q) = %v, want nil", test.tag, version.numbers)
+			}
+			continue
+		}
+		if version == nil {
+			t.Errorf("parseK3sVersion(%q) = nil, want %v", test.tag, test.want)
+			continue
+		}
+		if version.tag != test.tag || !reflect.DeepEqual(version.numbers, test.want) {
+			t.Errorf("parseK3sVersion(%q) = %s %v, want %v", test.tag, version.tag, version.numbers, test.want)
+		}
+	}
+}
+
+func TestNewerThan(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"v1.27.4-k3s1", "v1.27.3-k3s1", true},
+		{"v1.27.3-k3s1", "v1.27.4-k3s1", false},
+		{"v1.28.0-k3s1", "v1.27.10-k3s1", true},
+		{"v1.27.10-k3s1", "v1.27.9-k3s1", true},
+		{"v1.27.4-k3s2", "v1.27.4-k3s1", true},
+		{"v1.27.4-k3s1", "v1.27.4-k3s1", false},
+		{"v1.28.0-k3s1", "v1.28.0-rc2-k3s1", true},
+		{"v1.28.0-rc2-k3s1", "v1.28.0-k3s1", false},
+		{"v1.28.0-rc2-k3s1", "v1.28.0-rc1-k3s1", true},
+		{"v1.28.0-rc1-k3s1", "v1.27.4-k3s1", true},
+	}
+	for _, test := range tests {
+		a, b := parseK3sVersion(test.a), parseK3sVersion(test.b)
+		if got := a.newerThan(b); got != test.want {
+			t.Errorf("%s.newerThan(%s) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
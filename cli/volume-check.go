@@ -0,0 +1,153 @@
+package run
+
+/*
+ * The functions in this file check the host paths mounted with `--volume` before creating the cluster:
+ * they must exist, be shared with the VM of Docker Desktop for Mac and not give the nodes the control of the host.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/client"
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+)
+
+// dangerousHostPaths are the host paths mounted only with `--allow-dangerous-mounts`
+var dangerousHostPaths = []string{
+	"/",
+	"/var/run/docker.sock",
+	"/run/docker.sock",
+	"/var/lib/docker",
+}
+
+// defaultDockerDesktopSharedPaths are the directories shared with the VM by Docker Desktop for Mac out of the box
+var defaultDockerDesktopSharedPaths = []string{"/Users", "/Volumes", "/private", "/tmp", "/var/folders"}
+
+// getDockerDesktopSharedPaths returns the directories shared with the VM of Docker Desktop for Mac
+func getDockerDesktopSharedPaths() []string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return defaultDockerDesktopSharedPaths
+	}
+	content, err := ioutil.ReadFile(filepath.Join(home, "Library", "Group Containers", "group.com.docker", "settings.json"))
+	if err != nil {
+		return defaultDockerDesktopSharedPaths
+	}
+	settings := struct {
+		FilesharingDirectories []string `json:"filesharingDirectories"`
+	}{}
+	if err := json.Unmarshal(content, &settings); err != nil || len(settings.FilesharingDirectories) == 0 {
+		return defaultDockerDesktopSharedPaths
+	}
+	return settings.FilesharingDirectories
+}
+
+// isDockerDesktop checks if docker runs in the VM of Docker Desktop, which only sees the shared paths of the host
+// (and not in colima, lima, a docker-machine VM, ... which share other paths)
+func isDockerDesktop() (bool, error) {
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+	info, err := docker.Info(operationContext())
+	if err != nil {
+		return false, fmt.Errorf(" Couldn't get the information of the docker host\n%+v", err)
+	}
+	return strings.Contains(info.OperatingSystem, "Docker Desktop"), nil
+}
+
+// isPathUnder checks if a path is a directory or is in one
+func isPathUnder(p string, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isRemoteDocker checks if the docker daemon runs on another machine, where the host paths can't be checked
+func isRemoteDocker() bool {
+	host := os.Getenv("DOCKER_HOST")
+	return host != "" && !strings.HasPrefix(host, "unix://") && !strings.HasPrefix(host, "npipe://")
+}
+
+// checkHostPath checks the host path of a volume spec
+func checkHostPath(spec string, createMissing bool, allowDangerous bool, sharedPaths []string) error {
+	src := strings.SplitN(spec, ":", 2)[0]
+	if !filepath.IsAbs(src) {
+		return nil // a named volume
+	}
+	src = filepath.Clean(src)
+
+	for _, dangerous := range dangerousHostPaths {
+		if src == dangerous && !allowDangerous {
+			return fmt.Errorf("Mounting %s (volume %s) gives the nodes the control of your machine: use --allow-dangerous-mounts if you really mean it", src, spec)
+		}
+	}
+
+	if isRemoteDocker() {
+		log.Debugf("Not checking host path %s: docker runs on %s", src, os.Getenv("DOCKER_HOST"))
+		return nil
+	}
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		if !createMissing {
+			return fmt.Errorf("Host path %s of volume %s doesn't exist (create it, or use --create-missing-host-paths)", src, spec)
+		}
+		log.Printf("...Creating missing host path %s", src)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			return fmt.Errorf(" Couldn't create host path %s\n%+v", src, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf(" Couldn't check host path %s of volume %s\n%+v", src, spec, err)
+	}
+
+	// Docker Desktop forwards its socket into the VM by itself
+	if sharedPaths == nil || strings.HasSuffix(src, "/docker.sock") {
+		return nil
+	}
+	for _, shared := range sharedPaths {
+		if isPathUnder(src, shared) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Host path %s of volume %s is not shared with Docker Desktop (shared: %s): add it in Preferences > Resources > File sharing, or use --skip-shared-paths-check", src, spec, strings.Join(sharedPaths, ", "))
+}
+
+// checkHostPaths checks the host paths of the volumes, before creating anything.
+// Docker Desktop for Windows shares all the drives with the WSL 2 backend, so only macOS has its shared paths checked
+// (unless 'skipSharedPaths' is set, for the setups sharing other paths than the ones found in its settings).
+func checkHostPaths(volumes *Volumes, createMissing bool, allowDangerous bool, skipSharedPaths bool) error {
+	specs := append([]string{}, volumes.DefaultVolumes...)
+	for _, s := range volumes.NodeSpecificVolumes {
+		specs = append(specs, s...)
+	}
+	for _, s := range volumes.GroupSpecificVolumes {
+		specs = append(specs, s...)
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+
+	var sharedPaths []string
+	if runtime.GOOS == "darwin" && !isRemoteDocker() && !skipSharedPaths {
+		desktop, err := isDockerDesktop()
+		if err != nil {
+			return err
+		}
+		if desktop {
+			sharedPaths = getDockerDesktopSharedPaths()
+		}
+	}
+
+	for _, spec := range specs {
+		if err := checkHostPath(spec, createMissing, allowDangerous, sharedPaths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
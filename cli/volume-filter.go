@@ -0,0 +1,279 @@
+package run
+
+/*
+ * The functions in this file replace the bind mounts of host directories having a `.k3dignore` file
+ * with volumes holding a filtered copy of them (`--volume-filter`), leaving out the files ignored
+ * (node_modules, .git...): bind mounts of big trees are slow on macOS and Windows.
+ */
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// k3dIgnoreFile lists the files left out of the filtered copy of a directory (with the .dockerignore syntax)
+const k3dIgnoreFile = ".k3dignore"
+
+// ignorePattern is a line of a .k3dignore file
+type ignorePattern struct {
+	pattern string
+	negate  bool // `!pattern` includes again the files excluded by the previous patterns
+}
+
+// loadIgnorePatterns reads the .k3dignore file of a directory (returning nil if there's none)
+func loadIgnorePatterns(dir string) ([]ignorePattern, error) {
+	f, err := os.Open(filepath.Join(dir, k3dIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		p.pattern = strings.Trim(path.Clean(line), "/")
+		if _, err := path.Match(strings.TrimPrefix(p.pattern, "**/"), ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern [%s] in %s\n%+v", line, filepath.Join(dir, k3dIgnoreFile), err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// matchIgnorePattern checks if a path (relative to the root, with slashes) matches a pattern:
+// the pattern matches the path or any of its parents, anywhere in the tree when starting with `**/`
+func matchIgnorePattern(pattern string, relPath string) bool {
+	parts := strings.Split(relPath, "/")
+	anywhere := strings.HasPrefix(pattern, "**/")
+	pattern = strings.TrimPrefix(pattern, "**/")
+	for start := 0; start < len(parts); start++ {
+		for end := start + 1; end <= len(parts); end++ {
+			if matched, _ := path.Match(pattern, strings.Join(parts[start:end], "/")); matched {
+				return true
+			}
+		}
+		if !anywhere {
+			break
+		}
+	}
+	return false
+}
+
+// isIgnored checks if a path is excluded by the patterns (the last matching pattern wins)
+func isIgnored(patterns []ignorePattern, relPath string) bool {
+	ignored := false
+	for _, p := range patterns {
+		if matchIgnorePattern(p.pattern, relPath) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// tarFilteredDir writes a tarball with the files of a directory not excluded by the patterns.
+// As with .gitignore, the files in an excluded directory can't be included again.
+func tarFilteredDir(dir string, patterns []ignorePattern, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isIgnored(patterns, rel) {
+			log.Debugf("Leaving out %s", rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// filteredVolumeName returns the name of the volume holding the filtered copy of a host directory
+func filteredVolumeName(clusterName string, dir string) string {
+	return fmt.Sprintf("k3d-%s-src-%s", clusterName, fmt.Sprintf("%x", sha256.Sum256([]byte(dir)))[:8])
+}
+
+// createFilteredVolume creates a volume with the files of a host directory not excluded by its .k3dignore file
+func createFilteredVolume(clusterName string, image string, dir string, patterns []ignorePattern) (string, error) {
+	volName := filteredVolumeName(clusterName, dir)
+	if _, err := createVolume(volName, map[string]string{
+		"app":       "k3d",
+		"cluster":   clusterName,
+		"component": "filtered",
+		"source":    dir,
+	}); err != nil {
+		return "", fmt.Errorf(" Couldn't create volume %s\n%+v", volName, err)
+	}
+
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	// the files are copied through a container that is never started
+	config := &container.Config{
+		Image:  image,
+		Labels: map[string]string{"app": "k3d", "cluster": clusterName, "component": "helper"},
+	}
+	hostConfig := &container.HostConfig{
+		Binds: []string{fmt.Sprintf("%s:/src", volName)},
+	}
+	helperName := fmt.Sprintf("%s-%s-volume-filter", defaultContainerNamePrefix, clusterName)
+	id, err := createContainer(config, hostConfig, &network.NetworkingConfig{}, helperName)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := removeContainer(id); err != nil {
+			log.Warningf("Couldn't remove the helper container %s\n%+v", helperName, err)
+		}
+	}()
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(tarFilteredDir(dir, patterns, writer))
+	}()
+	if err := docker.CopyToContainer(ctx, id, "/src", reader, types.CopyToContainerOptions{}); err != nil {
+		reader.CloseWithError(err)
+		return "", fmt.Errorf(" Couldn't copy %s into volume %s\n%+v", dir, volName, err)
+	}
+	return volName, nil
+}
+
+// filterVolumeSpecs replaces the bind mounts of the directories having a .k3dignore file in some volume specs
+func filterVolumeSpecs(clusterName string, image string, specs []string, filtered map[string]string) ([]string, error) {
+	result := []string{}
+	for _, spec := range specs {
+		split := strings.SplitN(spec, ":", 2)
+		src := split[0]
+		if len(split) != 2 || !filepath.IsAbs(src) {
+			result = append(result, spec) // not a bind mount
+			continue
+		}
+		if volName, ok := filtered[src]; ok {
+			result = append(result, fmt.Sprintf("%s:%s", volName, split[1]))
+			continue
+		}
+
+		patterns, err := loadIgnorePatterns(src)
+		if err != nil {
+			return nil, fmt.Errorf(" Couldn't read the %s file of %s\n%+v", k3dIgnoreFile, src, err)
+		}
+		if patterns == nil {
+			result = append(result, spec)
+			continue
+		}
+		log.Printf("...Copying %s into a volume, without the files in %s", src, k3dIgnoreFile)
+		volName, err := createFilteredVolume(clusterName, image, src, patterns)
+		if err != nil {
+			return nil, err
+		}
+		filtered[src] = volName
+		result = append(result, fmt.Sprintf("%s:%s", volName, split[1]))
+	}
+	return result, nil
+}
+
+// filterVolumes replaces the bind mounts of the directories having a .k3dignore file with filtered copies
+func filterVolumes(volumes *Volumes, clusterName string, image string) error {
+	filtered := map[string]string{}
+	var err error
+	if volumes.DefaultVolumes, err = filterVolumeSpecs(clusterName, image, volumes.DefaultVolumes, filtered); err != nil {
+		return err
+	}
+	for node, specs := range volumes.NodeSpecificVolumes {
+		if volumes.NodeSpecificVolumes[node], err = filterVolumeSpecs(clusterName, image, specs, filtered); err != nil {
+			return err
+		}
+	}
+	for group, specs := range volumes.GroupSpecificVolumes {
+		if volumes.GroupSpecificVolumes[group], err = filterVolumeSpecs(clusterName, image, specs, filtered); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFilteredVolumes deletes the volumes with the filtered copies of the host directories of a cluster
+func deleteFilteredVolumes(clusterName string) error {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	vFilter := filters.NewArgs()
+	vFilter.Add("label", "app=k3d")
+	vFilter.Add("label", "component=filtered")
+	vFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	volumeList, err := docker.VolumeList(ctx, vFilter)
+	if err != nil {
+		return fmt.Errorf(" Couldn't list volumes\n%+v", err)
+	}
+	for _, vol := range volumeList.Volumes {
+		if err := deleteVolume(vol.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
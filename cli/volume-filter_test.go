@@ -0,0 +1,29 @@
+package run
+
+import "testing"
+
+func TestMatchIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{"node_modules", "node_modules", true},
+		{"node_modules", "node_modules/lodash/index.js", true},
+		{"node_modules", "web/node_modules", false},
+		{"**/node_modules", "web/node_modules", true},
+		{"**/node_modules", "web/app/node_modules/lodash", true},
+		{"*.log", "debug.log", true},
+		{"*.log", "logs/debug.log", false},
+		{"**/*.log", "logs/debug.log", true},
+		{"build/*.o", "build/main.o", true},
+		{"build/*.o", "src/build/main.o", false},
+		{".git", ".gitignore", false},
+		{"dist", "distribution", false},
+	}
+	for _, test := range tests {
+		if got := matchIgnorePattern(test.pattern, test.relPath); got != test.want {
+			t.Errorf("matchIgnorePattern(%q, %q) = %v, want %v", test.pattern, test.relPath, got, test.want)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package run
 
 import (
-	"context"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
 
 	"github.com/docker/docker/api/types"
@@ -10,6 +11,7 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/olekukonko/tablewriter"
 )
 
 type Volumes struct {
@@ -21,8 +23,11 @@ type Volumes struct {
 // createVolume will create a new docker volume
 func createVolume(volName string, volLabels map[string]string) (types.Volume, error) {
 	var vol types.Volume
+	if err := checkOperation(); err != nil {
+		return vol, err
+	}
 
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return vol, fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -44,7 +49,7 @@ func createVolume(volName string, volLabels map[string]string) (types.Volume, er
 
 // deleteVolume will delete a volume
 func deleteVolume(volName string) error {
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -59,7 +64,7 @@ func deleteVolume(volName string) error {
 
 // getVolume checks if a docker volume exists. The volume can be specified with a name and/or some labels.
 func getVolume(volName string, volLabels map[string]string) (*types.Volume, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -86,7 +91,7 @@ func getVolume(volName string, volLabels map[string]string) (*types.Volume, erro
 
 // getVolumeMountedIn gets the volume that is mounted in some container in some path
 func getVolumeMountedIn(ID string, path string) (string, error) {
-	ctx := context.Background()
+	ctx := operationContext()
 
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -126,7 +131,7 @@ func getImageVolume(clusterName string) (types.Volume, error) {
 	var vol types.Volume
 	volName := fmt.Sprintf("k3d-%s-images", clusterName)
 
-	ctx := context.Background()
+	ctx := operationContext()
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return vol, fmt.Errorf(" Couldn't create docker client\n%+v", err)
@@ -154,6 +159,101 @@ func getImageVolume(clusterName string) (types.Volume, error) {
 	return vol, nil
 }
 
+// default labels assigned to the data volumes created with `k3d volume create`
+var defaultDataVolumeLabels = map[string]string{
+	"app":       "k3d",
+	"component": "data",
+	"managed":   "true",
+}
+
+// createDataVolume creates a volume for user data, optionally owned by a cluster
+func createDataVolume(volName string, clusterName string) (types.Volume, error) {
+	volLabels := map[string]string{}
+	for k, v := range defaultDataVolumeLabels {
+		volLabels[k] = v
+	}
+	if clusterName != "" {
+		volLabels["cluster"] = clusterName
+	}
+	return createVolume(volName, volLabels)
+}
+
+// getVolumeKind returns the kind of a k3d volume: images, registry, data or filtered
+func getVolumeKind(vol *types.Volume) string {
+	switch {
+	case vol.Labels["component"] == "registry":
+		return "registry"
+	case vol.Labels["component"] == "data":
+		return "data"
+	case vol.Labels["component"] == "filtered":
+		return "filtered"
+	case vol.Name == fmt.Sprintf("k3d-%s-images", vol.Labels["cluster"]):
+		return "images"
+	}
+	return "unknown"
+}
+
+// getK3dVolumes returns the volumes created by k3d, optionally only the ones of a cluster
+func getK3dVolumes(clusterName string) ([]*types.Volume, error) {
+	ctx := operationContext()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	vFilter := filters.NewArgs()
+	vFilter.Add("label", "app=k3d")
+	if clusterName != "" {
+		vFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	}
+
+	volumeList, err := docker.VolumeList(ctx, vFilter)
+	if err != nil {
+		return nil, fmt.Errorf(" Couldn't list volumes\n%+v", err)
+	}
+
+	sort.Slice(volumeList.Volumes, func(i, j int) bool {
+		return volumeList.Volumes[i].Name < volumeList.Volumes[j].Name
+	})
+	return volumeList.Volumes, nil
+}
+
+// printVolumes prints the volumes created by k3d, optionally only the ones of a cluster
+func printVolumes(clusterName string) error {
+	volumes, err := getK3dVolumes(clusterName)
+	if err != nil {
+		return err
+	}
+	if len(volumes) == 0 {
+		return fmt.Errorf("No volumes found")
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_CENTER)
+	table.SetHeader([]string{"NAME", "KIND", "CLUSTER", "CREATED"})
+
+	for _, vol := range volumes {
+		table.Append([]string{vol.Name, getVolumeKind(vol), vol.Labels["cluster"], vol.CreatedAt})
+	}
+
+	table.Render()
+	return nil
+}
+
+// deleteK3dVolume deletes a volume, refusing to touch volumes that were not created by k3d
+func deleteK3dVolume(volName string) error {
+	volumes, err := getK3dVolumes("")
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes {
+		if vol.Name == volName {
+			return deleteVolume(volName)
+		}
+	}
+	return fmt.Errorf("No k3d volume %s found", volName)
+}
+
 func NewVolumes(volumes []string) (*Volumes, error) {
 	volumesSpec := &Volumes{
 		DefaultVolumes:       []string{},
@@ -0,0 +1,108 @@
+package run
+
+/*
+ * The functions in this file watch the images built in the local docker daemon (`k3d watch-builds`),
+ * importing the matching tags into a cluster (or pushing them to its registry) as soon as they are built.
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// matchImagePatterns checks if an image name matches any of the patterns (e.g. `myapp:*`)
+func matchImagePatterns(patterns []string, image string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// watchBuilds imports into a cluster the images tagged in the local docker daemon that match the patterns
+// (or pushes them to the registry of the cluster), until interrupted
+func watchBuilds(clusterName string, patterns []string, push bool) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid image pattern [%s]\n%+v", pattern, err)
+		}
+	}
+	clusters, err := getClusters(false, clusterName)
+	if err != nil {
+		return err
+	}
+	if _, ok := clusters[clusterName]; !ok {
+		return fmt.Errorf("No cluster with name '%s' found", clusterName)
+	}
+	registryName := ""
+	if push {
+		if registryName, err = getClusterRegistryName(clusterName); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	eFilter := filters.NewArgs()
+	eFilter.Add("type", events.ImageEventType)
+	eFilter.Add("event", "tag")
+	messages, errs := docker.Events(ctx, types.EventsOptions{Filters: eFilter})
+
+	// the tags added when pushing to the registry are events too: don't loop on them
+	pushed := map[string]bool{}
+
+	log.Printf("Watching the images built matching %v (Ctrl-C to stop)", patterns)
+	for {
+		select {
+		case <-signals:
+			return nil
+		case err := <-errs:
+			return fmt.Errorf(" Couldn't get the docker events\n%+v", err)
+		case msg := <-messages:
+			image := msg.Actor.Attributes["name"]
+			if image == "" || pushed[image] || !matchImagePatterns(patterns, image) {
+				continue
+			}
+
+			if push {
+				target, err := pushImageToRegistry(registryName, image)
+				if err != nil {
+					log.Warningf("Couldn't push %s\n%+v", image, err)
+					continue
+				}
+				pushed[target] = true
+				log.Printf("Pushed %s as %s", image, target)
+				continue
+			}
+
+			progress := newProgress("import")
+			err := importImage(clusterName, []string{image}, false, progress)
+			progress.finish(err)
+			if err != nil {
+				log.Warningf("Couldn't import %s into cluster %s\n%+v", image, clusterName, err)
+				continue
+			}
+			log.Printf("Imported %s into cluster %s", image, clusterName)
+		}
+	}
+}
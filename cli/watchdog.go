@@ -0,0 +1,162 @@
+package run
+
+/*
+ * The functions in this file watch the nodes of a cluster (`k3d watch`), restarting the ones that die
+ * unexpectedly (crash, OOM kill, `docker kill`), and logging why they died. The nodes stopped or removed
+ * on purpose (e.g. by `k3d stop`, `k3d delete` or `docker stop`) are left alone.
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait before restarting a node, for docker to report the node stopped on purpose in the meantime
+// (with a `stop` event)
+const defaultWatchdogRestartDelay = 2 * time.Second
+
+// getDeathReason explains why a node container died, from its state
+func getDeathReason(state *types.ContainerState) string {
+	reason := fmt.Sprintf("exit code %d", state.ExitCode)
+	if state.OOMKilled {
+		reason += ", killed by the OOM killer"
+	}
+	if state.Error != "" {
+		reason += fmt.Sprintf(", %s", state.Error)
+	}
+	return reason
+}
+
+// getLastLogLines returns the last lines logged by a container (without a TTY, so its logs are multiplexed:
+// every frame has a header of 8 bytes, with the size of the frame in the last 4 ones)
+func getLastLogLines(docker *client.Client, ID string, lines int) string {
+	logs, err := docker.ContainerLogs(operationContext(), ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(lines),
+	})
+	if err != nil {
+		return ""
+	}
+	defer logs.Close()
+	out, err := ioutil.ReadAll(logs)
+	if err != nil {
+		return ""
+	}
+
+	var text strings.Builder
+	for len(out) >= 8 {
+		size := int(binary.BigEndian.Uint32(out[4:8]))
+		if 8+size > len(out) {
+			break
+		}
+		text.Write(out[8 : 8+size])
+		out = out[8+size:]
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// watchCluster restarts the nodes of a cluster that die unexpectedly, until interrupted.
+// A node is restarted maxRestarts times at most (0 for no limit).
+func watchCluster(clusterName string, maxRestarts int) error {
+	if _, err := getCluster(clusterName); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf(" Couldn't create docker client\n%+v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	eFilter := filters.NewArgs()
+	eFilter.Add("type", events.ContainerEventType)
+	eFilter.Add("label", "app=k3d")
+	eFilter.Add("label", fmt.Sprintf("cluster=%s", clusterName))
+	eFilter.Add("event", "die")
+	eFilter.Add("event", "stop")
+	messages, errs := docker.Events(ctx, types.EventsOptions{Filters: eFilter})
+
+	// docker reports a `stop` event after the `die` one of the nodes stopped on purpose (`docker stop`,
+	// `k3d stop`), so a death is only checked after a delay. The nodes killed (`docker kill`, the OOM killer)
+	// or crashing have no `stop` event.
+	deaths := make(chan events.Message)
+	stopped := map[string]bool{}
+	restarts := map[string]int{}
+
+	log.Printf("Watching the nodes of cluster %s (Ctrl-C to stop)", clusterName)
+	for {
+		select {
+		case <-signals:
+			return nil
+		case err := <-errs:
+			return fmt.Errorf(" Couldn't get the docker events\n%+v", err)
+		case msg := <-messages:
+			component := msg.Actor.Attributes["component"]
+			if component != "server" && component != "worker" {
+				continue
+			}
+			if msg.Action == "stop" {
+				stopped[msg.Actor.ID] = true
+				continue
+			}
+			delete(stopped, msg.Actor.ID)
+			time.AfterFunc(defaultWatchdogRestartDelay, func() {
+				select {
+				case deaths <- msg:
+				case <-ctx.Done():
+				}
+			})
+		case msg := <-deaths:
+			name := msg.Actor.Attributes["name"]
+			if stopped[msg.Actor.ID] {
+				delete(stopped, msg.Actor.ID)
+				log.Debugf("Node %s was stopped on purpose (exit code %s)", name, msg.Actor.Attributes["exitCode"])
+				continue
+			}
+			node, err := docker.ContainerInspect(ctx, msg.Actor.ID)
+			if err != nil || node.State.Status == "removing" {
+				// removed in the meantime
+				continue
+			}
+			if node.State.Running {
+				log.Printf("Node %s died (%s) and was restarted by docker", name, getDeathReason(node.State))
+				continue
+			}
+			log.Warningf("Node %s died unexpectedly (%s)", name, getDeathReason(node.State))
+			if lines := getLastLogLines(docker, node.ID, 10); lines != "" {
+				log.Warningf("Last logs of node %s:\n%s", name, lines)
+			}
+
+			if maxRestarts > 0 && restarts[node.ID] >= maxRestarts {
+				log.Warningf("Node %s was already restarted %d times: leaving it stopped", name, restarts[node.ID])
+				continue
+			}
+			restarts[node.ID]++
+			if err := startContainer(node.ID); err != nil {
+				log.Warningf("Couldn't restart node %s\n%+v", name, err)
+				continue
+			}
+			log.Printf("Restarted node %s (restart %d)", name, restarts[node.ID])
+		}
+	}
+}